@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminAccounts returns the admin passwords by user: ADMIN_USER (default
+// "admin") with ADMIN_PASSWORD, if set, and the "user:password" pairs in
+// ADMIN_USERS, e.g. "alice:s3cret,bob:hunter2", for teams whose admins each
+// sign in as themselves
+func adminAccounts() map[string]string {
+	accounts := make(map[string]string)
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		user := os.Getenv("ADMIN_USER")
+		if user == "" {
+			user = "admin"
+		}
+		accounts[user] = password
+	}
+	for _, v := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		pair := strings.SplitN(v, ":", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			log.Printf("Ignoring ADMIN_USERS entry without a user and password: %q", pair[0])
+			continue
+		}
+		accounts[pair[0]] = pair[1]
+	}
+	return accounts
+}
+
+// adminAuthenticated reports whether r carries the basic auth credentials
+// of a dashboard user, see checkLogin
+func adminAuthenticated(store RideStore, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	return ok && checkLogin(store, user, password)
+}
+
+// requireAdmin protects a dashboard page: users signed in on the login
+// page get through, see sessions.go, as do requests with the HTTP basic
+// auth credentials of an admin account or user, see checkLogin, e.g. from
+// scripts. Browsers are sent to the login page. The dashboard is disabled
+// until ADMIN_PASSWORD or ADMIN_USERS is set or a user is added with the
+// users command. Posts from the login session need a CSRF token, see
+// requireCSRFToken. Those with basic auth don't: we never challenge for it,
+// so browsers have no credentials to send along with other sites' forms.
+func requireAdmin(store RideStore, next http.HandlerFunc) http.HandlerFunc {
+	signedIn := requireCSRFToken(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := sessionUser(store, r); ok {
+			next(w, withSessionUser(r, user))
+			return
+		}
+		if len(adminAccounts()) == 0 && !usersExist(store) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "The dashboard is disabled. Set ADMIN_PASSWORD or add a user with the users command to enable it.")
+			return
+		}
+		loginRedirect(w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			signedIn(w, r)
+			return
+		}
+		if !adminAuthenticated(store, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
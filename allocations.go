@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// allocationCheckInterval is how often the server compares the rate proxy
+// numbers are allocated at with its baseline
+const allocationCheckInterval = time.Minute
+
+// allocationWindow returns the recent period whose allocations are compared
+// with the baseline. Set ALLOCATION_WINDOW (e.g. "5m") to override the
+// default of 15 minutes.
+func allocationWindow() time.Duration {
+	return envDuration("ALLOCATION_WINDOW", 15*time.Minute)
+}
+
+// allocationBaseline returns the period before the window whose allocation
+// rate is considered normal. Set ALLOCATION_BASELINE (e.g. "24h") to
+// override the default of a week.
+func allocationBaseline() time.Duration {
+	return envDuration("ALLOCATION_BASELINE", 7*24*time.Hour)
+}
+
+// allocationSpikeFactor returns how many times the baseline rate proxy
+// numbers must be allocated at to raise an alert, set with ALLOCATION_SPIKE_FACTOR
+func allocationSpikeFactor() int {
+	return envInt("ALLOCATION_SPIKE_FACTOR", 5)
+}
+
+// allocationSpikeMinimum returns how many allocations a window needs at
+// least to raise an alert, so a few rides on a quiet pool don't, set with
+// ALLOCATION_SPIKE_MINIMUM
+func allocationSpikeMinimum() int {
+	return envInt("ALLOCATION_SPIKE_MINIMUM", 10)
+}
+
+// allocationCapDuration returns how long new rides are capped for after an
+// alert, or 0 if they aren't. Set ALLOCATION_CAP (e.g. "30m") to cap them.
+func allocationCapDuration() time.Duration {
+	if os.Getenv("ALLOCATION_CAP") == "" {
+		return 0
+	}
+	return envDuration("ALLOCATION_CAP", 0)
+}
+
+// allocationStatement records that the proxy number with ID proxyID was
+// given to a ride, new or handed off
+func allocationStatement(proxyID int) dbStatement {
+	return statement(sqlQuery{
+		SQLite:   "INSERT INTO proxy_allocations (number_id, allocated_at) VALUES (?, ?)",
+		Postgres: "INSERT INTO proxy_allocations (number_id, allocated_at) VALUES ($1, $2)",
+	}, proxyID, time.Now().UTC().Format(time.RFC3339))
+}
+
+// allocationStore is the part of RideStore that keeps the times proxy
+// numbers were allocated at, see allocationStatement
+type allocationStore interface {
+	// AllocationsSince returns when the proxy numbers allocated after since
+	// were, as RFC 3339 times in UTC
+	AllocationsSince(since time.Time) ([]string, error)
+	// DeleteAllocations forgets the allocations up to until
+	DeleteAllocations(until time.Time) error
+}
+
+// AllocationsSince implements allocationStore
+func (s *sqlStore) AllocationsSince(since time.Time) ([]string, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT allocated_at FROM proxy_allocations WHERE allocated_at > ?",
+		Postgres: "SELECT allocated_at FROM proxy_allocations WHERE allocated_at > $1",
+	}, since.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var allocations []string
+	for rows.Next() {
+		var allocatedAt string
+		if err := rows.Scan(&allocatedAt); err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, allocatedAt)
+	}
+	return allocations, rows.Err()
+}
+
+// DeleteAllocations implements allocationStore
+func (s *sqlStore) DeleteAllocations(until time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "DELETE FROM proxy_allocations WHERE allocated_at <= ?",
+		Postgres: "DELETE FROM proxy_allocations WHERE allocated_at <= $1",
+	}, until.UTC().Format(time.RFC3339))
+	return err
+}
+
+// allocationVelocity compares the proxy numbers allocated in the recent
+// window with the number the baseline before it predicts
+type allocationVelocity struct {
+	Window   time.Duration
+	Baseline time.Duration
+	Recent   int     // allocations in the window
+	Expected float64 // allocations per window during the baseline
+}
+
+// measureAllocationVelocity counts the allocations in the window ending at
+// now and in the baseline before it. Time before the first allocation
+// counts as a baseline without any.
+func measureAllocationVelocity(store RideStore, now time.Time) (allocationVelocity, error) {
+	v := allocationVelocity{Window: allocationWindow(), Baseline: allocationBaseline()}
+	windowStart := now.Add(-v.Window).UTC().Format(time.RFC3339)
+	allocations, err := store.AllocationsSince(now.Add(-v.Window - v.Baseline))
+	if err != nil {
+		return v, err
+	}
+	baseline := 0
+	for _, allocatedAt := range allocations {
+		// RFC 3339 times in UTC sort as strings
+		if allocatedAt > windowStart {
+			v.Recent++
+		} else {
+			baseline++
+		}
+	}
+	v.Expected = float64(baseline) * float64(v.Window) / float64(v.Baseline)
+	return v, nil
+}
+
+// Spiking reports whether proxy numbers are being allocated far faster than
+// during the baseline, which is often a bug or abuse
+func (v allocationVelocity) Spiking() bool {
+	return v.Recent >= allocationSpikeMinimum() && float64(v.Recent) > float64(allocationSpikeFactor())*v.Expected
+}
+
+// Limit returns how many allocations a window may have while new rides are
+// capped: the most it can have without spiking
+func (v allocationVelocity) Limit() int {
+	limit := int(float64(allocationSpikeFactor()) * v.Expected)
+	if limit < allocationSpikeMinimum() {
+		return allocationSpikeMinimum()
+	}
+	return limit
+}
+
+var (
+	// allocationAlertMu guards allocationAlerting
+	allocationAlertMu sync.Mutex
+	// allocationAlerting is whether the last check found a spike, so it is
+	// only logged when it starts and ends
+	allocationAlerting bool
+)
+
+// allocationCapUntil returns when the cap on new rides ends, and whether
+// new rides are capped now
+func allocationCapUntil(store RideStore) (time.Time, bool) {
+	until, err := store.Setting("allocation_cap_until")
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	return t, err == nil && t.After(time.Now())
+}
+
+// setAllocationCap caps new rides until until, or lifts the cap if until is
+// zero. The cap is stored in the database so it survives restarts.
+func setAllocationCap(store RideStore, until time.Time) error {
+	if until.IsZero() {
+		return store.DeleteSetting("allocation_cap_until")
+	}
+	return store.SetSetting("allocation_cap_until", until.UTC().Format(time.RFC3339), true)
+}
+
+// checkAllocationVelocity logs an alert when proxy numbers start being
+// allocated far faster than during the baseline, and when that ends. While
+// they are, new rides are capped if configured to. It drops allocations too
+// old to be part of the baseline.
+func checkAllocationVelocity(store RideStore, now time.Time) error {
+	v, err := measureAllocationVelocity(store, now)
+	if err != nil {
+		return err
+	}
+	spiking := v.Spiking()
+
+	allocationAlertMu.Lock()
+	started, ended := spiking && !allocationAlerting, !spiking && allocationAlerting
+	allocationAlerting = spiking
+	allocationAlertMu.Unlock()
+
+	if started {
+		log.Printf("Proxy pool alert: %d proxy numbers allocated in the last %s, about %.1f expected from the %s before. Check for a bug or abuse.",
+			v.Recent, v.Window, v.Expected, v.Baseline)
+	} else if ended {
+		log.Printf("Proxy pool alert over: %d proxy numbers allocated in the last %s", v.Recent, v.Window)
+	}
+	// The cap is set when an alert starts and extended while it lasts,
+	// unless an operator lifted it
+	if d := allocationCapDuration(); spiking && d > 0 {
+		_, capped := allocationCapUntil(store)
+		if started {
+			log.Printf("Capping new rides at %d proxy number allocations per %s for %s", v.Limit(), v.Window, d)
+		}
+		if started || capped {
+			if err := setAllocationCap(store, now.Add(d)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return store.DeleteAllocations(now.Add(-v.Window - v.Baseline))
+}
+
+// pollAllocationVelocity runs checkAllocationVelocity every interval until
+// ctx is done. It is meant to be run in its own goroutine.
+func pollAllocationVelocity(ctx context.Context, store RideStore, interval time.Duration) {
+	every(ctx, interval, func() {
+		if err := checkAllocationVelocity(store, time.Now()); err != nil {
+			log.Printf("Proxy allocation check: %v", err)
+		}
+	})
+}
+
+// allocationCapReached reports whether a new ride would exceed the cap on
+// allocations in the window, returning the limit if so
+func allocationCapReached(store RideStore) (bool, int, error) {
+	if _, capped := allocationCapUntil(store); !capped {
+		return false, 0, nil
+	}
+	v, err := measureAllocationVelocity(store, time.Now())
+	if err != nil {
+		return false, 0, err
+	}
+	return v.Recent >= v.Limit(), v.Limit(), nil
+}
+
+// allocationsPage is the data rendered by views/default/allocations.gohtml
+type allocationsPage struct {
+	Velocity allocationVelocity
+	Alerting bool
+	Capped   bool
+	CapUntil string
+	Message  string
+}
+
+// allocationsHandler shows how fast proxy numbers are being allocated
+// compared with the baseline, and lets operators lift a cap on new rides
+func allocationsHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var page allocationsPage
+		if r.Method == "POST" && r.FormValue("action") == "lift" {
+			if err := setAllocationCap(store, time.Time{}); err != nil {
+				log.Println(err)
+				page.Message = fmt.Sprint(err)
+			} else {
+				log.Println("Cap on new rides lifted")
+				page.Message = "The cap on new rides is lifted. It is set again if another alert starts."
+			}
+		}
+
+		v, err := measureAllocationVelocity(store, time.Now())
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		page.Velocity = v
+		page.Alerting = v.Spiking()
+		until, capped := allocationCapUntil(store)
+		page.Capped = capped
+		if capped {
+			page.CapUntil = until.Local().Format("2006-01-02 15:04")
+		}
+		renderDefaultTemplate(w, r, "allocations.gohtml", page)
+	}
+}
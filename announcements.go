@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Audiences an announcement can be sent to
+const (
+	audienceCustomers = "customers"
+	audienceDrivers   = "drivers"
+)
+
+// Keywords participants can text to any proxy number to manage announcements
+const (
+	optOutKeyword = "STOP"
+	optInKeyword  = "START"
+)
+
+// announcementOriginator returns the sender ID used for announcements.
+// Set ANNOUNCEMENT_ORIGINATOR to override the default.
+func announcementOriginator() string {
+	if originator := os.Getenv("ANNOUNCEMENT_ORIGINATOR"); originator != "" {
+		return originator
+	}
+	return "BirdCar"
+}
+
+// optOutStore is the part of RideStore that keeps who opted out of
+// announcements
+type optOutStore interface {
+	// SetOptOut records whether number opted out of announcements
+	SetOptOut(number string, optOut bool) error
+}
+
+// SetOptOut implements optOutStore
+func (s *sqlStore) SetOptOut(number string, optOut bool) error {
+	q := sqlQuery{
+		SQLite:   "DELETE FROM opt_outs WHERE number = ?",
+		Postgres: "DELETE FROM opt_outs WHERE number = $1",
+	}
+	if optOut {
+		q = sqlQuery{
+			SQLite:   "INSERT INTO opt_outs (number) VALUES (?) ON CONFLICT (number) DO NOTHING",
+			Postgres: "INSERT INTO opt_outs (number) VALUES ($1) ON CONFLICT (number) DO NOTHING",
+			MySQL:    "INSERT INTO opt_outs (number) VALUES (?) ON DUPLICATE KEY UPDATE number = number",
+		}
+	}
+	_, err := s.exec(q, number)
+	return err
+}
+
+// setOptOut records whether number has opted out of announcements, which
+// withdraws or grants their marketing consent, see consent.go. The opt_outs
+// table is kept up to date for servers still on the previous release
+// during a rolling deploy, and failing to update it is returned.
+func setOptOut(store RideStore, number string, optOut bool) error {
+	if err := recordConsent(store, number, consentMarketing, !optOut, consentSourceKeyword); err != nil {
+		log.Println(err)
+	}
+	return store.SetOptOut(number, optOut)
+}
+
+// queueAnnouncement renders msgTemplate for every person in the audience
+// and adds the messages to the notification queue, skipping people who
+// haven't given marketing consent, see consent.go, are in their quiet hours
+// or were deactivated. It returns the number of messages queued.
+func queueAnnouncement(dbdata *RideSharingDB, queue *notificationQueue, audience string, msgTemplate string) (int, error) {
+	var recipients map[int]Person
+	switch audience {
+	case audienceCustomers:
+		recipients = dbdata.Customers
+	case audienceDrivers:
+		recipients = dbdata.Drivers
+	default:
+		return 0, fmt.Errorf("unknown audience %q", audience)
+	}
+
+	t, err := template.New("announcement").Parse(msgTemplate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid announcement template: %v", err)
+	}
+
+	now := time.Now()
+	queued := 0
+	for _, v := range recipients {
+		if v.Deactivated {
+			continue
+		}
+		consent, err := currentConsent(dbdata.store, v.Number, consentMarketing)
+		if err != nil {
+			return queued, err
+		}
+		if !consent.Granted() {
+			continue
+		}
+		prefs, err := dbdata.store.Preferences(v.Number)
+		if err != nil {
+			return queued, err
+		}
+		if prefs.inQuietHours(now) {
+			continue
+		}
+		var body bytes.Buffer
+		if err := t.Execute(&body, v); err != nil {
+			return queued, fmt.Errorf("could not render announcement for %s: %v", v.Name, err)
+		}
+		err = queue.enqueue(outboundSMS{
+			Originator: announcementOriginator(),
+			Recipient:  v.Number,
+			Body:       body.String(),
+			Purpose:    consentMarketing,
+			Store:      dbdata.store,
+		})
+		if err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// announceHandler queues a templated announcement to all customers or all drivers.
+// The message is a text/template executed against each recipient's Person,
+// e.g. "Hi {{ .Name }}, the airport pickup zone is closed today."
+func announceHandler(dbdata *RideSharingDB, queue *notificationQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		message := ""
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				return
+			}
+			audience := r.FormValue("audience")
+			msgTemplate := strings.TrimSpace(r.FormValue("message"))
+			if msgTemplate == "" {
+				renderLanding(w, r, dbdata, "Announcement message cannot be empty")
+				return
+			}
+
+			queued, err := queueAnnouncement(dbdata, queue, audience, msgTemplate)
+			if err != nil {
+				log.Println(err)
+				message = fmt.Sprintf("Announcement stopped after queueing %d messages: %v", queued, err)
+			} else {
+				message = fmt.Sprintf("Queued announcement to %d %s", queued, audience)
+			}
+		}
+
+		renderLanding(w, r, dbdata, message)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// apiPrefix is where the JSON API is served, see apiHandler
+const apiPrefix = "/api/v1/"
+
+// apiPerson is a customer or driver in the API
+type apiPerson struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Number      string   `json:"number"`
+	AltNumbers  []string `json:"alt_numbers,omitempty"`
+	Vehicle     string   `json:"vehicle,omitempty"`
+	Deactivated bool     `json:"deactivated"`
+	Flags       []string `json:"flags,omitempty"`
+	Shift       string   `json:"shift,omitempty"`
+}
+
+// apiRide is a ride in the API. Rides waiting for a proxy number have no
+// ID or proxy number yet.
+type apiRide struct {
+	ID           int              `json:"id,omitempty"`
+	Start        string           `json:"start"`
+	Destination  string           `json:"destination"`
+	DateTime     string           `json:"datetime"`
+	Status       RideStatus       `json:"status"`
+	Customer     assignmentPerson `json:"customer"`
+	Driver       assignmentPerson `json:"driver"`
+	ProxyNumber  *assignmentProxy `json:"proxy_number,omitempty"`
+	RequiredTags []string         `json:"required_tags,omitempty"`
+	Labels       []string         `json:"labels,omitempty"`
+	Texts        int              `json:"relayed_texts"`
+	Calls        int              `json:"relayed_calls"`
+	LastActivity string           `json:"last_activity,omitempty"`
+}
+
+// apiRideRequest is the body of POST /api/v1/rides. Tags left out mean the
+// default tags, see defaultRideTags; an empty list means none.
+type apiRideRequest struct {
+	CustomerID  int      `json:"customer_id"`
+	DriverID    int      `json:"driver_id"`
+	Start       string   `json:"start"`
+	Destination string   `json:"destination"`
+	DateTime    string   `json:"datetime"`
+	Proxy       string   `json:"proxy,omitempty"`
+	Tags        []string `json:"tags"`
+	Labels      []string `json:"labels"`
+}
+
+// newAPIPerson returns the API view of p
+func newAPIPerson(p Person) apiPerson {
+	return apiPerson{p.ID, p.Name, p.Number, p.AltNumbers, p.Vehicle, p.Deactivated, p.Flags, p.Shift}
+}
+
+// newAPIProxy returns the API view of proxy
+func newAPIProxy(proxy ProxyNumberType) assignmentProxy {
+	return assignmentProxy{proxy.ID, proxy.Number, proxy.PortStatus, proxy.Tags, proxy.Features}
+}
+
+// newAPIRide returns the API view of ride
+func newAPIRide(ride RideType) apiRide {
+	v := apiRide{
+		ID:           ride.ID,
+		Start:        ride.Start,
+		Destination:  ride.Destination,
+		DateTime:     ride.DateTime,
+		Status:       ride.Status,
+		Customer:     newAssignmentPerson(ride.ThisCustomer),
+		Driver:       newAssignmentPerson(ride.ThisDriver),
+		RequiredTags: ride.RequiredTags,
+		Labels:       ride.Labels,
+		Texts:        ride.Activity.Texts,
+		Calls:        ride.Activity.Calls,
+		LastActivity: ride.Activity.Last(),
+	}
+	if ride.ThisProxyNumber.ID != 0 {
+		proxy := newAPIProxy(ride.ThisProxyNumber)
+		v.ProxyNumber = &proxy
+	}
+	return v
+}
+
+// writeAPI answers with v as JSON with status
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError answers with message as a JSON error with status, e.g.
+// {"error": "Unknown ride 7"}
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPI(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// apiHandler serves the JSON API for mobile apps and scripts. It does what
+// the dashboard does, sharing its business logic:
+//
+//	GET  /api/v1/rides                 rides, optionally filtered by ?status= and ?label=
+//	POST /api/v1/rides                 books a ride, see apiRideRequest
+//	GET  /api/v1/rides/{id}            a ride
+//	POST /api/v1/rides/{id}/cancel     cancels a ride
+//	POST /api/v1/rides/{id}/complete   completes a ride
+//	GET  /api/v1/customers             customers
+//	GET  /api/v1/drivers               drivers
+//	GET  /api/v1/proxy-numbers         the proxy number pool
+//	GET  /api/v1/messages              the message log, redacted, see apiListMessages
+//
+// Errors are answered as {"error": "..."}. Request bodies are checked
+// against the OpenAPI document, see apiOperations. Booking rides is rate
+// limited by limiter, like the create ride form. The message log is read
+// from reports.
+func apiHandler(dbdata, reports *RideSharingDB, mb *messagebird.Client, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+		method := r.Method
+		allow := func(methods ...string) bool {
+			for _, m := range methods {
+				if m == method {
+					return true
+				}
+			}
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed here", method))
+			return false
+		}
+
+		if err := checkAPIBody(r, parts); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("Server encountered an error: %v", err))
+			return
+		}
+
+		switch {
+		case len(parts) == 1 && parts[0] == "rides":
+			if !allow(http.MethodGet, http.MethodPost) {
+				return
+			}
+			if method == http.MethodPost {
+				apiBookRide(w, r, dbdata, mb, limiter)
+				return
+			}
+			filter := parseRideFilter(r.URL.Query())
+			rides := []apiRide{}
+			for _, ride := range dbdata.Rides {
+				if filter.matches(ride) {
+					rides = append(rides, newAPIRide(ride))
+				}
+			}
+			sort.Slice(rides, func(i, j int) bool { return rides[i].ID < rides[j].ID })
+			writeAPI(w, http.StatusOK, struct {
+				Rides []apiRide `json:"rides"`
+			}{rides})
+		case len(parts) >= 2 && len(parts) <= 3 && parts[0] == "rides":
+			id, err := strconv.Atoi(parts[1])
+			ride, ok := dbdata.Rides[id]
+			if err != nil || !ok {
+				writeAPIError(w, http.StatusNotFound, fmt.Sprintf("Unknown ride %q", parts[1]))
+				return
+			}
+			if len(parts) == 2 {
+				if allow(http.MethodGet) {
+					writeAPI(w, http.StatusOK, newAPIRide(ride))
+				}
+				return
+			}
+			next, ok := map[string]RideStatus{"cancel": rideCancelled, "complete": rideCompleted}[parts[2]]
+			if !ok {
+				writeAPIError(w, http.StatusNotFound, fmt.Sprintf("Unknown ride action %q", parts[2]))
+				return
+			}
+			if !allow(http.MethodPost) {
+				return
+			}
+			if err := endRide(dbdata.store, mb, ride, next); err != nil {
+				log.Println(err)
+				writeAPIError(w, http.StatusConflict, fmt.Sprint(err))
+				return
+			}
+			ride.Status = next
+			writeAPI(w, http.StatusOK, newAPIRide(ride))
+		case len(parts) == 1 && (parts[0] == "customers" || parts[0] == "drivers"):
+			if !allow(http.MethodGet) {
+				return
+			}
+			people := dbdata.Customers
+			if parts[0] == "drivers" {
+				people = dbdata.Drivers
+			}
+			list := []apiPerson{}
+			for _, p := range people {
+				list = append(list, newAPIPerson(p))
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+			writeAPI(w, http.StatusOK, map[string][]apiPerson{parts[0]: list})
+		case len(parts) == 1 && parts[0] == "proxy-numbers":
+			if !allow(http.MethodGet) {
+				return
+			}
+			list := []assignmentProxy{}
+			for _, v := range dbdata.ProxyNumbers {
+				list = append(list, newAPIProxy(v))
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+			writeAPI(w, http.StatusOK, struct {
+				ProxyNumbers []assignmentProxy `json:"proxy_numbers"`
+			}{list})
+		case len(parts) == 1 && parts[0] == "messages":
+			if allow(http.MethodGet) {
+				apiListMessages(w, r, reports)
+			}
+		default:
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("Unknown API path %s", r.URL.Path))
+		}
+	}
+}
+
+// apiBookRide books the ride in the body of r, see bookRide, answering
+// 201 Created with the ride, or 202 Accepted if it waits for a proxy number
+func apiBookRide(w http.ResponseWriter, r *http.Request, dbdata *RideSharingDB, mb *messagebird.Client, limiter *rateLimiter) {
+	if !limiter.allow(rateLimitKey(r)) {
+		writeAPIError(w, http.StatusTooManyRequests, "You're creating rides too quickly. Please wait a minute and try again.")
+		return
+	}
+	var req apiRideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ride: %v", err))
+		return
+	}
+	var tags []string
+	if req.Tags != nil {
+		tags = append([]string{}, parseTags(strings.Join(req.Tags, ","))...)
+	}
+	booking, err := bookRide(dbdata, mb, rideRequest{
+		CustomerID:  req.CustomerID,
+		DriverID:    req.DriverID,
+		Start:       req.Start,
+		Destination: req.Destination,
+		DateTime:    req.DateTime,
+		Proxy:       req.Proxy,
+		Tags:        tags,
+		Labels:      parseTags(strings.Join(req.Labels, ",")),
+	})
+	if e, ok := err.(bookingError); ok {
+		writeAPIError(w, e.Status, e.Message)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprint(err))
+		return
+	}
+
+	status := http.StatusCreated
+	if booking.Waiting {
+		status = http.StatusAccepted
+	}
+	writeAPI(w, status, struct {
+		Ride    apiRide `json:"ride"`
+		Waiting bool    `json:"waiting"`
+		Warning string  `json:"warning,omitempty"`
+	}{newAPIRide(booking.Ride), booking.Waiting, booking.Warning})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to spot, e.g.
+// "bck_3f9a0c..."
+const apiKeyPrefix = "bck_"
+
+// Roles of API keys, which decide how much personal data callers may see,
+// see redactionAllowed
+const (
+	apiRoleSupport   = "support"   // Support tooling: full numbers and message bodies on request
+	apiRoleReporting = "reporting" // Reporting and analytics: masked numbers, no message bodies
+)
+
+// apiKeyRoles are the roles, in the order they're offered, least access first
+var apiKeyRoles = []string{apiRoleReporting, apiRoleSupport}
+
+// apiKey is a key scripts and apps call the /api routes with, see
+// requireAPIKey. Only a hash of the key is stored; it is shown once, when
+// created.
+type apiKey struct {
+	ID         int
+	Name       string
+	Prefix     string // The start of the key, to tell keys apart
+	Role       string // apiRoleSupport or apiRoleReporting
+	CreatedBy  string // The admin who created the key
+	CreatedAt  string // RFC 3339
+	RevokedAt  string // RFC 3339, empty while the key works
+	LastUsedAt string // RFC 3339, empty if never used
+}
+
+// hashSecret returns the hash stored for an API key or session token
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyStore is the part of RideStore that keeps the API keys
+type apiKeyStore interface {
+	// AddAPIKey stores k, which is used with the secret that hashes to hash
+	AddAPIKey(k apiKey, hash string) error
+	// APIKeys returns all API keys, revoked ones included, newest first
+	APIKeys() ([]apiKey, error)
+	// FindAPIKey returns the ID, name and role of the API key that wasn't
+	// revoked whose secret hashes to hash, or sql.ErrNoRows
+	FindAPIKey(hash string) (apiKey, error)
+	// TouchAPIKey records that the API key with the given ID was used at at
+	TouchAPIKey(id int, at time.Time) error
+	// RevokeAPIKey revokes the API key with the given ID at at, reporting
+	// whether it was found and not revoked already
+	RevokeAPIKey(id int, at time.Time) (bool, error)
+}
+
+// AddAPIKey implements apiKeyStore
+func (s *sqlStore) AddAPIKey(k apiKey, hash string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO api_keys (name, key_hash, prefix, role, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO api_keys (name, key_hash, prefix, role, created_by, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+	}, k.Name, hash, k.Prefix, k.Role, k.CreatedBy, k.CreatedAt)
+	return err
+}
+
+// APIKeys implements apiKeyStore
+func (s *sqlStore) APIKeys() ([]apiKey, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, name, prefix, role, created_by, created_at, revoked_at, last_used_at FROM api_keys ORDER BY id DESC",
+		Postgres: "SELECT id, name, prefix, role, created_by, created_at, revoked_at, last_used_at FROM api_keys ORDER BY id DESC",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []apiKey
+	for rows.Next() {
+		var k apiKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Role, &k.CreatedBy, &k.CreatedAt, &k.RevokedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// FindAPIKey implements apiKeyStore
+func (s *sqlStore) FindAPIKey(hash string) (apiKey, error) {
+	var k apiKey
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT id, name, role FROM api_keys WHERE key_hash = ? AND revoked_at = ''",
+		Postgres: "SELECT id, name, role FROM api_keys WHERE key_hash = $1 AND revoked_at = ''",
+	}, hash).Scan(&k.ID, &k.Name, &k.Role)
+	return k, err
+}
+
+// TouchAPIKey implements apiKeyStore
+func (s *sqlStore) TouchAPIKey(id int, at time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE api_keys SET last_used_at = ? WHERE id = ?",
+		Postgres: "UPDATE api_keys SET last_used_at = $1 WHERE id = $2",
+	}, at.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// RevokeAPIKey implements apiKeyStore
+func (s *sqlStore) RevokeAPIKey(id int, at time.Time) (bool, error) {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at = ''",
+		Postgres: "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at = ''",
+	}, at.UTC().Format(time.RFC3339), id)
+	return n > 0, err
+}
+
+// createAPIKey creates a key called name with role for admin, returning the
+// key
+func createAPIKey(store RideStore, name string, role string, admin string) (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	err := store.AddAPIKey(apiKey{
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Role:      role,
+		CreatedBy: admin,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}, hashSecret(key))
+	if err != nil {
+		return "", err
+	}
+	log.Printf("%s created %s API key %q", admin, role, name)
+	return key, nil
+}
+
+// apiKeyContextKey is the request context key of the API key a request was
+// authenticated with
+type apiKeyContextKey struct{}
+
+// apiKeyName returns the name of the API key r was authenticated with, or
+// an empty string if it wasn't
+func apiKeyName(r *http.Request) string {
+	k, _ := r.Context().Value(apiKeyContextKey{}).(apiKey)
+	return k.Name
+}
+
+// apiKeyRole returns the role of the API key r was authenticated with, or
+// an empty string if it wasn't
+func apiKeyRole(r *http.Request) string {
+	k, _ := r.Context().Value(apiKeyContextKey{}).(apiKey)
+	return k.Role
+}
+
+// requireAPIKey protects the /api routes: requests must carry an API key
+// that wasn't revoked, e.g. "Authorization: Bearer bck_3f9a0c...". Keys are
+// managed at /admin/apikeys, see apiKeysHandler.
+func requireAPIKey(store RideStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		key := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		if !strings.HasPrefix(auth, "Bearer ") || !strings.HasPrefix(key, apiKeyPrefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="BirdCar API"`)
+			writeAPIError(w, http.StatusUnauthorized, "Send an API key as \"Authorization: Bearer <key>\"")
+			return
+		}
+
+		k, err := store.FindAPIKey(hashSecret(key))
+		if err == sql.ErrNoRows {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="BirdCar API", error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, "Unknown or revoked API key")
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("Server encountered an error: %v", err))
+			return
+		}
+		if err := store.TouchAPIKey(k.ID, time.Now()); err != nil {
+			log.Println(err)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	}
+}
+
+// apiKeysPage is the data rendered by views/default/apikeys.gohtml
+type apiKeysPage struct {
+	Keys    []apiKey
+	Roles   []string
+	NewKey  string // The key just created, shown this once
+	Message string
+}
+
+// apiKeysHandler lists the API keys, creates them and revokes them
+func apiKeysHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := apiKeysPage{Roles: apiKeyRoles}
+		if r.Method == "POST" {
+			admin := dashboardUser(r)
+			switch r.FormValue("action") {
+			case "create":
+				name := strings.TrimSpace(r.FormValue("name"))
+				role := r.FormValue("role")
+				if name == "" {
+					page.Message = "Name the key after the app or script that will use it."
+					break
+				}
+				if role != apiRoleSupport && role != apiRoleReporting {
+					page.Message = fmt.Sprintf("Unknown role %q", role)
+					break
+				}
+				key, err := createAPIKey(store, name, role, admin)
+				if err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+					break
+				}
+				page.NewKey = key
+				page.Message = fmt.Sprintf("API key %q created. Copy it now: it won't be shown again.", name)
+			case "revoke":
+				id, _ := strconv.Atoi(r.FormValue("id"))
+				revoked, err := store.RevokeAPIKey(id, time.Now())
+				if err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+					break
+				}
+				if !revoked {
+					page.Message = fmt.Sprintf("Could not find API key %q, or it was already revoked", r.FormValue("id"))
+					break
+				}
+				log.Printf("%s revoked API key %d", admin, id)
+				page.Message = "API key revoked. Apps using it can no longer call the API."
+			default:
+				page.Message = fmt.Sprintf("Unknown action %q", r.FormValue("action"))
+			}
+		}
+
+		keys, err := store.APIKeys()
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		page.Keys = keys
+		renderDefaultTemplate(w, r, "apikeys.gohtml", page)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redaction levels of the message log in the API, see parseRedaction
+const (
+	redactNone    = "none"    // full numbers and message bodies
+	redactNumbers = "numbers" // numbers masked, message bodies shown
+	redactFull    = "full"    // numbers masked, message bodies withheld
+)
+
+// redactionLevels are the redaction levels, least redacted first
+var redactionLevels = []string{redactNone, redactNumbers, redactFull}
+
+// Page sizes of GET /api/v1/messages
+const (
+	defaultMessagePage = 100
+	maxMessagePage     = 1000
+)
+
+// apiMessage is a logged message in the API
+type apiMessage struct {
+	ID         int    `json:"id"`
+	RideID     int    `json:"ride_id,omitempty"`
+	Direction  string `json:"direction"`
+	Originator string `json:"originator"`
+	Recipient  string `json:"recipient"`
+	Body       string `json:"body"`
+	Status     string `json:"status,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	ProviderID string `json:"provider_id,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// parseRedaction returns the redaction level value asks for, full if empty
+func parseRedaction(value string) (string, error) {
+	level := strings.ToLower(strings.TrimSpace(value))
+	switch level {
+	case "":
+		return redactFull, nil
+	case redactNone, redactNumbers, redactFull:
+		return level, nil
+	}
+	return "", fmt.Errorf("Unknown redaction %q, use one of %s", level, strings.Join(redactionLevels, ", "))
+}
+
+// redactionAllowed reports whether API keys with role may read messages
+// redacted to level. Only support keys may lower it from full.
+func redactionAllowed(role string, level string) bool {
+	return level == redactFull || role == apiRoleSupport
+}
+
+// redactionMask returns the export mask that redacts messages to level
+func redactionMask(level string) exportMask {
+	switch level {
+	case redactNone:
+		return exportMask{}
+	case redactNumbers:
+		return exportMask{maskNumbers: true}
+	}
+	return exportMask{maskNumbers: true, maskBodies: true}
+}
+
+// messageFilter selects logged messages, see messageQuery
+type messageFilter struct {
+	RideID    int       // 0 for any ride
+	Proxy     string    // the proxy number that sent or received them, if not empty
+	Direction string    // inbound or outbound, if not empty
+	Day       time.Time // the UTC day they were logged on, if not zero
+	Limit     int       // how many are selected, newest first
+}
+
+// messageQuery returns the filter selecting the logged messages the query
+// parameters of GET /api/v1/messages filter by: ride (an ID), proxy (a proxy
+// number, which sent or received the message), direction (inbound or
+// outbound) and date (a UTC day, e.g. 2020-04-01). limit caps how many
+// messages are answered, newest first.
+func messageQuery(values url.Values) (messageFilter, error) {
+	f := messageFilter{Limit: defaultMessagePage}
+	if v := strings.TrimSpace(values.Get("ride")); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			return f, fmt.Errorf("Invalid ride %q", v)
+		}
+		f.RideID = id
+	}
+	f.Proxy = strings.TrimSpace(values.Get("proxy"))
+	if v := strings.TrimSpace(values.Get("direction")); v != "" {
+		if v != directionInbound && v != directionOutbound {
+			return f, fmt.Errorf("Invalid direction %q, use %s or %s", v, directionInbound, directionOutbound)
+		}
+		f.Direction = v
+	}
+	if v := strings.TrimSpace(values.Get("date")); v != "" {
+		day, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid date %q, e.g. 2020-04-01", v)
+		}
+		f.Day = day
+	}
+	if v := strings.TrimSpace(values.Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMessagePage {
+			return f, fmt.Errorf("Invalid limit %q, between 1 and %d", v, maxMessagePage)
+		}
+		f.Limit = n
+	}
+	return f, nil
+}
+
+// LoggedMessages implements messageLogStore
+func (s *sqlStore) LoggedMessages(f messageFilter) ([]apiMessage, error) {
+	var where []string
+	var args []interface{}
+	// arg binds v to the next placeholder, which it returns
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return s.placeholders(len(args), 1)
+	}
+	if f.RideID != 0 {
+		where = append(where, "ride_id = "+arg(f.RideID))
+	}
+	if f.Proxy != "" {
+		where = append(where, "(originator = "+arg(f.Proxy)+" OR recipient = "+arg(f.Proxy)+")")
+	}
+	if f.Direction != "" {
+		where = append(where, "direction = "+arg(f.Direction))
+	}
+	if !f.Day.IsZero() {
+		where = append(where, "created_at >= "+arg(f.Day.Format(time.RFC3339))+
+			" AND created_at < "+arg(f.Day.AddDate(0, 0, 1).Format(time.RFC3339)))
+	}
+	rest := ""
+	if len(where) > 0 {
+		rest = "WHERE " + strings.Join(where, " AND ") + " "
+	}
+	rest += fmt.Sprintf("ORDER BY id DESC LIMIT %d", f.Limit)
+
+	messages := []apiMessage{}
+	var m apiMessage
+	columns := []scanColumn{
+		{"id", &m.ID}, {"ride_id", &m.RideID}, {"direction", &m.Direction}, {"originator", &m.Originator},
+		{"recipient", &m.Recipient}, {"body", &m.Body}, {"status", &m.Status}, {"provider", &m.Provider},
+		{"provider_id", &m.ProviderID}, {"created_at", &m.CreatedAt},
+	}
+	err := s.selectEach("messages", columns, s.built(rest), func() { m = apiMessage{} }, func() {
+		messages = append(messages, m)
+	}, args...)
+	return messages, err
+}
+
+// apiListMessages answers GET /api/v1/messages with the logged messages
+// the query selects, see messageQuery, redacted to the level asked for
+// with the redaction query parameter, see redactionAllowed. Messages of
+// archived rides aren't included. They are read from reports, which may
+// lag a little behind.
+func apiListMessages(w http.ResponseWriter, r *http.Request, reports *RideSharingDB) {
+	level, err := parseRedaction(r.URL.Query().Get("redaction"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprint(err))
+		return
+	}
+	if !redactionAllowed(apiKeyRole(r), level) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("Only support API keys may ask for redaction %q", level))
+		return
+	}
+	filter, err := messageQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprint(err))
+		return
+	}
+
+	messages, err := reports.store.LoggedMessages(filter)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("Server encountered an error: %v", err))
+		return
+	}
+	mask := redactionMask(level)
+	for i, m := range messages {
+		messages[i].Originator, messages[i].Recipient, messages[i].Body = mask.number(m.Originator), mask.number(m.Recipient), mask.body(m.Body)
+	}
+	if level != redactFull {
+		log.Printf("API key %q read %d message(s) with redaction %s", apiKeyName(r), len(messages), level)
+	}
+	writeAPI(w, http.StatusOK, struct {
+		Messages  []apiMessage `json:"messages"`
+		Redaction string       `json:"redaction"`
+	}{messages, level})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// approvalExpiry is how long a destructive action waits for a second admin
+// before it can no longer be approved
+const approvalExpiry = 24 * time.Hour
+
+// approvalRequired reports whether destructive admin actions need a second
+// admin's approval before they run. Set REQUIRE_APPROVAL=true, with at
+// least two admin accounts, to require it.
+func approvalRequired() bool {
+	return os.Getenv("REQUIRE_APPROVAL") == "true"
+}
+
+// adminAction is an admin action destructive enough to need a second
+// admin's approval, see approvalRequired. It acts on a target, e.g. a proxy
+// number ID, which may be empty.
+type adminAction struct {
+	Describe func(dbdata *RideSharingDB, target string) string
+	Run      func(dbdata *RideSharingDB, target string) (string, error)
+}
+
+// Destructive admin actions
+const (
+	actionDeleteProxy       = "delete-proxy"
+	actionPurgeArchivedLogs = "purge-archived-logs"
+)
+
+// adminActions are the destructive admin actions, by name
+var adminActions = map[string]adminAction{
+	actionDeleteProxy: {
+		Describe: func(dbdata *RideSharingDB, target string) string {
+			id, _ := strconv.Atoi(target)
+			if proxy, ok := dbdata.ProxyNumbers[id]; ok {
+				return "Delete proxy number " + proxy.Number
+			}
+			return "Delete proxy number " + target
+		},
+		Run: func(dbdata *RideSharingDB, target string) (string, error) {
+			id, _ := strconv.Atoi(target)
+			proxy, ok := dbdata.ProxyNumbers[id]
+			if !ok {
+				return "", fmt.Errorf("unknown proxy number %q", target)
+			}
+			if err := deleteProxy(dbdata, proxy); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Proxy number %s deleted.", proxy.Number), nil
+		},
+	},
+	actionPurgeArchivedLogs: {
+		Describe: func(dbdata *RideSharingDB, target string) string {
+			return "Purge the archived message and call logs"
+		},
+		Run: func(dbdata *RideSharingDB, target string) (string, error) {
+			if err := dbdata.store.PurgeArchivedLogs(); err != nil {
+				return "", err
+			}
+			return "Archived message and call logs purged.", nil
+		},
+	},
+}
+
+// approvalStore is the part of RideStore that keeps the destructive admin
+// actions waiting for approval and the audit log
+type approvalStore interface {
+	// AddPendingAction stores v, ignoring its ID, to wait for approval
+	AddPendingAction(v pendingAction) error
+	// PendingActions returns the actions waiting for approval requested
+	// after since, oldest first
+	PendingActions(since time.Time) ([]pendingAction, error)
+	// DecidePendingAction sets the status of the action with ID id that
+	// waits for approval, was requested after since and not by actor, to
+	// status, decided by actor at now. It reports whether there was such
+	// an action.
+	DecidePendingAction(id int, actor string, status string, since time.Time, now time.Time) (bool, error)
+	// AddAuditEntry adds v to the audit log
+	AddAuditEntry(v auditEntry) error
+	// AuditLog returns the latest limit entries of the audit log, newest
+	// first
+	AuditLog(limit int) ([]auditEntry, error)
+}
+
+// AddPendingAction implements approvalStore
+func (s *sqlStore) AddPendingAction(v pendingAction) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO pending_actions (action, target, description, requested_by, requested_at) VALUES (?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO pending_actions (action, target, description, requested_by, requested_at) VALUES ($1, $2, $3, $4, $5)",
+	}, v.Action, v.Target, v.Description, v.RequestedBy, v.RequestedAt)
+	return err
+}
+
+// PendingActions implements approvalStore
+func (s *sqlStore) PendingActions(since time.Time) ([]pendingAction, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite: "SELECT id, action, target, description, requested_by, requested_at FROM pending_actions " +
+			"WHERE status = 'pending' AND requested_at > ? ORDER BY id",
+		Postgres: "SELECT id, action, target, description, requested_by, requested_at FROM pending_actions " +
+			"WHERE status = 'pending' AND requested_at > $1 ORDER BY id",
+	}, since.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []pendingAction
+	for rows.Next() {
+		var v pendingAction
+		if err := rows.Scan(&v.ID, &v.Action, &v.Target, &v.Description, &v.RequestedBy, &v.RequestedAt); err != nil {
+			return nil, err
+		}
+		actions = append(actions, v)
+	}
+	return actions, rows.Err()
+}
+
+// DecidePendingAction implements approvalStore
+func (s *sqlStore) DecidePendingAction(id int, actor string, status string, since time.Time, now time.Time) (bool, error) {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite: "UPDATE pending_actions SET status = ?, decided_by = ?, decided_at = ? " +
+			"WHERE id = ? AND status = 'pending' AND requested_at > ? AND requested_by <> ?",
+		Postgres: "UPDATE pending_actions SET status = $1, decided_by = $2, decided_at = $3 " +
+			"WHERE id = $4 AND status = 'pending' AND requested_at > $5 AND requested_by <> $6",
+	}, status, actor, now.UTC().Format(time.RFC3339), id, since.UTC().Format(time.RFC3339), actor)
+	return n > 0, err
+}
+
+// AddAuditEntry implements approvalStore
+func (s *sqlStore) AddAuditEntry(v auditEntry) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO audit_log (time, actor, event, detail) VALUES (?, ?, ?, ?)",
+		Postgres: "INSERT INTO audit_log (time, actor, event, detail) VALUES ($1, $2, $3, $4)",
+	}, v.Time, v.Actor, v.Event, v.Detail)
+	return err
+}
+
+// AuditLog implements approvalStore
+func (s *sqlStore) AuditLog(limit int) ([]auditEntry, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT time, actor, event, detail FROM audit_log ORDER BY id DESC LIMIT ?",
+		Postgres: "SELECT time, actor, event, detail FROM audit_log ORDER BY id DESC LIMIT $1",
+	}, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []auditEntry
+	for rows.Next() {
+		var v auditEntry
+		if err := rows.Scan(&v.Time, &v.Actor, &v.Event, &v.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, v)
+	}
+	return entries, rows.Err()
+}
+
+// recordAudit adds an entry to the audit log: actor did event, e.g.
+// "requested" or "executed", described by detail
+func recordAudit(store RideStore, actor string, event string, detail string) {
+	log.Printf("Audit: %s %s: %s", actor, event, detail)
+	err := store.AddAuditEntry(auditEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Actor:  actor,
+		Event:  event,
+		Detail: detail,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// performAdminAction runs the destructive action name on target for actor,
+// or queues it for a second admin's approval if that is required. It
+// returns the message to show actor.
+func performAdminAction(dbdata *RideSharingDB, actor string, name string, target string) string {
+	action := adminActions[name]
+	description := action.Describe(dbdata, target)
+	if !approvalRequired() {
+		return runAdminAction(dbdata, actor, name, target)
+	}
+	err := dbdata.store.AddPendingAction(pendingAction{
+		Action:      name,
+		Target:      target,
+		Description: description,
+		RequestedBy: actor,
+		RequestedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Println(err)
+		return fmt.Sprint(err)
+	}
+	recordAudit(dbdata.store, actor, "requested", description)
+	return fmt.Sprintf("%s needs a second admin's approval. Ask another admin to approve it on the approvals page.", description)
+}
+
+// runAdminAction runs the destructive action name on target for actor and
+// audits the outcome, returning the message to show
+func runAdminAction(dbdata *RideSharingDB, actor string, name string, target string) string {
+	action := adminActions[name]
+	description := action.Describe(dbdata, target)
+	message, err := action.Run(dbdata, target)
+	if err != nil {
+		recordAudit(dbdata.store, actor, "failed", fmt.Sprintf("%s: %v", description, err))
+		return fmt.Sprintf("Could not %s: %v", description, err)
+	}
+	recordAudit(dbdata.store, actor, "executed", description)
+	return message
+}
+
+// pendingAction is a destructive action waiting for approval
+type pendingAction struct {
+	ID          int
+	Action      string
+	Target      string
+	Description string
+	RequestedBy string
+	RequestedAt string // RFC 3339
+}
+
+// loadPendingActions returns the actions waiting for approval that haven't
+// expired, oldest first
+func loadPendingActions(store RideStore, now time.Time) ([]pendingAction, error) {
+	return store.PendingActions(now.Add(-approvalExpiry))
+}
+
+// decidePendingAction marks the pending action with ID id as approved or
+// rejected by actor, reporting false if it isn't pending any more, expired,
+// or was requested by actor, who can't approve their own request
+func decidePendingAction(store RideStore, id int, actor string, status string) (bool, error) {
+	now := time.Now()
+	return store.DecidePendingAction(id, actor, status, now.Add(-approvalExpiry), now)
+}
+
+// auditEntry is an entry of the audit log
+type auditEntry struct {
+	Time   string // RFC 3339
+	Actor  string
+	Event  string
+	Detail string
+}
+
+// approvalsPage is the data rendered by views/default/approvals.gohtml
+type approvalsPage struct {
+	User             string
+	ApprovalRequired bool
+	Pending          []pendingAction
+	Audit            []auditEntry
+	Message          string
+}
+
+// approvalsHandler lets admins approve or reject the destructive actions
+// other admins requested, and request the ones without a page of their own.
+// It shows the latest entries of the audit log.
+func approvalsHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := approvalsPage{User: dashboardUser(r), ApprovalRequired: approvalRequired()}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		} else if r.Method == "POST" {
+			page.Message = decideAdminAction(dbdata, page.User, r)
+		}
+
+		if page.Pending, err = loadPendingActions(dbdata.store, time.Now()); err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		if page.Audit, err = dbdata.store.AuditLog(50); err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		renderDefaultTemplate(w, r, "approvals.gohtml", page)
+	}
+}
+
+// decideAdminAction handles a form posted on the approvals page by actor,
+// returning the message to show
+func decideAdminAction(dbdata *RideSharingDB, actor string, r *http.Request) string {
+	if r.FormValue("action") == "purge" {
+		return performAdminAction(dbdata, actor, actionPurgeArchivedLogs, "")
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	var pending pendingAction
+	actions, err := loadPendingActions(dbdata.store, time.Now())
+	if err != nil {
+		log.Println(err)
+		return fmt.Sprint(err)
+	}
+	for _, v := range actions {
+		if v.ID == id {
+			pending = v
+		}
+	}
+	if pending.ID == 0 {
+		return "That action is no longer waiting for approval."
+	}
+	if pending.RequestedBy == actor {
+		return "You requested this action: another admin has to approve or reject it."
+	}
+
+	status := "rejected"
+	if r.FormValue("action") == "approve" {
+		status = "approved"
+	}
+	ok, err := decidePendingAction(dbdata.store, pending.ID, actor, status)
+	if err != nil {
+		log.Println(err)
+		return fmt.Sprint(err)
+	}
+	if !ok {
+		return "That action is no longer waiting for approval."
+	}
+	recordAudit(dbdata.store, actor, status, fmt.Sprintf("%s, requested by %s", pending.Description, pending.RequestedBy))
+	if status == "rejected" {
+		return pending.Description + ": rejected."
+	}
+	return runAdminAction(dbdata, actor, pending.Action, pending.Target)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveInterval is how often the server archives completed rides
+const archiveInterval = 24 * time.Hour
+
+// archivedTables maps each table holding ride history to its archive table,
+// with the column that links its rows to a ride
+var archivedTables = []struct {
+	Table, Archive, RideColumn string
+}{
+	{"messages", "archived_messages", "ride_id"},
+	{"calls", "archived_calls", "ride_id"},
+	{"rides", "archived_rides", "id"},
+}
+
+// archiveAfter returns how long after a ride ends we archive it.
+// Set ARCHIVE_AFTER (e.g. "2160h") to override the default of 30 days.
+func archiveAfter() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ARCHIVE_AFTER")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// archivableRides returns the IDs of rides that ended before cutoff.
+// Rides with datetimes we can't parse are kept.
+func archivableRides(dbdata *RideSharingDB, cutoff time.Time) []int {
+	var ids []int
+	for _, v := range dbdata.Rides {
+		start, err := parseRideTime(v.DateTime)
+		if err != nil {
+			continue
+		}
+		if start.Add(rideDuration()).Before(cutoff) {
+			ids = append(ids, v.ID)
+		}
+	}
+	return ids
+}
+
+// archiveStore is the part of RideStore that archives ride history
+type archiveStore interface {
+	// ArchiveRides moves the rides with the given IDs, and their message
+	// and call logs, from the hot tables into the archive tables in one
+	// transaction, releasing their proxy numbers. If csvDir is set, the
+	// moved rows are also exported there as CSV files.
+	ArchiveRides(ids []int, csvDir string) error
+	// PurgeArchivedLogs deletes the archived message and call logs
+	PurgeArchivedLogs() error
+}
+
+// PurgeArchivedLogs implements archiveStore
+func (s *sqlStore) PurgeArchivedLogs() error {
+	return s.inTx(func(tx sqlTx) error {
+		return tx.execAll(
+			statement(sqlQuery{SQLite: "DELETE FROM archived_messages", Postgres: "DELETE FROM archived_messages"}),
+			statement(sqlQuery{SQLite: "DELETE FROM archived_calls", Postgres: "DELETE FROM archived_calls"}),
+		)
+	})
+}
+
+// ArchiveRides implements archiveStore
+func (s *sqlStore) ArchiveRides(ids []int, csvDir string) error {
+	placeholders := s.placeholders(1, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	// Columns are copied by name, as they may be in another order in the
+	// archive tables, or not be in both yet
+	columns := make(map[string]string)
+	for _, t := range archivedTables {
+		shared, err := s.sharedColumns(t.Table, t.Archive)
+		if err != nil {
+			return err
+		}
+		columns[t.Table] = strings.Join(shared, ", ")
+	}
+
+	return s.inTx(func(tx sqlTx) error {
+		// Hold the rides' proxy numbers back from their participants' next rides, see cooldown.go
+		releases, err := rideReleases(tx, placeholders, args)
+		if err != nil {
+			return err
+		}
+		if err := tx.execAll(releases...); err != nil {
+			return err
+		}
+
+		// Last-used contact numbers only matter while a ride is active. They
+		// go first, as they reference the rides. So do observers' guest
+		// links, see observers.go.
+		err = tx.execAll(
+			statement(tx.built("DELETE FROM ride_contacts WHERE ride_id IN ("+placeholders+")"), args...),
+			statement(tx.built("DELETE FROM ride_observers WHERE ride_id IN ("+placeholders+")"), args...),
+		)
+		if err != nil {
+			return err
+		}
+
+		stamp := time.Now().UTC().Format("20060102T150405Z")
+		for _, t := range archivedTables {
+			where := fmt.Sprintf(" WHERE %s IN (%s)", t.RideColumn, placeholders)
+			if csvDir != "" {
+				file := filepath.Join(csvDir, fmt.Sprintf("%s-%s.csv", t.Table, stamp))
+				if err := exportCSV(tx, tx.built("SELECT * FROM "+t.Table+where), args, file); err != nil {
+					return err
+				}
+			}
+			cols := columns[t.Table]
+			err := tx.execAll(
+				statement(tx.built("INSERT INTO "+t.Archive+" ("+cols+") SELECT "+cols+" FROM "+t.Table+where), args...),
+				statement(tx.built("DELETE FROM "+t.Table+where), args...),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// archiveRides moves the rides with the given IDs, and their message and call
+// logs, into the archive tables, so that loadDB stays fast as history
+// accumulates, see ArchiveRides. If csvDir is set, the moved rows are also
+// exported there as CSV files, e.g. to a mounted bucket.
+func archiveRides(store RideStore, ids []int, csvDir string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := store.ArchiveRides(ids, csvDir); err != nil {
+		return err
+	}
+	return store.SyncReservations()
+}
+
+// rideReleases returns the statements recording that the rides with the
+// given IDs, matched by placeholders, released their proxy numbers
+func rideReleases(tx sqlTx, placeholders string, ids []interface{}) ([]dbStatement, error) {
+	rows, err := tx.query(tx.built("SELECT number_id, customer_id, driver_id FROM rides WHERE id IN ("+placeholders+")"), ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var releases []dbStatement
+	now := time.Now()
+	for rows.Next() {
+		var proxyID, customerID, driverID int
+		if err := rows.Scan(&proxyID, &customerID, &driverID); err != nil {
+			return nil, err
+		}
+		releases = append(releases, releaseStatement(proxyID, customerID, driverID, now))
+	}
+	return releases, rows.Err()
+}
+
+// exportCSV writes the rows returned by q to file, with a header row
+func exportCSV(tx sqlTx, q sqlQuery, args []interface{}, file string) error {
+	rows, err := tx.query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var records [][]string
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		record := make([]string, len(columns))
+		for i, v := range values {
+			record[i] = v.String
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeCSV(file, columns, records)
+}
+
+// writeCSV writes records to file, after a header row of their columns
+func writeCSV(file string, columns []string, records [][]string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := csv.NewWriter(f)
+	if err := out.Write(columns); err != nil {
+		return err
+	}
+	if err := out.WriteAll(records); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// pollArchive archives completed rides every interval until ctx is done.
+// It is meant to be run in its own goroutine.
+func pollArchive(ctx context.Context, store RideStore, interval time.Duration) {
+	every(ctx, interval, func() {
+		dbdata, err := newRideSharingDB(store).loadDB()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		ids := archivableRides(dbdata, time.Now().Add(-archiveAfter()))
+		if err := archiveRides(store, ids, os.Getenv("ARCHIVE_CSV_DIR")); err != nil {
+			log.Printf("Could not archive rides: %v", err)
+			return
+		}
+		if len(ids) > 0 {
+			log.Printf("Archived %d completed rides", len(ids))
+		}
+	})
+}
+
+// runArchive implements the archive command, which archives completed rides
+// right away. It returns the exit status.
+func runArchive(args []string) int {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	olderThan := flags.Duration("older-than", archiveAfter(), "archive rides that ended at least this long ago")
+	csvDir := flags.String("csv", os.Getenv("ARCHIVE_CSV_DIR"), "also export archived rows as CSV files to this directory")
+	flags.Parse(args)
+
+	if err := openDB(databaseURL()); err != nil {
+		fmt.Println("Could not open database:", err)
+		return 1
+	}
+	// Make sure the archive tables exist
+	initExampleDB(appStore)
+	dbdata, err := newRideSharingDB(appStore).loadDB()
+	if err != nil {
+		fmt.Println("Could not load database:", err)
+		return 1
+	}
+
+	ids := archivableRides(dbdata, time.Now().Add(-*olderThan))
+	if err := archiveRides(appStore, ids, *csvDir); err != nil {
+		fmt.Println("Could not archive rides:", err)
+		return 1
+	}
+	fmt.Printf("Archived %d completed rides.\n", len(ids))
+	return 0
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recentTrafficLimit is how many recent messages and calls the assignment API returns
+const recentTrafficLimit = 20
+
+// proxyAssignment is what a proxy number is currently used for: a ride, a
+// relationship between regular riders, or a ride that moved off the number
+// and whose participants are still bridged from it
+type proxyAssignment struct {
+	Kind           string           `json:"kind"` // "ride", "relationship" or "handoff"
+	RideID         int              `json:"ride_id,omitempty"`
+	RelationshipID int              `json:"relationship_id,omitempty"`
+	Customer       assignmentPerson `json:"customer"`
+	Driver         assignmentPerson `json:"driver"`
+	From           string           `json:"from,omitempty"`  // start of the window the assignment holds, if known
+	Until          string           `json:"until,omitempty"` // end of the window, if known
+}
+
+// assignmentProxy is the proxy number an assignment lookup is about
+type assignmentProxy struct {
+	ID       int      `json:"id"`
+	Number   string   `json:"number"`
+	Status   string   `json:"status"`
+	Tags     []string `json:"tags,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
+
+// assignmentPerson is a participant of an assignment
+type assignmentPerson struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Number string `json:"number"`
+}
+
+// trafficEntry is a message or call through a proxy number. Message bodies
+// are left out; the ride transcript export has them.
+type trafficEntry struct {
+	Time       string `json:"time"`
+	Channel    string `json:"channel"` // "sms", "whatsapp" or "call"
+	Direction  string `json:"direction"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	RideID     int    `json:"ride_id"`
+	ProviderID string `json:"provider_id"`
+	Status     string `json:"status,omitempty"` // delivery status of outbound messages
+}
+
+// newAssignmentPerson returns the assignment view of p
+func newAssignmentPerson(p Person) assignmentPerson {
+	return assignmentPerson{ID: p.ID, Name: p.Name, Number: p.Number}
+}
+
+// findAssignments returns what proxy is used for now: rides on it that
+// haven't ended, live relationships on it, and rides handed off from it
+func findAssignments(dbdata *RideSharingDB, proxy ProxyNumberType, now time.Time) []proxyAssignment {
+	assignments := []proxyAssignment{}
+	for _, ride := range ridesInProgress(dbdata, proxy, now) {
+		a := proxyAssignment{
+			Kind:     "ride",
+			RideID:   ride.ID,
+			Customer: newAssignmentPerson(ride.ThisCustomer),
+			Driver:   newAssignmentPerson(ride.ThisDriver),
+		}
+		if start, err := parseRideTime(ride.DateTime); err == nil {
+			a.From = start.UTC().Format(time.RFC3339)
+			a.Until = start.Add(rideDuration()).UTC().Format(time.RFC3339)
+		}
+		assignments = append(assignments, a)
+	}
+	for _, rel := range dbdata.Relationships {
+		if rel.ThisProxyNumber.ID != proxy.ID || rel.expired(now) {
+			continue
+		}
+		assignments = append(assignments, proxyAssignment{
+			Kind:           "relationship",
+			RelationshipID: rel.ID,
+			Customer:       newAssignmentPerson(rel.ThisCustomer),
+			Driver:         newAssignmentPerson(rel.ThisDriver),
+			From:           rel.CreatedAt,
+			Until:          rel.ExpiresAt,
+		})
+	}
+	for _, h := range dbdata.Handoffs {
+		ride, ok := dbdata.Rides[h.RideID]
+		if h.OldProxy.ID != proxy.ID || !ok || ride.Status.Terminal() {
+			continue
+		}
+		assignments = append(assignments, proxyAssignment{
+			Kind:     "handoff",
+			RideID:   ride.ID,
+			Customer: newAssignmentPerson(ride.ThisCustomer),
+			Driver:   newAssignmentPerson(ride.ThisDriver),
+			Until:    h.ExpiresAt,
+		})
+	}
+	return assignments
+}
+
+// trafficStore is the part of RideStore that reads the traffic through
+// proxy numbers from the message and call logs
+type trafficStore interface {
+	// RecentTraffic returns the latest limit messages and the latest limit
+	// calls through number
+	RecentTraffic(number string, limit int) ([]trafficEntry, error)
+}
+
+// RecentTraffic implements trafficStore
+func (s *sqlStore) RecentTraffic(number string, limit int) ([]trafficEntry, error) {
+	traffic := []trafficEntry{}
+	rows, err := s.query(sqlQuery{
+		SQLite: "SELECT created_at, direction, originator, recipient, ride_id, provider_id, provider, status FROM messages " +
+			"WHERE originator = ? OR recipient = ? ORDER BY id DESC LIMIT ?",
+		Postgres: "SELECT created_at, direction, originator, recipient, ride_id, provider_id, provider, status FROM messages " +
+			"WHERE originator = $1 OR recipient = $2 ORDER BY id DESC LIMIT $3",
+	}, number, number, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := trafficEntry{Channel: "sms"}
+		var provider string
+		if err := rows.Scan(&e.Time, &e.Direction, &e.From, &e.To, &e.RideID, &e.ProviderID, &provider, &e.Status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if provider == providerWhatsApp {
+			e.Channel = textChannelWhatsApp
+		}
+		traffic = append(traffic, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.query(sqlQuery{
+		SQLite:   "SELECT created_at, source, destination, ride_id, provider_id FROM calls WHERE destination = ? ORDER BY id DESC LIMIT ?",
+		Postgres: "SELECT created_at, source, destination, ride_id, provider_id FROM calls WHERE destination = $1 ORDER BY id DESC LIMIT $2",
+	}, number, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := trafficEntry{Channel: "call", Direction: directionInbound}
+		if err := rows.Scan(&e.Time, &e.From, &e.To, &e.RideID, &e.ProviderID); err != nil {
+			return nil, err
+		}
+		traffic = append(traffic, e)
+	}
+	return traffic, rows.Err()
+}
+
+// loadRecentTraffic returns the latest messages and calls through number, newest first
+func loadRecentTraffic(store RideStore, number string, limit int) ([]trafficEntry, error) {
+	traffic, err := store.RecentTraffic(number, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Timestamps are RFC 3339 in UTC, so they sort as strings
+	sort.SliceStable(traffic, func(i, j int) bool { return traffic[i].Time > traffic[j].Time })
+	if len(traffic) > limit {
+		traffic = traffic[:limit]
+	}
+	return traffic, nil
+}
+
+// proxyAssignmentHandler answers GET /api/proxy-numbers/{id}/assignment with
+// what the proxy number is used for right now and its recent traffic, e.g.
+//
+//	{"proxy":{"id":1,"number":"319700004","status":"active"},
+//	 "assignments":[{"kind":"ride","ride_id":3,"customer":{...},"driver":{...},"from":"...","until":"..."}],
+//	 "recent_traffic":[{"time":"...","channel":"sms","direction":"inbound",...}]}
+func proxyAssignmentHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 || parts[0] != "api" || parts[1] != "proxy-numbers" || parts[3] != "assignment" {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		proxy, ok := dbdata.ProxyNumbers[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		traffic, err := loadRecentTraffic(dbdata.store, proxy.Number, recentTrafficLimit)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Proxy         assignmentProxy   `json:"proxy"`
+			Assignments   []proxyAssignment `json:"assignments"`
+			RecentTraffic []trafficEntry    `json:"recent_traffic"`
+		}{
+			Proxy:         newAPIProxy(proxy),
+			Assignments:   findAssignments(dbdata, proxy, time.Now()),
+			RecentTraffic: traffic,
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxAvailabilityHours caps how far ahead the availability calendar looks
+const maxAvailabilityHours = 7 * 24
+
+// poolSlot is the projected proxy pool usage for one hour
+type poolSlot struct {
+	Start        time.Time
+	ActiveRides  int // Rides in progress at any point during this hour
+	ProxiesInUse int // Distinct proxy numbers in the pool used by those rides
+	PoolSize     int // Active proxy numbers, less those cooling down unused, see cooldown.go
+}
+
+// Utilization is the percentage of the pool used during the slot
+func (s poolSlot) Utilization() int {
+	if s.PoolSize == 0 {
+		return 100
+	}
+	return s.ProxiesInUse * 100 / s.PoolSize
+}
+
+// Exhausted reports whether every proxy number is in use during the slot
+func (s poolSlot) Exhausted() bool {
+	return s.ProxiesInUse >= s.PoolSize
+}
+
+// availabilityPage is the data rendered by views/default/availability.gohtml
+type availabilityPage struct {
+	From    time.Time
+	Hours   int
+	Slots   []poolSlot
+	Message string
+}
+
+// projectPoolUsage computes hourly proxy pool usage for the given number of
+// hours starting at from, based on scheduled ride times and rideDuration.
+// Rides that ended, and rides with datetimes we can't parse, are left out of
+// the projection. Numbers that are pending a port, quarantined or disabled
+// aren't in the pool, and neither are numbers cooling down during the slot
+// that no ride uses then, as they can't be counted on for new rides.
+func projectPoolUsage(dbdata *RideSharingDB, from time.Time, hours int) []poolSlot {
+	active := 0
+	for _, v := range dbdata.ProxyNumbers {
+		if v.PortStatus == portStatusActive {
+			active++
+		}
+	}
+	inPool := func(proxyID int) bool {
+		return dbdata.ProxyNumbers[proxyID].PortStatus == portStatusActive
+	}
+
+	duration := rideDuration()
+	cooldown := proxyCooldown()
+	slots := make([]poolSlot, hours)
+	for i := range slots {
+		slotStart := from.Add(time.Duration(i) * time.Hour)
+		slotEnd := slotStart.Add(time.Hour)
+		inUse := make(map[int]bool)
+		rides := 0
+		for _, v := range dbdata.Rides {
+			if v.Status.Terminal() {
+				continue
+			}
+			rideStart, err := parseRideTime(v.DateTime)
+			if err != nil {
+				continue
+			}
+			if rideStart.Before(slotEnd) && slotStart.Before(rideStart.Add(duration)) {
+				rides++
+				if inPool(v.ThisProxyNumber.ID) {
+					inUse[v.ThisProxyNumber.ID] = true
+				}
+			}
+		}
+		coolingDown := make(map[int]bool)
+		for _, v := range dbdata.Releases {
+			releasedAt, err := time.Parse(time.RFC3339, v.ReleasedAt)
+			if err != nil || !inPool(v.ProxyID) || inUse[v.ProxyID] {
+				continue
+			}
+			if releasedAt.Before(slotEnd) && slotStart.Before(releasedAt.Add(cooldown)) {
+				coolingDown[v.ProxyID] = true
+			}
+		}
+		slots[i] = poolSlot{
+			Start:        slotStart,
+			ActiveRides:  rides,
+			ProxiesInUse: len(inUse),
+			PoolSize:     active - len(coolingDown),
+		}
+	}
+	return slots
+}
+
+// startOfHour returns the start of the hour t is in, in t's location.
+// Unlike t.Truncate(time.Hour), which truncates in UTC, this starts slots on
+// the hour in time zones whose offset isn't whole hours, e.g. India's.
+func startOfHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// availabilityHandler shows projected proxy pool utilization per hour, so
+// operators can see whether upcoming bookings will exhaust the pool.
+// Query parameters:
+// - from: first hour to show, as "2006-01-02T15:04" (default: the current hour)
+// - hours: number of hours to show (default: 24, maximum: one week)
+func availabilityHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+
+		page := availabilityPage{
+			From:  startOfHour(time.Now()),
+			Hours: 24,
+		}
+		if v := r.FormValue("from"); v != "" {
+			from, err := parseRideTime(v)
+			if err != nil {
+				page.Message = fmt.Sprint(err)
+			} else {
+				page.From = startOfHour(from)
+			}
+		}
+		if v := r.FormValue("hours"); v != "" {
+			hours, err := strconv.Atoi(v)
+			if err != nil || hours < 1 || hours > maxAvailabilityHours {
+				page.Message = fmt.Sprintf("hours must be a number between 1 and %d", maxAvailabilityHours)
+			} else {
+				page.Hours = hours
+			}
+		}
+
+		if page.Message != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		page.Slots = projectPoolUsage(dbdata, page.From, page.Hours)
+		renderDefaultTemplate(w, r, "availability.gohtml", page)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartOfHour(t *testing.T) {
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	nepal := time.FixedZone("NPT", 5*60*60+45*60)
+	tests := []struct {
+		t    time.Time
+		want time.Time
+	}{
+		{time.Date(2020, 3, 1, 10, 15, 30, 5, time.UTC), time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 3, 1, 10, 15, 0, 0, india), time.Date(2020, 3, 1, 10, 0, 0, 0, india)},
+		{time.Date(2020, 3, 1, 10, 50, 0, 0, india), time.Date(2020, 3, 1, 10, 0, 0, 0, india)},
+		{time.Date(2020, 3, 1, 0, 10, 0, 0, nepal), time.Date(2020, 3, 1, 0, 0, 0, 0, nepal)},
+	}
+	for _, test := range tests {
+		got := startOfHour(test.t)
+		if !got.Equal(test.want) || got.Location() != test.want.Location() {
+			t.Errorf("startOfHour(%v) = %v, want %v", test.t, got, test.want)
+		}
+	}
+}
+
+func TestProjectPoolUsageSlotsStartOnTheLocalHour(t *testing.T) {
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	local := time.Local
+	time.Local = india
+	defer func() { time.Local = local }()
+
+	dbdata := &RideSharingDB{
+		ProxyNumbers: map[int]ProxyNumberType{
+			1: {ID: 1, PortStatus: portStatusActive},
+			2: {ID: 2, PortStatus: portStatusActive},
+		},
+		Rides: map[int]RideType{
+			// Rides taking rideDuration, an hour, from 10:00 and 11:00
+			1: {ID: 1, DateTime: "2020-03-01T10:00", ThisProxyNumber: ProxyNumberType{ID: 1}, Status: rideScheduled},
+			2: {ID: 2, DateTime: "2020-03-01T11:00", ThisProxyNumber: ProxyNumberType{ID: 2}, Status: rideScheduled},
+		},
+	}
+	from, err := parseRideTime("2020-03-01T10:40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots := projectPoolUsage(dbdata, startOfHour(from), 3)
+	wantActive := []int{1, 1, 0}
+	for i, slot := range slots {
+		if slot.Start.Hour() != 10+i || slot.Start.Minute() != 0 {
+			t.Errorf("slot %d starts at %s, want %d:00", i, slot.Start.Format("15:04"), 10+i)
+		}
+		if slot.ActiveRides != wantActive[i] {
+			t.Errorf("slot %d has %d active rides, want %d", i, slot.ActiveRides, wantActive[i])
+		}
+		if slot.PoolSize != 2 {
+			t.Errorf("slot %d has pool size %d, want 2", i, slot.PoolSize)
+		}
+	}
+}
+
+func TestProjectPoolUsageCountsOnlyTheAssignablePool(t *testing.T) {
+	from, err := parseRideTime("2020-03-01T10:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbdata := &RideSharingDB{
+		ProxyNumbers: map[int]ProxyNumberType{
+			1: {ID: 1, PortStatus: portStatusActive},
+			2: {ID: 2, PortStatus: portStatusActive},
+			3: {ID: 3, PortStatus: portStatusActive},
+			4: {ID: 4, PortStatus: portStatusDisabled},
+		},
+		Rides: map[int]RideType{
+			1: {ID: 1, DateTime: "2020-03-01T10:00", ThisProxyNumber: ProxyNumberType{ID: 1}, Status: rideScheduled},
+			2: {ID: 2, DateTime: "2020-03-01T10:00", ThisProxyNumber: ProxyNumberType{ID: 2}, Status: rideCancelled},
+			// Still on a number that was drained since
+			3: {ID: 3, DateTime: "2020-03-01T10:00", ThisProxyNumber: ProxyNumberType{ID: 4}, Status: rideScheduled},
+		},
+		Releases: []ProxyRelease{
+			{ProxyID: 3, CustomerID: 1, DriverID: 1, ReleasedAt: from.Add(-time.Hour).UTC().Format(time.RFC3339)},
+		},
+	}
+	slot := projectPoolUsage(dbdata, from, 1)[0]
+	if slot.ActiveRides != 2 || slot.ProxiesInUse != 1 || slot.PoolSize != 2 {
+		t.Errorf("got %d active rides on %d of %d proxy numbers, want 2 on 1 of 2", slot.ActiveRides, slot.ProxiesInUse, slot.PoolSize)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+// The benchmarks measure the relay hot path, loading the database and
+// routing a webhook to a ride, against each store:
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// Each store is seeded with benchmarkRideCounts finished rides, which every
+// webhook request loads along with the live ones.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// benchmarkRideCounts are the numbers of finished rides the stores are seeded with
+var benchmarkRideCounts = []int{10, 1000}
+
+// benchmarkStores counts the stores opened, so in-memory ones get fresh names
+var benchmarkStores int64
+
+// benchmarkApp is the application with a seeded store and a ride to route to
+type benchmarkApp struct {
+	handler http.Handler
+	sim     *messageBirdSimulator
+	dbdata  *RideSharingDB // A snapshot of the seeded store, see loadDB
+	ride    RideType
+}
+
+// forEachStore runs bench against SQLite and the in-memory store, each
+// seeded with every count in benchmarkRideCounts
+func forEachStore(b *testing.B, bench func(b *testing.B, app *benchmarkApp)) {
+	for _, store := range []string{"sqlite", "memory"} {
+		for _, rides := range benchmarkRideCounts {
+			store, rides := store, rides
+			b.Run(fmt.Sprintf("%s/rides=%d", store, rides), func(b *testing.B) {
+				bench(b, startBenchmarkApp(b, store, rides))
+			})
+		}
+	}
+}
+
+// startBenchmarkApp opens a new store of kind, seeds it with rides finished
+// rides and one scheduled ride, and returns the application serving it
+func startBenchmarkApp(b *testing.B, kind string, rides int) *benchmarkApp {
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	storeURL := fmt.Sprintf("memory:benchmark-%d", atomic.AddInt64(&benchmarkStores, 1))
+	if kind == "sqlite" {
+		dir, err := ioutil.TempDir("", "benchmark")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { os.RemoveAll(dir) })
+		storeURL = filepath.Join(dir, "ridesharing.db")
+	}
+	if err := openDB(storeURL); err != nil {
+		b.Fatalf("could not open %s: %v", storeURL, err)
+	}
+	b.Cleanup(func() { closeDB() })
+	initExampleDB(appStore)
+
+	finished := time.Now().Add(-24 * time.Hour).Format("2006-01-02T15:04")
+	var err error
+	switch store := appStore.(type) {
+	case *sqlStore:
+		err = store.inTx(func(tx sqlTx) error {
+			for i := 0; i < rides; i++ {
+				_, err := tx.exec(sqlQuery{
+					SQLite: "INSERT INTO rides (start, destination, datetime, customer_id, driver_id, number_id, status) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				}, "Amsterdam Centraal", "Schiphol Airport", finished, 2, 2, 2, string(rideCompleted))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case *memoryStore:
+		store.mu.Lock()
+		for i := 0; i < rides; i++ {
+			id := store.newID("rides")
+			store.rides[id] = memoryRide{ID: id, Start: "Amsterdam Centraal", Destination: "Schiphol Airport", DateTime: finished,
+				CustomerID: 2, DriverID: 2, NumberID: 2, Status: rideCompleted}
+		}
+		store.mu.Unlock()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dbdata, err := newRideSharingDB(appStore).loadDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ride := RideType{
+		Start:           "Amsterdam Centraal",
+		Destination:     "Schiphol Airport",
+		DateTime:        time.Now().Add(time.Hour).Format("2006-01-02T15:04"),
+		ThisCustomer:    dbdata.Customers[1],
+		ThisDriver:      dbdata.Drivers[1],
+		ThisProxyNumber: dbdata.ProxyNumbers[1],
+		Status:          rideScheduled,
+	}
+	if ride.ID, err = appStore.InsertRide(ride); err != nil {
+		b.Fatal(err)
+	}
+	if dbdata, err = dbdata.loadDB(); err != nil {
+		b.Fatal(err)
+	}
+
+	sim := new(messageBirdSimulator)
+	mb := messagebird.New("benchmark")
+	mb.HTTPClient = &http.Client{Transport: sim}
+	queue := newNotificationQueue(mb, 100, newAdaptiveThrottle(0, 0))
+	// Every request comes from one client and participant, faster than the
+	// webhook rate limits allow
+	for _, name := range []string{"WEBHOOK_RATE_LIMIT", "SENDER_TEXT_RATE_LIMIT", "SENDER_CALL_RATE_LIMIT"} {
+		name := name
+		old, set := os.LookupEnv(name)
+		os.Setenv(name, "1000000000")
+		b.Cleanup(func() {
+			if set {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+	return &benchmarkApp{handler: newRouter(dbdata, dbdata, mb, queue), sim: sim, dbdata: dbdata, ride: ride}
+}
+
+// serve sends req to the application, failing b unless it answers 200 OK
+func (app *benchmarkApp) serve(b *testing.B, req *http.Request) {
+	w := httptest.NewRecorder()
+	app.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		b.Fatalf("%s %s answered %d: %s", req.Method, req.URL.Path, w.Code, w.Body)
+	}
+}
+
+// BenchmarkSMSWebhook relays texts from the customer of a ride to its driver
+func BenchmarkSMSWebhook(b *testing.B) {
+	forEachStore(b, func(b *testing.B, app *benchmarkApp) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			form := url.Values{
+				"id":         {fmt.Sprintf("benchmark-sms-%d", i)},
+				"originator": {app.ride.ThisCustomer.Number},
+				"receiver":   {app.ride.ThisProxyNumber.Number},
+				"payload":    {"I'm at the main entrance."},
+			}
+			req := httptest.NewRequest(http.MethodPost, smsWebhookPath(app.dbdata.webhookToken), strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			app.serve(b, req)
+		}
+		b.StopTimer()
+		if sent := len(app.sim.take()); sent != b.N {
+			b.Fatalf("relayed %d texts, want %d", sent, b.N)
+		}
+	})
+}
+
+// BenchmarkVoiceWebhook routes calls from the customer of a ride to its driver
+func BenchmarkVoiceWebhook(b *testing.B) {
+	forEachStore(b, func(b *testing.B, app *benchmarkApp) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			query := url.Values{
+				"callID":      {fmt.Sprintf("benchmark-call-%d", i)},
+				"source":      {app.ride.ThisCustomer.Number},
+				"destination": {app.ride.ThisProxyNumber.Number},
+			}
+			app.serve(b, httptest.NewRequest(http.MethodGet, voiceWebhookPath(app.dbdata.webhookToken)+"?"+query.Encode(), nil))
+		}
+	})
+}
+
+// BenchmarkLoadDB loads the whole database, as every webhook request does
+func BenchmarkLoadDB(b *testing.B) {
+	forEachStore(b, func(b *testing.B, app *benchmarkApp) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := app.dbdata.loadDB(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkFindRideParticipant finds the ride of a text or call in the
+// loaded database, the lookup an indexed query would replace
+func BenchmarkFindRideParticipant(b *testing.B) {
+	forEachStore(b, func(b *testing.B, app *benchmarkApp) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, _, ok := findRideParticipant(app.dbdata, app.ride.ThisProxyNumber.Number, app.ride.ThisCustomer.Number); !ok {
+				b.Fatal("ride not found")
+			}
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// voiceAPIRoot is the base URL of the MessageBird Voice API
+const voiceAPIRoot = "https://voice.messagebird.com"
+
+// maxNumberResults is how many numbers a search for numbers to buy shows
+const maxNumberResults = 20
+
+// mbAvailableNumber is the subset of the Numbers API available phone number
+// object we use
+type mbAvailableNumber struct {
+	Number   string   `json:"number"`
+	Country  string   `json:"country"`
+	Region   string   `json:"region"`
+	Locality string   `json:"locality"`
+	Features []string `json:"features"`
+	Type     string   `json:"type"`
+}
+
+// numberSearch is a search for numbers to buy in Country with Features
+// (e.g. "sms" and "voice"), whose digits contain Contains if it's set
+type numberSearch struct {
+	Country  string
+	Features []string
+	Contains string
+}
+
+// Wants reports whether the search asks for numbers with feature
+func (search numberSearch) Wants(feature string) bool {
+	for _, v := range search.Features {
+		if v == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// searchAvailableNumbers returns the numbers MessageBird has for sale that
+// match search
+func searchAvailableNumbers(mb *messagebird.Client, search numberSearch) ([]mbAvailableNumber, error) {
+	query := url.Values{}
+	for _, v := range search.Features {
+		query.Add("features", v)
+	}
+	if search.Contains != "" {
+		query.Set("number", search.Contains)
+		query.Set("search_pattern", "anywhere")
+	}
+	query.Set("limit", strconv.Itoa(maxNumberResults))
+
+	var resp struct {
+		Items []mbAvailableNumber `json:"items"`
+	}
+	path := numbersAPIRoot + "/available-phone-numbers/" + url.PathEscape(search.Country) + "?" + query.Encode()
+	if err := mb.Request(&resp, http.MethodGet, path, nil); err != nil {
+		return nil, err
+	}
+	return resp.Items, nil
+}
+
+// purchaseNumber buys number, in the country with ISO code country, for our
+// MessageBird account, billed monthly
+func purchaseNumber(mb *messagebird.Client, number string, country string) (mbPhoneNumber, error) {
+	body := struct {
+		Number                string `json:"number"`
+		CountryCode           string `json:"countryCode"`
+		BillingIntervalMonths int    `json:"billingIntervalMonths"`
+	}{number, country, 1}
+
+	var owned mbPhoneNumber
+	err := mb.Request(&owned, http.MethodPost, numbersAPIRoot+"/phone-numbers", body)
+	return owned, err
+}
+
+// assignVoiceCallFlow has MessageBird handle calls to number with the call
+// flow the flows command manages, which fetches their flow from our voice
+// webhook
+func assignVoiceCallFlow(mb *messagebird.Client, number string) error {
+	flows, err := loadCallFlows(mb)
+	if err != nil {
+		return err
+	}
+	for _, v := range flows {
+		if v.Title != voiceCallFlowTitle {
+			continue
+		}
+		body := struct {
+			Numbers []string `json:"numbers"`
+		}{[]string{number}}
+		var resp interface{}
+		return mb.Request(&resp, http.MethodPost, voiceAPIRoot+"/call-flows/"+v.ID+"/numbers", body)
+	}
+	return fmt.Errorf("there is no %q call flow yet: run the flows sync command", voiceCallFlowTitle)
+}
+
+// buyProxyNumber buys number and adds it to the proxy pool with tags, with
+// calls to it routed to our voice webhook. It returns the message to show.
+func buyProxyNumber(dbdata *RideSharingDB, mb *messagebird.Client, number string, country string, tags []string) string {
+	owned, err := purchaseNumber(mb, number, country)
+	if err != nil {
+		mbError(err)
+		return fmt.Sprintf("Could not buy %s: %v", number, err)
+	}
+	log.Printf("Bought proxy number %s", number)
+
+	if _, err := addProxy(dbdata.store, number, tags); err != nil {
+		log.Println(err)
+		return fmt.Sprintf("Bought %s, but could not add it to the pool: %v. Add it on the proxy pool page.", number, err)
+	}
+	if dbdata, err = dbdata.loadDB(); err != nil {
+		log.Println(err)
+	} else if proxy, ok := findProxyNumber(dbdata, number); ok {
+		storeFeatures(dbdata.store, proxy, owned.Features)
+	}
+
+	message := fmt.Sprintf("Bought %s and added it to the pool.", number)
+	if err := assignVoiceCallFlow(mb, number); err != nil {
+		mbError(err)
+		message += fmt.Sprintf(" Could not route its calls to the voice webhook: %v.", err)
+	}
+	message += " Route its texts to " + publicURL() + appPath(smsWebhookPath(dbdata.webhookToken)) + " in the MessageBird dashboard."
+	return message
+}
+
+// numbersPage is the data rendered by views/default/numbers.gohtml
+type numbersPage struct {
+	Search    numberSearch
+	Results   []mbAvailableNumber
+	Searched  bool
+	DialPlans []dialPlan
+	Message   string
+}
+
+// numbersAdminHandler searches for numbers MessageBird has for sale, and
+// buys them as proxy numbers
+func numbersAdminHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := numbersPage{
+			Search:    numberSearch{Country: defaultCountry(), Features: []string{"sms", "voice"}},
+			DialPlans: sortedDialPlans(),
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+			return
+		}
+
+		if r.Form.Get("country") != "" {
+			page.Search = numberSearch{
+				Country:  strings.ToUpper(r.Form.Get("country")),
+				Features: r.Form["feature"],
+				Contains: strings.TrimSpace(r.Form.Get("contains")),
+			}
+		}
+		if r.Method == "POST" && r.Form.Get("action") == "buy" {
+			page.Message = buyProxyNumber(dbdata, mb, r.Form.Get("number"), page.Search.Country, parseTags(r.Form.Get("tags")))
+		} else if r.Form.Get("country") != "" {
+			results, err := searchAvailableNumbers(mb, page.Search)
+			if err != nil {
+				mbError(err)
+				page.Message = fmt.Sprintf("Could not search for numbers: %v", err)
+			}
+			page.Results, page.Searched = results, err == nil
+		}
+		renderDefaultTemplate(w, r, "numbers.gohtml", page)
+	}
+}
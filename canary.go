@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// alertCanaryFailed is the kind of operator alert sent when the SMS canary
+// doesn't come back
+const alertCanaryFailed = "canary.failed"
+
+// canaryInterval returns how often the SMS canary runs, set with
+// CANARY_INTERVAL (e.g. "15m"). The canary is off unless it is set.
+func canaryInterval() time.Duration {
+	return envDuration("CANARY_INTERVAL", 0)
+}
+
+// canaryDeadline returns how long the canary waits for its text to reach
+// the SMS webhook, set with CANARY_DEADLINE
+func canaryDeadline() time.Duration {
+	return envDuration("CANARY_DEADLINE", 2*time.Minute)
+}
+
+// canaryNumber returns the number the canary texts, set with CANARY_NUMBER,
+// or else the self-test number. Like SELFTEST_NUMBER it must be a number of
+// ours whose flow posts inbound texts to the SMS webhook.
+func canaryNumber() string {
+	if v := os.Getenv("CANARY_NUMBER"); v != "" {
+		return v
+	}
+	return os.Getenv("SELFTEST_NUMBER")
+}
+
+// canaryResult is the outcome of the canary runs so far, see metricsHandler
+type canaryResult struct {
+	LastSuccess time.Time
+	Failures    int // Since the server started
+	Failing     bool
+}
+
+var (
+	// canaryMu guards canaryState
+	canaryMu sync.Mutex
+	// canaryState is the outcome of the canary runs so far
+	canaryState canaryResult
+)
+
+// lastCanary returns the outcome of the canary runs so far
+func lastCanary() canaryResult {
+	canaryMu.Lock()
+	defer canaryMu.Unlock()
+	return canaryState
+}
+
+// canaryProxy returns the proxy number the canary's run-th text goes out
+// from, taking turns among the active numbers that can text so each is
+// checked in time
+func canaryProxy(dbdata *RideSharingDB, run int) (ProxyNumberType, bool) {
+	var candidates []ProxyNumberType
+	for _, v := range dbdata.ProxyNumbers {
+		if v.PortStatus == portStatusActive && v.canSMS() {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return ProxyNumberType{}, false
+	}
+	sortProxyNumbers(candidates)
+	return candidates[run%len(candidates)], true
+}
+
+// runCanary texts the canary number from a proxy number and waits for the
+// text to come back through the SMS webhook, like an SMS self-test,
+// alerting operators if it doesn't within the deadline. The webhook must
+// reach this server: with several servers, run the canary on one that
+// MessageBird's flow posts to.
+func runCanary(store RideStore, mb *messagebird.Client, run int) error {
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		return err
+	}
+	proxy, ok := canaryProxy(dbdata, run)
+	if !ok {
+		return fmt.Errorf("no active proxy number can text")
+	}
+
+	err = runSelfTest(store, mb, "sms", proxy, canaryNumber(), canaryDeadline())
+	canaryMu.Lock()
+	recovered := canaryState.Failing && err == nil
+	canaryState.Failing = err != nil
+	if err != nil {
+		canaryState.Failures++
+	} else {
+		canaryState.LastSuccess = time.Now()
+	}
+	canaryMu.Unlock()
+
+	if err != nil {
+		alertOperator(store, mb, alertCanaryFailed, fmt.Sprintf(
+			"BirdCar SMS canary failed: a text from %s to %s did not come back: %v. Texts may not be getting through.",
+			proxy.Number, canaryNumber(), err))
+		return nil
+	}
+	if recovered {
+		log.Printf("SMS canary passed again, through %s", proxy.Number)
+	}
+	return nil
+}
+
+// pollCanary runs the canary every interval until ctx is done, if it is
+// configured. It is meant to be run in its own goroutine.
+func pollCanary(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	if interval == 0 {
+		return
+	}
+	if canaryNumber() == "" {
+		log.Println("SMS canary is off: set CANARY_NUMBER, or SELFTEST_NUMBER, to the number it texts")
+		return
+	}
+	log.Printf("SMS canary: texting %s every %s, alerting if it isn't back within %s (CANARY_INTERVAL, CANARY_DEADLINE)",
+		canaryNumber(), interval, canaryDeadline())
+	run := 0
+	every(ctx, interval, func() {
+		if err := runCanary(store, mb, run); err != nil {
+			log.Printf("SMS canary: %v", err)
+		}
+		run++
+	})
+}
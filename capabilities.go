@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// capabilitySyncInterval is how often we refresh proxy number features from the Numbers API
+const capabilitySyncInterval = time.Hour
+
+// hasFeature reports whether MessageBird lists feature (e.g. "sms" or "voice")
+// for the proxy number. Numbers we haven't synced yet are assumed to have every feature.
+func (proxy ProxyNumberType) hasFeature(feature string) bool {
+	if len(proxy.Features) == 0 {
+		return true
+	}
+	for _, v := range proxy.Features {
+		if v == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayOnly reports whether participants of the ride can only reach each
+// other by SMS because its proxy number can't receive calls
+func (ride RideType) RelayOnly() bool {
+	return !ride.ThisProxyNumber.canCall()
+}
+
+// findProxyNumber returns the proxy number with the given phone number
+func findProxyNumber(dbdata *RideSharingDB, number string) (ProxyNumberType, bool) {
+	for _, v := range dbdata.ProxyNumbers {
+		if v.Number == number {
+			return v, true
+		}
+	}
+	return ProxyNumberType{}, false
+}
+
+// storeFeatures saves the features MessageBird reports for a proxy number
+func storeFeatures(store RideStore, proxy ProxyNumberType, features []string) {
+	err := store.SetProxyFeatures(proxy.ID, parseTags(strings.Join(features, ",")))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// pollCapabilities syncs proxy number features now and then every interval
+// until ctx is done. It is meant to be run in its own goroutine.
+func pollCapabilities(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	syncCapabilities(store, mb)
+	every(ctx, interval, func() { syncCapabilities(store, mb) })
+}
+
+// syncCapabilities looks up every active proxy number with the Numbers API
+// and stores the features MessageBird reports for it
+func syncCapabilities(store RideStore, mb *messagebird.Client) {
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, v := range dbdata.ProxyNumbers {
+		if v.PortStatus != portStatusActive {
+			continue
+		}
+		var owned mbPhoneNumber
+		err := mb.Request(&owned, http.MethodGet, numbersAPIRoot+"/phone-numbers/"+v.Number, nil)
+		if err != nil {
+			mbError(err)
+			continue
+		}
+		storeFeatures(store, v, owned.Features)
+	}
+}
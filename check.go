@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/balance"
+	"github.com/messagebirdguides/masked-numbers-guide-go/config"
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// webhookCheckPath is the route the check command calls through PUBLIC_URL
+// to make sure MessageBird can reach our webhooks
+const webhookCheckPath = "/webhook-check"
+
+// webhookSigningKey returns the key MessageBird signs webhook requests with,
+// from MESSAGEBIRD_SIGNING_KEY, or an empty string if it isn't set
+func webhookSigningKey() string {
+	return os.Getenv("MESSAGEBIRD_SIGNING_KEY")
+}
+
+// signWebhookRequest signs r, whose body is body, the way MessageBird signs
+// the webhook requests it sends, see the signature package
+func signWebhookRequest(r *http.Request, body []byte, key string, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", ts, r.URL.Query().Encode(), bodyHash[:])
+	r.Header.Set("MessageBird-Request-Timestamp", ts)
+	r.Header.Set("MessageBird-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookCheckHandler answers the check command's calls with the nonce they
+// send, so it knows it reached this application. If MESSAGEBIRD_SIGNING_KEY
+// is set, calls must be signed with it, like the webhooks.
+func webhookCheckHandler() http.HandlerFunc {
+	return requireWebhookSignature(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Query().Get("nonce"))
+	})
+}
+
+// checkConfig reports settings the server would ignore or refuse to start with.
+// Invalid numbers and durations stop the check like they stop the server.
+func checkConfig() (string, error) {
+	var problems []string
+	if err := config.FromEnv().Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := checkViewTheme(); err != nil {
+		problems = append(problems, fmt.Sprintf("%v: set VIEWS_THEME to a theme in %s", err, viewsDir()))
+	}
+	if country := defaultCountry(); country != "" {
+		if _, ok := dialPlans[country]; !ok {
+			problems = append(problems, fmt.Sprintf("DEFAULT_COUNTRY %q is not a country we know the numbers of", country))
+		}
+	}
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("PROXY_SELECTION"))); v != "" && v != proxySelectionStrategy() {
+		problems = append(problems, fmt.Sprintf("unknown PROXY_SELECTION %q: use %s, %s, %s or %s",
+			v, selectRandom, selectRoundRobin, selectLeastRecentlyUsed, selectLeastActive))
+	}
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("UNKNOWN_SENDER_POLICY"))); v != "" && v != unknownSenderPolicy() {
+		problems = append(problems, fmt.Sprintf("UNKNOWN_SENDER_POLICY %q would drop texts from unknown senders: check its value and SUPPORT_INBOX_NUMBER", v))
+	}
+	if approvalRequired() && len(adminAccounts()) < 2 {
+		problems = append(problems, "REQUIRE_APPROVAL needs at least two admin accounts: set ADMIN_USERS")
+	}
+	if err := checkWebhookToken(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for kind := range quotaEnv {
+		quotaLimit(kind)
+	}
+	allocationWindow()
+	allocationBaseline()
+	allocationSpikeFactor()
+	allocationSpikeMinimum()
+	allocationCapDuration()
+
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return "settings are valid", nil
+}
+
+// checkDatabase opens the database and its read replica, if one is set,
+// and compares the schema version with the latest migration
+func checkDatabase() (string, error) {
+	if err := openDB(databaseURL()); err != nil {
+		return "", fmt.Errorf("could not open the database: %v: check DATABASE_URL", err)
+	}
+	if err := appStore.Ping(); err != nil {
+		return "", fmt.Errorf("could not reach the database: %v: check DATABASE_URL and that the database is up", err)
+	}
+	if err := migrations.Validate(); err != nil {
+		return "", err
+	}
+	current, err := appStore.SchemaVersion()
+	if err != nil {
+		return "", fmt.Errorf("could not read the schema version: %v", err)
+	}
+	target, contract, err := appStore.ExpandTarget()
+	if err != nil {
+		return "", fmt.Errorf("could not read the schema version: %v", err)
+	}
+	if current < target {
+		return "", fmt.Errorf("the schema is at version %d of %d: run the migrate up command", current, migrations.Latest())
+	}
+	detail := fmt.Sprintf("schema at version %d", current)
+	if contract != nil {
+		detail += fmt.Sprintf(", contract migration %d pending until every server runs this release", contract.Version)
+	}
+	if replica := databaseReplicaURL(); replica != "" {
+		if err := openReplica(replica); err != nil {
+			return "", fmt.Errorf("%v: check DATABASE_REPLICA_URL", err)
+		}
+		detail += ", read replica reachable"
+	}
+	return detail, nil
+}
+
+// checkCredentials reads the account balance, which fails unless
+// MESSAGEBIRD_API_KEY is a valid key
+func checkCredentials() (string, error) {
+	mb := newMessageBirdClient(appConfig.MessageBirdKey, newAdaptiveThrottle(200*time.Millisecond, 30*time.Second))
+	b, err := balance.Read(mb)
+	if _, refused := err.(messagebird.ErrorResponse); refused {
+		return "", fmt.Errorf("MessageBird refused MESSAGEBIRD_API_KEY: %v: copy a live key from the dashboard", err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not reach MessageBird: %v: check the network and MESSAGEBIRD_PROXY", err)
+	}
+	return fmt.Sprintf("API key accepted, balance %.2f %s", b.Amount, b.Type), nil
+}
+
+// checkWebhooks calls the running application at base through
+// webhookCheckPath, signed with MESSAGEBIRD_SIGNING_KEY if it is set, the
+// way MessageBird calls our webhooks
+func checkWebhooks(base string) (string, error) {
+	if base == "" {
+		return "", fmt.Errorf("set PUBLIC_URL or -url to the URL MessageBird reaches the application at, or pass -offline")
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	want := hex.EncodeToString(nonce)
+
+	u := base + appPath(webhookCheckPath) + "?" + url.Values{"nonce": {want}}.Encode()
+	r, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	key := webhookSigningKey()
+	if key != "" {
+		signWebhookRequest(r, nil, key, time.Now())
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("could not reach %s: %v: check that the server is running and PUBLIC_URL is public", u, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return "", fmt.Errorf("%s rejected the signature: the server's MESSAGEBIRD_SIGNING_KEY differs", u)
+	case resp.StatusCode != http.StatusOK || string(bytes.TrimSpace(body)) != want:
+		return "", fmt.Errorf("%s answered %s, not this application: check PUBLIC_URL and BASE_PATH", u, resp.Status)
+	case key == "":
+		return "reachable at " + base + ", unsigned: set MESSAGEBIRD_SIGNING_KEY to check signatures too", nil
+	}
+	return "reachable at " + base + " with signed requests", nil
+}
+
+// checkViews parses every view of the configured theme with the layouts it
+// can be rendered in
+func checkViews() (string, error) {
+	files, err := filepath.Glob(filepath.Join(viewsDir(), defaultViewTheme, "*.gohtml"))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no views in %s: set VIEWS_DIR or run from the directory holding views", filepath.Join(viewsDir(), defaultViewTheme))
+	}
+	for _, file := range files {
+		view := filepath.Base(file)
+		layout := "layouts/default.gohtml"
+		if view == "preferences.gohtml" || view == "observe.gohtml" {
+			layout = "layouts/participant.gohtml"
+		}
+		if _, err := views.lookup(layout, view); err != nil {
+			return "", fmt.Errorf("view %s: %v", view, err)
+		}
+	}
+	return fmt.Sprintf("%d views parse in theme %s", len(files), viewTheme()), nil
+}
+
+// checkNotificationTemplates renders every notification template, as
+// edited on the templates page and as translated, against a sample ride
+func checkNotificationTemplates(store RideStore) (string, error) {
+	var problems []string
+	data := newNotificationData(store, sampleRide, roleCustomer)
+	for _, t := range notificationTemplates {
+		body, err := currentTemplateBody(store, t)
+		if err != nil {
+			return "", err
+		}
+		if _, err := executeTemplate(body, data); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v: fix it on the templates page", t.Name, err))
+		}
+		for lang, entries := range messageCatalog {
+			if body, ok := entries[t.Name]; ok {
+				if _, err := executeTemplate(body, data); err != nil {
+					problems = append(problems, fmt.Sprintf("%s translation of %s: %v", lang, t.Name, err))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return fmt.Sprintf("%d notification templates render", len(notificationTemplates)), nil
+}
+
+// runCheck implements the check command, which diagnoses a deployment
+// before it takes traffic: settings, the database and its schema, the
+// MessageBird API key, whether the running server is reachable at
+// PUBLIC_URL, and the views and notification templates. With -offline it
+// skips the checks needing MessageBird or the running server. It returns
+// the exit status: 0 if every check passed, 1 otherwise.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	base := flags.String("url", publicURL(), "public URL of the running application (default: PUBLIC_URL)")
+	offline := flags.Bool("offline", false, "skip the checks that call MessageBird and the running application")
+	flags.Parse(args)
+
+	checks := []struct {
+		Name   string
+		Online bool
+		Run    func() (string, error)
+	}{
+		{"config", false, checkConfig},
+		{"database", false, checkDatabase},
+		{"messagebird", true, checkCredentials},
+		{"webhooks", true, func() (string, error) { return checkWebhooks(strings.TrimRight(*base, "/")) }},
+		{"views", false, checkViews},
+		{"templates", false, func() (string, error) { return checkNotificationTemplates(appStore) }},
+	}
+	failed := make(map[string]bool)
+	for _, check := range checks {
+		if check.Online && *offline {
+			fmt.Printf("%-4s %-12s skipped (-offline)\n", "-", check.Name)
+			continue
+		}
+		// The templates are read from the database
+		if check.Name == "templates" && failed["database"] {
+			fmt.Printf("%-4s %-12s skipped: the database check failed\n", "-", check.Name)
+			continue
+		}
+		detail, err := check.Run()
+		if err != nil {
+			failed[check.Name] = true
+			fmt.Printf("%-4s %-12s %v\n", "FAIL", check.Name, err)
+			continue
+		}
+		fmt.Printf("%-4s %-12s %s\n", "ok", check.Name, detail)
+	}
+
+	if len(failed) > 0 {
+		fmt.Printf("%d checks failed.\n", len(failed))
+		return 1
+	}
+	fmt.Println("All checks passed.")
+	return 0
+}
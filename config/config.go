@@ -0,0 +1,175 @@
+// Package config reads the settings the server needs to start: the address
+// it listens on, the database it keeps its data in, whether it texts and
+// calls, the MessageBird API key it does so with, the public URL MessageBird
+// reaches its webhooks at and the directory of its views.
+//
+// Each setting is a flag of the server, defaulting to an environment
+// variable, so deployments configured through the environment keep working
+// and a flag overrides the environment for one run:
+//
+//	-addr        LISTEN_ADDR          default ":8080"
+//	-db          DATABASE_URL         default "./ridesharing.db"
+//	-messaging   MESSAGING            default true
+//	-mb-key      MESSAGEBIRD_API_KEY  required unless messaging is off
+//	-public-url  PUBLIC_URL           optional
+//	-views       VIEWS_DIR            default "views"
+//
+// Turning messaging off runs the server without texting or calling anyone,
+// e.g. for local runs on the in-memory store, so it needs no API key.
+//
+// Validate reports every invalid setting at once, so the server can refuse
+// to start with all of them listed rather than fail on the first request.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Defaults of the settings that have one
+const (
+	DefaultAddr        = ":8080"
+	DefaultDatabaseURL = "./ridesharing.db"
+	DefaultViewsDir    = "views"
+)
+
+// Config is the configuration of the server
+type Config struct {
+	Addr           string // Address the HTTP server listens on, e.g. ":8080"
+	DatabaseURL    string // postgres://, mysql:// or memory: URL, or the path of a SQLite file
+	Messaging      bool   // Whether texts and calls go through MessageBird
+	MessageBirdKey string // Live API key from the MessageBird dashboard
+	PublicURL      string // URL MessageBird reaches the application at, e.g. "https://birdcar.example.com"
+	ViewsDir       string // Directory holding the view themes
+}
+
+// FromEnv returns the configuration set in the environment, with defaults
+// for the settings that aren't
+func FromEnv() *Config {
+	return &Config{
+		Addr:           env("LISTEN_ADDR", DefaultAddr),
+		DatabaseURL:    env("DATABASE_URL", DefaultDatabaseURL),
+		Messaging:      env("MESSAGING", "true") != "false",
+		MessageBirdKey: env("MESSAGEBIRD_API_KEY", ""),
+		PublicURL:      strings.TrimRight(env("PUBLIC_URL", ""), "/"),
+		ViewsDir:       env("VIEWS_DIR", DefaultViewsDir),
+	}
+}
+
+// env returns the environment variable name, trimmed, or def if it is empty
+func env(name string, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+// Flags returns the configuration set in the environment and defines the
+// flags that override it on flags. Call Validate once flags are parsed.
+func Flags(flags *flag.FlagSet) *Config {
+	c := FromEnv()
+	flags.StringVar(&c.Addr, "addr", c.Addr, "address to listen on (LISTEN_ADDR)")
+	flags.StringVar(&c.DatabaseURL, "db", c.DatabaseURL, "postgres://, mysql:// or memory: URL, or SQLite file, of the database (DATABASE_URL)")
+	flags.BoolVar(&c.Messaging, "messaging", c.Messaging, "text and call through MessageBird; false to run without an API key (MESSAGING)")
+	flags.Var(secret{&c.MessageBirdKey}, "mb-key", "MessageBird API key; prefer MESSAGEBIRD_API_KEY, as flags show in the process list")
+	flags.StringVar(&c.PublicURL, "public-url", c.PublicURL, "http(s) URL MessageBird reaches the application at (PUBLIC_URL)")
+	flags.StringVar(&c.ViewsDir, "views", c.ViewsDir, "directory of the view themes (VIEWS_DIR)")
+	return c
+}
+
+// secret is a flag.Value for a setting that usage messages mustn't show
+type secret struct {
+	value *string
+}
+
+// String implements flag.Value, hiding the value
+func (s secret) String() string {
+	return ""
+}
+
+// Set implements flag.Value
+func (s secret) Set(v string) error {
+	*s.value = v
+	return nil
+}
+
+// Validate returns an error listing the invalid settings of c, if any
+func (c *Config) Validate() error {
+	var problems []string
+	if err := validateAddr(c.Addr); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateDatabaseURL(c.DatabaseURL); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.Messaging && c.MessageBirdKey == "" {
+		problems = append(problems, "set MESSAGEBIRD_API_KEY to the live API key from the MessageBird dashboard, or -messaging=false to run without texting and calling")
+	}
+	if err := validatePublicURL(c.PublicURL); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if info, err := os.Stat(c.ViewsDir); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("views directory %q not found: set VIEWS_DIR or -views", c.ViewsDir))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateAddr checks that addr is a host, which may be empty, and a port
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("listen address %q must be host:port, e.g. :8080: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("listen address %q has an invalid port", addr)
+	}
+	return nil
+}
+
+// validateDatabaseURL checks that dsn is a database URL we can open, or the
+// path of a SQLite file in a directory that exists
+func validateDatabaseURL(dsn string) error {
+	if strings.HasPrefix(dsn, "memory:") {
+		return nil
+	}
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return fmt.Errorf("invalid DATABASE_URL: %v", err)
+		}
+		switch u.Scheme {
+		case "postgres", "postgresql", "mysql":
+			return nil
+		}
+		return fmt.Errorf("DATABASE_URL scheme %q is not postgres, postgresql or mysql", u.Scheme)
+	}
+	path := strings.SplitN(strings.TrimPrefix(dsn, "file:"), "?", 2)[0]
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return fmt.Errorf("the directory of the SQLite database %q doesn't exist: check DATABASE_URL", dsn)
+	}
+	return nil
+}
+
+// validatePublicURL checks that public, if set, is an http(s) URL
+func validatePublicURL(public string) error {
+	if public == "" {
+		return nil
+	}
+	u, err := url.Parse(public)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("PUBLIC_URL %q must be an http(s) URL", public)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("PUBLIC_URL %q must not have a query or fragment", public)
+	}
+	return nil
+}
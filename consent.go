@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Purposes we text participants for, each needing their consent:
+// transactional texts are about their rides, relays from the other
+// participant and replies to their keywords; marketing texts are
+// announcements
+const (
+	consentTransactional = "transactional"
+	consentMarketing     = "marketing"
+)
+
+// consentPurposes are the purposes, in the order they're shown
+var consentPurposes = []string{consentTransactional, consentMarketing}
+
+// Consent statuses
+const (
+	consentGranted   = "granted"
+	consentWithdrawn = "withdrawn"
+)
+
+// Sources of consent changes, besides operators, who are recorded as
+// "dashboard (<user>)"
+const (
+	consentSourceKeyword     = "sms keyword"
+	consentSourcePreferences = "preferences page"
+	consentSourceDefault     = "default"
+)
+
+// consentRecord is a change of a number's consent for a purpose. Changes
+// are kept, never updated, so we can show the basis for each text we sent.
+type consentRecord struct {
+	ID         int
+	Number     string
+	Purpose    string
+	Status     string
+	Source     string // e.g. "sms keyword" or "dashboard (alice)"
+	RecordedAt string // RFC 3339, empty for opt-outs from before the registry
+}
+
+// Granted reports whether c grants consent
+func (c consentRecord) Granted() bool {
+	return c.Status == consentGranted
+}
+
+// marketingOptIn reports whether participants only get announcements once
+// they granted marketing consent, set with MARKETING_CONSENT=opt-in. By
+// default they get them until they withdraw it, e.g. by texting STOP.
+func marketingOptIn() bool {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("MARKETING_CONSENT"))) == "opt-in"
+}
+
+// defaultConsent returns the consent numbers that never granted or
+// withdrawn consent for purpose have. Booking a ride is the basis for
+// transactional texts.
+func defaultConsent(number string, purpose string) consentRecord {
+	c := consentRecord{Number: number, Purpose: purpose, Status: consentGranted, Source: consentSourceDefault}
+	if purpose == consentMarketing && marketingOptIn() {
+		c.Status = consentWithdrawn
+	}
+	return c
+}
+
+// consentStore is the part of RideStore that keeps the consent records
+type consentStore interface {
+	// AddConsent records c, ignoring its ID
+	AddConsent(c consentRecord) error
+	// CurrentConsent returns the latest consent of number for purpose, or
+	// sql.ErrNoRows if they never gave or withdrew it
+	CurrentConsent(number string, purpose string) (consentRecord, error)
+	// ConsentHistory returns the consent changes of number, newest first
+	ConsentHistory(number string) ([]consentRecord, error)
+}
+
+// AddConsent implements consentStore
+func (s *sqlStore) AddConsent(c consentRecord) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO consents (number, purpose, status, source, recorded_at) VALUES (?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO consents (number, purpose, status, source, recorded_at) VALUES ($1, $2, $3, $4, $5)",
+	}, c.Number, c.Purpose, c.Status, c.Source, c.RecordedAt)
+	return err
+}
+
+// CurrentConsent implements consentStore
+func (s *sqlStore) CurrentConsent(number string, purpose string) (consentRecord, error) {
+	c := consentRecord{Number: number, Purpose: purpose}
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT id, status, source, recorded_at FROM consents WHERE number = ? AND purpose = ? ORDER BY id DESC LIMIT 1",
+		Postgres: "SELECT id, status, source, recorded_at FROM consents WHERE number = $1 AND purpose = $2 ORDER BY id DESC LIMIT 1",
+	}, number, purpose).Scan(&c.ID, &c.Status, &c.Source, &c.RecordedAt)
+	return c, err
+}
+
+// ConsentHistory implements consentStore
+func (s *sqlStore) ConsentHistory(number string) ([]consentRecord, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, number, purpose, status, source, recorded_at FROM consents WHERE number = ? ORDER BY id DESC",
+		Postgres: "SELECT id, number, purpose, status, source, recorded_at FROM consents WHERE number = $1 ORDER BY id DESC",
+	}, number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []consentRecord
+	for rows.Next() {
+		var c consentRecord
+		if err := rows.Scan(&c.ID, &c.Number, &c.Purpose, &c.Status, &c.Source, &c.RecordedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// recordConsent records that number granted or withdrew consent for
+// purpose, as told through source
+func recordConsent(store RideStore, number string, purpose string, granted bool, source string) error {
+	status := consentWithdrawn
+	if granted {
+		status = consentGranted
+	}
+	err := store.AddConsent(consentRecord{
+		Number:     number,
+		Purpose:    purpose,
+		Status:     status,
+		Source:     source,
+		RecordedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err == nil {
+		log.Printf("Consent of %s for %s texts %s through %s", number, purpose, status, source)
+	}
+	return err
+}
+
+// currentConsent returns the latest consent of number for purpose, or the
+// default, see defaultConsent
+func currentConsent(store RideStore, number string, purpose string) (consentRecord, error) {
+	c, err := store.CurrentConsent(number, purpose)
+	if err == sql.ErrNoRows {
+		return defaultConsent(number, purpose), nil
+	}
+	return c, err
+}
+
+// consentGiven reports whether we may text number for purpose. Sends are
+// suppressed if we can't tell. Suppressed sends are logged.
+func consentGiven(store RideStore, number string, purpose string) bool {
+	c, err := currentConsent(store, number, purpose)
+	if err != nil {
+		log.Printf("Suppressed %s text to %s: could not look up their consent: %v", purpose, number, err)
+		return false
+	}
+	if !c.Granted() {
+		log.Printf("Suppressed %s text to %s, who withdrew consent through %s", purpose, number, c.Source)
+		return false
+	}
+	return true
+}
+
+// consentedRecipients returns the recipients who didn't withdraw consent
+// for transactional texts. Every text needs it, announcements included.
+func consentedRecipients(store RideStore, recipients []string) []string {
+	var consented []string
+	for _, number := range recipients {
+		if consentGiven(store, number, consentTransactional) {
+			consented = append(consented, number)
+		}
+	}
+	return consented
+}
+
+// consentsPage is the data rendered by views/default/consents.gohtml
+type consentsPage struct {
+	Number   string
+	Owner    string // Who the number belongs to, e.g. "customer Caitlyn Carless"
+	Current  []consentRecord
+	History  []consentRecord
+	Purposes []string
+	Message  string
+}
+
+// consentsHandler shows the consent of the number given as the number
+// query parameter, with its history, and records consent operators were
+// given some other way, e.g. on the phone
+func consentsHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := consentsPage{Number: strings.TrimSpace(r.FormValue("number")), Purposes: consentPurposes}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		if page.Number == "" {
+			renderDefaultTemplate(w, r, "consents.gohtml", page)
+			return
+		}
+		page.Owner, _ = numberOwner(dbdata, page.Number, "", 0)
+
+		if r.Method == "POST" {
+			purpose := r.FormValue("purpose")
+			status := r.FormValue("status")
+			switch {
+			case purpose != consentTransactional && purpose != consentMarketing:
+				page.Message = fmt.Sprintf("Unknown purpose %q", purpose)
+			case status != consentGranted && status != consentWithdrawn:
+				page.Message = fmt.Sprintf("Unknown status %q", status)
+			default:
+				source := fmt.Sprintf("dashboard (%s)", dashboardUser(r))
+				if err := recordConsent(dbdata.store, page.Number, purpose, status == consentGranted, source); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+					break
+				}
+				page.Message = fmt.Sprintf("Consent for %s texts %s.", purpose, status)
+			}
+		}
+
+		for _, purpose := range consentPurposes {
+			c, err := currentConsent(dbdata.store, page.Number, purpose)
+			if err != nil {
+				log.Println(err)
+				page.Message = fmt.Sprint(err)
+			}
+			page.Current = append(page.Current, c)
+		}
+		history, err := dbdata.store.ConsentHistory(page.Number)
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		page.History = history
+		renderDefaultTemplate(w, r, "consents.gohtml", page)
+	}
+}
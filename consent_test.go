@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDefaultConsent(t *testing.T) {
+	tests := []struct {
+		marketingConsent string
+		purpose          string
+		granted          bool
+	}{
+		{"", consentTransactional, true},
+		{"", consentMarketing, true},
+		{"opt-out", consentMarketing, true},
+		{"opt-in", consentTransactional, true},
+		{"opt-in", consentMarketing, false},
+		{" Opt-In ", consentMarketing, false},
+	}
+	for _, test := range tests {
+		setenv(t, "MARKETING_CONSENT", test.marketingConsent)
+		c := defaultConsent("319700000", test.purpose)
+		if c.Granted() != test.granted || c.Source != consentSourceDefault {
+			t.Errorf("MARKETING_CONSENT=%q: %s consent %+v, want granted %v by default", test.marketingConsent, test.purpose, c, test.granted)
+		}
+	}
+}
+
+func TestConsentRegistry(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		openTestDB(t, kind)
+		setenv(t, "MARKETING_CONSENT", "opt-in")
+
+		if !consentGiven(appStore, "319700000", consentTransactional) || consentGiven(appStore, "319700000", consentMarketing) {
+			t.Errorf("%s: consent before any was recorded isn't the default", kind)
+		}
+		changes := []struct {
+			purpose string
+			granted bool
+			source  string
+		}{
+			{consentMarketing, true, consentSourcePreferences},
+			{consentTransactional, false, consentSourceKeyword},
+			{consentTransactional, true, "dashboard (alice)"},
+			{consentMarketing, false, consentSourceKeyword},
+		}
+		for _, c := range changes {
+			if err := recordConsent(appStore, "319700000", c.purpose, c.granted, c.source); err != nil {
+				t.Fatal(err)
+			}
+			if got := consentGiven(appStore, "319700000", c.purpose); got != c.granted {
+				t.Errorf("%s: %s consent %v after it was set to %v through %s", kind, c.purpose, got, c.granted, c.source)
+			}
+		}
+
+		c, err := currentConsent(appStore, "319700000", consentTransactional)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Granted() || c.Source != "dashboard (alice)" || c.RecordedAt == "" {
+			t.Errorf("%s: current transactional consent %+v, want the latest change", kind, c)
+		}
+		history, err := appStore.ConsentHistory("319700000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != len(changes) {
+			t.Fatalf("%s: %d consent changes, want %d", kind, len(history), len(changes))
+		}
+		for i, c := range changes {
+			h := history[len(history)-1-i]
+			if h.Purpose != c.purpose || h.Granted() != c.granted || h.Source != c.source {
+				t.Errorf("%s: change %d is %+v, want %+v", kind, i+1, h, c)
+			}
+		}
+		if other, err := appStore.ConsentHistory("319700001"); err != nil || len(other) != 0 {
+			t.Errorf("%s: another number has %d consent changes, %v, want none", kind, len(other), err)
+		}
+
+		if err := recordConsent(appStore, "319700001", consentTransactional, false, consentSourceKeyword); err != nil {
+			t.Fatal(err)
+		}
+		got := consentedRecipients(appStore, []string{"319700000", "319700001", "319700002"})
+		if len(got) != 2 || got[0] != "319700000" || got[1] != "319700002" {
+			t.Errorf("%s: consented recipients %v, want those who didn't withdraw transactional consent", kind, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Participant roles in a ride
+const (
+	roleCustomer = "customer"
+	roleDriver   = "driver"
+)
+
+// roleObserver is the participant type of a ride's observers: guests, e.g.
+// a parent, who follow the ride and reach its driver, see observers.go.
+// Observers aren't a side of the ride like the customer and driver, so the
+// helpers taking a role don't take this one.
+const roleObserver = "observer"
+
+// contactStore is the part of RideStore that keeps the numbers
+// participants contact us from
+type contactStore interface {
+	// SetRideContact records that the participant with role in the ride
+	// with ID rideID is reached on number, over channel
+	SetRideContact(rideID int, role string, number string, channel string) error
+	// AddAlternateNumber registers number as an alternate number of the
+	// person with role and ID personID
+	AddAlternateNumber(role string, personID int, number string) error
+	// RideContactChannel returns the channel number is reached on in the
+	// ride with ID rideID
+	RideContactChannel(rideID int, number string) (string, error)
+}
+
+// SetRideContact implements contactStore
+func (s *sqlStore) SetRideContact(rideID int, role string, number string, channel string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite: "INSERT INTO ride_contacts (ride_id, role, number, channel) VALUES (?, ?, ?, ?) " +
+			"ON CONFLICT (ride_id, role) DO UPDATE SET number = excluded.number, channel = excluded.channel",
+		Postgres: "INSERT INTO ride_contacts (ride_id, role, number, channel) VALUES ($1, $2, $3, $4) " +
+			"ON CONFLICT (ride_id, role) DO UPDATE SET number = excluded.number, channel = excluded.channel",
+		MySQL: "INSERT INTO ride_contacts (ride_id, role, number, channel) VALUES (?, ?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE number = VALUES(number), channel = VALUES(channel)",
+	}, rideID, role, number, channel)
+	return err
+}
+
+// RideContactChannel implements contactStore
+func (s *sqlStore) RideContactChannel(rideID int, number string) (string, error) {
+	var channel string
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT channel FROM ride_contacts WHERE ride_id = ? AND number = ?",
+		Postgres: "SELECT channel FROM ride_contacts WHERE ride_id = $1 AND number = $2",
+	}, rideID, number).Scan(&channel)
+	return channel, err
+}
+
+// AddAlternateNumber implements contactStore
+func (s *sqlStore) AddAlternateNumber(role string, personID int, number string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO alternate_numbers (role, person_id, number) VALUES (?, ?, ?)",
+		Postgres: "INSERT INTO alternate_numbers (role, person_id, number) VALUES ($1, $2, $3)",
+	}, role, personID, number)
+	return err
+}
+
+// otherRole returns the role of the other participant in a ride
+func otherRole(role string) string {
+	if role == roleCustomer {
+		return roleDriver
+	}
+	return roleCustomer
+}
+
+// hasNumber reports whether number is p's registered number or one of their alternates
+func (p Person) hasNumber(number string) bool {
+	if number == p.Number {
+		return true
+	}
+	for _, v := range p.AltNumbers {
+		if number == v {
+			return true
+		}
+	}
+	return false
+}
+
+// participant returns the customer or driver of the ride
+func (ride RideType) participant(role string) Person {
+	if role == roleDriver {
+		return ride.ThisDriver
+	}
+	return ride.ThisCustomer
+}
+
+// lastUsed returns the number the participant last contacted us from in this ride
+func (ride RideType) lastUsed(role string) string {
+	if role == roleDriver {
+		return ride.DriverLastUsed
+	}
+	return ride.CustomerLastUsed
+}
+
+// textChannel returns the channel we text the participant with role on in
+// this ride: the one they last texted us on, or SMS
+func (ride RideType) textChannel(role string) string {
+	channel := ride.CustomerChannel
+	if role == roleDriver {
+		channel = ride.DriverChannel
+	}
+	if channel == "" {
+		return textChannelSMS
+	}
+	return channel
+}
+
+// contactNumber returns the number we relay to for the participant with role:
+// the number they last contacted us from in this ride, or their registered number
+func (ride RideType) contactNumber(role string) string {
+	if n := ride.lastUsed(role); n != "" {
+		return n
+	}
+	return ride.participant(role).Number
+}
+
+// recordLastUsed remembers that the participant with role called us from
+// number, so that replies in this ride are relayed to that number. Texts to
+// a new number go by SMS.
+func recordLastUsed(store RideStore, ride RideType, role string, number string) {
+	if ride.contactNumber(role) == number {
+		return
+	}
+	saveRideContact(store, ride, role, number, textChannelSMS)
+}
+
+// recordTextedFrom remembers that the participant with role texted us from
+// number on channel, so that replies in this ride are relayed to that number
+// on that channel, even when the other participant texts on another one
+func recordTextedFrom(store RideStore, ride RideType, role string, number string, channel string) {
+	if ride.contactNumber(role) == number && ride.textChannel(role) == channel {
+		return
+	}
+	saveRideContact(store, ride, role, number, channel)
+}
+
+// saveRideContact stores the number and channel we reach the participant
+// with role on in this ride
+func saveRideContact(store RideStore, ride RideType, role string, number string, channel string) {
+	// Outside rides, regular riders are always reached on their registered numbers
+	if ride.ID == 0 {
+		return
+	}
+	// Replies keep going where they went before, so carry on
+	if err := store.SetRideContact(ride.ID, role, number, channel); err != nil {
+		log.Println(err)
+	}
+}
+
+// addNumberHandler registers an alternate number for a customer or driver.
+// Messages and calls from an alternate number are routed like ones from
+// the person's registered number.
+func addNumberHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				return
+			}
+			// The participant is submitted as "<role>:<id>", e.g. "driver:2"
+			participant := strings.SplitN(r.FormValue("participant"), ":", 2)
+			role := participant[0]
+			number, numberErr := normalizeNumber(r.FormValue("number"), r.FormValue("country"))
+			personID, err := strconv.Atoi(participant[len(participant)-1])
+			if err != nil {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Something went wrong. Invalid person id: %v", err))
+				return
+			}
+
+			var people map[int]Person
+			switch role {
+			case roleCustomer:
+				people = dbdata.Customers
+			case roleDriver:
+				people = dbdata.Drivers
+			default:
+				renderLanding(w, r, dbdata, fmt.Sprintf("Something went wrong. Invalid role: %q", role))
+				return
+			}
+			if _, ok := people[personID]; !ok {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Could not find %s %d", role, personID))
+				return
+			}
+			if numberErr != nil {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Invalid phone number: %v", numberErr))
+				return
+			}
+			// A number can only identify one person, even among their own numbers
+			if owner, ok := numberOwner(dbdata, number, "", 0); ok {
+				renderLanding(w, r, dbdata, fmt.Sprintf("%s is already registered to %s", number, owner))
+				return
+			}
+
+			if err := dbdata.store.AddAlternateNumber(role, personID, number); err != nil {
+				log.Println(err)
+				message := fmt.Sprintf("Could not add %s: %v", number, err)
+				if dbdata.store.IsUniqueViolation(err) {
+					// Registered by someone else since we loaded dbdata
+					message = fmt.Sprintf("%s is already registered", number)
+				}
+				renderLanding(w, r, dbdata, message)
+				return
+			}
+		}
+
+		message := ""
+		dbdata, err = dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderLanding(w, r, dbdata, message)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// ProxyRelease records that a customer and driver stopped using a proxy
+// number, because their ride ended or was archived, their relationship ended,
+// or their ride moved to another number
+type ProxyRelease struct {
+	ProxyID    int
+	CustomerID int
+	DriverID   int
+	ReleasedAt string // RFC 3339
+}
+
+// proxyCooldown returns how long a released proxy number is held back from
+// new rides of the customer and driver that used it, so late texts and calls
+// of theirs can't reach a stranger. Set PROXY_COOLDOWN (e.g. "72h") to
+// override the default of 24 hours, or to "0s" to reuse numbers right away.
+func proxyCooldown() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PROXY_COOLDOWN")); err == nil && d >= 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// releaseStatement records that customerID and driverID stop using the
+// proxy number with ID proxyID at releasedAt, which may be in the future.
+// The number cools down from then.
+func releaseStatement(proxyID int, customerID int, driverID int, releasedAt time.Time) dbStatement {
+	return statement(sqlQuery{
+		SQLite:   "INSERT INTO proxy_releases (number_id, customer_id, driver_id, released_at) VALUES (?, ?, ?, ?)",
+		Postgres: "INSERT INTO proxy_releases (number_id, customer_id, driver_id, released_at) VALUES ($1, $2, $3, $4)",
+	}, proxyID, customerID, driverID, releasedAt.UTC().Format(time.RFC3339))
+}
+
+// coolingDown reports whether proxyID was released by customerID or driverID
+// within the cool-down. The pair that released it together may use it again.
+func coolingDown(dbdata *RideSharingDB, customerID int, driverID int, proxyID int) bool {
+	for _, v := range dbdata.Releases {
+		if v.ProxyID != proxyID || (v.CustomerID == customerID && v.DriverID == driverID) {
+			continue
+		}
+		if v.CustomerID == customerID || v.DriverID == driverID {
+			return true
+		}
+	}
+	return false
+}
+
+// releasedParticipant reports whether number belongs to someone who stopped
+// using proxyNumber within the cool-down
+func releasedParticipant(dbdata *RideSharingDB, proxyNumber string, number string) bool {
+	for _, v := range dbdata.Releases {
+		if dbdata.ProxyNumbers[v.ProxyID].Number != proxyNumber {
+			continue
+		}
+		if dbdata.Customers[v.CustomerID].hasNumber(number) || dbdata.Drivers[v.DriverID].hasNumber(number) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProxyReleases returns the releases made after since
+func (s *sqlStore) loadProxyReleases(since time.Time) ([]ProxyRelease, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT number_id, customer_id, driver_id, released_at FROM proxy_releases WHERE released_at > ? ORDER BY id",
+		Postgres: "SELECT number_id, customer_id, driver_id, released_at FROM proxy_releases WHERE released_at > $1 ORDER BY id",
+	}, since.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var releases []ProxyRelease
+	for rows.Next() {
+		var v ProxyRelease
+		if err := rows.Scan(&v.ProxyID, &v.CustomerID, &v.DriverID, &v.ReleasedAt); err != nil {
+			return nil, err
+		}
+		releases = append(releases, v)
+	}
+	return releases, rows.Err()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// Forms the dashboard renders carry a token that must match the CSRF
+// cookie, so other sites can't post them on a signed-in user's behalf
+const (
+	csrfCookieName = "birdcar_csrf"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token" // For scripts that post without a form
+)
+
+// csrfTokenKey is the request context key of the CSRF token of a request
+type csrfTokenKey struct{}
+
+// csrfToken returns the token forms rendered for r must carry, see
+// requireCSRFToken
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfTokenKey{}).(string)
+	return token
+}
+
+// csrfField returns the hidden form field holding token, which views render
+// in every form that posts with {{ csrfField }}
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(token) + `" />`)
+}
+
+// stateChanging reports whether requests with method change something, and
+// so need a CSRF token
+func stateChanging(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// requireCSRFToken gives browsers a CSRF cookie, whose token views render
+// in their forms, and refuses requests that change something unless they
+// send the token back as the csrf_token form field or the X-CSRF-Token
+// header. The MessageBird webhooks, the /api routes, which take API keys
+// rather than cookies, and the preferences page, whose links carry their
+// own secret, don't need it.
+func requireCSRFToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) == 64 {
+			token = cookie.Value
+		}
+
+		if stateChanging(r.Method) {
+			sent := r.Header.Get(csrfHeaderName)
+			if sent == "" {
+				sent = r.PostFormValue(csrfFieldName)
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				log.Printf("Refused %s %s from %s: missing or wrong CSRF token", r.Method, r.URL.Path, clientIP(r))
+				http.Error(w, "This form has expired. Go back, reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+
+		if token == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				log.Println(err)
+				http.Error(w, "Server encountered an error", http.StatusInternalServerError)
+				return
+			}
+			token = hex.EncodeToString(secret)
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     appPath("/"),
+				HttpOnly: true,
+				Secure:   secureCookies(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, token)))
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
 )
 
 func must(err error) {
@@ -13,140 +15,340 @@ func must(err error) {
 	}
 }
 
-func dbInsert(queries []string) {
-	db, err := sql.Open("sqlite3", "./ridesharing.db")
-	must(err)
-	for _, i := range queries {
-		statement, err := db.Prepare(i)
-		must(err)
-		_, err = statement.Exec()
-		must(err)
+// appStore is the store of the server and the maintenance commands, opened
+// once at startup by openDB. Handlers and background work are handed their
+// store, see newRouter and startPollers, as the tenants command has one per
+// tenant.
+var appStore RideStore
+
+// reportStore serves the reads that can lag behind a little: the ride
+// board, exports and analytics. It is appStore unless openReplica opened a
+// read replica, which keeps those heavy reads off the primary that routes
+// webhooks.
+var reportStore RideStore
+
+// openDB opens appStore on url, see openStore, and reports from it too
+func openDB(url string) error {
+	store, err := openStore(url)
+	if err != nil {
+		return err
+	}
+	appStore, reportStore = store, store
+	return nil
+}
+
+// openReplica opens reportStore on the read replica at url, sized like the
+// primary's pool. It is never migrated or written to.
+func openReplica(url string) error {
+	store, err := openStore(url)
+	if err != nil {
+		return err
+	}
+	if err := store.Ping(); err != nil {
+		return fmt.Errorf("could not reach the read replica: %v", err)
+	}
+	reportStore = store
+	return nil
+}
+
+// closeDB closes appStore, and reportStore if it is a read replica, once
+// nothing uses them anymore
+func closeDB() error {
+	if reportStore != appStore {
+		if err := reportStore.Close(); err != nil {
+			log.Printf("Could not close the read replica: %v", err)
+		}
+	}
+	return appStore.Close()
+}
+
+// migrateDB brings the schema of store up to date, see the migrations
+// package, short of contract migrations, which would break servers still
+// running the previous release during a rolling deploy
+func migrateDB(store RideStore) error {
+	if err := migrations.Validate(); err != nil {
+		return err
+	}
+	target, contract, err := store.ExpandTarget()
+	if err != nil {
+		return err
+	}
+	applied, err := store.MigrateUp(target)
+	for _, m := range applied {
+		log.Printf("Applied migration %d (%s)", m.Version, m.Name)
 	}
-	defer db.Close()
+	if len(applied) > 0 {
+		forgetSchema()
+	}
+	if err == nil && contract != nil {
+		log.Printf("Not applying contract migration %d (%s) yet: run the migrate up command once every server runs this release", contract.Version, contract.Name)
+	}
+	return err
 }
 
-// initExampleDB inserts example data into the sqlite db
-func initExampleDB() {
-	createTables := []string{
-		"CREATE TABLE IF NOT EXISTS customers(id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
-		"CREATE TABLE IF NOT EXISTS drivers (id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
-		"CREATE TABLE IF NOT EXISTS proxy_numbers (id INTEGER PRIMARY KEY, number TEXT UNIQUE)",
-		"CREATE TABLE IF NOT EXISTS " +
-			"rides (id INTEGER PRIMARY KEY, " +
-			"start TEXT, destination TEXT, datetime TEXT, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
-			"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
-	}
-	dbInsert(createTables)
-	insertData := []string{
-		"INSERT INTO customers (name, number) VALUES ('Caitlyn Carless', '319700000') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
-		"INSERT INTO customers (name, number) VALUES ('Danny Bikes', '319700001') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
-		"INSERT INTO drivers (name, number) VALUES ('David Driver', '319700002') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
-		"INSERT INTO drivers (name, number) VALUES ('Eileen LaRue', '319700003') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
-		"INSERT INTO proxy_numbers (number) VALUES ('319700004') ON CONFLICT (number) DO NOTHING",
-		"INSERT INTO proxy_numbers (number) VALUES ('319700005') ON CONFLICT (number) DO NOTHING",
-	}
-	dbInsert(insertData)
+// initExampleDB migrates store, inserts example data into it and reserves
+// the proxy numbers of existing rides, see reservations.go
+func initExampleDB(store RideStore) {
+	must(migrateDB(store))
+	must(store.SeedExampleData())
+	must(store.SyncReservations())
+}
+
+// SeedExampleData implements peopleStore. Only an empty pool is seeded, so
+// numbers deleted on the proxy pool page stay deleted.
+func (s *sqlStore) SeedExampleData() error {
+	upsertCustomer := sqlQuery{
+		SQLite:   "INSERT INTO customers (name, number) VALUES (?, ?) ON CONFLICT (number) DO UPDATE SET name = excluded.name",
+		Postgres: "INSERT INTO customers (name, number) VALUES ($1, $2) ON CONFLICT (number) DO UPDATE SET name = excluded.name",
+		MySQL:    "INSERT INTO customers (name, number) VALUES (?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name)",
+	}
+	upsertDriver := sqlQuery{
+		SQLite:   "INSERT INTO drivers (name, number, vehicle) VALUES (?, ?, ?) ON CONFLICT (number) DO UPDATE SET name = excluded.name, vehicle = excluded.vehicle",
+		Postgres: "INSERT INTO drivers (name, number, vehicle) VALUES ($1, $2, $3) ON CONFLICT (number) DO UPDATE SET name = excluded.name, vehicle = excluded.vehicle",
+		MySQL:    "INSERT INTO drivers (name, number, vehicle) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name), vehicle = VALUES(vehicle)",
+	}
+	err := s.execAll(
+		statement(upsertCustomer, "Caitlyn Carless", "319700000"),
+		statement(upsertCustomer, "Danny Bikes", "319700001"),
+		statement(upsertDriver, "David Driver", "319700002", "Blue Toyota Prius"),
+		statement(upsertDriver, "Eileen LaRue", "319700003", "Silver Tesla Model 3"),
+	)
+	if err != nil {
+		return err
+	}
+	var proxyID int
+	err = s.queryRow(sqlQuery{
+		SQLite:   "SELECT id FROM proxy_numbers LIMIT 1",
+		Postgres: "SELECT id FROM proxy_numbers LIMIT 1",
+	}).Scan(&proxyID)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	insertProxy := sqlQuery{
+		SQLite:   "INSERT INTO proxy_numbers (number) VALUES (?)",
+		Postgres: "INSERT INTO proxy_numbers (number) VALUES ($1)",
+	}
+	return s.execAll(
+		statement(insertProxy, "319700004"),
+		statement(insertProxy, "319700005"),
+	)
 }
 
 // Person is a person
 type Person struct {
-	ID     int
-	Name   string
-	Number string
+	ID          int
+	Name        string
+	Number      string
+	AltNumbers  []string // Other numbers the person may contact us from
+	Vehicle     string   // Description of a driver's vehicle; empty for customers
+	Deactivated bool     // Can't be booked for new rides, see people.go
+	Flags       []string // Flags operators put on the person, e.g. "vip", see participantnotes.go
+	Shift       string   // A driver's "on shift" or "off shift" once they texted ON or OFF, see shifts.go
+	ShiftSince  string   // RFC 3339 start of the driver's current shift, if on shift
 }
 
 // ProxyNumberType templates proxy numbers
 type ProxyNumberType struct {
-	ID     int
-	Number string
+	ID         int
+	Number     string
+	PortStatus string   // "pending" while being ported into the MessageBird account, "quarantined" while out of service, "disabled" while drained, "active" otherwise
+	ProviderID string   // MessageBird's ID for the number, once we've seen it
+	Tags       []string // e.g. "premium", "sms-only" or "region:NL", see proxytags.go
+	Features   []string // Features MessageBird lists for the number, e.g. "sms" and "voice"; empty until synced
 }
 
 // RideType templates rides
 type RideType struct {
-	ID              int
-	Start           string
-	Destination     string
-	DateTime        string
-	ThisCustomer    Person          // foreign key
-	ThisDriver      Person          // foreign key
-	ThisProxyNumber ProxyNumberType // foreign key
-	NumGrp          [][]int         // Number groups for proxy number rotation
+	ID               int
+	Start            string
+	Destination      string
+	DateTime         string
+	ThisCustomer     Person          // foreign key
+	ThisDriver       Person          // foreign key
+	ThisProxyNumber  ProxyNumberType // foreign key
+	NumGrp           [][]int         // Number groups for proxy number rotation
+	CustomerPIN      string          // Identifies the customer when contacting us from another phone
+	DriverPIN        string          // Identifies the driver when contacting us from another phone
+	CustomerLastUsed string          // Number the customer last contacted us from in this ride, if any
+	DriverLastUsed   string          // Number the driver last contacted us from in this ride, if any
+	CustomerChannel  string          // Channel the customer last texted us on in this ride, if any, see whatsapp.go
+	DriverChannel    string          // Channel the driver last texted us on in this ride, if any
+	RequiredTags     []string        // Tags the ride's proxy number must meet, see proxytags.go
+	Labels           []string        // Labels dispatchers filter rides by, e.g. "airport" or "vip", see ridelabels.go
+	Status           RideStatus      // see ridestatus.go
+	MutedBy          []string        // Roles that muted the other participant's texts, see mute.go
+	Activity         RideActivity    // Texts and calls relayed in the ride, see rideactivity.go
 }
 
 // RideSharingDB outlines overall rideshare data structure
 type RideSharingDB struct {
-	Customers    map[int]Person
-	Drivers      map[int]Person
-	ProxyNumbers map[int]ProxyNumberType
-	Rides        map[int]RideType
-	Message      string // For misc messages to be displayed in rendered page
+	Customers     map[int]Person
+	Drivers       map[int]Person
+	ProxyNumbers  map[int]ProxyNumberType
+	Rides         map[int]RideType
+	Relationships map[int]RelationshipType // Regular riders, see relationships.go
+	Releases      []ProxyRelease           // Proxy numbers released within the cool-down, see cooldown.go
+	Handoffs      []ProxyHandoff           // Rides that moved off a quarantined proxy number within the grace period, see handoff.go
+	PairProxies   map[ridePair]int         // Proxy number ID each pair last shared, see stickyproxies.go
+	WaitingRides  []WaitingRide            // Rides waiting for a proxy number, oldest first, see waitingrides.go
+
+	store        RideStore // Where loadDB reads from
+	tenant       string    // Host of the tenant, or "" outside the tenants command, see tenants.go
+	webhookToken string    // What the webhook routes end in, see setupWebhookToken
 }
 
-func (dbdata *RideSharingDB) loadDB() error {
-	db, err := sql.Open("sqlite3", "./ridesharing.db")
+// newRideSharingDB returns an empty RideSharingDB that loads snapshots
+// from store, see loadDB
+func newRideSharingDB(store RideStore) *RideSharingDB {
+	return &RideSharingDB{store: store}
+}
+
+// loadDB returns a snapshot of the data in dbdata's store. Each request
+// reads the data it works with from a snapshot of its own, which later
+// loads don't change. If the data can't be read, the snapshot is empty, so
+// pages can still be rendered with the error.
+func (dbdata *RideSharingDB) loadDB() (*RideSharingDB, error) {
+	snapshot, err := dbdata.store.Load()
 	if err != nil {
-		return err
+		return &RideSharingDB{store: dbdata.store, tenant: dbdata.tenant, webhookToken: dbdata.webhookToken}, err
 	}
-	defer db.Close()
+	snapshot.store, snapshot.tenant, snapshot.webhookToken = dbdata.store, dbdata.tenant, dbdata.webhookToken
+	return snapshot, nil
+}
 
+// Load implements RideStore
+func (s *sqlStore) Load() (*RideSharingDB, error) {
 	hereCustomers := make(map[int]Person)
 	hereDrivers := make(map[int]Person)
 	hereProxyNumbers := make(map[int]ProxyNumberType)
 	hereRides := make(map[int]RideType)
 
-	q := "SELECT * FROM customers"
-	rows, err := db.Query(q)
-	if err != nil {
-		return err
+	// Columns are read by name, and those a rolling deploy hasn't added yet
+	// keep their zero value, see selectColumns
+	var thisPerson Person
+	personColumns := []scanColumn{
+		{"id", &thisPerson.ID},
+		{"name", &thisPerson.Name},
+		{"number", &thisPerson.Number},
+		{"vehicle", &thisPerson.Vehicle},
+		{"deactivated", &thisPerson.Deactivated},
 	}
-	for rows.Next() {
-		var thisPerson Person
-		err := rows.Scan(&thisPerson.ID, &thisPerson.Name, &thisPerson.Number)
-		if err != nil {
-			log.Println(err)
-		}
+	resetPerson := func() { thisPerson = Person{} }
+	err := s.selectEach("customers", personColumns, sqlQuery{}, resetPerson, func() {
 		hereCustomers[thisPerson.ID] = thisPerson
-	}
-
-	q2 := "SELECT * FROM drivers"
-	rows2, err := db.Query(q2)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for rows2.Next() {
-		var thisPerson Person
-		err := rows2.Scan(&thisPerson.ID, &thisPerson.Name, &thisPerson.Number)
-		if err != nil {
-			log.Println(err)
-		}
+	err = s.selectEach("drivers", personColumns, sqlQuery{}, resetPerson, func() {
 		hereDrivers[thisPerson.ID] = thisPerson
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	q3 := "SELECT * FROM proxy_numbers"
-	rows3, err := db.Query(q3)
+	// Alternate numbers and flags are added to the people they belong to
+	var role, value string
+	var personID int
+	personValueColumns := func(valueColumn string) []scanColumn {
+		return []scanColumn{{"role", &role}, {"person_id", &personID}, {valueColumn, &value}}
+	}
+	resetPersonValue := func() { role, personID, value = "", 0, "" }
+	personFor := func(add func(p *Person)) func() {
+		return func() {
+			people := hereCustomers
+			if role == roleDriver {
+				people = hereDrivers
+			}
+			if thisPerson, ok := people[personID]; ok {
+				add(&thisPerson)
+				people[personID] = thisPerson
+			}
+		}
+	}
+	err = s.selectEach("alternate_numbers", personValueColumns("number"), sqlQuery{}, resetPersonValue,
+		personFor(func(p *Person) { p.AltNumbers = append(p.AltNumbers, value) }))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for rows3.Next() {
-		var thisNumber ProxyNumberType
-		err := rows3.Scan(&thisNumber.ID, &thisNumber.Number)
-		if err != nil {
-			log.Println(err)
+	err = s.selectEach("participant_notes", personValueColumns("flag"), sqlQuery{
+		SQLite:   "WHERE flag <> '' ORDER BY id",
+		Postgres: "WHERE flag <> '' ORDER BY id",
+	}, resetPersonValue,
+		personFor(func(p *Person) { p.addFlag(value) }))
+	if err != nil {
+		return nil, err
+	}
+
+	// The latest shift of each driver says whether they're on shift
+	var driverID int
+	var shiftStart, shiftEnd string
+	err = s.selectEach("shifts", []scanColumn{
+		{"driver_id", &driverID},
+		{"started_at", &shiftStart},
+		{"ended_at", &shiftEnd},
+	}, sqlQuery{SQLite: "ORDER BY id", Postgres: "ORDER BY id"}, func() {
+		driverID, shiftStart, shiftEnd = 0, "", ""
+	}, func() {
+		if driver, ok := hereDrivers[driverID]; ok {
+			driver.Shift, driver.ShiftSince = shiftOn, shiftStart
+			if shiftEnd != "" {
+				driver.Shift, driver.ShiftSince = shiftOff, ""
+			}
+			hereDrivers[driverID] = driver
 		}
-		hereProxyNumbers[thisNumber.ID] = thisNumber
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	q4 := "SELECT * FROM rides"
-	rows4, err := db.Query(q4)
+	var thisNumber ProxyNumberType
+	var tags, features string
+	err = s.selectEach("proxy_numbers", []scanColumn{
+		{"id", &thisNumber.ID},
+		{"number", &thisNumber.Number},
+		{"port_status", &thisNumber.PortStatus},
+		{"provider_id", &thisNumber.ProviderID},
+		{"tags", &tags},
+		{"features", &features},
+	}, sqlQuery{}, func() {
+		thisNumber, tags, features = ProxyNumberType{}, "", ""
+	}, func() {
+		thisNumber.Tags = parseTags(tags)
+		thisNumber.Features = parseTags(features)
+		hereProxyNumbers[thisNumber.ID] = thisNumber
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for rows4.Next() {
-		var thisRide RideType
-		err := rows4.Scan(&thisRide.ID, &thisRide.Start, &thisRide.Destination, &thisRide.DateTime, &thisRide.ThisCustomer.ID, &thisRide.ThisDriver.ID, &thisRide.ThisProxyNumber.ID)
-		if err != nil {
-			log.Println(err)
-		}
+
+	var thisRide RideType
+	var requiredTags, labels, mutedBy string
+	err = s.selectEach("rides", []scanColumn{
+		{"id", &thisRide.ID},
+		{"start", &thisRide.Start},
+		{"destination", &thisRide.Destination},
+		{"datetime", &thisRide.DateTime},
+		{"customer_id", &thisRide.ThisCustomer.ID},
+		{"driver_id", &thisRide.ThisDriver.ID},
+		{"number_id", &thisRide.ThisProxyNumber.ID},
+		{"customer_pin", &thisRide.CustomerPIN},
+		{"driver_pin", &thisRide.DriverPIN},
+		{"required_tags", &requiredTags},
+		{"status", &thisRide.Status},
+		{"labels", &labels},
+		{"muted_by", &mutedBy},
+		{"relayed_texts", &thisRide.Activity.Texts},
+		{"last_text_at", &thisRide.Activity.LastText},
+		{"relayed_calls", &thisRide.Activity.Calls},
+		{"last_call_at", &thisRide.Activity.LastCall},
+	}, sqlQuery{}, func() {
+		// Rides from before the status column count as scheduled
+		thisRide, requiredTags, labels, mutedBy = RideType{Status: rideScheduled}, "", "", ""
+	}, func() {
+		thisRide.RequiredTags = parseTags(requiredTags)
+		thisRide.Labels = parseTags(labels)
+		thisRide.MutedBy = parseTags(mutedBy)
 
 		// Because the structure of our RideType struct uses
 		// nested structs to represent the customer, driver, and proxy number
@@ -162,23 +364,88 @@ func (dbdata *RideSharingDB) loadDB() error {
 			if k1 == thisRide.ThisCustomer.ID {
 				thisRide.ThisCustomer.Name = v1.Name
 				thisRide.ThisCustomer.Number = v1.Number
+				thisRide.ThisCustomer.AltNumbers = v1.AltNumbers
+				thisRide.ThisCustomer.Flags = v1.Flags
 			}
 		}
 		for k2, v2 := range hereDrivers {
 			if k2 == thisRide.ThisDriver.ID {
 				thisRide.ThisDriver.Name = v2.Name
 				thisRide.ThisDriver.Number = v2.Number
+				thisRide.ThisDriver.AltNumbers = v2.AltNumbers
+				thisRide.ThisDriver.Vehicle = v2.Vehicle
+				thisRide.ThisDriver.Flags = v2.Flags
+				thisRide.ThisDriver.Shift = v2.Shift
+				thisRide.ThisDriver.ShiftSince = v2.ShiftSince
 			}
 		}
 		for k3, v3 := range hereProxyNumbers {
 			if k3 == thisRide.ThisProxyNumber.ID {
-				thisRide.ThisProxyNumber.Number = v3.Number
+				thisRide.ThisProxyNumber = v3
 			}
 		}
 		thisRide.NumGrp = append(thisRide.NumGrp, []int{thisRide.ThisCustomer.ID, thisRide.ThisProxyNumber.ID})
 		thisRide.NumGrp = append(thisRide.NumGrp, []int{thisRide.ThisDriver.ID, thisRide.ThisProxyNumber.ID})
 		hereRides[thisRide.ID] = thisRide
+	})
+	if err != nil {
+		return nil, err
 	}
-	*dbdata = RideSharingDB{hereCustomers, hereDrivers, hereProxyNumbers, hereRides, ""}
-	return nil
+
+	var rideID int
+	var number, channel string
+	err = s.selectEach("ride_contacts", []scanColumn{
+		{"ride_id", &rideID},
+		{"role", &role},
+		{"number", &number},
+		{"channel", &channel},
+	}, sqlQuery{}, func() {
+		rideID, role, number, channel = 0, "", "", textChannelSMS
+	}, func() {
+		if thisRide, ok := hereRides[rideID]; ok {
+			if role == roleDriver {
+				thisRide.DriverLastUsed = number
+				thisRide.DriverChannel = channel
+			} else {
+				thisRide.CustomerLastUsed = number
+				thisRide.CustomerChannel = channel
+			}
+			hereRides[rideID] = thisRide
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hereRelationships, err := s.loadRelationships(hereCustomers, hereDrivers, hereProxyNumbers)
+	if err != nil {
+		return nil, err
+	}
+	hereReleases, err := s.loadProxyReleases(time.Now().Add(-proxyCooldown()))
+	if err != nil {
+		return nil, err
+	}
+	hereHandoffs, err := s.loadHandoffs(hereProxyNumbers, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	herePairProxies, err := s.loadPairProxies()
+	if err != nil {
+		return nil, err
+	}
+	hereWaitingRides, err := s.loadWaitingRides(hereCustomers, hereDrivers)
+	if err != nil {
+		return nil, err
+	}
+	return &RideSharingDB{
+		Customers:     hereCustomers,
+		Drivers:       hereDrivers,
+		ProxyNumbers:  hereProxyNumbers,
+		Rides:         hereRides,
+		Relationships: hereRelationships,
+		Releases:      hereReleases,
+		Handoffs:      hereHandoffs,
+		PairProxies:   herePairProxies,
+		WaitingRides:  hereWaitingRides,
+	}, nil
 }
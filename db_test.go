@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testStores numbers the in-memory stores opened by openTestDB
+var testStores int64
+
+// openTestDB opens a new, seeded store of kind, "memory" or "sqlite", as
+// appStore, closing it when t ends
+func openTestDB(t *testing.T, kind string) {
+	t.Helper()
+	openEmptyTestDB(t, kind)
+	initExampleDB(appStore)
+}
+
+// openEmptyTestDB opens a new store of kind, like openTestDB, without
+// creating any tables in it
+func openEmptyTestDB(t *testing.T, kind string) {
+	t.Helper()
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	url := fmt.Sprintf("memory:test-%d", atomic.AddInt64(&testStores, 1))
+	if kind == "sqlite" {
+		dir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		url = filepath.Join(dir, "ridesharing.db")
+	}
+	if err := openDB(url); err != nil {
+		t.Fatalf("could not open %s: %v", url, err)
+	}
+	t.Cleanup(func() { closeDB() })
+}
+
+// setenv sets the environment variable name to value until t ends
+func setenv(t *testing.T, name string, value string) {
+	old, had := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestLoadDBReturnsSnapshots(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		openTestDB(t, kind)
+		root := newRideSharingDB(appStore)
+		before, err := root.loadDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appStore.AddPerson(roleCustomer, Person{Name: "Frank", Number: "319700099"}); err != nil {
+			t.Fatal(err)
+		}
+		after, err := root.loadDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if root.Customers != nil {
+			t.Errorf("%s: loadDB filled in the RideSharingDB it loaded from", kind)
+		}
+		if len(after.Customers) != len(before.Customers)+1 {
+			t.Errorf("%s: %d customers after the insert, want %d", kind, len(after.Customers), len(before.Customers)+1)
+		}
+		for _, v := range before.Customers {
+			if v.Number == "319700099" {
+				t.Errorf("%s: a later insert changed an earlier snapshot", kind)
+			}
+		}
+		// Snapshots load from the same store
+		if again, err := after.loadDB(); err != nil || len(again.Customers) != len(after.Customers) {
+			t.Errorf("%s: snapshot of a snapshot has %d customers, err %v, want %d", kind, len(again.Customers), err, len(after.Customers))
+		}
+	}
+}
+
+func TestConcurrentLoads(t *testing.T) {
+	openTestDB(t, "memory")
+	root := newRideSharingDB(appStore)
+
+	// Requests load and read their snapshots while others change the data.
+	// Run with -race to check they don't share one.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				dbdata, err := root.loadDB()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, v := range dbdata.Customers {
+					_ = v.Name
+				}
+				if err := appStore.AddPerson(roleCustomer, Person{Name: "Rider", Number: fmt.Sprintf("3197%04d%02d", i, j)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	dbdata, err := root.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// initExampleDB seeds two customers
+	if want := 2 + 8*10; len(dbdata.Customers) != want {
+		t.Errorf("%d customers, want %d", len(dbdata.Customers), want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/sms"
+)
+
+// Final statuses MessageBird reports for messages that will never be delivered
+const (
+	statusExpired        = "expired"
+	statusDeliveryFailed = "delivery_failed"
+)
+
+// deliveryFailed reports whether status means a message permanently failed
+func deliveryFailed(status string) bool {
+	return status == statusExpired || status == statusDeliveryFailed
+}
+
+// deliveryReportParams asks MessageBird to send status reports for a message
+// to DELIVERY_REPORT_URL, if set. Otherwise reports go to the status report
+// URL configured in the MessageBird dashboard.
+func deliveryReportParams() *sms.Params {
+	if url := os.Getenv("DELIVERY_REPORT_URL"); url != "" {
+		return &sms.Params{ReportURL: url}
+	}
+	return nil
+}
+
+// loggedMessage is a message from our messages log
+type loggedMessage struct {
+	RideID      int
+	Originator  string
+	RelayedFrom string
+	Status      string
+}
+
+// deliveryReportStore is the part of RideStore that tracks the delivery of
+// the messages we send
+type deliveryReportStore interface {
+	// FindLoggedMessage returns the outbound message MessageBird knows as
+	// providerID that was sent to recipient, or sql.ErrNoRows
+	FindLoggedMessage(providerID string, recipient string) (loggedMessage, error)
+	// SetMessageStatus records the latest status of the message
+	// MessageBird knows as providerID that was sent to recipient
+	SetMessageStatus(providerID string, recipient string, status string) error
+}
+
+// FindLoggedMessage implements deliveryReportStore
+func (s *sqlStore) FindLoggedMessage(providerID string, recipient string) (loggedMessage, error) {
+	var msg loggedMessage
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT ride_id, originator, relayed_from, status FROM messages WHERE provider_id = ? AND recipient = ? AND direction = ?",
+		Postgres: "SELECT ride_id, originator, relayed_from, status FROM messages WHERE provider_id = $1 AND recipient = $2 AND direction = $3",
+	}, providerID, recipient, directionOutbound).Scan(&msg.RideID, &msg.Originator, &msg.RelayedFrom, &msg.Status)
+	return msg, err
+}
+
+// SetMessageStatus implements deliveryReportStore
+func (s *sqlStore) SetMessageStatus(providerID string, recipient string, status string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE messages SET status = ? WHERE provider_id = ? AND recipient = ?",
+		Postgres: "UPDATE messages SET status = $1 WHERE provider_id = $2 AND recipient = $3",
+	}, status, providerID, recipient)
+	return err
+}
+
+// notifyDeliveryFailure tells sender, through the ride's proxy number, that
+// the message they sent to the other participant could not be delivered
+func notifyDeliveryFailure(store RideStore, mb *messagebird.Client, ride RideType, sender string) {
+	role := ""
+	if ride.ThisCustomer.hasNumber(sender) {
+		role = roleCustomer
+	} else if ride.ThisDriver.hasNumber(sender) {
+		role = roleDriver
+	}
+	notice := renderNotification(store, templateDeliveryFailed, newNotificationData(store, ride, role))
+	sendRideMessage(store, mb, ride.ID, ride.ThisProxyNumber.notificationOriginator(), sender, notice, nil, "")
+}
+
+// deliveryReportHandler receives MessageBird status reports for the messages
+// we send. It records each message's latest status, and when a relayed
+// message permanently fails it lets the participant who sent it know, so
+// their message doesn't silently disappear.
+func deliveryReportHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.FormValue("id")
+		recipient := r.FormValue("recipient")
+		status := r.FormValue("status")
+		if id == "" || recipient == "" || status == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Invalid status report: id, recipient and status are required")
+			return
+		}
+
+		msg, err := dbdata.store.FindLoggedMessage(id, recipient)
+		if err == sql.ErrNoRows {
+			// Not one of ours, e.g. a message sent from the dashboard
+			fmt.Fprint(w, "OK")
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		if deliveryFailed(msg.Status) {
+			// We already handled the failure of this message
+			fmt.Fprint(w, "OK")
+			return
+		}
+
+		if err := dbdata.store.SetMessageStatus(id, recipient, status); err != nil {
+			log.Println(err)
+		}
+
+		if deliveryFailed(status) && msg.RelayedFrom != "" {
+			log.Printf("Relayed message %s to %s failed with status %s, notifying %s", id, recipient, status, msg.RelayedFrom)
+			dbdata, err := dbdata.loadDB()
+			if err != nil {
+				log.Println(err)
+			}
+			ride, ok := dbdata.Rides[msg.RideID]
+			if !ok {
+				// The ride is gone, e.g. archived; we can still answer through its proxy
+				ride = RideType{ID: msg.RideID}
+				ride.ThisProxyNumber, _ = findProxyNumber(dbdata, msg.Originator)
+				ride.ThisProxyNumber.Number = msg.Originator
+			}
+			notifyDeliveryFailure(dbdata.store, mb, ride, msg.RelayedFrom)
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// demoRun is a running demo: the application serving a scratch database,
+// talking to a simulated MessageBird API
+type demoRun struct {
+	server *httptest.Server
+	sim    *messageBirdSimulator
+	dbdata *RideSharingDB
+	step   int
+	// The admin account the operator's steps sign in to the dashboard as
+	adminUser     string
+	adminPassword string
+	csrfToken     string // Sent as both the CSRF cookie and header
+}
+
+// post submits form to one of the application's routes as the demo's admin,
+// returning the response body. Requests are signed like MessageBird's if
+// MESSAGEBIRD_SIGNING_KEY is set, see requireWebhookSignature.
+func (d *demoRun) post(path string, form url.Values) (string, error) {
+	body := []byte(form.Encode())
+	r, err := http.NewRequest(http.MethodPost, d.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(d.adminUser, d.adminPassword)
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: d.csrfToken})
+	r.Header.Set(csrfHeaderName, d.csrfToken)
+	if key := webhookSigningKey(); key != "" {
+		signWebhookRequest(r, body, key, time.Now())
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", path, resp.Status)
+	}
+	return string(answer), nil
+}
+
+// say starts the next step of the walkthrough
+func (d *demoRun) say(format string, args ...interface{}) {
+	d.step++
+	fmt.Printf("\n%d. %s\n", d.step, fmt.Sprintf(format, args...))
+}
+
+// showSent prints the SMS messages the simulator received since the last step
+func (d *demoRun) showSent(ride RideType) {
+	sent := d.sim.take()
+	if len(sent) == 0 {
+		fmt.Println("   (no SMS sent)")
+	}
+	for _, msg := range sent {
+		fmt.Printf("   SMS from %s to %s: %q\n", msg.Originator, demoParty(ride, msg.Recipient), msg.Body)
+	}
+}
+
+// demoParty describes number, e.g. "319700002 (driver)"
+func demoParty(ride RideType, number string) string {
+	if role := participantRole(ride, number); role != "" {
+		return number + " (" + role + ")"
+	}
+	return number
+}
+
+// runDemo walks through a scripted ride, printing what happens at each step:
+// it seeds a scratch database, starts the application against a simulated
+// MessageBird API, creates a ride, relays texts both ways and routes a call.
+func runDemo(args []string) int {
+	flags := flag.NewFlagSet("demo", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "keep the demo's database instead of deleting it afterwards")
+	verbose := flags.Bool("v", false, "show the application's log")
+	store := storeFlag(flags)
+	flags.Parse(args)
+	// Always a scratch SQLite file, whatever DATABASE_URL says
+	url, err := storeURL(*store, "")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	// Work in a scratch directory so the demo doesn't touch ./ridesharing.db
+	views, err := filepath.Abs("views")
+	if err != nil {
+		fmt.Println("Could not find views:", err)
+		return 1
+	}
+	dir, err := ioutil.TempDir("", "birdcar-demo")
+	if err != nil {
+		fmt.Println("Could not create a scratch directory:", err)
+		return 1
+	}
+	if *keep && *store == storeSQL {
+		defer fmt.Printf("\nThe demo database is kept in %s\n", filepath.Join(dir, "ridesharing.db"))
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	if err := os.Symlink(views, filepath.Join(dir, "views")); err != nil {
+		fmt.Println("Could not link views:", err)
+		return 1
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Println("Could not enter the scratch directory:", err)
+		return 1
+	}
+	if err := openDB(url); err != nil {
+		fmt.Println("Could not open the demo database:", err)
+		return 1
+	}
+	defer closeDB()
+
+	fmt.Println("Seeding the demo scenario: two customers, two drivers and two proxy numbers.")
+	initExampleDB(appStore)
+
+	sim := new(messageBirdSimulator)
+	mb := messagebird.New("demo")
+	mb.HTTPClient = &http.Client{Transport: sim}
+	dbdata := newRideSharingDB(appStore)
+	if dbdata.webhookToken, err = setupWebhookToken(appStore); err != nil {
+		fmt.Println("Could not set up the webhook token:", err)
+		return 1
+	}
+	queue := newNotificationQueue(mb, 100, newAdaptiveThrottle(0, 0))
+	go queue.run()
+	d := &demoRun{server: httptest.NewServer(newRouter(dbdata, dbdata, mb, queue)), sim: sim, dbdata: dbdata}
+	if d.adminUser, d.adminPassword, err = demoAdmin(); err != nil {
+		fmt.Println("Could not set up an admin account:", err)
+		return 1
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Println("Could not create a CSRF token:", err)
+		return 1
+	}
+	d.csrfToken = hex.EncodeToString(secret)
+	defer d.server.Close()
+	fmt.Println("Started the application against a simulated MessageBird API at", d.server.URL)
+
+	if err := d.walkthrough(); err != nil {
+		fmt.Println("Demo failed:", err)
+		return 1
+	}
+	fmt.Println("\nThat's it: the customer and driver reached each other without ever seeing each other's number.")
+	return 0
+}
+
+// demoAdmin returns an admin account to use the dashboard with, see
+// adminAccounts. Without one, the demo sets ADMIN_PASSWORD to a random
+// password for the duration of the run.
+func demoAdmin() (string, string, error) {
+	for user, password := range adminAccounts() {
+		return user, password, nil
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	if err := os.Setenv("ADMIN_PASSWORD", hex.EncodeToString(secret)); err != nil {
+		return "", "", err
+	}
+	for user, password := range adminAccounts() {
+		return user, password, nil
+	}
+	return "", "", fmt.Errorf("no admin account")
+}
+
+// walkthrough runs the scripted ride
+func (d *demoRun) walkthrough() error {
+	dbdata, err := d.dbdata.loadDB()
+	if err != nil {
+		return err
+	}
+	customer, driver := dbdata.Customers[1], dbdata.Drivers[1]
+
+	pickup := time.Now().Add(time.Hour).Format("2006-01-02T15:04")
+	d.say("An operator books a ride for %s with %s at %s.", customer.Name, driver.Name, pickup)
+	_, err = d.post("/createride", url.Values{
+		"customer":    {fmt.Sprint(customer.ID)},
+		"driver":      {fmt.Sprint(driver.ID)},
+		"start":       {"Amsterdam Centraal"},
+		"destination": {"Schiphol Airport"},
+		"datetime":    {pickup},
+	})
+	if err != nil {
+		return err
+	}
+	if dbdata, err = d.dbdata.loadDB(); err != nil {
+		return err
+	}
+	var ride RideType
+	for _, v := range dbdata.Rides {
+		ride = v
+	}
+	if ride.ID == 0 {
+		return fmt.Errorf("no ride was created")
+	}
+	proxy := ride.ThisProxyNumber.Number
+	fmt.Printf("   Ride %d gets proxy number %s. Both participants are notified:\n", ride.ID, proxy)
+	d.showSent(ride)
+
+	texts := []struct {
+		from Person
+		body string
+	}{
+		{customer, "Hi, I'm waiting at the main entrance."},
+		{driver, "On my way, see you in 5 minutes!"},
+	}
+	for i, text := range texts {
+		d.say("%s texts %q to the proxy number.", text.from.Name, text.body)
+		_, err := d.post(smsWebhookPath(d.dbdata.webhookToken), url.Values{
+			"id":         {fmt.Sprintf("demo-sms-%d", i+1)},
+			"originator": {text.from.Number},
+			"receiver":   {proxy},
+			"payload":    {text.body},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("   We relay it from the proxy number:")
+		d.showSent(ride)
+	}
+
+	d.say("%s calls the proxy number.", driver.Name)
+	flow, err := d.post(voiceWebhookPath(d.dbdata.webhookToken), url.Values{
+		"callID":      {"demo-call-1"},
+		"source":      {driver.Number},
+		"destination": {proxy},
+	})
+	if err != nil {
+		return err
+	}
+	if i := strings.Index(flow, "<Transfer destination='"); i >= 0 {
+		target := flow[i+len("<Transfer destination='"):]
+		target = target[:strings.Index(target, "'")]
+		fmt.Printf("   We tell MessageBird to transfer the call to %s.\n", demoParty(ride, target))
+	} else {
+		fmt.Printf("   We answer with this call flow: %s\n", flow)
+	}
+
+	d.say("%s texts STATUS to check the ride.", customer.Name)
+	_, err = d.post(smsWebhookPath(d.dbdata.webhookToken), url.Values{
+		"id":         {"demo-sms-3"},
+		"originator": {customer.Number},
+		"receiver":   {proxy},
+		"payload":    {statusKeyword},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("   We answer without bothering the driver:")
+	d.showSent(ride)
+	return nil
+}
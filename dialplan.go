@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// dialPlan describes the phone numbers of a country: its calling code,
+// the trunk prefix dialed before national numbers, and how many digits its
+// national significant numbers have
+type dialPlan struct {
+	Country string // ISO 3166 code, e.g. "NL"
+	Name    string
+	Code    string // Calling code, e.g. "31"
+	Trunk   string // e.g. "0", or empty if numbers are dialed as is
+	MinLen  int
+	MaxLen  int
+}
+
+// dialPlans are the countries whose numbers we validate, by ISO code.
+// Numbers with other calling codes only need to be valid E.164 numbers.
+var dialPlans = map[string]dialPlan{
+	"BE": {"BE", "Belgium", "32", "0", 8, 9},
+	"DE": {"DE", "Germany", "49", "0", 6, 13},
+	"ES": {"ES", "Spain", "34", "", 9, 9},
+	"FR": {"FR", "France", "33", "0", 9, 9},
+	"GB": {"GB", "United Kingdom", "44", "0", 9, 10},
+	"IT": {"IT", "Italy", "39", "", 6, 11},
+	// Including the 097 machine-to-machine numbers, with 11 digits
+	"NL": {"NL", "Netherlands", "31", "0", 9, 11},
+	"US": {"US", "United States and Canada", "1", "1", 10, 10},
+}
+
+// E.164 allows up to 15 digits, and no real number has fewer than 8
+const (
+	minE164Digits = 8
+	maxE164Digits = 15
+)
+
+// defaultCountry returns the ISO code of the country numbers entered
+// without a calling code are in, from DEFAULT_COUNTRY (e.g. "NL"), or an
+// empty string if they must have one
+func defaultCountry() string {
+	return strings.ToUpper(strings.TrimSpace(os.Getenv("DEFAULT_COUNTRY")))
+}
+
+// inferDialPlan returns the dial plan of the international number msisdn,
+// given as digits without the leading '+'
+func inferDialPlan(msisdn string) (dialPlan, bool) {
+	for _, v := range dialPlans {
+		if strings.HasPrefix(msisdn, v.Code) {
+			return v, true
+		}
+	}
+	return dialPlan{}, false
+}
+
+// normalizeNumber turns a phone number entered on a form into the MSISDN we
+// store, e.g. "+31 6 1234 5678" or "06-12345678" with country "NL" into
+// "31612345678". Numbers starting with + or 00 are international, and their
+// country is inferred from the calling code; others are national numbers of
+// country, or of defaultCountry if it is empty. Numbers impossible in their
+// country's dial plan are rejected.
+func normalizeNumber(input string, country string) (string, error) {
+	digits := strings.Map(func(c rune) rune {
+		switch c {
+		case ' ', '-', '.', '(', ')', '/':
+			return -1
+		}
+		return c
+	}, strings.TrimSpace(input))
+
+	international := false
+	switch {
+	case strings.HasPrefix(digits, "+"):
+		digits, international = digits[1:], true
+	case strings.HasPrefix(digits, "00"):
+		digits, international = digits[2:], true
+	}
+	if !isDigits(digits) {
+		return "", fmt.Errorf("%q is not a phone number", input)
+	}
+
+	var plan dialPlan
+	if international {
+		var ok bool
+		if plan, ok = inferDialPlan(digits); !ok {
+			if len(digits) < minE164Digits || len(digits) > maxE164Digits || digits[0] == '0' {
+				return "", fmt.Errorf("%q is not a valid international number", input)
+			}
+			return digits, nil
+		}
+	} else {
+		if country == "" {
+			country = defaultCountry()
+		}
+		var ok bool
+		if plan, ok = dialPlans[strings.ToUpper(country)]; !ok {
+			return "", fmt.Errorf("enter %q in international format, e.g. +31612345678, or choose its country", input)
+		}
+		digits = plan.Code + strings.TrimPrefix(digits, plan.Trunk)
+	}
+
+	national := strings.TrimPrefix(digits, plan.Code)
+	if len(national) < plan.MinLen || len(national) > plan.MaxLen {
+		return "", fmt.Errorf("%q is not a valid %s number: those have %s digits after +%s",
+			input, plan.Name, digitRange(plan.MinLen, plan.MaxLen), plan.Code)
+	}
+	if plan.Trunk != "" && strings.HasPrefix(national, plan.Trunk) {
+		return "", fmt.Errorf("%q is not a valid %s number: drop the %s after +%s", input, plan.Name, plan.Trunk, plan.Code)
+	}
+	return digits, nil
+}
+
+// digitRange describes a number of digits, e.g. "9" or "9 to 11"
+func digitRange(min int, max int) string {
+	if min == max {
+		return fmt.Sprint(min)
+	}
+	return fmt.Sprintf("%d to %d", min, max)
+}
+
+// sortedDialPlans returns the countries numbers can be entered for, by name
+func sortedDialPlans() []dialPlan {
+	var plans []dialPlan
+	for _, v := range dialPlans {
+		plans = append(plans, v)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Name < plans[j].Name })
+	return plans
+}
+
+// DialPlans returns the countries numbers can be entered for, by name
+func (page PageData) DialPlans() []dialPlan {
+	return sortedDialPlans()
+}
+
+// DefaultCountry returns the country selected on forms taking phone numbers
+func (page PageData) DefaultCountry() string {
+	return defaultCountry()
+}
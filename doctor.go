@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// consistencyCheckInterval is how often the server checks the database for
+// rides that can't be routed
+const consistencyCheckInterval = time.Hour
+
+// rideProblem is an inconsistency in the rides table found by checkConsistency
+type rideProblem struct {
+	Ride     RideType
+	Reason   string
+	Orphaned bool // The ride references a customer, driver or proxy number that no longer exists
+}
+
+// checkConsistency finds rides that reference missing customers, drivers or
+// proxy numbers, and rides that share a customer+proxy or driver+proxy
+// combination with an earlier ride. Incoming messages and calls for those
+// combinations can't be routed unambiguously.
+func checkConsistency(dbdata *RideSharingDB) []rideProblem {
+	var problems []rideProblem
+
+	// Check rides in order, so the earliest ride keeps a shared combination
+	var rideIDs []int
+	for id := range dbdata.Rides {
+		rideIDs = append(rideIDs, id)
+	}
+	sort.Ints(rideIDs)
+
+	seen := make(map[string]int)
+	for _, id := range rideIDs {
+		v := dbdata.Rides[id]
+		var missing []string
+		if _, ok := dbdata.Customers[v.ThisCustomer.ID]; !ok {
+			missing = append(missing, fmt.Sprintf("customer %d", v.ThisCustomer.ID))
+		}
+		if _, ok := dbdata.Drivers[v.ThisDriver.ID]; !ok {
+			missing = append(missing, fmt.Sprintf("driver %d", v.ThisDriver.ID))
+		}
+		if _, ok := dbdata.ProxyNumbers[v.ThisProxyNumber.ID]; !ok {
+			missing = append(missing, fmt.Sprintf("proxy number %d", v.ThisProxyNumber.ID))
+		}
+		if len(missing) > 0 {
+			problems = append(problems, rideProblem{
+				Ride:     v,
+				Reason:   "references missing " + strings.Join(missing, ", "),
+				Orphaned: true,
+			})
+			continue
+		}
+		// Rides that are over have released their proxy number
+		if v.Status.Terminal() {
+			continue
+		}
+
+		for _, pair := range []struct {
+			role string
+			id   int
+		}{
+			{roleCustomer, v.ThisCustomer.ID},
+			{roleDriver, v.ThisDriver.ID},
+		} {
+			key := fmt.Sprintf("%s %d via proxy %d", pair.role, pair.id, v.ThisProxyNumber.ID)
+			if other, ok := seen[key]; ok {
+				// Regular riders keep their proxy number across rides; we route
+				// to the same people whichever of their rides we pick
+				earlier := dbdata.Rides[other]
+				if earlier.ThisCustomer.ID == v.ThisCustomer.ID && earlier.ThisDriver.ID == v.ThisDriver.ID {
+					continue
+				}
+				problems = append(problems, rideProblem{
+					Ride:   v,
+					Reason: fmt.Sprintf("%s is also used by ride %d", key, other),
+				})
+				break
+			}
+			seen[key] = v.ID
+		}
+	}
+	return problems
+}
+
+// repairProblem fixes a problem found by checkConsistency: orphaned rides are
+// deleted, and rides sharing a combination with an earlier ride are moved to
+// another proxy number.
+func repairProblem(dbdata *RideSharingDB, problem rideProblem) error {
+	if problem.Orphaned {
+		if err := dbdata.store.DeleteRide(problem.Ride.ID); err != nil {
+			return err
+		}
+		return dbdata.store.SyncReservations()
+	}
+
+	proxy, err := getAvailableProxyNumber(dbdata, problem.Ride.ThisCustomer.ID, problem.Ride.ThisDriver.ID, problem.Ride.RequiredTags)
+	if err != nil {
+		return err
+	}
+	if err := dbdata.store.MoveRide(problem.Ride, proxy); err != nil {
+		return err
+	}
+	return dbdata.store.SyncReservations()
+}
+
+// pollConsistency logs problems found by checkConsistency every interval
+// until ctx is done. It is meant to be run in its own goroutine.
+func pollConsistency(ctx context.Context, store RideStore, interval time.Duration) {
+	every(ctx, interval, func() {
+		dbdata, err := newRideSharingDB(store).loadDB()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, problem := range checkConsistency(dbdata) {
+			log.Printf("Consistency check: ride %d %s. Run the doctor command with -repair to fix it.", problem.Ride.ID, problem.Reason)
+		}
+	})
+}
+
+// runDoctor implements the doctor command, which reports problems found by
+// checkConsistency and, with -repair, fixes them. It returns the exit status:
+// 0 if no problems remain, 1 otherwise.
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "delete orphaned rides and move rides with clashing proxy numbers to a free proxy")
+	flags.Parse(args)
+
+	if err := openDB(databaseURL()); err != nil {
+		fmt.Println("Could not open database:", err)
+		return 1
+	}
+	dbdata, err := newRideSharingDB(appStore).loadDB()
+	if err != nil {
+		fmt.Println("Could not load database:", err)
+		return 1
+	}
+
+	problems := checkConsistency(dbdata)
+	if len(problems) == 0 {
+		fmt.Println("No problems found.")
+		return 0
+	}
+
+	unresolved := 0
+	for _, problem := range problems {
+		fmt.Printf("Ride %d %s.\n", problem.Ride.ID, problem.Reason)
+		if !*repair {
+			unresolved++
+			continue
+		}
+		if err := repairProblem(dbdata, problem); err != nil {
+			fmt.Printf("  Could not repair ride %d: %v\n", problem.Ride.ID, err)
+			unresolved++
+			continue
+		}
+		fmt.Printf("  Repaired ride %d.\n", problem.Ride.ID)
+		// Later repairs must see the proxy numbers assigned so far
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			fmt.Println("Could not reload database:", err)
+			return 1
+		}
+	}
+
+	if unresolved > 0 {
+		if !*repair {
+			fmt.Printf("%d problems found. Run doctor -repair to fix them.\n", unresolved)
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PII masking options for ride exports, passed as a comma-separated mask parameter
+const (
+	maskNumbers = "numbers" // show only the last digits of phone numbers
+	maskNames   = "names"   // show participants by initials
+	maskBodies  = "bodies"  // leave out message contents
+)
+
+// exportMask holds the masking options of an export
+type exportMask map[string]bool
+
+// parseExportMask reads masking options such as "numbers,names" or "all"
+func parseExportMask(value string) exportMask {
+	mask := make(exportMask)
+	for _, option := range strings.Split(value, ",") {
+		option = strings.ToLower(strings.TrimSpace(option))
+		if option == "all" {
+			mask[maskNumbers], mask[maskNames], mask[maskBodies] = true, true, true
+		} else if option != "" {
+			mask[option] = true
+		}
+	}
+	return mask
+}
+
+// number masks all but the last three digits of number if requested
+func (m exportMask) number(number string) string {
+	if !m[maskNumbers] {
+		return number
+	}
+	return maskNumber(number)
+}
+
+// name reduces name to initials if requested
+func (m exportMask) name(name string) string {
+	if !m[maskNames] {
+		return name
+	}
+	var initials string
+	for _, part := range strings.Fields(name) {
+		initials += part[:1] + "."
+	}
+	return initials
+}
+
+// body leaves out a message body if requested
+func (m exportMask) body(body string) string {
+	if !m[maskBodies] {
+		return body
+	}
+	return fmt.Sprintf("[%d characters withheld]", len([]rune(body)))
+}
+
+// transcriptEvent is one relayed message or call in a ride's transcript
+type transcriptEvent struct {
+	Time       string
+	Channel    string // "sms", "whatsapp" or "call"
+	Direction  string
+	From       string
+	FromRole   string
+	To         string
+	ToRole     string
+	Text       string
+	ProviderID string
+	Status     string
+}
+
+// rideTranscript is everything we log about one ride, for insurance and dispute workflows
+type rideTranscript struct {
+	Ride   RideType
+	Events []transcriptEvent
+}
+
+// exportStore is the part of RideStore that exports read rides from,
+// including archived ones
+type exportStore interface {
+	// ArchivedRide returns the archived ride with the given ID
+	ArchivedRide(id int) (archivedRide, error)
+	// RideEvents returns the messages and calls logged for the ride with the
+	// given ID, including archived ones, in no particular order
+	RideEvents(rideID int) ([]transcriptEvent, error)
+}
+
+// archivedRide is a ride moved to the archive, see archive.go
+type archivedRide struct {
+	Start       string
+	Destination string
+	DateTime    string
+	CustomerID  int
+	DriverID    int
+	NumberID    int
+}
+
+// ArchivedRide implements exportStore
+func (s *sqlStore) ArchivedRide(id int) (archivedRide, error) {
+	var r archivedRide
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT start, destination, datetime, customer_id, driver_id, number_id FROM archived_rides WHERE id = ?",
+		Postgres: "SELECT start, destination, datetime, customer_id, driver_id, number_id FROM archived_rides WHERE id = $1",
+	}, id).Scan(&r.Start, &r.Destination, &r.DateTime, &r.CustomerID, &r.DriverID, &r.NumberID)
+	return r, err
+}
+
+// RideEvents implements exportStore
+func (s *sqlStore) RideEvents(rideID int) ([]transcriptEvent, error) {
+	var events []transcriptEvent
+	rows, err := s.query(sqlQuery{
+		SQLite: "SELECT created_at, direction, originator, recipient, body, provider_id, provider, status FROM messages WHERE ride_id = ? " +
+			"UNION ALL SELECT created_at, direction, originator, recipient, body, provider_id, provider, status FROM archived_messages WHERE ride_id = ?",
+		Postgres: "SELECT created_at, direction, originator, recipient, body, provider_id, provider, status FROM messages WHERE ride_id = $1 " +
+			"UNION ALL SELECT created_at, direction, originator, recipient, body, provider_id, provider, status FROM archived_messages WHERE ride_id = $2",
+	}, rideID, rideID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := transcriptEvent{Channel: "sms"}
+		var provider string
+		if err := rows.Scan(&e.Time, &e.Direction, &e.From, &e.To, &e.Text, &e.ProviderID, &provider, &e.Status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if provider == providerWhatsApp {
+			e.Channel = textChannelWhatsApp
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.query(sqlQuery{
+		SQLite: "SELECT created_at, source, destination, transferred_to, provider_id FROM calls WHERE ride_id = ? " +
+			"UNION ALL SELECT created_at, source, destination, transferred_to, provider_id FROM archived_calls WHERE ride_id = ?",
+		Postgres: "SELECT created_at, source, destination, transferred_to, provider_id FROM calls WHERE ride_id = $1 " +
+			"UNION ALL SELECT created_at, source, destination, transferred_to, provider_id FROM archived_calls WHERE ride_id = $2",
+	}, rideID, rideID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := transcriptEvent{Channel: "call", Direction: directionInbound}
+		var transferredTo string
+		if err := rows.Scan(&e.Time, &e.From, &e.To, &transferredTo, &e.ProviderID); err != nil {
+			return nil, err
+		}
+		e.Text = "Call transferred to " + transferredTo
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// findRideForExport returns the ride with the given ID, looking in the
+// archive of dbdata's store for rides that have been archived, see archive.go
+func findRideForExport(dbdata *RideSharingDB, id int) (RideType, error) {
+	if ride, ok := dbdata.Rides[id]; ok {
+		return ride, nil
+	}
+	ride := RideType{ID: id}
+	archived, err := dbdata.store.ArchivedRide(id)
+	if err != nil {
+		return ride, err
+	}
+	ride.Start = archived.Start
+	ride.Destination = archived.Destination
+	ride.DateTime = archived.DateTime
+	ride.ThisCustomer = dbdata.Customers[archived.CustomerID]
+	ride.ThisDriver = dbdata.Drivers[archived.DriverID]
+	ride.ThisProxyNumber = dbdata.ProxyNumbers[archived.NumberID]
+	return ride, nil
+}
+
+// participantRole names the ride participant number belongs to
+func participantRole(ride RideType, number string) string {
+	switch {
+	case number == ride.ThisProxyNumber.Number:
+		return "proxy"
+	case ride.ThisCustomer.hasNumber(number):
+		return roleCustomer
+	case ride.ThisDriver.hasNumber(number):
+		return roleDriver
+	}
+	return ""
+}
+
+// loadRideTranscript collects the messages and calls logged for a ride,
+// including archived ones, in chronological order
+func loadRideTranscript(dbdata *RideSharingDB, id int) (rideTranscript, error) {
+	ride, err := findRideForExport(dbdata, id)
+	if err != nil {
+		return rideTranscript{}, err
+	}
+	events, err := dbdata.store.RideEvents(id)
+	if err != nil {
+		return rideTranscript{Ride: ride}, err
+	}
+	t := rideTranscript{Ride: ride, Events: events}
+	for i := range t.Events {
+		t.Events[i].FromRole = participantRole(ride, t.Events[i].From)
+		t.Events[i].ToRole = participantRole(ride, t.Events[i].To)
+	}
+	sort.SliceStable(t.Events, func(i, j int) bool { return t.Events[i].Time < t.Events[j].Time })
+	return t, nil
+}
+
+// masked returns a copy of e with mask applied. Proxy numbers are ours, so they
+// are left as is. Call targets are masked like other numbers, so the text of
+// call events is rebuilt. Participants' names are masked in message bodies too.
+func (e transcriptEvent) masked(ride RideType, mask exportMask) transcriptEvent {
+	if e.Channel == "call" {
+		target := strings.TrimPrefix(e.Text, "Call transferred to ")
+		e.Text = "Call transferred to " + mask.number(target)
+	} else {
+		for _, p := range []Person{ride.ThisCustomer, ride.ThisDriver} {
+			if p.Name != "" {
+				e.Text = strings.Replace(e.Text, p.Name, mask.name(p.Name), -1)
+			}
+		}
+		e.Text = mask.body(e.Text)
+	}
+	if e.FromRole != "proxy" {
+		e.From = mask.number(e.From)
+	}
+	if e.ToRole != "proxy" {
+		e.To = mask.number(e.To)
+	}
+	return e
+}
+
+// writeTranscriptCSV writes t to w as CSV
+func writeTranscriptCSV(w http.ResponseWriter, t rideTranscript, mask exportMask) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"ride-%d.csv\"", t.Ride.ID))
+	out := csv.NewWriter(w)
+	out.Write([]string{"time", "channel", "direction", "from", "from_role", "to", "to_role", "text", "provider_id", "status"})
+	for _, e := range t.Events {
+		e = e.masked(t.Ride, mask)
+		out.Write([]string{e.Time, e.Channel, e.Direction, e.From, e.FromRole, e.To, e.ToRole, e.Text, e.ProviderID, e.Status})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writeTranscriptPDF writes t to w as a PDF document
+func writeTranscriptPDF(w http.ResponseWriter, t rideTranscript, mask exportMask) error {
+	ride := t.Ride
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.Cell(0, 10, fmt.Sprintf("Ride %d transcript", ride.ID))
+	pdf.Ln(12)
+
+	pdf.SetFont("Helvetica", "", 10)
+	details := [][2]string{
+		{"From", ride.Start},
+		{"To", ride.Destination},
+		{"Date and time", ride.DateTime},
+		{"Customer", mask.name(ride.ThisCustomer.Name) + " (" + mask.number(ride.ThisCustomer.Number) + ")"},
+		{"Driver", mask.name(ride.ThisDriver.Name) + " (" + mask.number(ride.ThisDriver.Number) + ")"},
+		{"Proxy number", ride.ThisProxyNumber.Number},
+	}
+	for _, d := range details {
+		pdf.CellFormat(35, 6, d[0]+":", "", 0, "", false, 0, "")
+		pdf.CellFormat(0, 6, tr(d[1]), "", 1, "", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	if len(t.Events) == 0 {
+		pdf.Cell(0, 6, "No messages or calls were logged for this ride.")
+	}
+	for _, e := range t.Events {
+		e = e.masked(ride, mask)
+		pdf.SetFont("Helvetica", "B", 9)
+		heading := fmt.Sprintf("%s  %s %s  %s", e.Time, strings.ToUpper(e.Channel), e.Direction, transcriptParty(e.From, e.FromRole))
+		heading += " -> " + transcriptParty(e.To, e.ToRole)
+		if e.Status != "" {
+			heading += "  [" + e.Status + "]"
+		}
+		pdf.MultiCell(0, 5, tr(heading), "", "", false)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 5, tr(e.Text), "", "", false)
+		pdf.Ln(3)
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"ride-%d.pdf\"", ride.ID))
+	return pdf.Output(w)
+}
+
+// transcriptParty describes a sender or recipient, e.g. "***002 (driver)"
+func transcriptParty(number string, role string) string {
+	if role == "" {
+		return number
+	}
+	return number + " (" + role + ")"
+}
+
+// rideExportHandler serves /rides/{id}/export, a transcript of all messages
+// and calls of a ride for insurance and dispute workflows. format is "csv"
+// (the default) or "pdf"; mask takes a comma-separated list of "numbers",
+// "names" and "bodies", or "all", to leave personal data out of the export.
+func rideExportHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 || parts[0] != "rides" || parts[2] != "export" {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		t, err := loadRideTranscript(dbdata, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+
+		mask := parseExportMask(r.FormValue("mask"))
+		switch r.FormValue("format") {
+		case "", "csv":
+			err = writeTranscriptCSV(w, t, mask)
+		case "pdf":
+			err = writeTranscriptPDF(w, t, mask)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Invalid format: use csv or pdf")
+			return
+		}
+		if err != nil {
+			log.Printf("Could not export ride %d: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/sms"
+)
+
+// providerMessageBird is the provider recorded for messages MessageBird,
+// our primary provider, sent or received
+const providerMessageBird = "messagebird"
+
+// smsProvider sends texts on our behalf. MessageBird sends them unless it
+// keeps failing and a failover provider is configured, see
+// failoverSMSProvider.
+type smsProvider interface {
+	// Name is recorded with the messages the provider sends
+	Name() string
+	// Send sends body from originator to recipients, returning the ID the
+	// provider assigned to the message
+	Send(originator string, recipients []string, body string, params *sms.Params) (string, error)
+}
+
+// messageBirdProvider sends texts through a MessageBird account
+type messageBirdProvider struct {
+	name string
+	mb   *messagebird.Client
+}
+
+func (p messageBirdProvider) Name() string { return p.name }
+
+// Send implements smsProvider
+func (p messageBirdProvider) Send(originator string, recipients []string, body string, params *sms.Params) (string, error) {
+	msg, err := sms.Create(p.mb, originator, recipients, body, params)
+	if err != nil {
+		mbError(err)
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+// httpSMSProvider sends texts by posting them as JSON to an SMS gateway,
+// e.g. {"originator": "319700004", "recipients": ["319700000"], "body": "..."},
+// which answers with the message's ID, e.g. {"id": "abc123"}
+type httpSMSProvider struct {
+	name   string
+	url    string
+	token  string // Sent as a bearer token, if set
+	client *http.Client
+}
+
+func (p httpSMSProvider) Name() string { return p.name }
+
+// Send implements smsProvider. The gateway gets no MessageBird parameters.
+func (p httpSMSProvider) Send(originator string, recipients []string, body string, params *sms.Params) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"originator": originator,
+		"recipients": recipients,
+		"body":       body,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("%s responded with %s", p.url, resp.Status)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("could not read the message ID %s responded with: %v", p.url, err)
+	}
+	return result.ID, nil
+}
+
+// failoverSMSProvider is the provider texts fail over to, or nil if none is
+// configured. It is set up once by setupSMSFailover.
+var failoverSMSProvider smsProvider
+
+// setupSMSFailover configures the provider texts fail over to while
+// MessageBird keeps failing, from SMS_FAILOVER_PROVIDER:
+//
+//	messagebird   another MessageBird account, with SMS_FAILOVER_API_KEY
+//	http          an SMS gateway at SMS_FAILOVER_URL, see httpSMSProvider,
+//	              with the optional bearer token SMS_FAILOVER_TOKEN
+//
+// The failover provider sends from the same originators, so it must be
+// allowed to send from our proxy numbers. SMS_FAILOVER_NAME names it in the
+// message log; it defaults to the kind of provider.
+func setupSMSFailover() error {
+	kind := os.Getenv("SMS_FAILOVER_PROVIDER")
+	name := os.Getenv("SMS_FAILOVER_NAME")
+	if name == "" {
+		name = kind
+	}
+	switch kind {
+	case "":
+		return nil
+	case "messagebird":
+		key := os.Getenv("SMS_FAILOVER_API_KEY")
+		if key == "" {
+			return fmt.Errorf("SMS_FAILOVER_PROVIDER=messagebird needs the account's access key in SMS_FAILOVER_API_KEY")
+		}
+		// The other account has rate limits of its own
+		throttle := newAdaptiveThrottle(200*time.Millisecond, 30*time.Second)
+		failoverSMSProvider = messageBirdProvider{name: name, mb: newMessageBirdClient(key, throttle)}
+	case "http":
+		url := os.Getenv("SMS_FAILOVER_URL")
+		if url == "" {
+			return fmt.Errorf("SMS_FAILOVER_PROVIDER=http needs the gateway's URL in SMS_FAILOVER_URL")
+		}
+		failoverSMSProvider = httpSMSProvider{
+			name:   name,
+			url:    url,
+			token:  os.Getenv("SMS_FAILOVER_TOKEN"),
+			client: &http.Client{Timeout: envDuration("MESSAGEBIRD_TIMEOUT", 10*time.Second)},
+		}
+	default:
+		return fmt.Errorf("unknown SMS_FAILOVER_PROVIDER %q, use \"messagebird\" or \"http\"", kind)
+	}
+	if name == providerMessageBird || name == providerWhatsApp {
+		return fmt.Errorf("set SMS_FAILOVER_NAME to tell the failover provider's messages from MessageBird's")
+	}
+	return nil
+}
+
+// smsFailoverThreshold returns how many texts MessageBird must fail to send
+// within smsFailoverWindow before we fail over, set with SMS_FAILOVER_THRESHOLD
+func smsFailoverThreshold() int {
+	return envInt("SMS_FAILOVER_THRESHOLD", 3)
+}
+
+// smsFailoverWindow returns the period failed texts are counted over, set
+// with SMS_FAILOVER_WINDOW (e.g. "5m")
+func smsFailoverWindow() time.Duration {
+	return envDuration("SMS_FAILOVER_WINDOW", 2*time.Minute)
+}
+
+// smsFailoverCooldown returns how long texts go through the failover
+// provider before MessageBird is tried again, set with SMS_FAILOVER_COOLDOWN
+func smsFailoverCooldown() time.Duration {
+	return envDuration("SMS_FAILOVER_COOLDOWN", 10*time.Minute)
+}
+
+var (
+	// smsFailoverMu guards smsFailures and smsFailoverUntil
+	smsFailoverMu sync.Mutex
+	// smsFailures are when MessageBird failed to send a text within the
+	// failover window
+	smsFailures []time.Time
+	// smsFailoverUntil is when texts go back to MessageBird after failing over
+	smsFailoverUntil time.Time
+)
+
+// failedOver reports whether texts go through the failover provider at now
+func failedOver(now time.Time) bool {
+	smsFailoverMu.Lock()
+	defer smsFailoverMu.Unlock()
+	return now.Before(smsFailoverUntil)
+}
+
+// recordSMSFailure notes that MessageBird failed to send a text at now,
+// failing over if that makes smsFailoverThreshold failures in the window.
+// It reports whether texts now go through the failover provider.
+func recordSMSFailure(now time.Time) bool {
+	smsFailoverMu.Lock()
+	defer smsFailoverMu.Unlock()
+	since := now.Add(-smsFailoverWindow())
+	for len(smsFailures) > 0 && !smsFailures[0].After(since) {
+		smsFailures = smsFailures[1:]
+	}
+	smsFailures = append(smsFailures, now)
+	if len(smsFailures) < smsFailoverThreshold() {
+		return false
+	}
+	if !now.Before(smsFailoverUntil) {
+		log.Printf("MessageBird failed to send %d texts within %s: sending through %s for %s",
+			len(smsFailures), smsFailoverWindow(), failoverSMSProvider.Name(), smsFailoverCooldown())
+	}
+	smsFailoverUntil = now.Add(smsFailoverCooldown())
+	return true
+}
+
+// isProviderFailure reports whether err says MessageBird couldn't send a
+// text, e.g. because it couldn't be reached or had a server error, rather
+// than that it refused the text, e.g. for an invalid recipient
+func isProviderFailure(err error) bool {
+	_, refused := err.(messagebird.ErrorResponse)
+	return !refused
+}
+
+// sendThroughFailover sends a text through the failover provider, returning
+// its ID for the message log, see providerMessageID, or an empty string if
+// that failed too
+func sendThroughFailover(originator string, recipients []string, body string, params *sms.Params) string {
+	id, err := failoverSMSProvider.Send(originator, recipients, body, params)
+	if err != nil {
+		log.Printf("Could not send sms notification to %s through %s either: %v", recipients, failoverSMSProvider.Name(), err)
+		return ""
+	}
+	log.Printf("Sent sms notification to %s through %s as %s", recipients, failoverSMSProvider.Name(), id)
+	return failoverSMSProvider.Name() + ":" + id
+}
+
+// providerMessageID splits an ID mbSender returned into the provider that
+// sent the message and the ID the provider assigned to it. Failover
+// providers' IDs are prefixed with their name, e.g. "backup:abc123", and
+// WhatsApp messages' with providerWhatsApp; other IDs are MessageBird's.
+// Messages that weren't sent have no provider.
+func providerMessageID(id string) (provider string, providerID string) {
+	switch id {
+	case "", heldMessageID, suppressedMessageID:
+		return "", id
+	}
+	if prefix := providerWhatsApp + ":"; strings.HasPrefix(id, prefix) {
+		return providerWhatsApp, id[len(prefix):]
+	}
+	if failoverSMSProvider != nil {
+		if prefix := failoverSMSProvider.Name() + ":"; strings.HasPrefix(id, prefix) {
+			return failoverSMSProvider.Name(), id[len(prefix):]
+		}
+	}
+	return providerMessageBird, id
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// flashCallParam is the query parameter of the voice webhook URL that marks
+// a call flow fetched again by a caller who stayed on the line
+const flashCallParam = "flash"
+
+// flashCallGrace is how long after the window we wait for MessageBird to
+// fetch the call flow again before treating the call as a flash call
+const flashCallGrace = 10 * time.Second
+
+// flashCallWindow returns how soon customers hang up on calls to their
+// proxy number for us to text them the ride status instead of connecting
+// the call, set with FLASH_CALL_WINDOW, e.g. 5s. It is off by default.
+func flashCallWindow() time.Duration {
+	return envDuration("FLASH_CALL_WINDOW", 0)
+}
+
+// flashCallRegistry tracks calls waiting to see whether the caller hangs up.
+// Like probes, it lives in memory: with several instances, the webhook has
+// to reach the one that answered the call first.
+type flashCallRegistry struct {
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// flashCalls holds the calls within their flash call window
+var flashCalls = flashCallRegistry{pending: make(map[string]*time.Timer)}
+
+// start calls hungUp after wait, unless the call with callID is held first
+func (f *flashCallRegistry) start(callID string, wait time.Duration, hungUp func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.pending[callID]; ok {
+		t.Stop()
+	}
+	f.pending[callID] = time.AfterFunc(wait, func() {
+		f.mu.Lock()
+		_, ok := f.pending[callID]
+		delete(f.pending, callID)
+		f.mu.Unlock()
+		if ok {
+			hungUp()
+		}
+	})
+}
+
+// held marks the caller of callID as having stayed on the line, reporting
+// whether the call was still waiting
+func (f *flashCallRegistry) held(callID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.pending[callID]
+	if ok {
+		t.Stop()
+		delete(f.pending, callID)
+	}
+	return ok
+}
+
+// startFlashCall answers call, from the customer of ride, with a pause as
+// long as the flash call window before fetching its call flow again to
+// connect it. If the customer hangs up before that they are texted the
+// ride status. It reports whether it answered the call.
+func startFlashCall(dbdata *RideSharingDB, w http.ResponseWriter, r *http.Request, mb *messagebird.Client, ride RideType, call InboundCall) bool {
+	if r.URL.Query().Get(flashCallParam) != "" {
+		if flashCalls.held(call.CallID) {
+			log.Printf("Call %s from %s stayed on the line, connecting it", call.CallID, call.Source)
+		}
+		return false
+	}
+	window := flashCallWindow()
+	if window <= 0 || call.CallID == "" {
+		return false
+	}
+	customer := ride.contactNumber(roleCustomer)
+	flashCalls.start(call.CallID, window+flashCallGrace, func() {
+		log.Printf("Call %s from %s hung up within %s, texting them the status of ride %d", call.CallID, call.Source, window, ride.ID)
+		sendRideMessage(dbdata.store, mb, ride.ID, ride.ThisProxyNumber.notificationOriginator(), customer, rideStatusReply(dbdata.store, ride, roleCustomer), nil, "")
+	})
+	fmt.Fprint(w, flashCallXML(window, webhookURL(r, voiceWebhookPath(dbdata.webhookToken))+"?"+url.Values{flashCallParam: {"held"}}.Encode()))
+	return true
+}
+
+// flashCallXML returns a call flow waiting for length before fetching the
+// call flow again from fetchURL
+func flashCallXML(length time.Duration, fetchURL string) string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		fmt.Sprintf("<Pause length='%ds' />", int((length+time.Second-1)/time.Second)) +
+		fmt.Sprintf("<FetchCallFlow url='%s' />", html.EscapeString(fetchURL)) +
+		"</CallFlow>"
+}
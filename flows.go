@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/voice"
+)
+
+// callFlowPrefix starts the titles of the call flows the flows command
+// manages, so it leaves the account's other flows alone
+const callFlowPrefix = "BirdCar "
+
+// voiceCallFlowTitle is the title of the call flow that fetches the flow of
+// every call from our voice webhook
+const voiceCallFlowTitle = callFlowPrefix + "voice webhook"
+
+// publicURL returns the URL MessageBird reaches the application at, e.g.
+// "https://birdcar.example.com", set with -public-url or PUBLIC_URL.
+// BASE_PATH is added to it.
+func publicURL() string {
+	return strings.TrimRight(strings.TrimSpace(appConfig.PublicURL), "/")
+}
+
+// wantedCallFlows returns the call flows the account should have for the
+// application served at base with the webhook token token: one fetching
+// each call's flow from our voice webhook, which routes it
+func wantedCallFlows(base string, token string) []voice.CallFlow {
+	return []voice.CallFlow{{
+		Title: voiceCallFlowTitle,
+		Steps: []voice.CallFlowStep{&voice.CallFlowFetchStep{URL: base + appPath(voiceWebhookPath(token))}},
+	}}
+}
+
+// sameCallFlow reports whether the steps of have do what those of want do,
+// ignoring the IDs MessageBird gives them
+func sameCallFlow(have voice.CallFlow, want voice.CallFlow) bool {
+	if have.Record != want.Record || len(have.Steps) != len(want.Steps) {
+		return false
+	}
+	for i, step := range want.Steps {
+		fetch, ok := step.(*voice.CallFlowFetchStep)
+		if !ok {
+			return false
+		}
+		got, ok := have.Steps[i].(*voice.CallFlowFetchStep)
+		if !ok || got.URL != fetch.URL {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCallFlows returns the call flows of the account whose titles start
+// with callFlowPrefix
+func loadCallFlows(mb *messagebird.Client) ([]voice.CallFlow, error) {
+	var flows []voice.CallFlow
+	pages := voice.CallFlows(mb)
+	for {
+		page, err := pages.NextPage()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for _, v := range page.([]voice.CallFlow) {
+			if strings.HasPrefix(v.Title, callFlowPrefix) {
+				flows = append(flows, v)
+			}
+		}
+		if err == io.EOF {
+			return flows, nil
+		}
+	}
+}
+
+// callFlowChange is what flows sync does to one call flow
+type callFlowChange struct {
+	Action string // "create", "update", "delete", or "keep" and "unused" for none
+	Have   voice.CallFlow
+	Want   voice.CallFlow
+}
+
+// planCallFlows returns the changes that turn the managed flows have into
+// want. Flows with the same title are updated in place. Managed flows that
+// aren't wanted any more are deleted if prune is set, or else left unused.
+func planCallFlows(have []voice.CallFlow, want []voice.CallFlow, prune bool) []callFlowChange {
+	var changes []callFlowChange
+	matched := make(map[string]bool)
+	for _, w := range want {
+		change := callFlowChange{Action: "create", Want: w}
+		for _, h := range have {
+			if h.Title != w.Title || matched[h.ID] {
+				continue
+			}
+			matched[h.ID] = true
+			change.Have = h
+			change.Want.ID = h.ID
+			change.Action = "update"
+			if sameCallFlow(h, w) {
+				change.Action = "keep"
+			}
+			break
+		}
+		changes = append(changes, change)
+	}
+	for _, h := range have {
+		if matched[h.ID] {
+			continue
+		}
+		action := "unused"
+		if prune {
+			action = "delete"
+		}
+		changes = append(changes, callFlowChange{Action: action, Have: h})
+	}
+	return changes
+}
+
+// pending reports whether change needs to be made in the account
+func (change callFlowChange) pending() bool {
+	return change.Action != "keep" && change.Action != "unused"
+}
+
+// apply makes change in the account. Created flows get their new ID.
+func (change *callFlowChange) apply(mb *messagebird.Client) error {
+	switch change.Action {
+	case "create":
+		return change.Want.Create(mb)
+	case "update":
+		return change.Want.Update(mb)
+	case "delete":
+		return change.Have.Delete(mb)
+	}
+	return nil
+}
+
+// flow returns the call flow change is about
+func (change callFlowChange) flow() voice.CallFlow {
+	if change.Want.Title == "" {
+		return change.Have
+	}
+	return change.Want
+}
+
+// String describes change, e.g. `update "BirdCar voice webhook" (abc123) -> https://...`
+func (change callFlowChange) String() string {
+	flow := change.flow()
+	s := fmt.Sprintf("%-6s %q", change.Action, flow.Title)
+	if flow.ID != "" {
+		s += " (" + flow.ID + ")"
+	}
+	if fetch, ok := callFlowURL(flow); ok {
+		s += " -> " + fetch
+	}
+	return s
+}
+
+// callFlowURL returns the URL flow fetches its steps from, if it does
+func callFlowURL(flow voice.CallFlow) (string, bool) {
+	for _, step := range flow.Steps {
+		if fetch, ok := step.(*voice.CallFlowFetchStep); ok {
+			return fetch.URL, true
+		}
+	}
+	return "", false
+}
+
+// runFlows implements the flows command, which manages the call flows that
+// send MessageBird's calls to our voice webhook, so deployments don't have
+// to set them up by hand. "flows status" shows what "flows sync" would
+// change; "flows sync" creates and updates them to point at PUBLIC_URL, and
+// with -prune deletes managed flows that are no longer wanted. It returns
+// the exit status.
+func runFlows(args []string) int {
+	command := "status"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("flows "+command, flag.ExitOnError)
+	base := flags.String("url", publicURL(), "public URL of the application (default: PUBLIC_URL)")
+	prune := flags.Bool("prune", false, "delete call flows titled \""+callFlowPrefix+"...\" that are no longer wanted")
+	flags.Parse(args)
+	if command != "status" && command != "sync" {
+		fmt.Printf("Unknown flows command %q: use status or sync\n", command)
+		return 1
+	}
+	if *base == "" || !strings.HasPrefix(*base, "https://") && !strings.HasPrefix(*base, "http://") {
+		fmt.Println("Set PUBLIC_URL or -url to the http(s) URL MessageBird reaches the application at")
+		return 1
+	}
+	key := appConfig.MessageBirdKey
+	if key == "" {
+		fmt.Println("Set MESSAGEBIRD_API_KEY to manage the account's call flows")
+		return 1
+	}
+	mb := newMessageBirdClient(key, newAdaptiveThrottle(200*time.Millisecond, 30*time.Second))
+
+	// The webhook token is kept in the database unless WEBHOOK_TOKEN is set
+	if err := openDB(databaseURL()); err != nil {
+		fmt.Println("Could not open the database:", err)
+		return 1
+	}
+	defer closeDB()
+	if err := migrateDB(appStore); err != nil {
+		fmt.Println("Could not migrate the database:", err)
+		return 1
+	}
+	token, err := setupWebhookToken(appStore)
+	if err != nil {
+		fmt.Println("Could not set up the webhook token:", err)
+		return 1
+	}
+
+	have, err := loadCallFlows(mb)
+	if err != nil {
+		fmt.Println("Could not list call flows:", err)
+		return 1
+	}
+	changes := planCallFlows(have, wantedCallFlows(strings.TrimRight(*base, "/"), token), *prune)
+	pending := 0
+	for _, change := range changes {
+		if change.pending() {
+			pending++
+			if command == "sync" {
+				if err := change.apply(mb); err != nil {
+					fmt.Printf("Could not %s call flow %q: %v\n", change.Action, change.flow().Title, err)
+					return 1
+				}
+			}
+		}
+		fmt.Println(change)
+	}
+
+	switch {
+	case pending == 0:
+		fmt.Println("The call flows are up to date.")
+	case command == "status":
+		fmt.Printf("%d call flows need changes: run flows sync to make them.\n", pending)
+		return 1
+	default:
+		fmt.Printf("Changed %d call flows. Assign the %q flow to the proxy numbers in the MessageBird dashboard if they don't use it yet.\n", pending, voiceCallFlowTitle)
+	}
+	return 0
+}
@@ -3,6 +3,11 @@ module github.com/messagebirdguides/masked-numbers-guide-go
 go 1.14
 
 require (
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/jackc/pgconn v1.14.3
+	github.com/jackc/pgx/v4 v4.18.3
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/messagebird/go-rest-api v5.3.0+incompatible
+	golang.org/x/crypto v0.20.0
 )
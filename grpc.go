@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// grpcService is the gRPC service defined in proto/rides.proto
+const grpcService = "/birdcar.rides.v1.RideService/"
+
+// gRPC status codes we answer with, see
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is why a gRPC call failed, with the status code to answer with
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (e grpcError) Error() string {
+	return e.Message
+}
+
+// grpcErrorf returns a grpcError with code and the formatted message
+func grpcErrorf(code int, format string, args ...interface{}) grpcError {
+	return grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcAddr returns the address the gRPC server listens on, from GRPC_ADDR
+// (e.g. ":9090"). The gRPC server is off if it isn't set.
+func grpcAddr() string {
+	return os.Getenv("GRPC_ADDR")
+}
+
+// serveGRPC serves the ride service on grpcAddr beside the HTTP server. gRPC
+// needs HTTP/2, which net/http only speaks over TLS, so it is served with
+// the certificate and key in the files GRPC_TLS_CERT and GRPC_TLS_KEY.
+// Shutting srv down makes it return http.ErrServerClosed.
+func serveGRPC(srv *http.Server) error {
+	cert, key := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY")
+	if cert == "" || key == "" {
+		return fmt.Errorf("GRPC_ADDR needs a TLS certificate and key in GRPC_TLS_CERT and GRPC_TLS_KEY")
+	}
+	return srv.ListenAndServeTLS(cert, key)
+}
+
+// newGRPCServer returns the server of the ride service, see serveGRPC
+func newGRPCServer(dbdata *RideSharingDB, mb *messagebird.Client) *http.Server {
+	return &http.Server{Addr: grpcAddr(), Handler: grpcHandler(dbdata, mb)}
+}
+
+// grpcMethod handles a call to a method of the ride service, decoding its
+// request and encoding its response
+type grpcMethod func(dbdata *RideSharingDB, mb *messagebird.Client, req []protoField) (protoMessage, error)
+
+// grpcMethods are the methods of the ride service by name
+var grpcMethods = map[string]grpcMethod{
+	"CreateRide":  grpcCreateRide,
+	"EndRide":     grpcEndRide,
+	"ListRides":   grpcListRides,
+	"AssignProxy": grpcAssignProxy,
+}
+
+// grpcHandler serves unary calls to the ride service for internal dispatch
+// systems. They share the business logic of the dashboard and the JSON API,
+// and authenticate as an admin with basic auth, like the API. Unlike the
+// create ride form, booking isn't rate limited: dispatch systems book rides
+// for many riders from one address.
+func grpcHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+
+		if len(adminAccounts()) == 0 && !usersExist(dbdata.store) {
+			writeGRPCStatus(w, grpcPermissionDenied, "The ride service is disabled. Set ADMIN_PASSWORD or add a user with the users command to enable it.")
+			return
+		}
+		if !adminAuthenticated(dbdata.store, r) {
+			writeGRPCStatus(w, grpcUnauthenticated, "Unauthorized")
+			return
+		}
+		method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcService)]
+		if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+			writeGRPCStatus(w, grpcUnimplemented, fmt.Sprintf("Unknown method %s", r.URL.Path))
+			return
+		}
+		req, err := readGRPCRequest(r)
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			writeGRPCStatus(w, grpcInternal, fmt.Sprintf("Server encountered an error: %v", err))
+			return
+		}
+		resp, err := method(dbdata, mb, req)
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+
+		frame := make([]byte, 5, 5+len(resp))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(frame, resp...))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcOK))
+	}
+}
+
+// readGRPCRequest reads the request message of a unary call from the body
+// of r, which is framed as a compressed flag, its length and the message
+func readGRPCRequest(r *http.Request) ([]protoField, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 5+maxAPIBody))
+	if err != nil {
+		return nil, grpcErrorf(grpcResourceExhausted, "Could not read the request: %v", err)
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return nil, grpcErrorf(grpcInvalidArgument, "Expected a single request message")
+	}
+	if body[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "Compressed messages aren't supported")
+	}
+	fields, err := parseProto(body[5:])
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "Invalid request message: %v", err)
+	}
+	return fields, nil
+}
+
+// writeGRPCStatus ends a call that failed with code and message, sending
+// them in the headers since there is no response message
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	// Percent-encoded, spaces included, like gRPC's own implementations do
+	w.Header().Set("Grpc-Message", strings.Replace(url.QueryEscape(message), "+", "%20", -1))
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeGRPCError ends a call that failed with err, a grpcError or an
+// internal error
+func writeGRPCError(w http.ResponseWriter, err error) {
+	e, ok := err.(grpcError)
+	if !ok {
+		log.Println(err)
+		e = grpcErrorf(grpcInternal, "Server encountered an error: %v", err)
+	}
+	writeGRPCStatus(w, e.Code, e.Message)
+}
+
+// grpcCodeForStatus returns the gRPC status code for an HTTP status the
+// business logic shared with the dashboard failed with, e.g. a
+// bookingError's
+func grpcCodeForStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusInternalServerError:
+		return grpcInternal
+	}
+	return grpcUnknown
+}
+
+// grpcRideStatus returns the RideStatus enum value of status. The enum lists
+// the statuses in lifecycle order, like rideStatuses.
+func grpcRideStatus(status RideStatus) int {
+	for i, v := range rideStatuses {
+		if v == status {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// encodeGRPCRide encodes ride as a Ride message
+func encodeGRPCRide(ride RideType) protoMessage {
+	v := newAPIRide(ride)
+	var m protoMessage
+	m.int(1, v.ID)
+	m.string(2, v.Start)
+	m.string(3, v.Destination)
+	m.string(4, v.DateTime)
+	m.int(5, grpcRideStatus(v.Status))
+	for i, p := range []assignmentPerson{v.Customer, v.Driver} {
+		var person protoMessage
+		person.int(1, p.ID)
+		person.string(2, p.Name)
+		person.string(3, p.Number)
+		m.bytes(6+i, person)
+	}
+	if v.ProxyNumber != nil {
+		var proxy protoMessage
+		proxy.int(1, v.ProxyNumber.ID)
+		proxy.string(2, v.ProxyNumber.Number)
+		proxy.string(3, v.ProxyNumber.Status)
+		proxy.strings(4, v.ProxyNumber.Tags)
+		proxy.strings(5, v.ProxyNumber.Features)
+		m.bytes(8, proxy)
+	}
+	m.strings(9, v.RequiredTags)
+	m.strings(10, v.Labels)
+	m.int(11, v.Texts)
+	m.int(12, v.Calls)
+	m.string(13, v.LastActivity)
+	return m
+}
+
+// grpcOpenRide returns the ride with the ID in field, which must not have
+// ended
+func grpcOpenRide(dbdata *RideSharingDB, field protoField) (RideType, error) {
+	id, err := field.int()
+	if err != nil {
+		return RideType{}, grpcErrorf(grpcInvalidArgument, "Invalid ride_id: %v", err)
+	}
+	ride, ok := dbdata.Rides[id]
+	if !ok {
+		return RideType{}, grpcErrorf(grpcNotFound, "Unknown ride %d", id)
+	}
+	if ride.Status.Terminal() {
+		return RideType{}, grpcErrorf(grpcFailedPrecondition, "Ride %d is %s", id, ride.Status)
+	}
+	return ride, nil
+}
+
+// grpcField returns the last occurrence of field number num in fields, or
+// the field's default value if it isn't there, like proto3 decoders do
+func grpcField(fields []protoField, num int) protoField {
+	f := protoField{Num: num, Wire: wireAbsent}
+	for _, v := range fields {
+		if v.Num == num {
+			f = v
+		}
+	}
+	return f
+}
+
+// grpcCreateRide books a ride, see bookRide
+func grpcCreateRide(dbdata *RideSharingDB, mb *messagebird.Client, fields []protoField) (protoMessage, error) {
+	var req rideRequest
+	noTags := false
+	var tags, labels []string
+	for _, f := range fields {
+		var err error
+		var s string
+		switch f.Num {
+		case 1:
+			req.CustomerID, err = f.int()
+		case 2:
+			req.DriverID, err = f.int()
+		case 3:
+			req.Start, err = f.string()
+		case 4:
+			req.Destination, err = f.string()
+		case 5:
+			req.DateTime, err = f.string()
+		case 6:
+			req.Proxy, err = f.string()
+		case 7:
+			s, err = f.string()
+			tags = append(tags, s)
+		case 8:
+			noTags, err = f.bool()
+		case 9:
+			s, err = f.string()
+			labels = append(labels, s)
+		}
+		if err != nil {
+			return nil, grpcErrorf(grpcInvalidArgument, "Invalid ride: %v", err)
+		}
+	}
+	if noTags || len(tags) > 0 {
+		req.Tags = append([]string{}, parseTags(strings.Join(tags, ","))...)
+	}
+	req.Labels = parseTags(strings.Join(labels, ","))
+
+	booking, err := bookRide(dbdata, mb, req)
+	if e, ok := err.(bookingError); ok {
+		return nil, grpcError{grpcCodeForStatus(e.Status), e.Message}
+	} else if err != nil {
+		return nil, err
+	}
+	var m protoMessage
+	m.bytes(1, encodeGRPCRide(booking.Ride))
+	m.bool(2, booking.Waiting)
+	m.string(3, booking.Warning)
+	return m, nil
+}
+
+// grpcEndRide completes or cancels a ride, see endRide
+func grpcEndRide(dbdata *RideSharingDB, mb *messagebird.Client, fields []protoField) (protoMessage, error) {
+	outcome, err := grpcField(fields, 2).int()
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "Invalid outcome: %v", err)
+	}
+	next, ok := map[int]RideStatus{1: rideCompleted, 2: rideCancelled}[outcome]
+	if !ok {
+		return nil, grpcErrorf(grpcInvalidArgument, "Choose the outcome: completed or cancelled")
+	}
+	ride, err := grpcOpenRide(dbdata, grpcField(fields, 1))
+	if err != nil {
+		return nil, err
+	}
+	if err := endRide(dbdata.store, mb, ride, next); err != nil {
+		log.Println(err)
+		return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+	}
+	ride.Status = next
+	return encodeGRPCRide(ride), nil
+}
+
+// grpcListRides lists the rides, optionally filtered by status and label
+func grpcListRides(dbdata *RideSharingDB, mb *messagebird.Client, fields []protoField) (protoMessage, error) {
+	status, err := grpcField(fields, 1).int()
+	if err != nil || status < 0 || status > len(rideStatuses) {
+		return nil, grpcErrorf(grpcInvalidArgument, "Invalid status")
+	}
+	label, err := grpcField(fields, 2).string()
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "Invalid label: %v", err)
+	}
+	values := url.Values{"label": {label}}
+	if status > 0 {
+		values.Set("status", string(rideStatuses[status-1]))
+	}
+	filter := parseRideFilter(values)
+
+	var rides []RideType
+	for _, ride := range dbdata.Rides {
+		if filter.matches(ride) {
+			rides = append(rides, ride)
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool { return rides[i].ID < rides[j].ID })
+	var m protoMessage
+	for _, ride := range rides {
+		m.bytes(1, encodeGRPCRide(ride))
+	}
+	return m, nil
+}
+
+// grpcAssignProxy hands a ride off to the proxy number with the requested
+// ID, or to any suitable free one, see handOffRide
+func grpcAssignProxy(dbdata *RideSharingDB, mb *messagebird.Client, fields []protoField) (protoMessage, error) {
+	ride, err := grpcOpenRide(dbdata, grpcField(fields, 1))
+	if err != nil {
+		return nil, err
+	}
+	proxyID, err := grpcField(fields, 2).int()
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "Invalid proxy_id: %v", err)
+	}
+	if proxyID == 0 {
+		err = handOffRide(dbdata, mb, ride)
+		if _, ok := err.(noProxyError); ok {
+			return nil, grpcErrorf(grpcResourceExhausted, "%v", err)
+		}
+	} else {
+		if _, ok := dbdata.ProxyNumbers[proxyID]; !ok {
+			return nil, grpcErrorf(grpcNotFound, "Unknown proxy number %d", proxyID)
+		}
+		if proxyID == ride.ThisProxyNumber.ID {
+			return nil, grpcErrorf(grpcFailedPrecondition, "Ride %d already uses proxy number %s", ride.ID, ride.ThisProxyNumber.Number)
+		}
+		proxy, err := selectProxyNumber(dbdata, ride.ThisCustomer.ID, ride.ThisDriver.ID, fmt.Sprintf("id:%d", proxyID), ride.RequiredTags)
+		if err != nil {
+			return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+		}
+		err = handOffRideTo(dbdata.store, mb, ride, proxy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if dbdata, err = dbdata.loadDB(); err != nil {
+		return nil, err
+	}
+	return encodeGRPCRide(dbdata.Rides[ride.ID]), nil
+}
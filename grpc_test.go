@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// grpcFrame frames msg as the message of a unary call
+func grpcFrame(compressed byte, msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	frame[0] = compressed
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestReadGRPCRequest(t *testing.T) {
+	var msg protoMessage
+	msg.int(1, 3)
+	msg.string(2, "airport")
+	tests := []struct {
+		name string
+		body []byte
+		code int // grpcOK if the request is read
+	}{
+		{"message", grpcFrame(0, msg), grpcOK},
+		{"empty message", grpcFrame(0, nil), grpcOK},
+		{"no frame", nil, grpcInvalidArgument},
+		{"short header", []byte{0, 0, 0}, grpcInvalidArgument},
+		{"length past the end", grpcFrame(0, msg)[:len(msg)+4], grpcInvalidArgument},
+		{"two messages", append(grpcFrame(0, msg), grpcFrame(0, msg)...), grpcInvalidArgument},
+		{"compressed", grpcFrame(1, msg), grpcUnimplemented},
+		{"malformed message", grpcFrame(0, []byte{0x08}), grpcInvalidArgument},
+		{"too large", grpcFrame(0, make([]byte, maxAPIBody+1)), grpcResourceExhausted},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", grpcService+"ListRides", bytes.NewReader(test.body))
+		fields, err := readGRPCRequest(r)
+		if test.code == grpcOK {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		e, ok := err.(grpcError)
+		if !ok || e.Code != test.code {
+			t.Errorf("%s: read %+v, %v, want status %d", test.name, fields, err, test.code)
+		}
+	}
+
+	r := httptest.NewRequest("POST", grpcService+"ListRides", bytes.NewReader(grpcFrame(0, msg)))
+	fields, err := readGRPCRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := grpcField(fields, 1).int(); n != 3 {
+		t.Errorf("field 1 = %d, want 3", n)
+	}
+	if s, _ := grpcField(fields, 2).string(); s != "airport" {
+		t.Errorf("field 2 = %q, want %q", s, "airport")
+	}
+}
+
+func TestGRPCCallRoundTrip(t *testing.T) {
+	openTestDB(t, "memory")
+	setenv(t, "ADMIN_PASSWORD", "s3cret")
+
+	dbdata := newRideSharingDB(appStore)
+	snapshot, err := dbdata.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ride := RideType{
+		Start:           "Amsterdam Centraal",
+		Destination:     "Schiphol Airport",
+		DateTime:        "2030-01-02T10:00",
+		ThisCustomer:    snapshot.Customers[1],
+		ThisDriver:      snapshot.Drivers[1],
+		ThisProxyNumber: snapshot.ProxyNumbers[1],
+		Status:          rideScheduled,
+	}
+	if ride.ID, err = appStore.InsertRide(ride); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(grpcHandler(dbdata, messagebird.New("test")))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// call calls method with req, returning the response message and status
+	call := func(method string, password string, req protoMessage) ([]byte, string) {
+		t.Helper()
+		r, err := http.NewRequest("POST", server.URL+grpcService+method, bytes.NewReader(grpcFrame(0, req)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/grpc")
+		r.SetBasicAuth("admin", password)
+		resp, err := server.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("%s answered over HTTP/%d", method, resp.ProtoMajor)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := resp.Header.Get("Grpc-Status")
+		if status == "" {
+			status = resp.Trailer.Get("Grpc-Status")
+		}
+		if len(body) == 0 {
+			return nil, status
+		}
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Fatalf("%s answered % x, want a single framed message", method, body)
+		}
+		return body[5:], status
+	}
+
+	if msg, status := call("ListRides", "wrong", nil); status != "16" || msg != nil {
+		t.Errorf("wrong password: status %s with % x, want 16 (unauthenticated)", status, msg)
+	}
+	if _, status := call("BookEverything", "s3cret", nil); status != "12" {
+		t.Errorf("unknown method: status %s, want 12 (unimplemented)", status)
+	}
+
+	var req protoMessage
+	req.int(1, grpcRideStatus(rideScheduled))
+	msg, status := call("ListRides", "s3cret", req)
+	if status != "0" {
+		t.Fatalf("ListRides: status %s, want 0", status)
+	}
+	fields, err := parseProto(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rides [][]protoField
+	for _, f := range fields {
+		if f.Num != 1 {
+			continue
+		}
+		r, err := parseProto(f.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rides = append(rides, r)
+	}
+	if len(rides) != 1 {
+		t.Fatalf("ListRides answered %d rides, want 1", len(rides))
+	}
+	got := rides[0]
+	if id, _ := grpcField(got, 1).int(); id != ride.ID {
+		t.Errorf("ride ID %d, want %d", id, ride.ID)
+	}
+	if s, _ := grpcField(got, 3).string(); s != ride.Destination {
+		t.Errorf("destination %q, want %q", s, ride.Destination)
+	}
+	if n, _ := grpcField(got, 5).int(); n != grpcRideStatus(rideScheduled) {
+		t.Errorf("status %d, want %d", n, grpcRideStatus(rideScheduled))
+	}
+	customer, err := parseProto(grpcField(got, 6).Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := grpcField(customer, 2).string(); s != ride.ThisCustomer.Name {
+		t.Errorf("customer %q, want %q", s, ride.ThisCustomer.Name)
+	}
+	proxy, err := parseProto(grpcField(got, 8).Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := grpcField(proxy, 2).string(); s != ride.ThisProxyNumber.Number {
+		t.Errorf("proxy number %q, want %q", s, ride.ThisProxyNumber.Number)
+	}
+}
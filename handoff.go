@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// portStatusQuarantined marks a proxy number taken out of service, e.g. because
+// it was flagged as spam. It isn't assigned to rides until it is reinstated.
+const portStatusQuarantined = "quarantined"
+
+// ProxyHandoff records that a ride moved off a quarantined proxy number.
+// Texts and calls its participants still send to the old number are bridged
+// to the ride until the handoff expires.
+type ProxyHandoff struct {
+	RideID    int
+	OldProxy  ProxyNumberType
+	ExpiresAt string // RFC 3339
+}
+
+// handoffGrace returns how long texts and calls to the old proxy number of a
+// ride are still bridged after the ride moves to a new one. Set HANDOFF_GRACE
+// (e.g. "2h") to override the default of 24 hours.
+func handoffGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("HANDOFF_GRACE")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// handoffStore is the part of RideStore that hands rides off to new proxy
+// numbers
+type handoffStore interface {
+	// HandOffRide moves ride to proxy like MoveRide, bridging its old number
+	// from now until expires
+	HandOffRide(ride RideType, proxy ProxyNumberType, now time.Time, expires time.Time) error
+}
+
+// HandOffRide implements handoffStore
+func (s *sqlStore) HandOffRide(ride RideType, proxy ProxyNumberType, now time.Time, expires time.Time) error {
+	handoff := statement(sqlQuery{
+		SQLite:   "INSERT INTO proxy_handoffs (ride_id, old_number_id, new_number_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO proxy_handoffs (ride_id, old_number_id, new_number_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+	}, ride.ID, ride.ThisProxyNumber.ID, proxy.ID, now.UTC().Format(time.RFC3339), expires.UTC().Format(time.RFC3339))
+	// The old number is bridged until the handoff expires, and cools down
+	// after that in case it is reinstated
+	return s.moveRide(ride, proxy, expires, handoff)
+}
+
+// loadHandoffs returns the handoffs that hadn't expired at now
+func (s *sqlStore) loadHandoffs(proxyNumbers map[int]ProxyNumberType, now time.Time) ([]ProxyHandoff, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT ride_id, old_number_id, expires_at FROM proxy_handoffs WHERE expires_at > ? ORDER BY id",
+		Postgres: "SELECT ride_id, old_number_id, expires_at FROM proxy_handoffs WHERE expires_at > $1 ORDER BY id",
+	}, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var handoffs []ProxyHandoff
+	for rows.Next() {
+		var v ProxyHandoff
+		if err := rows.Scan(&v.RideID, &v.OldProxy.ID, &v.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if proxy, ok := proxyNumbers[v.OldProxy.ID]; ok {
+			v.OldProxy = proxy
+		}
+		handoffs = append(handoffs, v)
+	}
+	return handoffs, rows.Err()
+}
+
+// findHandoffParticipant finds the ride that moved off proxyNumber within the
+// grace period that number belongs to, returning the ride, which uses its new
+// proxy number, and the role of the participant number belongs to
+func findHandoffParticipant(dbdata *RideSharingDB, proxyNumber string, number string) (RideType, string, bool) {
+	for i := len(dbdata.Handoffs) - 1; i >= 0; i-- {
+		v := dbdata.Handoffs[i]
+		ride, ok := dbdata.Rides[v.RideID]
+		if v.OldProxy.Number != proxyNumber || !ok || ride.Status.Terminal() {
+			continue
+		}
+		switch {
+		case ride.ThisCustomer.hasNumber(number):
+			return ride, roleCustomer, true
+		case ride.ThisDriver.hasNumber(number):
+			return ride, roleDriver, true
+		}
+	}
+	return RideType{}, "", false
+}
+
+// ridesInProgress returns the rides on proxy that haven't ended by now,
+// including upcoming ones. Rides with datetimes we can't parse are included
+// unless they are over.
+func ridesInProgress(dbdata *RideSharingDB, proxy ProxyNumberType, now time.Time) []RideType {
+	var rides []RideType
+	for _, v := range dbdata.Rides {
+		if v.ThisProxyNumber.ID != proxy.ID || v.Status.Terminal() {
+			continue
+		}
+		start, err := parseRideTime(v.DateTime)
+		if err == nil && !start.Add(rideDuration()+rideEndGrace()).After(now) {
+			continue
+		}
+		rides = append(rides, v)
+	}
+	return rides
+}
+
+// quarantineProxy takes proxy out of service and hands every ride still
+// using it off to a new proxy number, telling both participants the number
+// to use from now on. It returns how many rides were moved, and the errors
+// of those that couldn't be.
+func quarantineProxy(dbdata *RideSharingDB, mb *messagebird.Client, proxy ProxyNumberType) (int, []error) {
+	err := dbdata.store.SetPortStatus(proxy.ID, portStatusQuarantined)
+	if err != nil {
+		return 0, []error{err}
+	}
+	log.Printf("Proxy number %s quarantined", proxy.Number)
+	if dbdata, err = dbdata.loadDB(); err != nil {
+		return 0, []error{err}
+	}
+
+	moved := 0
+	var errs []error
+	for _, ride := range ridesInProgress(dbdata, proxy, time.Now()) {
+		if err := handOffRide(dbdata, mb, ride); err != nil {
+			errs = append(errs, fmt.Errorf("ride %d: %v", ride.ID, err))
+			continue
+		}
+		moved++
+		// The next ride must see the number this one took
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			return moved, append(errs, err)
+		}
+	}
+	if err := dbdata.store.SyncReservations(); err != nil {
+		errs = append(errs, err)
+	}
+	return moved, errs
+}
+
+// handOffRide moves ride to a new proxy number, bridging its old number for
+// handoffGrace, and notifies both participants from the new number
+func handOffRide(dbdata *RideSharingDB, mb *messagebird.Client, ride RideType) error {
+	proxy, err := getAvailableProxyNumber(dbdata, ride.ThisCustomer.ID, ride.ThisDriver.ID, ride.RequiredTags)
+	if err != nil {
+		alertIfPoolExhausted(dbdata.store, mb, err, fmt.Sprintf("moving ride %d off proxy number %s", ride.ID, ride.ThisProxyNumber.Number), ride)
+		return err
+	}
+	return handOffRideTo(dbdata.store, mb, ride, proxy)
+}
+
+// handOffRideTo moves ride to proxy, which must be available to its
+// participants, like handOffRide
+func handOffRideTo(store RideStore, mb *messagebird.Client, ride RideType, proxy ProxyNumberType) error {
+	now := time.Now().UTC()
+	expires := now.Add(handoffGrace())
+	if err := store.HandOffRide(ride, proxy, now, expires); err != nil {
+		return err
+	}
+	log.Printf("Ride %d handed off from proxy number %s to %s", ride.ID, ride.ThisProxyNumber.Number, proxy.Number)
+
+	ride.ThisProxyNumber = proxy
+	for _, role := range []string{roleCustomer, roleDriver} {
+		body := renderNotification(store, templateProxyChanged, newNotificationData(store, ride, role))
+		sendRideMessage(store, mb, ride.ID, proxy.notificationOriginator(), ride.contactNumber(role), body, nil, "")
+	}
+	return nil
+}
+
+// quarantineHandler quarantines a proxy number, handing its rides off to
+// other numbers, or reinstates a quarantined one
+func quarantineHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		message := ""
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				return
+			}
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			proxy, ok := dbdata.ProxyNumbers[id]
+			if !ok {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Unknown proxy number %q", r.FormValue("id")))
+				return
+			}
+			switch r.FormValue("action") {
+			case "quarantine":
+				if proxy.PortStatus != portStatusActive && proxy.PortStatus != portStatusMissing {
+					message = fmt.Sprintf("Proxy number %s is %s, only active and missing numbers can be quarantined.", proxy.Number, proxy.PortStatus)
+					break
+				}
+				moved, errs := quarantineProxy(dbdata, mb, proxy)
+				message = fmt.Sprintf("Proxy number %s quarantined, %d rides moved to other numbers.", proxy.Number, moved)
+				for _, err := range errs {
+					log.Println(err)
+					message += fmt.Sprintf(" Could not move %v.", err)
+				}
+			case "reinstate":
+				if proxy.PortStatus != portStatusQuarantined {
+					message = fmt.Sprintf("Proxy number %s is not quarantined.", proxy.Number)
+					break
+				}
+				err := dbdata.store.SetPortStatus(proxy.ID, portStatusActive)
+				if err != nil {
+					log.Println(err)
+					message = fmt.Sprint(err)
+					break
+				}
+				log.Printf("Proxy number %s reinstated", proxy.Number)
+			}
+		}
+
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderLanding(w, r, dbdata, message)
+	}
+}
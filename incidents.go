@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of incidents. At most one incident of each kind is open at a time.
+const (
+	incidentProviderFailures = "provider.failures"
+	incidentPoolExhausted    = "pool.exhausted"
+)
+
+// incidentCheckInterval is how often we check whether to open or resolve
+// incidents
+const incidentCheckInterval = time.Minute
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// incidentWindow returns the period provider failures are counted over, and
+// that must pass without failures or pool exhaustion for an incident to be
+// resolved. Set INCIDENT_WINDOW (e.g. "10m") to override the default of 5m.
+func incidentWindow() time.Duration {
+	return envDuration("INCIDENT_WINDOW", 5*time.Minute)
+}
+
+// providerFailureThreshold returns how many MessageBird calls must fail in
+// the incident window to open an incident, set with PROVIDER_FAILURE_THRESHOLD
+func providerFailureThreshold() int {
+	return envInt("PROVIDER_FAILURE_THRESHOLD", 5)
+}
+
+var (
+	// incidentSignalsMu guards providerFailures and lastPoolExhaustion
+	incidentSignalsMu sync.Mutex
+	// providerFailures are when MessageBird calls failed within the
+	// incident window
+	providerFailures []time.Time
+	// lastPoolExhaustion is when a ride last found no proxy number
+	lastPoolExhaustion time.Time
+)
+
+// recordProviderFailure notes that a MessageBird call failed at at: it
+// couldn't be made, or MessageBird answered with a server error
+func recordProviderFailure(at time.Time) {
+	incidentSignalsMu.Lock()
+	defer incidentSignalsMu.Unlock()
+	providerFailures = append(recentFailures(providerFailures, at), at)
+}
+
+// recentFailures returns the failures within the incident window before now.
+// The caller must hold incidentSignalsMu.
+func recentFailures(failures []time.Time, now time.Time) []time.Time {
+	since := now.Add(-incidentWindow())
+	for len(failures) > 0 && !failures[0].After(since) {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// incident is a record of repeated provider failures or pool exhaustion,
+// with the rides and proxy numbers it affected
+type incident struct {
+	ID         int
+	Kind       string
+	Summary    string
+	Rides      []int
+	Numbers    []string
+	OpenedAt   string // RFC 3339
+	ResolvedAt string // RFC 3339, empty while the incident is open
+}
+
+// Open reports whether the incident isn't resolved yet
+func (inc incident) Open() bool {
+	return inc.ResolvedAt == ""
+}
+
+// scanIncident reads an incident from a row of id, kind, summary, rides,
+// numbers, opened_at and resolved_at
+func scanIncident(row interface{ Scan(...interface{}) error }) (incident, error) {
+	var inc incident
+	var rides, numbers string
+	err := row.Scan(&inc.ID, &inc.Kind, &inc.Summary, &rides, &numbers, &inc.OpenedAt, &inc.ResolvedAt)
+	for _, v := range strings.Split(rides, ",") {
+		if id, err := strconv.Atoi(v); err == nil {
+			inc.Rides = append(inc.Rides, id)
+		}
+	}
+	if numbers != "" {
+		inc.Numbers = strings.Split(numbers, ",")
+	}
+	return inc, err
+}
+
+// incidentStore is the part of RideStore that keeps the incidents
+type incidentStore interface {
+	// OpenIncident returns the open incident of kind, or sql.ErrNoRows if
+	// there is none
+	OpenIncident(kind string) (incident, error)
+	// AddIncident stores inc, returning its ID
+	AddIncident(inc incident) (int, error)
+	// UpdateIncident stores the summary, rides and numbers of inc
+	UpdateIncident(inc incident) error
+	// ResolveIncident records that the incident with the given ID was
+	// resolved at resolvedAt, RFC 3339
+	ResolveIncident(id int, resolvedAt string) error
+	// Incidents returns the latest limit incidents, newest first
+	Incidents(limit int) ([]incident, error)
+	// FailedSends returns the rides, and the proxy numbers they were sent
+	// from, of the texts MessageBird didn't accept since since
+	FailedSends(since time.Time) ([]int, []string, error)
+}
+
+// OpenIncident implements incidentStore
+func (s *sqlStore) OpenIncident(kind string) (incident, error) {
+	return scanIncident(s.queryRow(sqlQuery{
+		SQLite:   "SELECT id, kind, summary, rides, numbers, opened_at, resolved_at FROM incidents WHERE kind = ? AND resolved_at = ''",
+		Postgres: "SELECT id, kind, summary, rides, numbers, opened_at, resolved_at FROM incidents WHERE kind = $1 AND resolved_at = ''",
+	}, kind))
+}
+
+// AddIncident implements incidentStore
+func (s *sqlStore) AddIncident(inc incident) (int, error) {
+	id, err := s.insertID(sqlQuery{
+		SQLite:   "INSERT INTO incidents (kind, summary, rides, numbers, opened_at) VALUES (?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO incidents (kind, summary, rides, numbers, opened_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+	}, inc.Kind, inc.Summary, joinRideIDs(inc.Rides), joinNumbers(inc.Numbers), inc.OpenedAt)
+	return int(id), err
+}
+
+// UpdateIncident implements incidentStore
+func (s *sqlStore) UpdateIncident(inc incident) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE incidents SET summary = ?, rides = ?, numbers = ? WHERE id = ?",
+		Postgres: "UPDATE incidents SET summary = $1, rides = $2, numbers = $3 WHERE id = $4",
+	}, inc.Summary, joinRideIDs(inc.Rides), joinNumbers(inc.Numbers), inc.ID)
+	return err
+}
+
+// ResolveIncident implements incidentStore
+func (s *sqlStore) ResolveIncident(id int, resolvedAt string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE incidents SET resolved_at = ? WHERE id = ?",
+		Postgres: "UPDATE incidents SET resolved_at = $1 WHERE id = $2",
+	}, resolvedAt, id)
+	return err
+}
+
+// Incidents implements incidentStore
+func (s *sqlStore) Incidents(limit int) ([]incident, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, kind, summary, rides, numbers, opened_at, resolved_at FROM incidents ORDER BY id DESC LIMIT ?",
+		Postgres: "SELECT id, kind, summary, rides, numbers, opened_at, resolved_at FROM incidents ORDER BY id DESC LIMIT $1",
+	}, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var incidents []incident
+	for rows.Next() {
+		inc, err := scanIncident(rows)
+		if err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, inc)
+	}
+	return incidents, rows.Err()
+}
+
+// FailedSends implements incidentStore
+func (s *sqlStore) FailedSends(since time.Time) ([]int, []string, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT ride_id, originator FROM messages WHERE direction = ? AND provider_id = '' AND created_at > ?",
+		Postgres: "SELECT ride_id, originator FROM messages WHERE direction = $1 AND provider_id = '' AND created_at > $2",
+	}, directionOutbound, since.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var rides []int
+	var numbers []string
+	for rows.Next() {
+		var rideID int
+		var originator string
+		if err := rows.Scan(&rideID, &originator); err != nil {
+			return nil, nil, err
+		}
+		if rideID != 0 {
+			rides = append(rides, rideID)
+			numbers = append(numbers, originator)
+		}
+	}
+	return rides, numbers, rows.Err()
+}
+
+// findOpenIncident returns the open incident of kind, reporting false if
+// there is none
+func findOpenIncident(store RideStore, kind string) (incident, bool, error) {
+	inc, err := store.OpenIncident(kind)
+	if err == sql.ErrNoRows {
+		return inc, false, nil
+	}
+	return inc, err == nil, err
+}
+
+// joinRideIDs returns ids without duplicates, sorted and comma-separated
+func joinRideIDs(ids []int) string {
+	seen := make(map[int]bool)
+	var list []string
+	sort.Ints(ids)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			list = append(list, strconv.Itoa(id))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// joinNumbers returns numbers without duplicates, sorted and comma-separated
+func joinNumbers(numbers []string) string {
+	seen := make(map[string]bool)
+	var list []string
+	for _, v := range numbers {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			list = append(list, v)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// openIncident opens an incident of kind described by summary, affecting
+// rides and numbers, and pages PagerDuty about it. If one is open already,
+// its summary is updated and the rides and numbers are added to it.
+func openIncident(store RideStore, kind string, summary string, rides []int, numbers []string) error {
+	inc, ok, err := findOpenIncident(store, kind)
+	if err != nil {
+		return err
+	}
+	if ok {
+		inc.Summary = summary
+		inc.Rides = append(inc.Rides, rides...)
+		inc.Numbers = append(inc.Numbers, numbers...)
+		return store.UpdateIncident(inc)
+	}
+
+	inc = incident{Kind: kind, Summary: summary, Rides: rides, Numbers: numbers, OpenedAt: time.Now().UTC().Format(time.RFC3339)}
+	if inc.ID, err = store.AddIncident(inc); err != nil {
+		return err
+	}
+	log.Printf("Incident %d opened: %s", inc.ID, summary)
+	go pageIncident(inc, "trigger")
+	return nil
+}
+
+// resolveIncident resolves the open incident of kind, if there is one, and
+// resolves it in PagerDuty
+func resolveIncident(store RideStore, kind string, now time.Time) error {
+	inc, ok, err := findOpenIncident(store, kind)
+	if err != nil || !ok {
+		return err
+	}
+	inc.ResolvedAt = now.UTC().Format(time.RFC3339)
+	if err := store.ResolveIncident(inc.ID, inc.ResolvedAt); err != nil {
+		return err
+	}
+	log.Printf("Incident %d resolved: %s", inc.ID, inc.Summary)
+	go pageIncident(inc, "resolve")
+	return nil
+}
+
+// reportPoolExhaustion opens an incident for a ride that found no proxy
+// number, what describes, e.g. "a new ride". ride is the ride being moved to
+// another number, or the zero RideType for a new ride.
+func reportPoolExhaustion(store RideStore, what string, ride RideType) {
+	incidentSignalsMu.Lock()
+	lastPoolExhaustion = time.Now()
+	incidentSignalsMu.Unlock()
+
+	var rides []int
+	if ride.ID != 0 {
+		rides = append(rides, ride.ID)
+	}
+	err := openIncident(store, incidentPoolExhausted, "The proxy pool ran dry: "+what+" found no proxy number", rides, []string{ride.ThisProxyNumber.Number})
+	if err != nil {
+		log.Printf("Could not record the proxy pool incident: %v", err)
+	}
+}
+
+// checkIncidents opens an incident when MessageBird calls keep failing, and
+// resolves incidents once there have been no failures, or no rides without a
+// proxy number and no projected exhaustion, for the incident window
+func checkIncidents(store RideStore, now time.Time) error {
+	window := incidentWindow()
+	incidentSignalsMu.Lock()
+	providerFailures = recentFailures(providerFailures, now)
+	failures, exhaustedAt := len(providerFailures), lastPoolExhaustion
+	incidentSignalsMu.Unlock()
+
+	switch {
+	case failures >= providerFailureThreshold():
+		rides, numbers, err := store.FailedSends(now.Add(-window))
+		if err != nil {
+			return err
+		}
+		summary := fmt.Sprintf("%d MessageBird API calls failed in the last %s", failures, window)
+		if err := openIncident(store, incidentProviderFailures, summary, rides, numbers); err != nil {
+			return err
+		}
+	case failures == 0:
+		if err := resolveIncident(store, incidentProviderFailures, now); err != nil {
+			return err
+		}
+	}
+
+	if now.Sub(exhaustedAt) < window {
+		return nil
+	}
+	if _, ok, err := findOpenIncident(store, incidentPoolExhausted); err != nil || !ok {
+		return err
+	}
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		return err
+	}
+	if projectPoolUsage(dbdata, now, 1)[0].Exhausted() {
+		return nil
+	}
+	return resolveIncident(store, incidentPoolExhausted, now)
+}
+
+// pollIncidents runs checkIncidents every interval until ctx is done.
+// It is meant to be run in its own goroutine.
+func pollIncidents(ctx context.Context, store RideStore, interval time.Duration) {
+	every(ctx, interval, func() {
+		if err := checkIncidents(store, time.Now()); err != nil {
+			log.Printf("Incident check: %v", err)
+		}
+	})
+}
+
+// pagerDutyEvent is the body of a PagerDuty Events API v2 request
+type pagerDutyEvent struct {
+	RoutingKey  string              `json:"routing_key"`
+	EventAction string              `json:"event_action"`
+	DedupKey    string              `json:"dedup_key"`
+	Payload     *pagerDutyPayload   `json:"payload,omitempty"`
+	Links       []map[string]string `json:"links,omitempty"`
+}
+
+// pagerDutyPayload describes a triggered PagerDuty alert
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Component     string            `json:"component"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+// pageIncident triggers or resolves inc in PagerDuty, as action says, if
+// PAGERDUTY_ROUTING_KEY is set to the integration key of a PagerDuty
+// service. Triggered alerts link to the incident's rides and numbers when
+// PUBLIC_URL is set.
+func pageIncident(inc incident, action string) {
+	key := os.Getenv("PAGERDUTY_ROUTING_KEY")
+	if key == "" {
+		return
+	}
+	event := pagerDutyEvent{
+		RoutingKey:  key,
+		EventAction: action,
+		DedupKey:    fmt.Sprintf("birdcar-incident-%d", inc.ID),
+	}
+	if action == "trigger" {
+		event.Payload = &pagerDutyPayload{
+			Summary:   inc.Summary,
+			Source:    "birdcar",
+			Severity:  "critical",
+			Component: inc.Kind,
+			CustomDetails: map[string]string{
+				"rides":   joinRideIDs(inc.Rides),
+				"numbers": joinNumbers(inc.Numbers),
+			},
+		}
+		if base := publicURL(); base != "" {
+			event.Links = append(event.Links, map[string]string{"href": base + appPath("/admin/incidents"), "text": "Incidents"})
+			for _, id := range inc.Rides {
+				event.Links = append(event.Links, map[string]string{"href": base + appPath(fmt.Sprintf("/rides/%d/export", id)), "text": fmt.Sprintf("Ride %d", id)})
+			}
+			if len(inc.Numbers) > 0 {
+				event.Links = append(event.Links, map[string]string{"href": base + appPath("/admin/proxies"), "text": "Proxy pool"})
+			}
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err == nil {
+		err = postPagerDutyEvent(body)
+	}
+	if err != nil {
+		log.Printf("Could not %s incident %d in PagerDuty: %v", action, inc.ID, err)
+	}
+}
+
+// postPagerDutyEvent posts body to the PagerDuty Events API
+func postPagerDutyEvent(body []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(pagerDutyEventsURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PagerDuty responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// incidentsPage is the data rendered by views/default/incidents.gohtml
+type incidentsPage struct {
+	Incidents []incident
+	Message   string
+}
+
+// incidentsHandler lists the latest incidents, open and resolved, with
+// links to the rides and proxy numbers they affected
+func incidentsHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var page incidentsPage
+		var err error
+		if page.Incidents, err = store.Incidents(50); err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		renderDefaultTemplate(w, r, "incidents.gohtml", page)
+	}
+}
@@ -0,0 +1,291 @@
+//go:build integration
+// +build integration
+
+package main
+
+// The integration tests run the application end to end, over HTTP, against
+// each store and the MessageBird simulator:
+//
+//	go test -tags integration -v .
+//
+// The in-memory store always runs. PostgreSQL runs against
+// INTEGRATION_POSTGRES_URL, which must point at an empty database, or else
+// in a throwaway Docker container if docker is installed.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// postgresImage is the image the PostgreSQL container runs
+const postgresImage = "postgres:13-alpine"
+
+// integrationStores are the stores the tests run against, by name, set up by TestMain
+var integrationStores []struct{ name, url string }
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	integrationStores = append(integrationStores, struct{ name, url string }{"memory", "memory:integration"})
+	postgresURL, stop, err := startPostgres()
+	if err != nil {
+		fmt.Println("Skipping PostgreSQL:", err)
+	} else {
+		integrationStores = append(integrationStores, struct{ name, url string }{"postgres", postgresURL})
+	}
+
+	code := m.Run()
+	if stop != nil {
+		stop()
+	}
+	os.Exit(code)
+}
+
+// startPostgres returns the URL of a PostgreSQL database to test against:
+// INTEGRATION_POSTGRES_URL, or a new Docker container's, along with a
+// function removing the container
+func startPostgres() (string, func(), error) {
+	if u := os.Getenv("INTEGRATION_POSTGRES_URL"); u != "" {
+		return u, nil, nil
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", nil, fmt.Errorf("set INTEGRATION_POSTGRES_URL or install docker")
+	}
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-e", "POSTGRES_PASSWORD=birdcar", "-e", "POSTGRES_DB=birdcar",
+		"-p", "127.0.0.1::5432", postgresImage).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not start %s: %v", postgresImage, err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() { exec.Command("docker", "rm", "-f", id).Run() }
+
+	out, err = exec.Command("docker", "port", id, "5432/tcp").Output()
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("could not find the PostgreSQL port: %v", err)
+	}
+	addr := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	u := fmt.Sprintf("postgres://postgres:birdcar@%s/birdcar?sslmode=disable", addr)
+
+	// The server restarts once while the container initializes
+	deadline := time.Now().Add(time.Minute)
+	for {
+		store, err := openStore(u)
+		if err == nil {
+			err = store.Ping()
+			store.Close()
+		}
+		if err == nil {
+			return u, stop, nil
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return "", nil, fmt.Errorf("PostgreSQL did not come up: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// integrationApp is the application serving a store, talking to the simulator
+type integrationApp struct {
+	server *httptest.Server
+	sim    *messageBirdSimulator
+	dbdata *RideSharingDB
+}
+
+// startApp opens the store at storeURL, seeds it and serves the application
+func startApp(t *testing.T, storeURL string) *integrationApp {
+	if err := openDB(storeURL); err != nil {
+		t.Fatalf("could not open %s: %v", storeURL, err)
+	}
+	initExampleDB(appStore)
+	os.Setenv("ADMIN_PASSWORD", integrationPassword)
+
+	sim := new(messageBirdSimulator)
+	mb := messagebird.New("integration")
+	mb.HTTPClient = &http.Client{Transport: sim}
+	dbdata := newRideSharingDB(appStore)
+	var err error
+	if dbdata.webhookToken, err = setupWebhookToken(appStore); err != nil {
+		t.Fatal(err)
+	}
+	queue := newNotificationQueue(mb, 100, newAdaptiveThrottle(0, 0))
+	go queue.run()
+	app := &integrationApp{server: httptest.NewServer(newRouter(dbdata, dbdata, mb, queue)), sim: sim, dbdata: dbdata}
+	t.Cleanup(func() {
+		app.server.Close()
+		closeDB()
+	})
+	return app
+}
+
+// integrationPassword is the password of the admin account requests to
+// dashboard pages sign in as
+const integrationPassword = "integration"
+
+// integrationCSRFToken is sent as both the CSRF cookie and header, as a
+// browser would send the cookie and the form field, see requireCSRFToken
+var integrationCSRFToken = strings.Repeat("c0", 32)
+
+// request sends form to path with method, returning the response body
+func (app *integrationApp) request(t *testing.T, method string, path string, form url.Values) string {
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, app.server.URL+path+"?"+form.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, app.server.URL+path, strings.NewReader(form.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", integrationPassword)
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: integrationCSRFToken})
+	req.Header.Set(csrfHeaderName, integrationCSRFToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s answered %s: %s", method, path, resp.Status, body)
+	}
+	return string(body)
+}
+
+// expectSent checks that the simulator was asked to send exactly want since
+// the last check, in any order. Message IDs are ignored.
+func (app *integrationApp) expectSent(t *testing.T, want ...simulatedSMS) {
+	t.Helper()
+	sent := app.sim.take()
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d messages, want %d: %+v", len(sent), len(want), sent)
+	}
+	for _, w := range want {
+		found := false
+		for i, s := range sent {
+			if s.Originator == w.Originator && s.Recipient == w.Recipient && (w.Body == "" || s.Body == w.Body) {
+				sent = append(sent[:i], sent[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no message from %s to %s %q among %+v", w.Originator, w.Recipient, w.Body, sent)
+		}
+	}
+}
+
+// TestRide books a ride, relays texts both ways through its proxy number
+// and routes calls between its participants, on every store
+func TestRide(t *testing.T) {
+	for _, store := range integrationStores {
+		store := store
+		t.Run(store.name, func(t *testing.T) {
+			app := startApp(t, store.url)
+			dbdata, err := app.dbdata.loadDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			customer, driver := dbdata.Customers[1], dbdata.Drivers[1]
+
+			var ride RideType
+			t.Run("create ride", func(t *testing.T) {
+				app.request(t, http.MethodPost, "/createride", url.Values{
+					"customer":    {fmt.Sprint(customer.ID)},
+					"driver":      {fmt.Sprint(driver.ID)},
+					"start":       {"Amsterdam Centraal"},
+					"destination": {"Schiphol Airport"},
+					"datetime":    {time.Now().Add(time.Hour).Format("2006-01-02T15:04")},
+				})
+				dbdata, err := app.dbdata.loadDB()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, v := range dbdata.Rides {
+					if v.ID > ride.ID {
+						ride = v
+					}
+				}
+				if ride.ThisCustomer.ID != customer.ID || ride.ThisDriver.ID != driver.ID {
+					t.Fatalf("got ride %+v, want one for customer %d and driver %d", ride, customer.ID, driver.ID)
+				}
+				proxy := ride.ThisProxyNumber.Number
+				app.expectSent(t,
+					simulatedSMS{Originator: proxy, Recipient: customer.Number},
+					simulatedSMS{Originator: proxy, Recipient: driver.Number},
+				)
+			})
+			if ride.ID == 0 {
+				t.FailNow()
+			}
+			proxy := ride.ThisProxyNumber.Number
+
+			t.Run("relay sms", func(t *testing.T) {
+				texts := []struct {
+					from, to Person
+					body     string
+				}{
+					{customer, driver, "Hi, I'm waiting at the main entrance."},
+					{driver, customer, "On my way, see you in 5 minutes!"},
+				}
+				for i, text := range texts {
+					app.request(t, http.MethodPost, smsWebhookPath(app.dbdata.webhookToken), url.Values{
+						"id":         {fmt.Sprintf("%s-sms-%d", store.name, i)},
+						"originator": {text.from.Number},
+						"receiver":   {proxy},
+						"payload":    {text.body},
+					})
+					app.expectSent(t, simulatedSMS{Originator: proxy, Recipient: text.to.Number, Body: text.body})
+				}
+			})
+
+			t.Run("route call", func(t *testing.T) {
+				calls := []struct{ from, to Person }{{customer, driver}, {driver, customer}}
+				for i, call := range calls {
+					flow := app.request(t, http.MethodGet, voiceWebhookPath(app.dbdata.webhookToken), url.Values{
+						"callID":      {fmt.Sprintf("%s-call-%d", store.name, i)},
+						"source":      {call.from.Number},
+						"destination": {proxy},
+					})
+					if want := fmt.Sprintf("<Transfer destination='%s'", call.to.Number); !strings.Contains(flow, want) {
+						t.Errorf("call from %s got call flow %s, want a transfer to %s", call.from.Number, flow, call.to.Number)
+					}
+				}
+			})
+
+			t.Run("reject stranger", func(t *testing.T) {
+				app.request(t, http.MethodPost, smsWebhookPath(app.dbdata.webhookToken), url.Values{
+					"id":         {store.name + "-sms-stranger"},
+					"originator": {"319799999"},
+					"receiver":   {proxy},
+					"payload":    {"Who is this?"},
+				})
+				app.expectSent(t)
+			})
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+)
+
+// languageKeyword lets participants choose the language of our messages,
+// e.g. by texting "LANGUAGE NL" to any proxy number
+const languageKeyword = "LANGUAGE"
+
+// catalogLanguageSet is the catalog entry confirming a participant's language choice
+const catalogLanguageSet = "language_set"
+
+// messageCatalog holds translations of our ride confirmation messages, by
+// language and notification template name. Messages in the default language,
+// and messages without a translation, use the templates operators edit on
+// the templates admin page. The templates' defaults are the English entries.
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		catalogLanguageSet: "We'll send you messages in English from now on.",
+	},
+	"nl": {
+		templateRideCreatedCustomer: "{{ .Ride.ThisDriver.Name }} haalt je op om {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Beantwoord dit bericht{{ else }}Bel {{ .Ride.ThisProxyNumber.Number }}{{ end }} om contact op te nemen met de chauffeur. " +
+			"Je ritcode is {{ .PIN }}: begin je bericht ermee, of toets hem in als je belt, als je ons vanaf een andere telefoon benadert.",
+		templateRideCreatedDriver: "Je haalt {{ .Ride.ThisCustomer.Name }} op om {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Beantwoord dit bericht{{ else }}Bel {{ .Ride.ThisProxyNumber.Number }}{{ end }} om contact op te nemen met de klant. " +
+			"Je ritcode is {{ .PIN }}: begin je bericht ermee, of toets hem in als je belt, als je ons vanaf een andere telefoon benadert.",
+		catalogLanguageSet: "We sturen je vanaf nu berichten in het Nederlands.",
+	},
+	"de": {
+		templateRideCreatedCustomer: "{{ .Ride.ThisDriver.Name }} holt Sie um {{ .Ride.DateTime }} ab. " +
+			"{{ if .CanReply }}Antworten Sie auf diese Nachricht{{ else }}Rufen Sie {{ .Ride.ThisProxyNumber.Number }} an{{ end }}, um den Fahrer zu erreichen. " +
+			"Ihre Fahrt-PIN ist {{ .PIN }}: Beginnen Sie Ihre Nachricht damit oder geben Sie sie beim Anruf ein, wenn Sie uns von einem anderen Telefon kontaktieren.",
+		templateRideCreatedDriver: "Sie holen {{ .Ride.ThisCustomer.Name }} um {{ .Ride.DateTime }} ab. " +
+			"{{ if .CanReply }}Antworten Sie auf diese Nachricht{{ else }}Rufen Sie {{ .Ride.ThisProxyNumber.Number }} an{{ end }}, um den Fahrgast zu erreichen. " +
+			"Ihre Fahrt-PIN ist {{ .PIN }}: Beginnen Sie Ihre Nachricht damit oder geben Sie sie beim Anruf ein, wenn Sie uns von einem anderen Telefon kontaktieren.",
+		catalogLanguageSet: "Wir senden Ihnen ab jetzt Nachrichten auf Deutsch.",
+	},
+	"fr": {
+		templateRideCreatedCustomer: "{{ .Ride.ThisDriver.Name }} viendra vous chercher le {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Répondez à ce message{{ else }}Appelez le {{ .Ride.ThisProxyNumber.Number }}{{ end }} pour contacter le chauffeur. " +
+			"Votre code de course est {{ .PIN }} : commencez votre message par ce code, ou saisissez-le lors d'un appel, si vous nous contactez depuis un autre téléphone.",
+		templateRideCreatedDriver: "Vous prendrez en charge {{ .Ride.ThisCustomer.Name }} le {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Répondez à ce message{{ else }}Appelez le {{ .Ride.ThisProxyNumber.Number }}{{ end }} pour contacter le client. " +
+			"Votre code de course est {{ .PIN }} : commencez votre message par ce code, ou saisissez-le lors d'un appel, si vous nous contactez depuis un autre téléphone.",
+		catalogLanguageSet: "Nous vous enverrons désormais nos messages en français.",
+	},
+	"es": {
+		templateRideCreatedCustomer: "{{ .Ride.ThisDriver.Name }} te recogerá el {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Responde a este mensaje{{ else }}Llama al {{ .Ride.ThisProxyNumber.Number }}{{ end }} para contactar con el conductor. " +
+			"Tu PIN de viaje es {{ .PIN }}: empieza tu mensaje con él, o introdúcelo al llamar, si nos contactas desde otro teléfono.",
+		templateRideCreatedDriver: "Recogerás a {{ .Ride.ThisCustomer.Name }} el {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Responde a este mensaje{{ else }}Llama al {{ .Ride.ThisProxyNumber.Number }}{{ end }} para contactar con el cliente. " +
+			"Tu PIN de viaje es {{ .PIN }}: empieza tu mensaje con él, o introdúcelo al llamar, si nos contactas desde otro teléfono.",
+		catalogLanguageSet: "A partir de ahora te enviaremos los mensajes en español.",
+	},
+}
+
+// countryLanguages maps country calling codes to the language most people
+// there read. Countries with several widely used languages are left out.
+var countryLanguages = map[string]string{
+	"1":   "en", // United States, Canada
+	"31":  "nl", // Netherlands
+	"33":  "fr", // France
+	"34":  "es", // Spain
+	"43":  "de", // Austria
+	"44":  "en", // United Kingdom
+	"49":  "de", // Germany
+	"52":  "es", // Mexico
+	"54":  "es", // Argentina
+	"56":  "es", // Chile
+	"57":  "es", // Colombia
+	"61":  "en", // Australia
+	"64":  "en", // New Zealand
+	"353": "en", // Ireland
+	"377": "fr", // Monaco
+	"423": "de", // Liechtenstein
+	"597": "nl", // Suriname
+}
+
+// defaultLanguage returns the language of the templates operators edit.
+// Set DEFAULT_LANGUAGE to override the default of English.
+func defaultLanguage() string {
+	if lang := strings.ToLower(os.Getenv("DEFAULT_LANGUAGE")); lang != "" {
+		return lang
+	}
+	return "en"
+}
+
+// languageDetection reports whether we guess participants' languages from
+// their country code. Set DETECT_LANGUAGE=false to always use the default.
+func languageDetection() bool {
+	return os.Getenv("DETECT_LANGUAGE") != "false"
+}
+
+// detectLanguage guesses the language of the owner of number from its
+// country calling code, returning the default language if we can't tell
+func detectLanguage(number string) string {
+	number = strings.TrimPrefix(strings.TrimPrefix(number, "+"), "00")
+	// Calling codes are one to three digits; the longest match wins
+	for n := 3; n >= 1; n-- {
+		if len(number) > n {
+			if lang, ok := countryLanguages[number[:n]]; ok {
+				return lang
+			}
+		}
+	}
+	return defaultLanguage()
+}
+
+// languageStore is the part of RideStore that keeps the languages
+// participants chose
+type languageStore interface {
+	// Language returns the language the owner of number chose, or
+	// sql.ErrNoRows if they didn't
+	Language(number string) (string, error)
+	// SetLanguage stores lang as the language the owner of number chose
+	SetLanguage(number string, lang string) error
+}
+
+// Language implements languageStore
+func (s *sqlStore) Language(number string) (string, error) {
+	var lang string
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT language FROM language_preferences WHERE number = ?",
+		Postgres: "SELECT language FROM language_preferences WHERE number = $1",
+	}, number).Scan(&lang)
+	return lang, err
+}
+
+// SetLanguage implements languageStore
+func (s *sqlStore) SetLanguage(number string, lang string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO language_preferences (number, language) VALUES (?, ?) ON CONFLICT (number) DO UPDATE SET language = excluded.language",
+		Postgres: "INSERT INTO language_preferences (number, language) VALUES ($1, $2) ON CONFLICT (number) DO UPDATE SET language = excluded.language",
+		MySQL:    "INSERT INTO language_preferences (number, language) VALUES (?, ?) ON DUPLICATE KEY UPDATE language = VALUES(language)",
+	}, number, lang)
+	return err
+}
+
+// storedLanguage returns the language the owner of number chose, if any
+func storedLanguage(store RideStore, number string) (string, bool) {
+	lang, err := store.Language(number)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return "", false
+	}
+	return lang, true
+}
+
+// participantLanguage returns the language to message number in: the one
+// its owner chose, or else the one we detect from its country code
+func participantLanguage(store RideStore, number string) string {
+	if lang, ok := storedLanguage(store, number); ok {
+		return lang
+	}
+	if languageDetection() {
+		return detectLanguage(number)
+	}
+	return defaultLanguage()
+}
+
+// parseLanguageRequest returns the language in a LANGUAGE keyword message,
+// e.g. "nl" for "language NL"
+func parseLanguageRequest(payload string) (string, bool) {
+	fields := strings.Fields(payload)
+	if len(fields) != 2 || strings.ToUpper(fields[0]) != languageKeyword {
+		return "", false
+	}
+	return strings.ToLower(fields[1]), true
+}
+
+// supportedLanguage reports whether we have messages in lang
+func supportedLanguage(lang string) bool {
+	_, ok := messageCatalog[lang]
+	return ok || lang == defaultLanguage()
+}
+
+// catalogEntry returns the translation of the notification template called
+// name into lang, if we have one and lang isn't the default language
+func catalogEntry(lang string, name string) (string, bool) {
+	if lang == "" || lang == defaultLanguage() {
+		return "", false
+	}
+	if body, ok := messageCatalog[lang][name]; ok {
+		return body, true
+	}
+	if t, ok := findNotificationTemplate(name); ok && lang == "en" {
+		return t.Default, true
+	}
+	return "", false
+}
+
+// languageSetReply confirms to a participant that we'll message them in lang
+func languageSetReply(lang string) string {
+	if reply, ok := messageCatalog[lang][catalogLanguageSet]; ok {
+		return reply
+	}
+	return "We'll send you messages in " + lang + " from now on."
+}
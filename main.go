@@ -1,29 +1,287 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/messagebirdguides/masked-numbers-guide-go/config"
 
 	messagebird "github.com/messagebird/go-rest-api"
 )
 
+// appConfig is the configuration of the server, set from its flags by main.
+// The other commands read it from the environment.
+var appConfig = config.FromEnv()
+
 func main() {
-	dbdata := new(RideSharingDB)
-	initExampleDB()
+	// Random proxy selection differs on every run
+	rand.Seed(time.Now().UnixNano())
 
-	mb := messagebird.New(os.Getenv("MESSAGEBIRD_API_KEY"))
+	// Maintenance commands, e.g. "go run *.go doctor -repair"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "archive":
+			os.Exit(runArchive(os.Args[2:]))
+		case "demo":
+			os.Exit(runDemo(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "flows":
+			os.Exit(runFlows(os.Args[2:]))
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "users":
+			os.Exit(runUsers(os.Args[2:]))
+		case "tenants":
+			os.Exit(runTenants(os.Args[2:]))
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/", landing(dbdata))
-	mux.Handle("/createride", createRideHandler(dbdata, mb))
-	mux.Handle("/webhook", messageHookHandler(dbdata, mb))
-	mux.Handle("/webhook-voice", voiceHookHandler(dbdata, mb))
-
-	port := ":8080"
-	log.Println("Serving on", port)
-	err := http.ListenAndServe(port, mux)
-	if err != nil {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	store := storeFlag(flags)
+	cfg := config.Flags(flags)
+	flags.Parse(os.Args[1:])
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	appConfig = cfg
+	url, err := storeURL(*store, cfg.DatabaseURL)
+	must(err)
+	must(openDB(url))
+	if replica := databaseReplicaURL(); replica != "" && *store == storeSQL {
+		must(openReplica(replica))
+		log.Println("Reading the ride board, exports and analytics from the read replica (DATABASE_REPLICA_URL)")
+	}
+	dbdata := newRideSharingDB(appStore)
+	initExampleDB(appStore)
+	dbdata.webhookToken, err = setupWebhookToken(appStore)
+	must(err)
+
+	mb, queue := startMessaging(cfg)
+	mux := newRouter(dbdata, newRideSharingDB(reportStore), mb, queue)
+	startPollers(appStore, mb, cfg.Messaging)
+	logSettings()
+
+	servers := []*http.Server{{Addr: cfg.Addr, Handler: mountAtBasePath(mux)}}
+	if addr := grpcAddr(); addr != "" {
+		log.Printf("Serving the gRPC ride service (proto/rides.proto) on %s (GRPC_ADDR)", addr)
+		grpcServer := newGRPCServer(dbdata, mb)
+		servers = append(servers, grpcServer)
+		go func() {
+			if err := serveGRPC(grpcServer); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	log.Println("Serving on", servers[0].Addr+appPath("/"))
+	go func() {
+		if err := servers[0].ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := waitForShutdownSignal()
+	log.Printf("Received %s, shutting down within %s (SHUTDOWN_TIMEOUT)", sig, shutdownTimeout())
+	if err := shutdown(servers, queue, closeDB); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Shut down")
+}
+
+// startMessaging returns the MessageBird client and the notification queue
+// configured by cfg, with the queue running in the background, and sets up
+// what relaying texts depends on: failover, notifiers and moderators
+func startMessaging(cfg *config.Config) (*messagebird.Client, *notificationQueue) {
+	throttle := newAdaptiveThrottle(200*time.Millisecond, 30*time.Second)
+	mb := newMessageBirdClient(cfg.MessageBirdKey, throttle)
+	if !cfg.Messaging {
+		mb.HTTPClient = &http.Client{Transport: messagingOffTransport{}}
+		log.Println("Messaging is off (-messaging=false, MESSAGING): texts and calls fail without reaching MessageBird")
+	}
+	if err := setupSMSFailover(); err != nil {
+		log.Fatal(err)
+	}
+	if failoverSMSProvider != nil {
+		log.Printf("Failing texts over to %s when %d+ fail within %s, for %s at a time (SMS_FAILOVER_THRESHOLD, SMS_FAILOVER_WINDOW, SMS_FAILOVER_COOLDOWN)",
+			failoverSMSProvider.Name(), smsFailoverThreshold(), smsFailoverWindow(), smsFailoverCooldown())
+	}
+	registerWebhookNotifiers()
+	if err := registerModerators(); err != nil {
+		log.Fatal(err)
+	}
+	queue := newNotificationQueue(mb, 1000, throttle)
+	background.start(func(context.Context) { queue.run() })
+	return mb, queue
+}
+
+// startPollers starts the background work on store, sending through mb.
+// Without messaging, the pollers that only call MessageBird aren't started.
+func startPollers(store RideStore, mb *messagebird.Client, messaging bool) {
+	if messaging {
+		// Without messaging these would only log MessageBird being unreachable
+		background.start(func(ctx context.Context) { pollPortingStatus(ctx, store, mb, portPollInterval) })
+		background.start(func(ctx context.Context) { pollCapabilities(ctx, store, mb, capabilitySyncInterval) })
+		background.start(func(ctx context.Context) { pollProvisioning(ctx, store, mb, provisioningCheckInterval) })
+		background.start(func(ctx context.Context) { pollCanary(ctx, store, mb, canaryInterval()) })
+	}
+	background.start(func(ctx context.Context) { pollConsistency(ctx, store, consistencyCheckInterval) })
+	background.start(func(ctx context.Context) { pollArchive(ctx, store, archiveInterval) })
+	background.start(func(ctx context.Context) { pollRelationships(ctx, store, relationshipCheckInterval) })
+	background.start(func(ctx context.Context) { pollRideStatuses(ctx, store, mb, rideStatusInterval) })
+	background.start(func(ctx context.Context) { pollAllocationVelocity(ctx, store, allocationCheckInterval) })
+	background.start(func(ctx context.Context) { pollPoolUtilization(ctx, store, mb, poolCheckInterval) })
+	background.start(func(ctx context.Context) { pollIncidents(ctx, store, incidentCheckInterval) })
+	background.start(func(ctx context.Context) { pollWaitingRides(ctx, store, mb, waitingRideInterval) })
+	if !maintenanceOn(store) {
+		// In case we were stopped while sending them
+		background.start(func(ctx context.Context) { releaseHeldMessages(ctx, store, mb) })
+	}
+}
+
+// logSettings logs the settings that change how the server behaves, and
+// stops it if one of them is invalid, rather than failing mid-request
+func logSettings() {
+	if allowed := sendAllowlist(); allowed != nil {
+		log.Printf("Soft launch mode: only texting and calling the %d numbers in SEND_ALLOWLIST", len(allowed))
+	}
+	for kind, name := range quotaEnv {
+		// Also catches invalid quotas at startup rather than mid-request
+		if limit := quotaLimit(kind); limit > 0 {
+			log.Printf("Daily %s quota: %d (%s)", kind, limit, name)
+		}
+	}
+	if pprofEnabled() {
+		log.Println("Serving profiles at", appPath("/debug/pprof/"))
+	}
+	if policy := unknownSenderPolicy(); policy != unknownSenderDrop {
+		log.Printf("Texts from unknown senders: %s (UNKNOWN_SENDER_POLICY)", policy)
+	}
+	if err := checkViewTheme(); err != nil {
 		log.Fatal(err)
 	}
+	if theme := viewTheme(); theme != defaultViewTheme {
+		log.Printf("Views: %s theme from %s (VIEWS_THEME)", theme, viewsDir())
+	}
+	if strategy := proxySelectionStrategy(); strategy != selectRandom {
+		log.Printf("Proxy numbers for new rides: %s (PROXY_SELECTION)", strategy)
+	}
+	// Also catches invalid settings at startup rather than mid-request
+	log.Printf("Alerting when %d+ proxy numbers are allocated in %s, at %dx the rate of the %s before",
+		allocationSpikeMinimum(), allocationWindow(), allocationSpikeFactor(), allocationBaseline())
+	if d := allocationCapDuration(); d > 0 {
+		log.Printf("Capping new rides for %s after an alert (ALLOCATION_CAP)", d)
+	}
+	log.Printf("Alerting operators when the proxy pool runs dry or is projected to reach %d%% utilization (POOL_ALERT_UTILIZATION), at most every %s",
+		poolAlertUtilization(), operatorAlertCooldown())
+	if channels := operatorAlertChannels(); channels != "" {
+		log.Println("Operator alerts:", channels)
+	}
+	log.Printf("Opening incidents when %d+ MessageBird calls fail within %s (PROVIDER_FAILURE_THRESHOLD, INCIDENT_WINDOW)",
+		providerFailureThreshold(), incidentWindow())
+	if os.Getenv("PAGERDUTY_ROUTING_KEY") != "" {
+		log.Println("Paging PagerDuty about incidents (PAGERDUTY_ROUTING_KEY)")
+	}
+	log.Printf("Flagging rides silent after %s without texts or calls (RIDE_SILENT_AFTER), and noisy from %d (RIDE_NOISY_THRESHOLD)",
+		silentRideAfter(), noisyRideThreshold())
+	if approvalRequired() {
+		if n := len(adminAccounts()); n < 2 {
+			log.Fatalf("REQUIRE_APPROVAL needs at least two admin accounts to approve each other's actions, but there are %d: set ADMIN_USERS", n)
+		}
+		log.Println("Destructive admin actions need a second admin's approval (REQUIRE_APPROVAL)")
+	}
+	if id := whatsAppChannelID(); id != "" {
+		log.Printf("Relaying WhatsApp messages from channel %s (WHATSAPP_CHANNEL_ID) received at %s, followed by the webhook token if there is one",
+			id, appPath(whatsAppWebhookPath("")))
+	}
+	switch {
+	case webhookToken() != "":
+		log.Println("Webhooks are served at secret URLs ending in WEBHOOK_TOKEN: see the self-test page for the URLs to configure")
+	case webhookSigningKey() == "":
+		log.Println("Webhooks are served at secret URLs ending in the webhook token kept in the database: see the self-test page for the URLs to configure, " +
+			"set WEBHOOK_TOKEN to choose the token, or MESSAGEBIRD_SIGNING_KEY to have MessageBird sign its requests")
+	}
+	if line := operatorLine(); line != "" {
+		log.Printf("Calls from unknown callers: transferred to %s (OPERATOR_LINE_NUMBER)", line)
+	}
+}
+
+// newRouter returns the application's routes on dbdata, with the pages that
+// only read on reports, sending through mb and queuing bulk messages on queue
+func newRouter(dbdata, reports *RideSharingDB, mb *messagebird.Client, queue *notificationQueue) *http.ServeMux {
+	// Rides allowed per minute per signed-in user or API key, or else client IP
+	ridesPerMinute := envInt("CREATERIDE_RATE_LIMIT", 5)
+	// Webhook requests allowed per minute per client IP, which are
+	// MessageBird's few servers unless someone spoofs them, and texts and
+	// calls per minute per sender
+	webhookLimiter := newRateLimiter(envInt("WEBHOOK_RATE_LIMIT", 600))
+	textLimiter := newRateLimiter(envInt("SENDER_TEXT_RATE_LIMIT", 20))
+	callLimiter := newRateLimiter(envInt("SENDER_CALL_RATE_LIMIT", 10))
+
+	// Dashboard pages need a signed-in user, see requireAdmin. Webhooks
+	// check MessageBird's signature, are rate limited per client IP, and
+	// texts and calls per sender too, and end in the webhook token if one is
+	// set. Preferences and guest links stay open for participants and their
+	// guests, and the API checks API keys.
+	mux := http.NewServeMux()
+	mux.Handle("/", requireAdmin(dbdata.store, landing(reports)))
+	mux.Handle(loginPath, requireCSRFToken(loginHandler(dbdata.store, newRateLimiter(envInt("LOGIN_RATE_LIMIT", 10)))))
+	mux.Handle(logoutPath, requireCSRFToken(logoutHandler(dbdata.store)))
+	rideLimiter := newRateLimiter(ridesPerMinute)
+	mux.Handle("/createride", requireAdmin(dbdata.store, createRideHandler(dbdata, mb, rideLimiter)))
+	handleWebhook(mux, smsWebhookPath(dbdata.webhookToken), dbdata.webhookToken, rateLimitByIP(webhookLimiter,
+		requireWebhookSignature(rateLimitBySender(textLimiter, "originator", messageHookHandler(dbdata, mb)))))
+	handleWebhook(mux, voiceWebhookPath(dbdata.webhookToken), dbdata.webhookToken, rateLimitByIP(webhookLimiter,
+		requireWebhookSignature(rateLimitBySender(callLimiter, "source", voiceHookHandler(dbdata, mb, loadVoicePrompts())))))
+	handleWebhook(mux, statusWebhookPath(dbdata.webhookToken), dbdata.webhookToken, rateLimitByIP(webhookLimiter,
+		requireWebhookSignature(deliveryReportHandler(dbdata, mb))))
+	handleWebhook(mux, whatsAppWebhookPath(dbdata.webhookToken), dbdata.webhookToken, rateLimitByIP(webhookLimiter,
+		requireWebhookSignature(whatsAppHookHandler(dbdata, mb, textLimiter))))
+	mux.Handle(webhookCheckPath, webhookCheckHandler())
+	mux.Handle("/portnumber", requireAdmin(dbdata.store, portNumberHandler(dbdata)))
+	mux.Handle("/announce", requireAdmin(dbdata.store, announceHandler(dbdata, queue)))
+	mux.Handle("/availability", requireAdmin(dbdata.store, availabilityHandler(reports)))
+	mux.Handle("/metrics", metricsHandler(reports))
+	mux.Handle("/addnumber", requireAdmin(dbdata.store, addNumberHandler(dbdata)))
+	mux.Handle("/quarantine", requireAdmin(dbdata.store, quarantineHandler(dbdata, mb)))
+	mux.Handle("/completeride", requireAdmin(dbdata.store, endRideHandler(dbdata, mb, rideCompleted)))
+	mux.Handle("/cancelride", requireAdmin(dbdata.store, endRideHandler(dbdata, mb, rideCancelled)))
+	mux.Handle("/waitingrides", requireAdmin(dbdata.store, waitingRidesHandler(dbdata)))
+	mux.Handle("/ridelabels", requireAdmin(dbdata.store, rideLabelsHandler(dbdata)))
+	mux.Handle("/filters", requireAdmin(dbdata.store, filtersHandler(dbdata)))
+	mux.Handle("/relationships", requireAdmin(dbdata.store, relationshipsHandler(dbdata)))
+	mux.Handle("/preferences", preferencesHandler(dbdata.store))
+	mux.Handle("/observe", observeHandler(reports))
+	mux.Handle("/templates", requireAdmin(dbdata.store, templatesHandler(dbdata.store)))
+	mux.Handle("/rides/", requireAdmin(dbdata.store, ridesHandler(reports)))
+	mux.Handle("/quota", requireAdmin(dbdata.store, quotaHandler(dbdata)))
+	mux.Handle("/api/proxy-numbers/", requireAPIKey(dbdata.store, proxyAssignmentHandler(dbdata)))
+	mux.Handle("/api/filters", requireAPIKey(dbdata.store, filtersAPIHandler(dbdata.store)))
+	mux.Handle(apiPrefix, requireAPIKey(dbdata.store, apiHandler(dbdata, reports, mb, rideLimiter)))
+	mux.Handle("/admin/apikeys", requireAdmin(dbdata.store, apiKeysHandler(dbdata.store)))
+	mux.Handle(openAPIPath, openAPIHandler())
+	mux.Handle("/maintenance", requireAdmin(dbdata.store, maintenanceHandler(dbdata.store, mb)))
+	mux.Handle("/allocations", requireAdmin(dbdata.store, allocationsHandler(dbdata.store)))
+	mux.Handle("/admin/proxies", requireAdmin(dbdata.store, proxiesAdminHandler(dbdata, mb)))
+	mux.Handle("/admin/numbers", requireAdmin(dbdata.store, numbersAdminHandler(dbdata, mb)))
+	mux.Handle("/admin/approvals", requireAdmin(dbdata.store, approvalsHandler(dbdata)))
+	mux.Handle("/admin/incidents", requireAdmin(dbdata.store, incidentsHandler(dbdata.store)))
+	mux.Handle("/admin/people", requireAdmin(dbdata.store, peopleAdminHandler(dbdata)))
+	mux.Handle("/admin/notes", requireAdmin(dbdata.store, participantNotesHandler(dbdata)))
+	mux.Handle("/admin/consents", requireAdmin(dbdata.store, consentsHandler(dbdata)))
+	mux.Handle("/admin/observers", requireAdmin(dbdata.store, observersHandler(dbdata, mb)))
+	mux.Handle("/selftest", requireAdmin(dbdata.store, selfTestHandler(dbdata, mb)))
+	if pprofEnabled() {
+		registerPprof(dbdata.store, mux)
+	}
+	return mux
 }
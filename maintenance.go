@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/sms"
+)
+
+// heldMessageID is returned instead of a MessageBird ID for messages held back
+// by maintenance mode. They are sent, and logged, when it is turned off.
+const heldMessageID = "held"
+
+// maintenanceCheckInterval is how often the notification queue checks
+// whether maintenance mode is still on
+const maintenanceCheckInterval = 10 * time.Second
+
+// settingStore is the part of RideStore that keeps settings operators
+// change at runtime, e.g. maintenance mode, so they survive restarts
+type settingStore interface {
+	// Setting returns the value of the setting name, or sql.ErrNoRows if it
+	// isn't set
+	Setting(name string) (string, error)
+	// SetSetting sets the setting name to value. If it is set already, it
+	// keeps its value unless replace is true.
+	SetSetting(name string, value string, replace bool) error
+	// DeleteSetting unsets the setting name
+	DeleteSetting(name string) error
+}
+
+// Setting implements settingStore
+func (s *sqlStore) Setting(name string) (string, error) {
+	var value string
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT value FROM settings WHERE name = ?",
+		Postgres: "SELECT value FROM settings WHERE name = $1",
+	}, name).Scan(&value)
+	return value, err
+}
+
+// SetSetting implements settingStore
+func (s *sqlStore) SetSetting(name string, value string, replace bool) error {
+	q := sqlQuery{
+		SQLite:   "INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO NOTHING",
+		Postgres: "INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING",
+		MySQL:    "INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = value",
+	}
+	if replace {
+		q = sqlQuery{
+			SQLite:   "INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value",
+			Postgres: "INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = excluded.value",
+			MySQL:    "INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+		}
+	}
+	_, err := s.exec(q, name, value)
+	return err
+}
+
+// DeleteSetting implements settingStore
+func (s *sqlStore) DeleteSetting(name string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "DELETE FROM settings WHERE name = ?",
+		Postgres: "DELETE FROM settings WHERE name = $1",
+	}, name)
+	return err
+}
+
+// maintenanceStore is the part of RideStore that holds messages back during
+// maintenance mode
+type maintenanceStore interface {
+	// HoldMessage holds m back, ignoring its ID
+	HoldMessage(m heldMessage) error
+	// HeldMessages returns the messages held back, oldest first
+	HeldMessages() ([]heldMessage, error)
+	// ReleaseHeldMessage deletes the held message with the given ID,
+	// reporting whether it was still held
+	ReleaseHeldMessage(id int) (bool, error)
+}
+
+// HoldMessage implements maintenanceStore
+func (s *sqlStore) HoldMessage(m heldMessage) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO held_messages (ride_id, originator, recipient, body, relayed_from, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO held_messages (ride_id, originator, recipient, body, relayed_from, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+	}, m.RideID, m.Originator, m.Recipient, m.Body, m.RelayedFrom, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// HeldMessages implements maintenanceStore
+func (s *sqlStore) HeldMessages() ([]heldMessage, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, ride_id, originator, recipient, body, relayed_from FROM held_messages ORDER BY id",
+		Postgres: "SELECT id, ride_id, originator, recipient, body, relayed_from FROM held_messages ORDER BY id",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var held []heldMessage
+	for rows.Next() {
+		var m heldMessage
+		if err := rows.Scan(&m.ID, &m.RideID, &m.Originator, &m.Recipient, &m.Body, &m.RelayedFrom); err != nil {
+			return nil, err
+		}
+		held = append(held, m)
+	}
+	return held, rows.Err()
+}
+
+// ReleaseHeldMessage implements maintenanceStore
+func (s *sqlStore) ReleaseHeldMessage(id int) (bool, error) {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "DELETE FROM held_messages WHERE id = ?",
+		Postgres: "DELETE FROM held_messages WHERE id = $1",
+	}, id)
+	return n > 0, err
+}
+
+// maintenanceSince returns when maintenance mode was turned on, and whether it is on.
+// While it is on, we don't send notifications or relay messages, and
+// participants who contact us are told the service is temporarily unavailable.
+func maintenanceSince(store RideStore) (time.Time, bool) {
+	since, err := store.Setting("maintenance_since")
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	return t, err == nil
+}
+
+// maintenanceOn reports whether maintenance mode is on
+func maintenanceOn(store RideStore) bool {
+	_, on := maintenanceSince(store)
+	return on
+}
+
+// setMaintenance turns maintenance mode on or off. The setting is stored in
+// the database so it survives restarts during a migration.
+func setMaintenance(store RideStore, on bool) error {
+	if !on {
+		return store.DeleteSetting("maintenance_since")
+	}
+	return store.SetSetting("maintenance_since", time.Now().UTC().Format(time.RFC3339), false)
+}
+
+// sendRideMessage sends a message for a ride and logs it, or holds it back
+// until maintenance mode is turned off. relayedFrom is set for messages we
+// relay between participants, see logRelay. It returns the MessageBird ID of
+// the message, or heldMessageID.
+func sendRideMessage(store RideStore, mb *messagebird.Client, rideID int, originator string, recipient string, body string, params *sms.Params, relayedFrom string) string {
+	if maintenanceOn(store) {
+		err := store.HoldMessage(heldMessage{
+			RideID:      rideID,
+			Originator:  originator,
+			Recipient:   recipient,
+			Body:        body,
+			RelayedFrom: relayedFrom,
+		})
+		if err == nil {
+			return heldMessageID
+		}
+		log.Printf("Could not hold message to %s during maintenance, sending it: %v", recipient, err)
+	}
+	id := sendText(store, mb, rideContactChannel(store, rideID, recipient), originator, recipient, body, params)
+	if relayedFrom != "" {
+		logRelay(store, rideID, id, originator, recipient, body, relayedFrom)
+	} else {
+		logMessage(store, rideID, directionOutbound, id, originator, recipient, body)
+	}
+	return id
+}
+
+// heldMessage is a message held back by maintenance mode
+type heldMessage struct {
+	ID          int
+	RideID      int
+	Originator  string
+	Recipient   string
+	Body        string
+	RelayedFrom string
+}
+
+// releaseHeldMessages sends the messages held back by maintenance mode, in
+// the order they were held. It stops if maintenance mode is turned back on,
+// or ctx is done.
+func releaseHeldMessages(ctx context.Context, store RideStore, mb *messagebird.Client) {
+	held, err := store.HeldMessages()
+	if err != nil {
+		log.Printf("Could not load messages held during maintenance: %v", err)
+		return
+	}
+	if len(held) == 0 {
+		return
+	}
+	log.Printf("Maintenance mode off, sending %d held messages", len(held))
+	for _, m := range held {
+		if ctx.Err() != nil {
+			log.Println("Shutting down, holding the remaining messages")
+			return
+		}
+		if maintenanceOn(store) {
+			log.Println("Maintenance mode back on, holding the remaining messages")
+			return
+		}
+		// Delete first, so a message is never sent twice, even if it is
+		// being released by someone else too
+		released, err := store.ReleaseHeldMessage(m.ID)
+		if err != nil {
+			log.Printf("Could not release held message %d: %v", m.ID, err)
+			continue
+		}
+		if !released {
+			continue
+		}
+		var params *sms.Params
+		if m.RelayedFrom != "" {
+			params = deliveryReportParams()
+		}
+		sendRideMessage(store, mb, m.RideID, m.Originator, m.Recipient, m.Body, params, m.RelayedFrom)
+	}
+}
+
+// maintenancePage is the data rendered by views/default/maintenance.gohtml
+type maintenancePage struct {
+	On      bool
+	Since   string
+	Held    int
+	Message string
+}
+
+// maintenanceHandler lets operators turn maintenance mode on and off, e.g.
+// during migrations. Turning it off sends the messages held in the meantime.
+func maintenanceHandler(store RideStore, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var page maintenancePage
+		if r.Method == "POST" {
+			switch r.FormValue("action") {
+			case "on":
+				if err := setMaintenance(store, true); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+				} else {
+					log.Println("Maintenance mode on")
+					page.Message = "Maintenance mode is on. Notifications and relayed messages are held until you turn it off."
+				}
+			case "off":
+				if err := setMaintenance(store, false); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+				} else {
+					background.start(func(ctx context.Context) { releaseHeldMessages(ctx, store, mb) })
+					page.Message = "Maintenance mode is off. Held messages are being sent."
+				}
+			}
+		}
+
+		since, on := maintenanceSince(store)
+		page.On = on
+		if on {
+			page.Since = since.Local().Format("2006-01-02 15:04")
+		}
+		held, err := store.HeldMessages()
+		if err != nil {
+			log.Println(err)
+		}
+		page.Held = len(held)
+		renderDefaultTemplate(w, r, "maintenance.gohtml", page)
+	}
+}
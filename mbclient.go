@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// envDuration returns the duration in the environment variable name, or def
+// if it is unset. It exits on invalid values so misconfiguration is caught at startup.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s %q: must be a positive duration such as 10s", name, v)
+	}
+	return d
+}
+
+// envInt returns the positive integer in the environment variable name, or def
+// if it is unset. It exits on invalid values.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Fatalf("Invalid %s %q: must be a positive integer", name, v)
+	}
+	return n
+}
+
+// newMessageBirdHTTPClient returns the HTTP client we talk to MessageBird
+// with. Every request is bounded by MESSAGEBIRD_TIMEOUT, so a slow API can't
+// hang our handlers, and connections are pooled for bursts of sends.
+//
+// Knobs, with defaults:
+//
+//	MESSAGEBIRD_TIMEOUT=10s              whole request, including reading the response
+//	MESSAGEBIRD_DIAL_TIMEOUT=5s          opening a connection
+//	MESSAGEBIRD_TLS_TIMEOUT=5s           TLS handshake
+//	MESSAGEBIRD_MAX_IDLE_CONNS=20        idle connections kept for reuse
+//	MESSAGEBIRD_IDLE_CONN_TIMEOUT=90s    how long idle connections are kept
+//	MESSAGEBIRD_PROXY                    proxy URL; defaults to HTTPS_PROXY
+//
+// Responses are passed to throttle, which paces the notification queue.
+func newMessageBirdHTTPClient(throttle *adaptiveThrottle) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if v := os.Getenv("MESSAGEBIRD_PROXY"); v != "" {
+		proxyURL, err := url.Parse(v)
+		if err != nil {
+			log.Fatalf("Invalid MESSAGEBIRD_PROXY %q: %v", v, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	maxIdle := envInt("MESSAGEBIRD_MAX_IDLE_CONNS", 20)
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   envDuration("MESSAGEBIRD_DIAL_TIMEOUT", 5*time.Second),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: envDuration("MESSAGEBIRD_TLS_TIMEOUT", 5*time.Second),
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     envDuration("MESSAGEBIRD_IDLE_CONN_TIMEOUT", 90*time.Second),
+		ForceAttemptHTTP2:   true,
+	}
+	return &http.Client{
+		Transport: throttleTransport{next: transport, throttle: throttle},
+		Timeout:   envDuration("MESSAGEBIRD_TIMEOUT", 10*time.Second),
+	}
+}
+
+// newMessageBirdClient returns a MessageBird client using newMessageBirdHTTPClient
+func newMessageBirdClient(accessKey string, throttle *adaptiveThrottle) *messagebird.Client {
+	mb := messagebird.New(accessKey)
+	mb.HTTPClient = newMessageBirdHTTPClient(throttle)
+	return mb
+}
+
+// errMessagingOff is what MessageBird requests fail with while messaging is
+// off, see config.Config
+var errMessagingOff = errors.New("messaging is off: set -messaging=true and MESSAGEBIRD_API_KEY to text and call")
+
+// messagingOffTransport fails every request instead of sending it, for the
+// MessageBird client of a server running with messaging off
+type messagingOffTransport struct{}
+
+// RoundTrip implements http.RoundTripper
+func (messagingOffTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+	return nil, errMessagingOff
+}
@@ -0,0 +1,2025 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// memoryStore implements RideStore in memory, in maps and slices guarded by
+// a mutex, so the application can run without a database file or cgo, e.g.
+// for demos and tests. The data is lost when the application stops.
+//
+// Each method holds the mutex while it runs, so it is a transaction of its
+// own. Rows are kept like the SQL stores keep them, e.g. tags as
+// comma-separated lists, and methods return the same results and errors,
+// sql.ErrNoRows included, with unique constraints failing with a
+// *memoryUniqueError.
+type memoryStore struct {
+	mu  sync.Mutex
+	ids map[string]int // The last ID given to a row of each table
+
+	customers       map[int]Person // Without their alternate numbers, flags and shifts
+	drivers         map[int]Person
+	altNumbers      []memoryAltNumber
+	shifts          []memoryShift
+	proxyNumbers    map[int]memoryProxyNumber
+	rides           map[int]memoryRide
+	rideContacts    []memoryRideContact
+	reservations    map[int]proxyReservation
+	releases        []ProxyRelease
+	handoffs        []memoryHandoff
+	allocations     []string // RFC 3339 times in UTC
+	pairProxies     map[ridePair]int
+	relationships   map[int]memoryRelationship
+	waitingRides    []memoryWaitingRide
+	messages        []memoryMessage
+	calls           []memoryCall
+	archivedRides   map[int]memoryRide
+	archivedMsgs    []memoryMessage
+	archivedCalls   []memoryCall
+	optOuts         map[string]bool
+	templates       []templateVersion
+	quotaUsage      map[[3]string]int // By tenant, day and kind
+	settings        map[string]string
+	heldMessages    []heldMessage
+	languages       map[string]string
+	preferences     map[string]participantPreferences
+	preferenceLinks map[string]memoryPreferenceLink // By token hash
+	pendingActions  []memoryPendingAction
+	auditLog        []auditEntry
+	incidents       []memoryIncident
+	savedFilters    map[string]map[string]rideFilter // By owner and name
+	consents        []consentRecord
+	apiKeys         []memoryAPIKey
+	observers       []rideObserver
+	notes           []participantNote
+	sessions        map[string]memorySession // By token hash
+	users           map[string]memoryUser    // By name
+	processed       map[string]string        // When each webhook message ID was received
+}
+
+// Rows of the tables memoryStore keeps in slices or with fields of their own
+type (
+	memoryAltNumber struct {
+		ID       int
+		Role     string
+		PersonID int
+		Number   string
+	}
+	memoryShift struct {
+		ID        int
+		DriverID  int
+		StartedAt string
+		EndedAt   string // Empty while the shift lasts
+	}
+	memoryProxyNumber struct {
+		ProxyNumberType        // Without tags and features
+		Tags            string // comma-separated, see parseTags
+		Features        string
+	}
+	memoryRide struct {
+		ID           int
+		Start        string
+		Destination  string
+		DateTime     string
+		CustomerID   int
+		DriverID     int
+		NumberID     int
+		CustomerPIN  string
+		DriverPIN    string
+		RequiredTags string // comma-separated, see parseTags
+		Status       RideStatus
+		Labels       string
+		MutedBy      string
+		Activity     RideActivity
+	}
+	memoryRideContact struct {
+		RideID  int
+		Role    string
+		Number  string
+		Channel string
+	}
+	memoryHandoff struct {
+		ID          int
+		RideID      int
+		OldNumberID int
+		NewNumberID int
+		CreatedAt   string
+		ExpiresAt   string
+	}
+	memoryRelationship struct {
+		ID         int
+		CustomerID int
+		DriverID   int
+		NumberID   int
+		CreatedAt  string
+		ExpiresAt  string
+		EndedAt    string // Empty while the relationship lasts
+	}
+	memoryWaitingRide struct {
+		ID           int
+		Start        string
+		Destination  string
+		DateTime     string
+		CustomerID   int
+		DriverID     int
+		RequiredTags string
+		Labels       string
+		QueuedAt     string
+	}
+	memoryMessage struct {
+		ID int
+		messageRecord
+		CreatedAt string
+		Status    string
+	}
+	memoryCall struct {
+		ID            int
+		RideID        int
+		ProviderID    string
+		Source        string
+		Destination   string
+		TransferredTo string
+		CreatedAt     string
+	}
+	memoryPreferenceLink struct {
+		Number    string
+		CreatedAt string
+		ExpiresAt string
+	}
+	memoryPendingAction struct {
+		pendingAction
+		Status    string
+		DecidedBy string
+		DecidedAt string
+	}
+	memoryIncident struct {
+		ID         int
+		Kind       string
+		Summary    string
+		Rides      string // comma-separated, see joinRideIDs
+		Numbers    string // comma-separated, see joinNumbers
+		OpenedAt   string
+		ResolvedAt string
+	}
+	memoryAPIKey struct {
+		apiKey
+		Hash string
+	}
+	memorySession struct {
+		User      string
+		CreatedAt string
+		ExpiresAt string
+	}
+	memoryUser struct {
+		ID        int
+		Hash      string
+		CreatedAt string
+	}
+)
+
+// memoryUniqueError is returned by memoryStore methods that would give two
+// rows the same values where the SQL schema has a UNIQUE constraint
+type memoryUniqueError struct {
+	Constraint string // e.g. "customers.number"
+}
+
+// Error implements error
+func (e *memoryUniqueError) Error() string {
+	return "UNIQUE constraint failed: " + e.Constraint
+}
+
+var (
+	memoryStoresMu sync.Mutex
+	memoryStores   = make(map[string]*memoryStore)
+)
+
+// openMemoryStore opens the in-memory store called name. Stores opened with
+// the same name share their data, which lasts as long as the process.
+func openMemoryStore(name string) RideStore {
+	memoryStoresMu.Lock()
+	defer memoryStoresMu.Unlock()
+	if s, ok := memoryStores[name]; ok {
+		return s
+	}
+	s := &memoryStore{
+		ids:             make(map[string]int),
+		customers:       make(map[int]Person),
+		drivers:         make(map[int]Person),
+		proxyNumbers:    make(map[int]memoryProxyNumber),
+		rides:           make(map[int]memoryRide),
+		reservations:    make(map[int]proxyReservation),
+		pairProxies:     make(map[ridePair]int),
+		relationships:   make(map[int]memoryRelationship),
+		archivedRides:   make(map[int]memoryRide),
+		optOuts:         make(map[string]bool),
+		quotaUsage:      make(map[[3]string]int),
+		settings:        make(map[string]string),
+		languages:       make(map[string]string),
+		preferences:     make(map[string]participantPreferences),
+		preferenceLinks: make(map[string]memoryPreferenceLink),
+		savedFilters:    make(map[string]map[string]rideFilter),
+		sessions:        make(map[string]memorySession),
+		users:           make(map[string]memoryUser),
+		processed:       make(map[string]string),
+	}
+	memoryStores[name] = s
+	return s
+}
+
+// newID returns the ID of a new row of table
+func (s *memoryStore) newID(table string) int {
+	s.ids[table]++
+	return s.ids[table]
+}
+
+// IsUniqueViolation implements RideStore
+func (s *memoryStore) IsUniqueViolation(err error) bool {
+	var uniqueErr *memoryUniqueError
+	return errors.As(err, &uniqueErr)
+}
+
+// Ping implements RideStore
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+// Close implements RideStore. The data stays, for stores opened with the
+// same name later.
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// AppliedMigrations implements migrationStore. The in-memory store has no
+// schema to migrate, so it is always up to date.
+func (s *memoryStore) AppliedMigrations() ([]int, error) {
+	var versions []int
+	for _, m := range migrations.All {
+		versions = append(versions, m.Version)
+	}
+	return versions, nil
+}
+
+// SchemaVersion implements migrationStore
+func (s *memoryStore) SchemaVersion() (int, error) {
+	return migrations.Latest(), nil
+}
+
+// ExpandTarget implements migrationStore
+func (s *memoryStore) ExpandTarget() (int, *migrations.Migration, error) {
+	return migrations.Latest(), nil, nil
+}
+
+// MigrateUp implements migrationStore
+func (s *memoryStore) MigrateUp(target int) ([]migrations.Migration, error) {
+	return nil, nil
+}
+
+// MigrateDown implements migrationStore
+func (s *memoryStore) MigrateDown(target int) ([]migrations.Migration, error) {
+	if target >= migrations.Latest() {
+		return nil, nil
+	}
+	return nil, errors.New("the in-memory store has no schema to revert")
+}
+
+// Load implements RideStore
+func (s *memoryStore) Load() (*RideSharingDB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	customers := make(map[int]Person)
+	for id, v := range s.customers {
+		customers[id] = v
+	}
+	drivers := make(map[int]Person)
+	for id, v := range s.drivers {
+		drivers[id] = v
+	}
+	personFor := func(role string, id int, add func(p *Person)) {
+		people := customers
+		if role == roleDriver {
+			people = drivers
+		}
+		if p, ok := people[id]; ok {
+			add(&p)
+			people[id] = p
+		}
+	}
+	for _, v := range s.altNumbers {
+		number := v.Number
+		personFor(v.Role, v.PersonID, func(p *Person) { p.AltNumbers = append(p.AltNumbers, number) })
+	}
+	for _, v := range s.notes {
+		if flag := v.Flag; flag != "" {
+			personFor(v.Role, v.PersonID, func(p *Person) { p.addFlag(flag) })
+		}
+	}
+	// The latest shift of each driver says whether they're on shift
+	for _, v := range s.shifts {
+		if driver, ok := drivers[v.DriverID]; ok {
+			driver.Shift, driver.ShiftSince = shiftOn, v.StartedAt
+			if v.EndedAt != "" {
+				driver.Shift, driver.ShiftSince = shiftOff, ""
+			}
+			drivers[v.DriverID] = driver
+		}
+	}
+
+	proxyNumbers := make(map[int]ProxyNumberType)
+	for id, v := range s.proxyNumbers {
+		number := v.ProxyNumberType
+		number.Tags = parseTags(v.Tags)
+		number.Features = parseTags(v.Features)
+		proxyNumbers[id] = number
+	}
+
+	rides := make(map[int]RideType)
+	for id, v := range s.rides {
+		ride := RideType{
+			ID:              v.ID,
+			Start:           v.Start,
+			Destination:     v.Destination,
+			DateTime:        v.DateTime,
+			ThisCustomer:    Person{ID: v.CustomerID},
+			ThisDriver:      Person{ID: v.DriverID},
+			ThisProxyNumber: ProxyNumberType{ID: v.NumberID},
+			CustomerPIN:     v.CustomerPIN,
+			DriverPIN:       v.DriverPIN,
+			RequiredTags:    parseTags(v.RequiredTags),
+			Labels:          parseTags(v.Labels),
+			Status:          v.Status,
+			MutedBy:         parseTags(v.MutedBy),
+			Activity:        v.Activity,
+		}
+		// Like sqlStore.Load, rides get the participants' details shown
+		// on the views
+		if c, ok := customers[v.CustomerID]; ok {
+			ride.ThisCustomer.Name = c.Name
+			ride.ThisCustomer.Number = c.Number
+			ride.ThisCustomer.AltNumbers = c.AltNumbers
+			ride.ThisCustomer.Flags = c.Flags
+		}
+		if d, ok := drivers[v.DriverID]; ok {
+			ride.ThisDriver.Name = d.Name
+			ride.ThisDriver.Number = d.Number
+			ride.ThisDriver.AltNumbers = d.AltNumbers
+			ride.ThisDriver.Vehicle = d.Vehicle
+			ride.ThisDriver.Flags = d.Flags
+			ride.ThisDriver.Shift = d.Shift
+			ride.ThisDriver.ShiftSince = d.ShiftSince
+		}
+		if proxy, ok := proxyNumbers[v.NumberID]; ok {
+			ride.ThisProxyNumber = proxy
+		}
+		ride.NumGrp = [][]int{{v.CustomerID, ride.ThisProxyNumber.ID}, {v.DriverID, ride.ThisProxyNumber.ID}}
+		rides[id] = ride
+	}
+	for _, v := range s.rideContacts {
+		if ride, ok := rides[v.RideID]; ok {
+			if v.Role == roleDriver {
+				ride.DriverLastUsed, ride.DriverChannel = v.Number, v.Channel
+			} else {
+				ride.CustomerLastUsed, ride.CustomerChannel = v.Number, v.Channel
+			}
+			rides[v.RideID] = ride
+		}
+	}
+
+	relationships := make(map[int]RelationshipType)
+	for id, v := range s.relationships {
+		if v.EndedAt == "" {
+			relationships[id] = RelationshipType{
+				ID:              v.ID,
+				ThisCustomer:    customers[v.CustomerID],
+				ThisDriver:      drivers[v.DriverID],
+				ThisProxyNumber: proxyNumbers[v.NumberID],
+				CreatedAt:       v.CreatedAt,
+				ExpiresAt:       v.ExpiresAt,
+			}
+		}
+	}
+	var releases []ProxyRelease
+	since := time.Now().Add(-proxyCooldown()).UTC().Format(time.RFC3339)
+	for _, v := range s.releases {
+		if v.ReleasedAt > since {
+			releases = append(releases, v)
+		}
+	}
+	var handoffs []ProxyHandoff
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, v := range s.handoffs {
+		if v.ExpiresAt > now {
+			handoff := ProxyHandoff{RideID: v.RideID, OldProxy: ProxyNumberType{ID: v.OldNumberID}, ExpiresAt: v.ExpiresAt}
+			if proxy, ok := proxyNumbers[v.OldNumberID]; ok {
+				handoff.OldProxy = proxy
+			}
+			handoffs = append(handoffs, handoff)
+		}
+	}
+	pairProxies := make(map[ridePair]int)
+	for pair, proxyID := range s.pairProxies {
+		pairProxies[pair] = proxyID
+	}
+	var waitingRides []WaitingRide
+	for _, v := range s.waitingRides {
+		waitingRides = append(waitingRides, WaitingRide{
+			ID:           v.ID,
+			Start:        v.Start,
+			Destination:  v.Destination,
+			DateTime:     v.DateTime,
+			ThisCustomer: customers[v.CustomerID],
+			ThisDriver:   drivers[v.DriverID],
+			RequiredTags: parseTags(v.RequiredTags),
+			Labels:       parseTags(v.Labels),
+			QueuedAt:     v.QueuedAt,
+		})
+	}
+	return &RideSharingDB{
+		Customers:     customers,
+		Drivers:       drivers,
+		ProxyNumbers:  proxyNumbers,
+		Rides:         rides,
+		Relationships: relationships,
+		Releases:      releases,
+		Handoffs:      handoffs,
+		PairProxies:   pairProxies,
+		WaitingRides:  waitingRides,
+	}, nil
+}
+
+// people returns the customers or drivers, depending on role
+func (s *memoryStore) people(role string) (map[int]Person, string) {
+	if role == roleDriver {
+		return s.drivers, "drivers"
+	}
+	return s.customers, "customers"
+}
+
+// personWithNumber returns the ID of the person in people with number, or 0
+func personWithNumber(people map[int]Person, number string) int {
+	for id, v := range people {
+		if v.Number == number {
+			return id
+		}
+	}
+	return 0
+}
+
+// SeedExampleData implements peopleStore
+func (s *memoryStore) SeedExampleData() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upsert := func(role string, p Person) {
+		people, table := s.people(role)
+		if id := personWithNumber(people, p.Number); id != 0 {
+			existing := people[id]
+			existing.Name, existing.Vehicle = p.Name, p.Vehicle
+			people[id] = existing
+			return
+		}
+		p.ID = s.newID(table)
+		people[p.ID] = p
+	}
+	upsert(roleCustomer, Person{Name: "Caitlyn Carless", Number: "319700000"})
+	upsert(roleCustomer, Person{Name: "Danny Bikes", Number: "319700001"})
+	upsert(roleDriver, Person{Name: "David Driver", Number: "319700002", Vehicle: "Blue Toyota Prius"})
+	upsert(roleDriver, Person{Name: "Eileen LaRue", Number: "319700003", Vehicle: "Silver Tesla Model 3"})
+	if len(s.proxyNumbers) == 0 {
+		s.addProxyNumber("319700004", "active", "")
+		s.addProxyNumber("319700005", "active", "")
+	}
+	return nil
+}
+
+// AddPerson implements peopleStore
+func (s *memoryStore) AddPerson(role string, p Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	people, table := s.people(role)
+	if personWithNumber(people, p.Number) != 0 {
+		return &memoryUniqueError{table + ".number"}
+	}
+	person := Person{ID: s.newID(table), Name: p.Name, Number: p.Number}
+	if role == roleDriver {
+		person.Vehicle = p.Vehicle
+	}
+	people[person.ID] = person
+	return nil
+}
+
+// UpdatePerson implements peopleStore
+func (s *memoryStore) UpdatePerson(role string, p Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	people, table := s.people(role)
+	person, ok := people[p.ID]
+	if !ok {
+		return nil
+	}
+	if id := personWithNumber(people, p.Number); id != 0 && id != p.ID {
+		return &memoryUniqueError{table + ".number"}
+	}
+	person.Name, person.Number = p.Name, p.Number
+	if role == roleDriver {
+		person.Vehicle = p.Vehicle
+	}
+	people[p.ID] = person
+	return nil
+}
+
+// SetDeactivated implements peopleStore
+func (s *memoryStore) SetDeactivated(role string, id int, deactivated bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	people, _ := s.people(role)
+	if person, ok := people[id]; ok {
+		person.Deactivated = deactivated
+		people[id] = person
+	}
+	return nil
+}
+
+// addProxyNumber adds number to the pool, reporting false if the pool
+// already has it
+func (s *memoryStore) addProxyNumber(number string, status string, tags string) bool {
+	for _, v := range s.proxyNumbers {
+		if v.Number == number {
+			return false
+		}
+	}
+	id := s.newID("proxy_numbers")
+	s.proxyNumbers[id] = memoryProxyNumber{ProxyNumberType: ProxyNumberType{ID: id, Number: number, PortStatus: status}, Tags: tags}
+	return true
+}
+
+// AddProxyNumber implements proxyNumberStore
+func (s *memoryStore) AddProxyNumber(number string, status string, tags []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addProxyNumber(number, status, strings.Join(tags, ",")), nil
+}
+
+// DeleteProxyNumber implements proxyNumberStore
+func (s *memoryStore) DeleteProxyNumber(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for reservationID, v := range s.reservations {
+		if v.ProxyID == id {
+			delete(s.reservations, reservationID)
+		}
+	}
+	releases := s.releases[:0]
+	for _, v := range s.releases {
+		if v.ProxyID != id {
+			releases = append(releases, v)
+		}
+	}
+	s.releases = releases
+	for pair, proxyID := range s.pairProxies {
+		if proxyID == id {
+			delete(s.pairProxies, pair)
+		}
+	}
+	delete(s.proxyNumbers, id)
+	return nil
+}
+
+// updateProxyNumber applies change to the proxy number with id, if there is one
+func (s *memoryStore) updateProxyNumber(id int, change func(v *memoryProxyNumber)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.proxyNumbers[id]; ok {
+		change(&v)
+		s.proxyNumbers[id] = v
+	}
+	return nil
+}
+
+// SetPortStatus implements proxyNumberStore
+func (s *memoryStore) SetPortStatus(id int, status string) error {
+	return s.updateProxyNumber(id, func(v *memoryProxyNumber) { v.PortStatus = status })
+}
+
+// ChangePortStatus implements proxyNumberStore
+func (s *memoryStore) ChangePortStatus(id int, from string, to string) error {
+	return s.updateProxyNumber(id, func(v *memoryProxyNumber) {
+		if v.PortStatus == from {
+			v.PortStatus = to
+		}
+	})
+}
+
+// SetProxyFeatures implements proxyNumberStore
+func (s *memoryStore) SetProxyFeatures(id int, features []string) error {
+	return s.updateProxyNumber(id, func(v *memoryProxyNumber) { v.Features = strings.Join(features, ",") })
+}
+
+// SetProviderID implements proxyNumberStore
+func (s *memoryStore) SetProviderID(id int, providerID string) error {
+	return s.updateProxyNumber(id, func(v *memoryProxyNumber) { v.ProviderID = providerID })
+}
+
+// release records that customerID and driverID stop using the proxy number
+// with ID proxyID at releasedAt, see releaseStatement
+func (s *memoryStore) release(proxyID int, customerID int, driverID int, releasedAt time.Time) {
+	s.releases = append(s.releases, ProxyRelease{proxyID, customerID, driverID, releasedAt.UTC().Format(time.RFC3339)})
+}
+
+// allocate records that the proxy number with ID proxyID was given to
+// customerID and driverID's ride, see allocationStatement and
+// pairProxyStatement
+func (s *memoryStore) allocate(proxyID int, customerID int, driverID int) {
+	s.allocations = append(s.allocations, time.Now().UTC().Format(time.RFC3339))
+	s.pairProxies[ridePair{customerID, driverID}] = proxyID
+}
+
+// TransitionRide implements rideStore
+func (s *memoryStore) TransitionRide(ride RideType, next RideStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.rides[ride.ID]
+	if !ok || v.Status != ride.Status {
+		return fmt.Errorf("ride %d is no longer %s", ride.ID, ride.Status)
+	}
+	v.Status = next
+	s.rides[ride.ID] = v
+	if next.Terminal() {
+		// Hold the number back from the participants' next rides
+		s.release(ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID, time.Now())
+	}
+	return nil
+}
+
+// DeleteRide implements rideStore
+func (s *memoryStore) DeleteRide(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteRideContacts(map[int]bool{id: true})
+	delete(s.rides, id)
+	return nil
+}
+
+// deleteRideContacts deletes the contact numbers of the rides in ids
+func (s *memoryStore) deleteRideContacts(ids map[int]bool) {
+	contacts := s.rideContacts[:0]
+	for _, v := range s.rideContacts {
+		if !ids[v.RideID] {
+			contacts = append(contacts, v)
+		}
+	}
+	s.rideContacts = contacts
+}
+
+// reserveProxy reserves the proxy number of r for its customer and driver,
+// like sqlStore.reserveProxy
+func (s *memoryStore) reserveProxy(r proxyReservation) error {
+	held := false
+	for _, v := range s.reservations {
+		if v.ProxyID != r.ProxyID || (v.CustomerID != r.CustomerID && v.DriverID != r.DriverID) {
+			continue
+		}
+		if v != r {
+			return errProxyTaken
+		}
+		held = true
+	}
+	if !held {
+		s.reservations[s.newID("proxy_reservations")] = r
+	}
+	return nil
+}
+
+// InsertRide implements reservationStore
+func (s *memoryStore) InsertRide(ride RideType) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertRide(ride)
+}
+
+// insertRide inserts ride like InsertRide, with s locked
+func (s *memoryStore) insertRide(ride RideType) (int, error) {
+	if err := s.reserveProxy(proxyReservation{ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID}); err != nil {
+		return 0, err
+	}
+	id := s.newID("rides")
+	s.rides[id] = memoryRide{
+		ID:           id,
+		Start:        ride.Start,
+		Destination:  ride.Destination,
+		DateTime:     ride.DateTime,
+		CustomerID:   ride.ThisCustomer.ID,
+		DriverID:     ride.ThisDriver.ID,
+		NumberID:     ride.ThisProxyNumber.ID,
+		CustomerPIN:  ride.CustomerPIN,
+		DriverPIN:    ride.DriverPIN,
+		RequiredTags: strings.Join(ride.RequiredTags, ","),
+		Status:       rideScheduled,
+		Labels:       strings.Join(ride.Labels, ","),
+	}
+	s.allocate(ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID)
+	return id, nil
+}
+
+// MoveRide implements reservationStore
+func (s *memoryStore) MoveRide(ride RideType, proxy ProxyNumberType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.moveRide(ride, proxy, time.Now())
+}
+
+// moveRide moves ride to proxy like MoveRide, with its participants
+// releasing their old number at releasedAt, with s locked
+func (s *memoryStore) moveRide(ride RideType, proxy ProxyNumberType, releasedAt time.Time) error {
+	if err := s.reserveProxy(proxyReservation{proxy.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID}); err != nil {
+		return err
+	}
+	if v, ok := s.rides[ride.ID]; ok {
+		v.NumberID = proxy.ID
+		s.rides[ride.ID] = v
+	}
+	s.allocate(proxy.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID)
+	s.release(ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID, releasedAt)
+	return nil
+}
+
+// SyncReservations implements reservationStore
+func (s *memoryStore) SyncReservations() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := make(map[proxyReservation]bool)
+	for _, v := range s.rides {
+		if v.Status == rideScheduled || v.Status == rideActive {
+			held[proxyReservation{v.NumberID, v.CustomerID, v.DriverID}] = true
+		}
+	}
+	now := time.Now()
+	for _, v := range s.relationships {
+		if v.EndedAt == "" && !(RelationshipType{ExpiresAt: v.ExpiresAt}).expired(now) {
+			held[proxyReservation{v.NumberID, v.CustomerID, v.DriverID}] = true
+		}
+	}
+
+	type participant struct{ ProxyID, ID int }
+	reserved := make(map[proxyReservation]bool)
+	customers := make(map[participant]bool)
+	drivers := make(map[participant]bool)
+	for id, r := range s.reservations {
+		if !held[r] {
+			delete(s.reservations, id)
+			continue
+		}
+		reserved[r] = true
+		customers[participant{r.ProxyID, r.CustomerID}] = true
+		drivers[participant{r.ProxyID, r.DriverID}] = true
+	}
+	for r := range held {
+		if reserved[r] {
+			continue
+		}
+		c, d := participant{r.ProxyID, r.CustomerID}, participant{r.ProxyID, r.DriverID}
+		if customers[c] || drivers[d] {
+			log.Printf("Could not reserve proxy number %d for customer %d and driver %d: it is reserved for one of them with someone else. Run the doctor command to repair it.",
+				r.ProxyID, r.CustomerID, r.DriverID)
+			continue
+		}
+		s.reservations[s.newID("proxy_reservations")] = r
+		customers[c] = true
+		drivers[d] = true
+	}
+	return nil
+}
+
+// SetOptOut implements optOutStore
+func (s *memoryStore) SetOptOut(number string, optOut bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if optOut {
+		s.optOuts[number] = true
+	} else {
+		delete(s.optOuts, number)
+	}
+	return nil
+}
+
+// SetRideContact implements contactStore
+func (s *memoryStore) SetRideContact(rideID int, role string, number string, channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.rideContacts {
+		if v.RideID == rideID && v.Role == role {
+			s.rideContacts[i].Number, s.rideContacts[i].Channel = number, channel
+			return nil
+		}
+	}
+	s.rideContacts = append(s.rideContacts, memoryRideContact{rideID, role, number, channel})
+	return nil
+}
+
+// AddAlternateNumber implements contactStore
+func (s *memoryStore) AddAlternateNumber(role string, personID int, number string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.altNumbers {
+		if v.Number == number {
+			return &memoryUniqueError{"alternate_numbers.number"}
+		}
+	}
+	s.altNumbers = append(s.altNumbers, memoryAltNumber{s.newID("alternate_numbers"), role, personID, number})
+	return nil
+}
+
+// RideContactChannel implements contactStore
+func (s *memoryStore) RideContactChannel(rideID int, number string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.rideContacts {
+		if v.RideID == rideID && v.Number == number {
+			return v.Channel, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+// LogMessage implements messageLogStore
+func (s *memoryStore) LogMessage(m messageRecord, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, memoryMessage{ID: s.newID("messages"), messageRecord: m, CreatedAt: at.UTC().Format(time.RFC3339)})
+	return nil
+}
+
+// LogCall implements messageLogStore
+func (s *memoryStore) LogCall(rideID int, call InboundCall, transferredTo string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, memoryCall{
+		ID:            s.newID("calls"),
+		RideID:        rideID,
+		ProviderID:    call.CallID,
+		Source:        call.Source,
+		Destination:   call.Destination,
+		TransferredTo: transferredTo,
+		CreatedAt:     at.UTC().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// LoggedMessages implements messageLogStore
+func (s *memoryStore) LoggedMessages(f messageFilter) ([]apiMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var from, until string
+	if !f.Day.IsZero() {
+		from, until = f.Day.Format(time.RFC3339), f.Day.AddDate(0, 0, 1).Format(time.RFC3339)
+	}
+	messages := []apiMessage{}
+	for i := len(s.messages) - 1; i >= 0 && len(messages) < f.Limit; i-- {
+		m := s.messages[i]
+		switch {
+		case f.RideID != 0 && m.RideID != f.RideID,
+			f.Proxy != "" && m.Originator != f.Proxy && m.Recipient != f.Proxy,
+			f.Direction != "" && m.Direction != f.Direction,
+			from != "" && (m.CreatedAt < from || m.CreatedAt >= until):
+			continue
+		}
+		messages = append(messages, apiMessage{
+			ID:         m.ID,
+			RideID:     m.RideID,
+			Direction:  m.Direction,
+			Originator: m.Originator,
+			Recipient:  m.Recipient,
+			Body:       m.Body,
+			Status:     m.Status,
+			Provider:   m.Provider,
+			ProviderID: m.ProviderID,
+			CreatedAt:  m.CreatedAt,
+		})
+	}
+	return messages, nil
+}
+
+// FindLoggedMessage implements deliveryReportStore
+func (s *memoryStore) FindLoggedMessage(providerID string, recipient string) (loggedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m.ProviderID == providerID && m.Recipient == recipient && m.Direction == directionOutbound {
+			return loggedMessage{RideID: m.RideID, Originator: m.Originator, RelayedFrom: m.RelayedFrom, Status: m.Status}, nil
+		}
+	}
+	return loggedMessage{}, sql.ErrNoRows
+}
+
+// SetMessageStatus implements deliveryReportStore
+func (s *memoryStore) SetMessageStatus(providerID string, recipient string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.messages {
+		if m.ProviderID == providerID && m.Recipient == recipient {
+			s.messages[i].Status = status
+		}
+	}
+	return nil
+}
+
+// TemplateVersions implements templateStore
+func (s *memoryStore) TemplateVersions(name string) ([]templateVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var versions []templateVersion
+	for i := len(s.templates) - 1; i >= 0; i-- {
+		if s.templates[i].Name == name {
+			versions = append(versions, s.templates[i])
+		}
+	}
+	return versions, nil
+}
+
+// SaveTemplateVersion implements templateStore
+func (s *memoryStore) SaveTemplateVersion(name string, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templates = append(s.templates, templateVersion{s.newID("message_templates"), name, body, time.Now().UTC().Format(time.RFC3339)})
+	return nil
+}
+
+// memoryCSVColumns are the columns of the tables ArchiveRides exports, as
+// the SQL stores export them
+var memoryCSVColumns = map[string][]string{
+	"messages": {"id", "ride_id", "direction", "provider_id", "originator", "recipient", "body", "created_at", "relayed_from", "status", "provider"},
+	"calls":    {"id", "ride_id", "provider_id", "source", "destination", "transferred_to", "created_at"},
+	"rides": {"id", "start", "destination", "datetime", "customer_id", "driver_id", "number_id", "customer_pin", "driver_pin",
+		"required_tags", "status", "labels", "muted_by", "relayed_texts", "last_text_at", "relayed_calls", "last_call_at"},
+}
+
+// record returns the columns of m in the order of memoryCSVColumns
+func (m memoryMessage) record() []string {
+	return []string{strconv.Itoa(m.ID), strconv.Itoa(m.RideID), m.Direction, m.ProviderID, m.Originator, m.Recipient,
+		m.Body, m.CreatedAt, m.RelayedFrom, m.Status, m.Provider}
+}
+
+// record returns the columns of c in the order of memoryCSVColumns
+func (c memoryCall) record() []string {
+	return []string{strconv.Itoa(c.ID), strconv.Itoa(c.RideID), c.ProviderID, c.Source, c.Destination, c.TransferredTo, c.CreatedAt}
+}
+
+// record returns the columns of r in the order of memoryCSVColumns
+func (r memoryRide) record() []string {
+	return []string{strconv.Itoa(r.ID), r.Start, r.Destination, r.DateTime, strconv.Itoa(r.CustomerID), strconv.Itoa(r.DriverID),
+		strconv.Itoa(r.NumberID), r.CustomerPIN, r.DriverPIN, r.RequiredTags, string(r.Status), r.Labels, r.MutedBy,
+		strconv.Itoa(r.Activity.Texts), r.Activity.LastText, strconv.Itoa(r.Activity.Calls), r.Activity.LastCall}
+}
+
+// ArchiveRides implements archiveStore
+func (s *memoryStore) ArchiveRides(ids []int, csvDir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archived := make(map[int]bool)
+	for _, id := range ids {
+		archived[id] = true
+	}
+	var messages, keptMessages []memoryMessage
+	for _, m := range s.messages {
+		if archived[m.RideID] {
+			messages = append(messages, m)
+		} else {
+			keptMessages = append(keptMessages, m)
+		}
+	}
+	var calls, keptCalls []memoryCall
+	for _, c := range s.calls {
+		if archived[c.RideID] {
+			calls = append(calls, c)
+		} else {
+			keptCalls = append(keptCalls, c)
+		}
+	}
+	var rides []memoryRide
+	for _, id := range ids {
+		if r, ok := s.rides[id]; ok {
+			rides = append(rides, r)
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool { return rides[i].ID < rides[j].ID })
+
+	// Nothing changes until the CSV files are written, so a failed export
+	// leaves the rides where they were
+	if csvDir != "" {
+		stamp := time.Now().UTC().Format("20060102T150405Z")
+		records := map[string][][]string{}
+		for _, m := range messages {
+			records["messages"] = append(records["messages"], m.record())
+		}
+		for _, c := range calls {
+			records["calls"] = append(records["calls"], c.record())
+		}
+		for _, r := range rides {
+			records["rides"] = append(records["rides"], r.record())
+		}
+		for _, t := range archivedTables {
+			file := filepath.Join(csvDir, fmt.Sprintf("%s-%s.csv", t.Table, stamp))
+			if err := writeCSV(file, memoryCSVColumns[t.Table], records[t.Table]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Hold the rides' proxy numbers back from their participants' next rides, see cooldown.go
+	now := time.Now()
+	for _, r := range rides {
+		s.release(r.NumberID, r.CustomerID, r.DriverID, now)
+	}
+	s.deleteRideContacts(archived)
+	observers := s.observers[:0]
+	for _, o := range s.observers {
+		if !archived[o.RideID] {
+			observers = append(observers, o)
+		}
+	}
+	s.observers = observers
+	s.archivedMsgs = append(s.archivedMsgs, messages...)
+	s.messages = keptMessages
+	s.archivedCalls = append(s.archivedCalls, calls...)
+	s.calls = keptCalls
+	for _, r := range rides {
+		s.archivedRides[r.ID] = r
+		delete(s.rides, r.ID)
+	}
+	return nil
+}
+
+// PurgeArchivedLogs implements archiveStore
+func (s *memoryStore) PurgeArchivedLogs() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.archivedMsgs, s.archivedCalls = nil, nil
+	return nil
+}
+
+// ConsumeQuota implements quotaStore
+func (s *memoryStore) ConsumeQuota(tenant string, day string, kind string, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [3]string{tenant, day, kind}
+	if limit != 0 && s.quotaUsage[key] >= limit {
+		return false, nil
+	}
+	s.quotaUsage[key]++
+	return true, nil
+}
+
+// RefundQuota implements quotaStore
+func (s *memoryStore) RefundQuota(tenant string, day string, kind string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [3]string{tenant, day, kind}
+	if s.quotaUsage[key] > 0 {
+		s.quotaUsage[key]--
+	}
+	return nil
+}
+
+// QuotaUsage implements quotaStore
+func (s *memoryStore) QuotaUsage(tenant string, day string) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := make(map[string]int)
+	for key, n := range s.quotaUsage {
+		if key[0] == tenant && key[1] == day {
+			used[key[2]] = n
+		}
+	}
+	return used, nil
+}
+
+// Setting implements settingStore
+func (s *memoryStore) Setting(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.settings[name]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return value, nil
+}
+
+// SetSetting implements settingStore
+func (s *memoryStore) SetSetting(name string, value string, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.settings[name]; !ok || replace {
+		s.settings[name] = value
+	}
+	return nil
+}
+
+// DeleteSetting implements settingStore
+func (s *memoryStore) DeleteSetting(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.settings, name)
+	return nil
+}
+
+// HoldMessage implements maintenanceStore
+func (s *memoryStore) HoldMessage(m heldMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = s.newID("held_messages")
+	s.heldMessages = append(s.heldMessages, m)
+	return nil
+}
+
+// HeldMessages implements maintenanceStore
+func (s *memoryStore) HeldMessages() ([]heldMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]heldMessage(nil), s.heldMessages...), nil
+}
+
+// ReleaseHeldMessage implements maintenanceStore
+func (s *memoryStore) ReleaseHeldMessage(id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.heldMessages {
+		if m.ID == id {
+			s.heldMessages = append(s.heldMessages[:i], s.heldMessages[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Language implements languageStore
+func (s *memoryStore) Language(number string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lang, ok := s.languages[number]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return lang, nil
+}
+
+// SetLanguage implements languageStore
+func (s *memoryStore) SetLanguage(number string, lang string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.languages[number] = lang
+	return nil
+}
+
+// AddRelationship implements relationshipStore
+func (s *memoryStore) AddRelationship(customerID int, driverID int, proxyID int, now time.Time, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID("relationships")
+	s.relationships[id] = memoryRelationship{
+		ID:         id,
+		CustomerID: customerID,
+		DriverID:   driverID,
+		NumberID:   proxyID,
+		CreatedAt:  now.UTC().Format(time.RFC3339),
+		ExpiresAt:  expires.UTC().Format(time.RFC3339),
+	}
+	return nil
+}
+
+// SetRelationshipExpiry implements relationshipStore
+func (s *memoryStore) SetRelationshipExpiry(id int, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rel, ok := s.relationships[id]; ok {
+		rel.ExpiresAt = expires.UTC().Format(time.RFC3339)
+		s.relationships[id] = rel
+	}
+	return nil
+}
+
+// EndRelationship implements relationshipStore
+func (s *memoryStore) EndRelationship(id int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rel, ok := s.relationships[id]
+	if !ok || rel.EndedAt != "" {
+		return nil
+	}
+	rel.EndedAt = now.UTC().Format(time.RFC3339)
+	s.relationships[id] = rel
+	s.release(rel.NumberID, rel.CustomerID, rel.DriverID, now)
+	return nil
+}
+
+// HandOffRide implements handoffStore
+func (s *memoryStore) HandOffRide(ride RideType, proxy ProxyNumberType, now time.Time, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The old number is bridged until the handoff expires, and cools down
+	// after that in case it is reinstated
+	if err := s.moveRide(ride, proxy, expires); err != nil {
+		return err
+	}
+	s.handoffs = append(s.handoffs, memoryHandoff{
+		ID:          s.newID("proxy_handoffs"),
+		RideID:      ride.ID,
+		OldNumberID: ride.ThisProxyNumber.ID,
+		NewNumberID: proxy.ID,
+		CreatedAt:   now.UTC().Format(time.RFC3339),
+		ExpiresAt:   expires.UTC().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// Preferences implements preferenceStore
+func (s *memoryStore) Preferences(number string) (participantPreferences, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.preferences[number]; ok {
+		return p, nil
+	}
+	return participantPreferences{Number: number, Channel: channelAny}, nil
+}
+
+// SavePreferences implements preferenceStore
+func (s *memoryStore) SavePreferences(p participantPreferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.preferences[p.Number] = p
+	return nil
+}
+
+// AddPreferencesLink implements preferenceStore
+func (s *memoryStore) AddPreferencesLink(tokenHash string, number string, now time.Time, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.preferenceLinks[tokenHash]; ok {
+		return &memoryUniqueError{"preference_links.token"}
+	}
+	s.preferenceLinks[tokenHash] = memoryPreferenceLink{number, now.UTC().Format(time.RFC3339), expires.UTC().Format(time.RFC3339)}
+	return nil
+}
+
+// PreferencesLinkNumber implements preferenceStore
+func (s *memoryStore) PreferencesLinkNumber(tokenHash string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.preferenceLinks[tokenHash]
+	if !ok || link.ExpiresAt <= now.UTC().Format(time.RFC3339) {
+		return "", sql.ErrNoRows
+	}
+	return link.Number, nil
+}
+
+// AllocationsSince implements allocationStore
+func (s *memoryStore) AllocationsSince(since time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	after := since.UTC().Format(time.RFC3339)
+	var allocations []string
+	for _, v := range s.allocations {
+		if v > after {
+			allocations = append(allocations, v)
+		}
+	}
+	return allocations, nil
+}
+
+// DeleteAllocations implements allocationStore
+func (s *memoryStore) DeleteAllocations(until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := until.UTC().Format(time.RFC3339)
+	allocations := s.allocations[:0]
+	for _, v := range s.allocations {
+		if v > last {
+			allocations = append(allocations, v)
+		}
+	}
+	s.allocations = allocations
+	return nil
+}
+
+// AddPendingAction implements approvalStore
+func (s *memoryStore) AddPendingAction(v pendingAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v.ID = s.newID("pending_actions")
+	s.pendingActions = append(s.pendingActions, memoryPendingAction{pendingAction: v, Status: "pending"})
+	return nil
+}
+
+// PendingActions implements approvalStore
+func (s *memoryStore) PendingActions(since time.Time) ([]pendingAction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	after := since.UTC().Format(time.RFC3339)
+	var actions []pendingAction
+	for _, v := range s.pendingActions {
+		if v.Status == "pending" && v.RequestedAt > after {
+			actions = append(actions, v.pendingAction)
+		}
+	}
+	return actions, nil
+}
+
+// DecidePendingAction implements approvalStore
+func (s *memoryStore) DecidePendingAction(id int, actor string, status string, since time.Time, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	after := since.UTC().Format(time.RFC3339)
+	for i, v := range s.pendingActions {
+		if v.ID == id && v.Status == "pending" && v.RequestedAt > after && v.RequestedBy != actor {
+			s.pendingActions[i].Status = status
+			s.pendingActions[i].DecidedBy = actor
+			s.pendingActions[i].DecidedAt = now.UTC().Format(time.RFC3339)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddAuditEntry implements approvalStore
+func (s *memoryStore) AddAuditEntry(v auditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auditLog = append(s.auditLog, v)
+	return nil
+}
+
+// AuditLog implements approvalStore
+func (s *memoryStore) AuditLog(limit int) ([]auditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []auditEntry
+	for i := len(s.auditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, s.auditLog[i])
+	}
+	return entries, nil
+}
+
+// incident returns v as an incident, like scanIncident
+func (v memoryIncident) incident() incident {
+	inc := incident{ID: v.ID, Kind: v.Kind, Summary: v.Summary, OpenedAt: v.OpenedAt, ResolvedAt: v.ResolvedAt}
+	for _, id := range strings.Split(v.Rides, ",") {
+		if id, err := strconv.Atoi(id); err == nil {
+			inc.Rides = append(inc.Rides, id)
+		}
+	}
+	if v.Numbers != "" {
+		inc.Numbers = strings.Split(v.Numbers, ",")
+	}
+	return inc
+}
+
+// OpenIncident implements incidentStore
+func (s *memoryStore) OpenIncident(kind string) (incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.incidents {
+		if v.Kind == kind && v.ResolvedAt == "" {
+			return v.incident(), nil
+		}
+	}
+	return incident{}, sql.ErrNoRows
+}
+
+// AddIncident implements incidentStore
+func (s *memoryStore) AddIncident(inc incident) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID("incidents")
+	s.incidents = append(s.incidents, memoryIncident{
+		ID:       id,
+		Kind:     inc.Kind,
+		Summary:  inc.Summary,
+		Rides:    joinRideIDs(inc.Rides),
+		Numbers:  joinNumbers(inc.Numbers),
+		OpenedAt: inc.OpenedAt,
+	})
+	return id, nil
+}
+
+// UpdateIncident implements incidentStore
+func (s *memoryStore) UpdateIncident(inc incident) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.incidents {
+		if v.ID == inc.ID {
+			s.incidents[i].Summary = inc.Summary
+			s.incidents[i].Rides = joinRideIDs(inc.Rides)
+			s.incidents[i].Numbers = joinNumbers(inc.Numbers)
+		}
+	}
+	return nil
+}
+
+// ResolveIncident implements incidentStore
+func (s *memoryStore) ResolveIncident(id int, resolvedAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.incidents {
+		if v.ID == id {
+			s.incidents[i].ResolvedAt = resolvedAt
+		}
+	}
+	return nil
+}
+
+// Incidents implements incidentStore
+func (s *memoryStore) Incidents(limit int) ([]incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var incidents []incident
+	for i := len(s.incidents) - 1; i >= 0 && len(incidents) < limit; i-- {
+		incidents = append(incidents, s.incidents[i].incident())
+	}
+	return incidents, nil
+}
+
+// FailedSends implements incidentStore
+func (s *memoryStore) FailedSends(since time.Time) ([]int, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	after := since.UTC().Format(time.RFC3339)
+	var rides []int
+	var numbers []string
+	for _, m := range s.messages {
+		if m.Direction == directionOutbound && m.ProviderID == "" && m.CreatedAt > after && m.RideID != 0 {
+			rides = append(rides, m.RideID)
+			numbers = append(numbers, m.Originator)
+		}
+	}
+	return rides, numbers, nil
+}
+
+// QueueRide implements waitingRideStore
+func (s *memoryStore) QueueRide(ride RideType, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitingRides = append(s.waitingRides, memoryWaitingRide{
+		ID:           s.newID("pending_rides"),
+		Start:        ride.Start,
+		Destination:  ride.Destination,
+		DateTime:     ride.DateTime,
+		CustomerID:   ride.ThisCustomer.ID,
+		DriverID:     ride.ThisDriver.ID,
+		RequiredTags: strings.Join(ride.RequiredTags, ","),
+		Labels:       strings.Join(ride.Labels, ","),
+		QueuedAt:     now.UTC().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// InsertWaitingRide implements waitingRideStore
+func (s *memoryStore) InsertWaitingRide(ride RideType, waitingID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.insertRide(ride)
+	if err == nil {
+		s.deleteWaitingRide(waitingID)
+	}
+	return id, err
+}
+
+// DeleteWaitingRide implements waitingRideStore
+func (s *memoryStore) DeleteWaitingRide(id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteWaitingRide(id), nil
+}
+
+// deleteWaitingRide stops the waiting ride with the given ID waiting,
+// reporting whether it still was
+func (s *memoryStore) deleteWaitingRide(id int) bool {
+	for i, v := range s.waitingRides {
+		if v.ID == id {
+			s.waitingRides = append(s.waitingRides[:i], s.waitingRides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// updateRide applies change to the ride with the given ID, if there is one
+func (s *memoryStore) updateRide(id int, change func(v *memoryRide)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.rides[id]; ok {
+		change(&v)
+		s.rides[id] = v
+	}
+	return nil
+}
+
+// SetMutedBy implements muteStore
+func (s *memoryStore) SetMutedBy(rideID int, roles []string) error {
+	return s.updateRide(rideID, func(v *memoryRide) { v.MutedBy = strings.Join(roles, ",") })
+}
+
+// CountRideActivity implements rideActivityStore
+func (s *memoryStore) CountRideActivity(rideID int, kind string, at time.Time) error {
+	return s.updateRide(rideID, func(v *memoryRide) {
+		if kind == activityCall {
+			v.Activity.Calls++
+			v.Activity.LastCall = at.UTC().Format(time.RFC3339)
+		} else {
+			v.Activity.Texts++
+			v.Activity.LastText = at.UTC().Format(time.RFC3339)
+		}
+	})
+}
+
+// SetRideLabels implements rideLabelStore
+func (s *memoryStore) SetRideLabels(rideID int, labels []string) error {
+	return s.updateRide(rideID, func(v *memoryRide) { v.Labels = strings.Join(labels, ",") })
+}
+
+// SavedFilters implements rideLabelStore
+func (s *memoryStore) SavedFilters(owner string) ([]savedFilter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var filters []savedFilter
+	for name, f := range s.savedFilters[owner] {
+		filters = append(filters, savedFilter{Name: name, Filter: f})
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Name < filters[j].Name })
+	return filters, nil
+}
+
+// SaveFilter implements rideLabelStore
+func (s *memoryStore) SaveFilter(owner string, f savedFilter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.savedFilters[owner] == nil {
+		s.savedFilters[owner] = make(map[string]rideFilter)
+	}
+	s.savedFilters[owner][f.Name] = f.Filter
+	return nil
+}
+
+// DeleteFilter implements rideLabelStore
+func (s *memoryStore) DeleteFilter(owner string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.savedFilters[owner], name)
+	return nil
+}
+
+// RecentTraffic implements trafficStore
+func (s *memoryStore) RecentTraffic(number string, limit int) ([]trafficEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	traffic := []trafficEntry{}
+	n := 0
+	for i := len(s.messages) - 1; i >= 0 && n < limit; i-- {
+		m := s.messages[i]
+		if m.Originator != number && m.Recipient != number {
+			continue
+		}
+		e := trafficEntry{Time: m.CreatedAt, Channel: "sms", Direction: m.Direction, From: m.Originator, To: m.Recipient,
+			RideID: m.RideID, ProviderID: m.ProviderID, Status: m.Status}
+		if m.Provider == providerWhatsApp {
+			e.Channel = textChannelWhatsApp
+		}
+		traffic = append(traffic, e)
+		n++
+	}
+	n = 0
+	for i := len(s.calls) - 1; i >= 0 && n < limit; i-- {
+		c := s.calls[i]
+		if c.Destination != number {
+			continue
+		}
+		traffic = append(traffic, trafficEntry{Time: c.CreatedAt, Channel: "call", Direction: directionInbound, From: c.Source,
+			To: c.Destination, RideID: c.RideID, ProviderID: c.ProviderID})
+		n++
+	}
+	return traffic, nil
+}
+
+// AddConsent implements consentStore
+func (s *memoryStore) AddConsent(c consentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.ID = s.newID("consents")
+	s.consents = append(s.consents, c)
+	return nil
+}
+
+// CurrentConsent implements consentStore
+func (s *memoryStore) CurrentConsent(number string, purpose string) (consentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.consents) - 1; i >= 0; i-- {
+		if c := s.consents[i]; c.Number == number && c.Purpose == purpose {
+			return c, nil
+		}
+	}
+	return consentRecord{Number: number, Purpose: purpose}, sql.ErrNoRows
+}
+
+// ConsentHistory implements consentStore
+func (s *memoryStore) ConsentHistory(number string) ([]consentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var history []consentRecord
+	for i := len(s.consents) - 1; i >= 0; i-- {
+		if s.consents[i].Number == number {
+			history = append(history, s.consents[i])
+		}
+	}
+	return history, nil
+}
+
+// AddAPIKey implements apiKeyStore
+func (s *memoryStore) AddAPIKey(k apiKey, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k.ID, k.RevokedAt, k.LastUsedAt = s.newID("api_keys"), "", ""
+	s.apiKeys = append(s.apiKeys, memoryAPIKey{k, hash})
+	return nil
+}
+
+// APIKeys implements apiKeyStore
+func (s *memoryStore) APIKeys() ([]apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []apiKey
+	for i := len(s.apiKeys) - 1; i >= 0; i-- {
+		keys = append(keys, s.apiKeys[i].apiKey)
+	}
+	return keys, nil
+}
+
+// FindAPIKey implements apiKeyStore
+func (s *memoryStore) FindAPIKey(hash string) (apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.apiKeys {
+		if k.Hash == hash && k.RevokedAt == "" {
+			return apiKey{ID: k.ID, Name: k.Name, Role: k.Role}, nil
+		}
+	}
+	return apiKey{}, sql.ErrNoRows
+}
+
+// TouchAPIKey implements apiKeyStore
+func (s *memoryStore) TouchAPIKey(id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.apiKeys {
+		if k.ID == id {
+			s.apiKeys[i].LastUsedAt = at.UTC().Format(time.RFC3339)
+		}
+	}
+	return nil
+}
+
+// RevokeAPIKey implements apiKeyStore
+func (s *memoryStore) RevokeAPIKey(id int, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.apiKeys {
+		if k.ID == id && k.RevokedAt == "" {
+			s.apiKeys[i].RevokedAt = at.UTC().Format(time.RFC3339)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// selectObservers returns the observers include selects, newest first
+func (s *memoryStore) selectObservers(include func(o rideObserver) bool) []rideObserver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var observers []rideObserver
+	for i := len(s.observers) - 1; i >= 0; i-- {
+		if include(s.observers[i]) {
+			observers = append(observers, s.observers[i])
+		}
+	}
+	return observers
+}
+
+// RideObservers implements observerStore
+func (s *memoryStore) RideObservers(rideID int) ([]rideObserver, error) {
+	return s.selectObservers(func(o rideObserver) bool { return o.RideID == rideID }), nil
+}
+
+// ObserverLinks implements observerStore
+func (s *memoryStore) ObserverLinks(number string, now time.Time) ([]rideObserver, error) {
+	return s.selectObservers(func(o rideObserver) bool { return o.Number == number && o.activeAt(now) }), nil
+}
+
+// FindObserver implements observerStore
+func (s *memoryStore) FindObserver(tokenHash string) (rideObserver, error) {
+	observers := s.selectObservers(func(o rideObserver) bool { return o.TokenHash == tokenHash })
+	if len(observers) == 0 {
+		return rideObserver{}, sql.ErrNoRows
+	}
+	return observers[0], nil
+}
+
+// AddObserver implements observerStore
+func (s *memoryStore) AddObserver(o rideObserver) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.observers {
+		if v.TokenHash == o.TokenHash {
+			return 0, &memoryUniqueError{"ride_observers.token"}
+		}
+	}
+	o.ID, o.RevokedAt = s.newID("ride_observers"), ""
+	s.observers = append(s.observers, o)
+	return o.ID, nil
+}
+
+// SetObserverToken implements observerStore
+func (s *memoryStore) SetObserverToken(id int, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.observers {
+		if o.ID == id {
+			s.observers[i].TokenHash = tokenHash
+		}
+	}
+	return nil
+}
+
+// RevokeObserver implements observerStore
+func (s *memoryStore) RevokeObserver(id int, rideID int, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.observers {
+		if o.ID == id && o.RideID == rideID && o.RevokedAt == "" {
+			s.observers[i].RevokedAt = at.UTC().Format(time.RFC3339)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ParticipantNotes implements participantNoteStore
+func (s *memoryStore) ParticipantNotes(role string, personID int) ([]participantNote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var notes []participantNote
+	for i := len(s.notes) - 1; i >= 0; i-- {
+		if n := s.notes[i]; n.Role == role && n.PersonID == personID {
+			notes = append(notes, n)
+		}
+	}
+	return notes, nil
+}
+
+// AddParticipantNote implements participantNoteStore
+func (s *memoryStore) AddParticipantNote(n participantNote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n.ID = s.newID("participant_notes")
+	s.notes = append(s.notes, n)
+	return nil
+}
+
+// DeleteParticipantNote implements participantNoteStore
+func (s *memoryStore) DeleteParticipantNote(id int, role string, personID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, n := range s.notes {
+		if n.ID == id && n.Role == role && n.PersonID == personID {
+			s.notes = append(s.notes[:i], s.notes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ArchivedRide implements exportStore
+func (s *memoryStore) ArchivedRide(id int) (archivedRide, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.archivedRides[id]
+	if !ok {
+		return archivedRide{}, sql.ErrNoRows
+	}
+	return archivedRide{r.Start, r.Destination, r.DateTime, r.CustomerID, r.DriverID, r.NumberID}, nil
+}
+
+// RideEvents implements exportStore
+func (s *memoryStore) RideEvents(rideID int) ([]transcriptEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []transcriptEvent
+	for _, list := range [][]memoryMessage{s.messages, s.archivedMsgs} {
+		for _, m := range list {
+			if m.RideID != rideID {
+				continue
+			}
+			e := transcriptEvent{Time: m.CreatedAt, Channel: "sms", Direction: m.Direction, From: m.Originator, To: m.Recipient,
+				Text: m.Body, ProviderID: m.ProviderID, Status: m.Status}
+			if m.Provider == providerWhatsApp {
+				e.Channel = textChannelWhatsApp
+			}
+			events = append(events, e)
+		}
+	}
+	for _, list := range [][]memoryCall{s.calls, s.archivedCalls} {
+		for _, c := range list {
+			if c.RideID == rideID {
+				events = append(events, transcriptEvent{Time: c.CreatedAt, Channel: "call", Direction: directionInbound,
+					From: c.Source, To: c.Destination, Text: "Call transferred to " + c.TransferredTo, ProviderID: c.ProviderID})
+			}
+		}
+	}
+	return events, nil
+}
+
+// SessionUser implements sessionStore
+func (s *memoryStore) SessionUser(tokenHash string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[tokenHash]
+	if !ok || session.ExpiresAt <= now.Format(time.RFC3339) {
+		return "", sql.ErrNoRows
+	}
+	return session.User, nil
+}
+
+// StartSession implements sessionStore
+func (s *memoryStore) StartSession(tokenHash string, user string, now time.Time, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Expired sessions are dropped as users sign in
+	for hash, session := range s.sessions {
+		if session.ExpiresAt <= now.Format(time.RFC3339) {
+			delete(s.sessions, hash)
+		}
+	}
+	if _, ok := s.sessions[tokenHash]; ok {
+		return &memoryUniqueError{"sessions.token_hash"}
+	}
+	s.sessions[tokenHash] = memorySession{user, now.Format(time.RFC3339), expires.Format(time.RFC3339)}
+	return nil
+}
+
+// EndSession implements sessionStore
+func (s *memoryStore) EndSession(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+// StartShift implements shiftStore
+func (s *memoryStore) StartShift(driverID int, now string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shifts = append(s.shifts, memoryShift{ID: s.newID("shifts"), DriverID: driverID, StartedAt: now})
+	return nil
+}
+
+// EndShift implements shiftStore
+func (s *memoryStore) EndShift(driverID int, now string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ended := false
+	for i, v := range s.shifts {
+		if v.DriverID == driverID && v.EndedAt == "" {
+			s.shifts[i].EndedAt = now
+			ended = true
+		}
+	}
+	if !ended {
+		// Drivers who never clocked in go off shift too
+		s.shifts = append(s.shifts, memoryShift{s.newID("shifts"), driverID, now, now})
+	}
+	return nil
+}
+
+// RecordDelivery implements webhookDedupStore
+func (s *memoryStore) RecordDelivery(id string, at time.Time, since time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for v, receivedAt := range s.processed {
+		if receivedAt < since.Format(time.RFC3339) {
+			delete(s.processed, v)
+		}
+	}
+	if _, ok := s.processed[id]; ok {
+		return false, nil
+	}
+	s.processed[id] = at.Format(time.RFC3339)
+	return true, nil
+}
+
+// PasswordHash implements userStore
+func (s *memoryStore) PasswordHash(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return u.Hash, nil
+}
+
+// UsersExist implements userStore
+func (s *memoryStore) UsersExist() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users) > 0, nil
+}
+
+// Users implements userStore
+func (s *memoryStore) Users() ([]userAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var users []userAccount
+	for name, u := range s.users {
+		users = append(users, userAccount{name, u.CreatedAt})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// AddUser implements userStore
+func (s *memoryStore) AddUser(name string, hash string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return &memoryUniqueError{"users.username"}
+	}
+	s.users[name] = memoryUser{s.newID("users"), hash, at.Format(time.RFC3339)}
+	return nil
+}
+
+// SetPassword implements userStore
+func (s *memoryStore) SetPassword(name string, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return false, nil
+	}
+	u.Hash = hash
+	s.users[name] = u
+	s.endSessions(name)
+	return true, nil
+}
+
+// RemoveUser implements userStore
+func (s *memoryStore) RemoveUser(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return false, nil
+	}
+	delete(s.users, name)
+	s.endSessions(name)
+	return true, nil
+}
+
+// endSessions signs the user called name out
+func (s *memoryStore) endSessions(name string) {
+	for hash, session := range s.sessions {
+		if session.User == name {
+			delete(s.sessions, hash)
+		}
+	}
+}
+
+// Values of the -store flag
+const (
+	storeSQL    = "sql"
+	storeMemory = "memory"
+)
+
+// storeFlag defines the -store flag on flags
+func storeFlag(flags *flag.FlagSet) *string {
+	return flags.String("store", storeSQL,
+		`where to keep the data: "sql" for the database at -db or DATABASE_URL, or "memory" to keep it in memory until the application stops`)
+}
+
+// storeURL returns the URL openDB opens the store chosen with -store at.
+// url is the database to use for "sql".
+func storeURL(store string, url string) (string, error) {
+	switch store {
+	case storeSQL:
+		return url, nil
+	case storeMemory:
+		return "memory:birdcar", nil
+	}
+	return "", fmt.Errorf("unknown store %q, use %q or %q", store, storeSQL, storeMemory)
+}
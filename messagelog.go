@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Message directions, relative to our application
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+)
+
+// messageLogStore is the part of RideStore that logs the messages and
+// calls we route
+type messageLogStore interface {
+	// LogMessage records m, sent or received at
+	LogMessage(m messageRecord, at time.Time) error
+	// LogCall records call, routed for the ride with ID rideID and
+	// transferred to transferredTo, at at
+	LogCall(rideID int, call InboundCall, transferredTo string, at time.Time) error
+	// LoggedMessages returns the logged messages f selects, newest first.
+	// Messages of archived rides aren't included.
+	LoggedMessages(f messageFilter) ([]apiMessage, error)
+}
+
+// messageRecord is an SMS in the messages log
+type messageRecord struct {
+	RideID      int
+	Direction   string
+	Provider    string
+	ProviderID  string
+	Originator  string
+	Recipient   string
+	Body        string
+	RelayedFrom string // see logRelay
+}
+
+// LogMessage implements messageLogStore
+func (s *sqlStore) LogMessage(m messageRecord, at time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO messages (ride_id, direction, provider_id, provider, originator, recipient, body, created_at, relayed_from) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO messages (ride_id, direction, provider_id, provider, originator, recipient, body, created_at, relayed_from) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+	}, m.RideID, m.Direction, m.ProviderID, m.Provider, m.Originator, m.Recipient, m.Body, at.UTC().Format(time.RFC3339), m.RelayedFrom)
+	return err
+}
+
+// LogCall implements messageLogStore
+func (s *sqlStore) LogCall(rideID int, call InboundCall, transferredTo string, at time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO calls (ride_id, provider_id, source, destination, transferred_to, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO calls (ride_id, provider_id, source, destination, transferred_to, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+	}, rideID, call.CallID, call.Source, call.Destination, transferredTo, at.UTC().Format(time.RFC3339))
+	return err
+}
+
+// logMessage records an SMS we received or sent, with the ID MessageBird,
+// or the failover provider, assigned to it, see providerMessageID, so
+// dashboard entries can be matched with our rides.
+// rideID is 0 for messages that don't belong to a ride, such as announcements.
+func logMessage(store RideStore, rideID int, direction string, providerID string, originator string, recipient string, body string) {
+	provider, providerID := providerMessageID(providerID)
+	err := store.LogMessage(messageRecord{
+		RideID:     rideID,
+		Direction:  direction,
+		Provider:   provider,
+		ProviderID: providerID,
+		Originator: originator,
+		Recipient:  recipient,
+		Body:       body,
+	}, time.Now())
+	if err != nil {
+		log.Printf("Could not log %s message %s: %v", direction, providerID, err)
+	}
+}
+
+// logRelay records a message we relayed to the other participant of a ride.
+// relayedFrom is the number the original message came from, whom we tell
+// if the relayed message can't be delivered.
+func logRelay(store RideStore, rideID int, providerID string, originator string, recipient string, body string, relayedFrom string) {
+	provider, providerID := providerMessageID(providerID)
+	err := store.LogMessage(messageRecord{
+		RideID:      rideID,
+		Direction:   directionOutbound,
+		Provider:    provider,
+		ProviderID:  providerID,
+		Originator:  originator,
+		Recipient:   recipient,
+		Body:        body,
+		RelayedFrom: relayedFrom,
+	}, time.Now())
+	if err != nil {
+		log.Printf("Could not log relayed message %s: %v", providerID, err)
+	}
+	recordRideActivity(store, rideID, activityText)
+}
+
+// logCall records a call we routed for a ride, with the call ID MessageBird assigned to it
+func logCall(store RideStore, rideID int, call InboundCall, transferredTo string) {
+	if err := store.LogCall(rideID, call, transferredTo, time.Now()); err != nil {
+		log.Printf("Could not log call %s: %v", call.CallID, err)
+	}
+	recordRideActivity(store, rideID, activityCall)
+}
+
+// recordProviderNumberID stores the ID MessageBird uses for a proxy number,
+// which inbound calls tell us, if we don't know it yet
+func recordProviderNumberID(store RideStore, proxy ProxyNumberType, numberID string) {
+	if numberID == "" || proxy.ProviderID == numberID {
+		return
+	}
+	err := store.SetProviderID(proxy.ID, numberID)
+	if err != nil {
+		log.Printf("Could not record MessageBird number ID for %s: %v", proxy.Number, err)
+	}
+}
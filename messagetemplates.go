@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Names of the editable notification templates
+const (
+	templateRideCreatedCustomer = "ride_created_customer"
+	templateRideCreatedDriver   = "ride_created_driver"
+	templateStatusCustomer      = "status_customer"
+	templateStatusDriver        = "status_driver"
+	templateDeliveryFailed      = "delivery_failed"
+	templateMaintenance         = "maintenance"
+	templateUnknownSender       = "unknown_sender"
+	templateConversationEnded   = "conversation_ended"
+	templateProxyChanged        = "proxy_changed"
+	templateRideCancelled       = "ride_cancelled"
+	templateRideClosed          = "ride_closed"
+)
+
+// notificationTemplate is an SMS we send that operators can reword
+type notificationTemplate struct {
+	Name        string
+	Description string
+	Default     string
+	Env         string // environment variable overriding Default, if any
+	Role        string // who receives the message, used for previews
+}
+
+// notificationTemplates are the templates shown on the templates admin page
+var notificationTemplates = []notificationTemplate{
+	{
+		Name:        templateRideCreatedCustomer,
+		Role:        roleCustomer,
+		Description: "Sent to the customer when a ride is created",
+		Default: "{{ .Ride.ThisDriver.Name }} will pick you up at {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Reply to this message{{ else }}Call {{ .Ride.ThisProxyNumber.Number }}{{ end }} to contact the driver. " +
+			"Your ride PIN is {{ .PIN }}: start your message with it, or enter it when calling, if you contact us from another phone.",
+	},
+	{
+		Name:        templateRideCreatedDriver,
+		Role:        roleDriver,
+		Description: "Sent to the driver when a ride is created",
+		Default: "You will pick up {{ .Ride.ThisCustomer.Name }} at {{ .Ride.DateTime }}. " +
+			"{{ if .CanReply }}Reply to this message{{ else }}Call {{ .Ride.ThisProxyNumber.Number }}{{ end }} to contact the customer. " +
+			"Your ride PIN is {{ .PIN }}: start your message with it, or enter it when calling, if you contact us from another phone.",
+	},
+	{
+		Name:        templateStatusCustomer,
+		Role:        roleCustomer,
+		Description: "Reply when the customer texts STATUS",
+		Default: "Your ride on {{ .Ride.DateTime }}: pickup at {{ .Ride.Start }}, going to {{ .Ride.Destination }}. " +
+			"Your driver is {{ .Ride.ThisDriver.Name }}{{ with .Ride.ThisDriver.Vehicle }} ({{ . }}){{ end }}.",
+		Env: "STATUS_TEMPLATE_CUSTOMER",
+	},
+	{
+		Name:        templateStatusDriver,
+		Role:        roleDriver,
+		Description: "Reply when the driver texts STATUS",
+		Default: "Your ride on {{ .Ride.DateTime }}: pick up {{ .Ride.ThisCustomer.Name }} at {{ .Ride.Start }}, " +
+			"going to {{ .Ride.Destination }}.",
+		Env: "STATUS_TEMPLATE_DRIVER",
+	},
+	{
+		Name:        templateDeliveryFailed,
+		Role:        roleCustomer,
+		Description: "Sent to a participant whose relayed message could not be delivered",
+		Default: "We couldn't deliver your message to the other participant of your ride. " +
+			"{{ if .CanCall }}Please try calling them on this number instead.{{ else }}Please try again later.{{ end }}",
+	},
+	{
+		Name:        templateMaintenance,
+		Role:        roleCustomer,
+		Description: "Reply to participants who text us while maintenance mode is on",
+		Default: "Sorry, our service is temporarily unavailable for maintenance. " +
+			"We'll pass your message on as soon as we're back.",
+	},
+	{
+		Name:        templateUnknownSender,
+		Description: "Reply to people we can't match to a ride, if UNKNOWN_SENDER_POLICY is \"reply\"",
+		Default: "Hi! This BirdCar number connects customers and drivers during their rides, and we couldn't find a ride for you. " +
+			"To reach your driver or customer, text us from the phone number your ride was booked with.",
+		Env: "UNKNOWN_SENDER_REPLY",
+	},
+	{
+		Name:        templateConversationEnded,
+		Description: "Reply to people who text a proxy number shortly after their ride on it ended",
+		Default: "Your ride has ended, so we no longer pass on messages through this number. " +
+			"For a new ride, use the number in its confirmation.",
+	},
+	{
+		Name:        templateProxyChanged,
+		Role:        roleCustomer,
+		Description: "Sent to both participants when their ride moves to a new proxy number, and to those who still use the old one",
+		Default: "The number for your ride on {{ .Ride.DateTime }} has changed: " +
+			"{{ if .CanReply }}text or call{{ else }}call{{ end }} {{ .Ride.ThisProxyNumber.Number }} " +
+			"to reach your {{ if eq .Role \"driver\" }}customer{{ else }}driver{{ end }} from now on.",
+	},
+	{
+		Name:        templateRideCancelled,
+		Role:        roleCustomer,
+		Description: "Sent to both participants when an operator cancels their ride",
+		Default: "Your ride from {{ .Ride.Start }} to {{ .Ride.Destination }} on {{ .Ride.DateTime }} has been cancelled. " +
+			"{{ .Ride.ThisProxyNumber.Number }} no longer connects you to your {{ if eq .Role \"driver\" }}customer{{ else }}driver{{ end }}.",
+	},
+	{
+		Name:        templateRideClosed,
+		Role:        roleCustomer,
+		Description: "Sent to both participants when their ride's time is up, if NOTIFY_RIDE_CLOSED is true",
+		Default: "Your ride from {{ .Ride.Start }} to {{ .Ride.Destination }} on {{ .Ride.DateTime }} is over. " +
+			"{{ .Ride.ThisProxyNumber.Number }} no longer connects you to your {{ if eq .Role \"driver\" }}customer{{ else }}driver{{ end }}.",
+	},
+}
+
+// notificationData is what notification templates are executed against
+type notificationData struct {
+	Ride     RideType
+	Role     string // "customer" or "driver", whoever receives the message; may be empty
+	PIN      string // the recipient's ride PIN
+	CanReply bool   // whether the ride's proxy number can receive SMS
+	CanCall  bool   // whether the ride's proxy number can take calls
+	Language string // the recipient's language, see languages.go
+}
+
+// newNotificationData returns the data for a notification to the participant of ride with role
+func newNotificationData(store RideStore, ride RideType, role string) notificationData {
+	data := notificationData{
+		Ride:     ride,
+		Role:     role,
+		CanReply: ride.ThisProxyNumber.canSMS(),
+		CanCall:  ride.ThisProxyNumber.canCall(),
+	}
+	switch role {
+	case roleCustomer:
+		data.PIN = ride.CustomerPIN
+	case roleDriver:
+		data.PIN = ride.DriverPIN
+	}
+	if role != "" {
+		data.Language = participantLanguage(store, ride.contactNumber(role))
+	}
+	return data
+}
+
+// findNotificationTemplate returns the notification template called name
+func findNotificationTemplate(name string) (notificationTemplate, bool) {
+	for _, v := range notificationTemplates {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return notificationTemplate{}, false
+}
+
+// defaultBody returns the body of t used until an operator edits it
+func (t notificationTemplate) defaultBody() string {
+	if t.Env != "" {
+		if body := os.Getenv(t.Env); body != "" {
+			return body
+		}
+	}
+	return t.Default
+}
+
+// templateVersion is a saved version of a notification template
+type templateVersion struct {
+	ID        int
+	Name      string
+	Body      string
+	CreatedAt string
+}
+
+// templateStore is the part of RideStore that keeps the versions of the
+// notification templates operators edited
+type templateStore interface {
+	// TemplateVersions returns the saved versions of the template called
+	// name, newest first
+	TemplateVersions(name string) ([]templateVersion, error)
+	// SaveTemplateVersion stores body as the newest version of the
+	// template called name
+	SaveTemplateVersion(name string, body string) error
+}
+
+// TemplateVersions implements templateStore
+func (s *sqlStore) TemplateVersions(name string) ([]templateVersion, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, name, body, created_at FROM message_templates WHERE name = ? ORDER BY id DESC",
+		Postgres: "SELECT id, name, body, created_at FROM message_templates WHERE name = $1 ORDER BY id DESC",
+	}, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []templateVersion
+	for rows.Next() {
+		var v templateVersion
+		if err := rows.Scan(&v.ID, &v.Name, &v.Body, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// currentTemplateBody returns the latest saved body of t, or its default body
+func currentTemplateBody(store RideStore, t notificationTemplate) (string, error) {
+	versions, err := store.TemplateVersions(t.Name)
+	if err != nil || len(versions) == 0 {
+		return t.defaultBody(), err
+	}
+	return versions[0].Body, nil
+}
+
+// SaveTemplateVersion implements templateStore
+func (s *sqlStore) SaveTemplateVersion(name string, body string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO message_templates (name, body, created_at) VALUES (?, ?, ?)",
+		Postgres: "INSERT INTO message_templates (name, body, created_at) VALUES ($1, $2, $3)",
+	}, name, body, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// executeTemplate renders body against data
+func executeTemplate(body string, data notificationData) (string, error) {
+	t, err := template.New("notification").Parse(body)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// renderNotification renders the notification template called name, in the
+// recipient's language if the message catalog has a translation.
+// If the operator's version fails to render, we log it and fall back to the
+// default so the participant still gets a message.
+func renderNotification(store RideStore, name string, data notificationData) string {
+	t, ok := findNotificationTemplate(name)
+	if !ok {
+		log.Printf("Unknown notification template %q", name)
+		return ""
+	}
+	if body, ok := catalogEntry(data.Language, name); ok {
+		msg, err := executeTemplate(body, data)
+		if err == nil {
+			return msg
+		}
+		log.Printf("Could not render %s translation of notification template %s: %v", data.Language, name, err)
+	}
+	body, err := currentTemplateBody(store, t)
+	if err != nil {
+		log.Printf("Could not load notification template %s: %v", name, err)
+	}
+	msg, err := executeTemplate(body, data)
+	if err != nil {
+		log.Printf("Could not render notification template %s, using the default: %v", name, err)
+		msg, err = executeTemplate(t.Default, data)
+		if err != nil {
+			log.Printf("Could not render default notification template %s: %v", name, err)
+		}
+	}
+	return msg
+}
+
+// sampleRide is the ride template previews are rendered against
+var sampleRide = RideType{
+	ID:              42,
+	Start:           "Amsterdam Centraal",
+	Destination:     "Schiphol Airport",
+	DateTime:        "2031-06-01T09:30",
+	ThisCustomer:    Person{ID: 1, Name: "Caitlyn Carless", Number: "319700000"},
+	ThisDriver:      Person{ID: 1, Name: "David Driver", Number: "319700002", Vehicle: "Blue Toyota Prius"},
+	ThisProxyNumber: ProxyNumberType{ID: 1, Number: "319700004", PortStatus: portStatusActive},
+	CustomerPIN:     "123456",
+	DriverPIN:       "567890",
+}
+
+// templatesPage is the data rendered by views/default/templates.gohtml
+type templatesPage struct {
+	Templates []notificationTemplate
+	Selected  notificationTemplate
+	Body      string // template body shown in the editor
+	Preview   string // Body rendered against sampleRide
+	Versions  []templateVersion
+	Message   string
+}
+
+// templatesHandler lets operators edit notification templates, preview them
+// against a sample ride and roll back to earlier versions.
+// Every save is kept as a new version.
+func templatesHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+			return
+		}
+		name := r.FormValue("name")
+		if name == "" {
+			name = notificationTemplates[0].Name
+		}
+		selected, ok := findNotificationTemplate(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Unknown notification template %q", name)
+			return
+		}
+
+		page := templatesPage{Templates: notificationTemplates, Selected: selected}
+		body, err := currentTemplateBody(store, selected)
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		page.Body = body
+
+		if r.Method == "POST" {
+			switch r.FormValue("action") {
+			case "preview":
+				page.Body = r.FormValue("body")
+			case "save":
+				page.Body = r.FormValue("body")
+				if _, err := executeTemplate(page.Body, newNotificationData(store, sampleRide, selected.Role)); err != nil {
+					page.Message = fmt.Sprintf("Not saved, the template doesn't render: %v", err)
+				} else if err := store.SaveTemplateVersion(selected.Name, page.Body); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+				} else {
+					page.Message = "Template saved."
+				}
+			case "restore":
+				versionID, _ := strconv.Atoi(r.FormValue("version"))
+				versions, err := store.TemplateVersions(selected.Name)
+				if err != nil {
+					log.Println(err)
+				}
+				page.Message = fmt.Sprintf("Unknown version %q", r.FormValue("version"))
+				for _, v := range versions {
+					if v.ID != versionID {
+						continue
+					}
+					if err := store.SaveTemplateVersion(selected.Name, v.Body); err != nil {
+						log.Println(err)
+						page.Message = fmt.Sprint(err)
+					} else {
+						page.Body = v.Body
+						page.Message = fmt.Sprintf("Restored version %d.", v.ID)
+					}
+				}
+			case "reset":
+				if err := store.SaveTemplateVersion(selected.Name, selected.defaultBody()); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+				} else {
+					page.Body = selected.defaultBody()
+					page.Message = "Template reset to the default."
+				}
+			}
+		}
+
+		preview, err := executeTemplate(page.Body, newNotificationData(store, sampleRide, selected.Role))
+		if err != nil {
+			preview = fmt.Sprintf("Template error: %v", err)
+		}
+		page.Preview = preview
+		versions, err := store.TemplateVersions(selected.Name)
+		if err != nil {
+			log.Println(err)
+		}
+		page.Versions = versions
+
+		renderDefaultTemplate(w, r, "templates.gohtml", page)
+	}
+}
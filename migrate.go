@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// runMigrate implements the migrate command, which shows the schema version
+// of ridesharing.db ("migrate status") or moves it to another version:
+// "migrate up" applies every pending migration, "migrate down" reverts the
+// latest one, and -to picks the version to stop at, e.g. "migrate down -to 0".
+// Unlike servers starting up, it applies contract migrations, see the
+// migrations package. It returns the exit status.
+func runMigrate(args []string) int {
+	command := "status"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate "+command, flag.ExitOnError)
+	to := flags.Int("to", -1, "version to migrate up or down to (default: the latest for up, the previous for down)")
+	flags.Parse(args)
+
+	if err := openDB(databaseURL()); err != nil {
+		fmt.Println("Could not open database:", err)
+		return 1
+	}
+	current, err := appStore.SchemaVersion()
+	if err != nil {
+		fmt.Println("Could not read the schema version:", err)
+		return 1
+	}
+
+	var done []migrations.Migration
+	verb := "Applied"
+	switch command {
+	case "status":
+		applied, err := appStore.AppliedMigrations()
+		if err != nil {
+			fmt.Println("Could not read the applied migrations:", err)
+			return 1
+		}
+		isApplied := make(map[int]bool)
+		for _, v := range applied {
+			isApplied[v] = true
+		}
+		for _, m := range migrations.All {
+			state := "pending"
+			if isApplied[m.Version] {
+				state = "applied"
+			}
+			name := m.Name
+			if m.Contract {
+				name += " (contract)"
+			}
+			fmt.Printf("%4d  %-8s %s\n", m.Version, state, name)
+		}
+		fmt.Printf("The database is at version %d of %d.\n", current, migrations.Latest())
+		return 0
+	case "up":
+		target := migrations.Latest()
+		if *to >= 0 {
+			target = *to
+		}
+		done, err = appStore.MigrateUp(target)
+	case "down":
+		target := current - 1
+		if *to >= 0 {
+			target = *to
+		}
+		verb = "Reverted"
+		done, err = appStore.MigrateDown(target)
+	default:
+		fmt.Printf("Unknown migrate command %q: use status, up or down\n", command)
+		return 1
+	}
+
+	for _, m := range done {
+		fmt.Printf("%s migration %d (%s).\n", verb, m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Println("Migration failed:", err)
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Printf("Nothing to do: the database is at version %d.\n", current)
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// tutorialDB are the statements the original guide created and seeded its
+// database with, plus a ride booked in it
+var tutorialDB = []string{
+	"CREATE TABLE IF NOT EXISTS customers(id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+	"CREATE TABLE IF NOT EXISTS drivers (id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+	"CREATE TABLE IF NOT EXISTS proxy_numbers (id INTEGER PRIMARY KEY, number TEXT UNIQUE)",
+	"CREATE TABLE IF NOT EXISTS " +
+		"rides (id INTEGER PRIMARY KEY, " +
+		"start TEXT, destination TEXT, datetime TEXT, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+		"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+	"INSERT INTO customers (name, number) VALUES ('Caitlyn Carless', '319700000') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
+	"INSERT INTO customers (name, number) VALUES ('Danny Bikes', '319700001') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
+	"INSERT INTO drivers (name, number) VALUES ('David Driver', '319700002') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
+	"INSERT INTO drivers (name, number) VALUES ('Eileen LaRue', '319700003') ON CONFLICT (number) DO UPDATE SET name=excluded.name",
+	"INSERT INTO proxy_numbers (number) VALUES ('319700004') ON CONFLICT (number) DO NOTHING",
+	"INSERT INTO proxy_numbers (number) VALUES ('319700005') ON CONFLICT (number) DO NOTHING",
+	"INSERT INTO rides (start, destination, datetime, customer_id, driver_id, number_id) VALUES ('Amsterdam', 'Utrecht', '2030-01-02T10:00', 1, 2, 1)",
+}
+
+func TestMigrateUpgradesTutorialDatabase(t *testing.T) {
+	// The in-memory store has no tables for the guide to have created
+	openEmptyTestDB(t, "sqlite")
+	for _, s := range tutorialDB {
+		if _, err := appStore.(*sqlStore).db.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	initExampleDB(appStore)
+	if current, err := appStore.SchemaVersion(); err != nil || current != migrations.Latest() {
+		t.Fatalf("database at version %d (%v), want %d", current, err, migrations.Latest())
+	}
+	dbdata, err := newRideSharingDB(appStore).loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbdata.Customers) != 2 || len(dbdata.Drivers) != 2 || len(dbdata.ProxyNumbers) != 2 {
+		t.Errorf("%d customers, %d drivers and %d proxy numbers after migrating, want 2 of each",
+			len(dbdata.Customers), len(dbdata.Drivers), len(dbdata.ProxyNumbers))
+	}
+	ride, ok := dbdata.Rides[1]
+	if !ok {
+		t.Fatal("the tutorial's ride is gone")
+	}
+	if ride.Start != "Amsterdam" || ride.ThisCustomer.Name != "Caitlyn Carless" || ride.ThisDriver.Name != "Eileen LaRue" {
+		t.Errorf("ride = %+v, want the tutorial's ride", ride)
+	}
+	if ride.Status != rideScheduled || ride.ThisProxyNumber.PortStatus != "active" {
+		t.Errorf("ride status %q on a %q proxy number, want the columns' defaults", ride.Status, ride.ThisProxyNumber.PortStatus)
+	}
+	if ride.ThisDriver.Vehicle != "Blue Toyota Prius" && ride.ThisDriver.Vehicle != "Silver Tesla Model 3" {
+		t.Errorf("driver vehicle %q, want the one seeded into the new column", ride.ThisDriver.Vehicle)
+	}
+
+	// Servers starting on the migrated database have nothing to apply
+	applied, err := appStore.MigrateUp(migrations.Latest())
+	if err != nil || len(applied) != 0 {
+		t.Errorf("migrating again applied %d migrations (%v), want none", len(applied), err)
+	}
+}
+
+func TestMigrationsRevertAndReapply(t *testing.T) {
+	openTestDB(t, "sqlite")
+	db := appStore.(*sqlStore).db
+
+	// Tables keep their rows when the columns migrations added are dropped
+	if _, err := appStore.MigrateDown(1); err != nil {
+		t.Fatal(err)
+	}
+	var customers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM customers").Scan(&customers); err != nil || customers != 2 {
+		t.Errorf("%d customers after reverting to the baseline (%v), want 2", customers, err)
+	}
+	if _, err := db.Exec("SELECT deactivated FROM customers"); err == nil {
+		t.Error("customers.deactivated outlived reverting the migration that added it")
+	}
+
+	if _, err := appStore.MigrateDown(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SELECT * FROM customers"); err == nil {
+		t.Error("customers table outlived reverting every migration")
+	}
+	applied, err := appStore.MigrateUp(migrations.Latest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations.All) {
+		t.Errorf("reapplied %d migrations, want %d", len(applied), len(migrations.All))
+	}
+}
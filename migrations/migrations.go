@@ -0,0 +1,1530 @@
+// Package migrations evolves the ridesharing database schema through
+// numbered migrations, recording the ones applied in schema_migrations.
+//
+// To change the schema, append a Migration to All with the next version
+// number, giving PostgreSQL and MySQL statements of their own wherever
+// SQLite's aren't valid for them. Never edit a migration that has been released: databases that
+// already applied it won't run it again.
+//
+// The SQLite go-sqlite3 bundles can't drop columns, so its Down statements
+// rebuild a table without the columns the migration added instead: they
+// create the table as it was before, copy the rows over, drop the table and
+// rename the copy to it.
+//
+// Servers are deployed one at a time, so the previous release keeps running
+// against a schema the new one has migrated. Migrations therefore expand
+// the schema: they add tables, and columns with a default, which releases
+// that don't know them yet ignore, as the store names every column it reads.
+// A migration that drops or renames something an older release still reads
+// is a contract migration. Servers don't apply those when they start; run
+// the migrate command once every server runs a release that no longer reads
+// what it removes.
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Dialects migrations can be run in
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+	MySQL    = "mysql"
+)
+
+// Statements apply a migration (Up) and revert it (Down) in one dialect
+type Statements struct {
+	Up   []string
+	Down []string
+}
+
+// Migration is a numbered schema change, written out for each dialect:
+// PostgreSQL and MySQL run SQLite's statements where they have none of
+// their own, the SQL being the same. Up and Down each run in a single
+// transaction, though MySQL commits schema changes as it makes them.
+type Migration struct {
+	Version  int
+	Name     string
+	SQLite   Statements
+	Postgres Statements
+	MySQL    Statements
+	Contract bool // Up drops or renames what older releases read, see the package docs
+}
+
+// For returns the statements m runs in dialect
+func (m Migration) For(dialect string) Statements {
+	var own Statements
+	switch dialect {
+	case Postgres:
+		own = m.Postgres
+	case MySQL:
+		own = m.MySQL
+	}
+	if own.Up == nil {
+		own.Up = m.SQLite.Up
+	}
+	if own.Down == nil {
+		own.Down = m.SQLite.Down
+	}
+	return own
+}
+
+// All are the schema's migrations, in version order
+var All = []Migration{
+	{
+		// The schema of the original guide. Databases created before
+		// migrations existed already have these tables, so they only get
+		// recorded as being at version 1.
+		Version: 1,
+		Name:    "baseline",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE IF NOT EXISTS customers(id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS drivers (id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS proxy_numbers (id INTEGER PRIMARY KEY, number TEXT UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS " +
+					"rides (id INTEGER PRIMARY KEY, " +
+					"start TEXT, destination TEXT, datetime TEXT, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+			},
+			Down: []string{
+				"DROP TABLE rides",
+				"DROP TABLE proxy_numbers",
+				"DROP TABLE drivers",
+				"DROP TABLE customers",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE IF NOT EXISTS customers(id SERIAL PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS drivers (id SERIAL PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS proxy_numbers (id SERIAL PRIMARY KEY, number TEXT UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS " +
+					"rides (id SERIAL PRIMARY KEY, " +
+					"start TEXT, destination TEXT, datetime TEXT, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE IF NOT EXISTS customers(id INTEGER AUTO_INCREMENT PRIMARY KEY, name VARCHAR(255), number VARCHAR(255) UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS drivers (id INTEGER AUTO_INCREMENT PRIMARY KEY, name VARCHAR(255), number VARCHAR(255) UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS proxy_numbers (id INTEGER AUTO_INCREMENT PRIMARY KEY, number VARCHAR(255) UNIQUE)",
+				"CREATE TABLE IF NOT EXISTS " +
+					"rides (id INTEGER AUTO_INCREMENT PRIMARY KEY, " +
+					"start VARCHAR(255), destination VARCHAR(255), datetime VARCHAR(255), customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+			},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "proxy number porting",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN port_status TEXT NOT NULL DEFAULT 'active'",
+			},
+			Down: []string{
+				"CREATE TABLE proxy_numbers_down (id INTEGER PRIMARY KEY, number TEXT UNIQUE)",
+				"INSERT INTO proxy_numbers_down (id, number) SELECT id, number FROM proxy_numbers",
+				"DROP TABLE proxy_numbers",
+				"ALTER TABLE proxy_numbers_down RENAME TO proxy_numbers",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE proxy_numbers DROP COLUMN port_status",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN port_status VARCHAR(255) NOT NULL DEFAULT 'active'",
+			},
+			Down: []string{
+				"ALTER TABLE proxy_numbers DROP COLUMN port_status",
+			},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "opt-outs",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE opt_outs (number TEXT PRIMARY KEY)",
+			},
+			Down: []string{
+				"DROP TABLE opt_outs",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE opt_outs (number VARCHAR(255) PRIMARY KEY)",
+			},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "ride PINs",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN customer_pin TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE rides ADD COLUMN driver_pin TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE rides_down (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+				"INSERT INTO rides_down (id, start, destination, datetime, customer_id, driver_id, number_id) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id FROM rides",
+				"DROP TABLE rides",
+				"ALTER TABLE rides_down RENAME TO rides",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE rides DROP COLUMN driver_pin",
+				"ALTER TABLE rides DROP COLUMN customer_pin",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN customer_pin VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE rides ADD COLUMN driver_pin VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE rides DROP COLUMN driver_pin",
+				"ALTER TABLE rides DROP COLUMN customer_pin",
+			},
+		},
+	},
+	{
+		Version: 5,
+		Name:    "alternate numbers and ride contacts",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE alternate_numbers (id INTEGER PRIMARY KEY, role TEXT, person_id INTEGER, number TEXT UNIQUE)",
+				"CREATE TABLE ride_contacts (ride_id INTEGER, role TEXT, number TEXT, PRIMARY KEY (ride_id, role), " +
+					"FOREIGN KEY (ride_id) REFERENCES rides(id))",
+			},
+			Down: []string{
+				"DROP TABLE ride_contacts",
+				"DROP TABLE alternate_numbers",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE alternate_numbers (id SERIAL PRIMARY KEY, role TEXT, person_id INTEGER, number TEXT UNIQUE)",
+				"CREATE TABLE ride_contacts (ride_id INTEGER, role TEXT, number TEXT, PRIMARY KEY (ride_id, role), " +
+					"FOREIGN KEY (ride_id) REFERENCES rides(id))",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE alternate_numbers (id INTEGER AUTO_INCREMENT PRIMARY KEY, role VARCHAR(255), person_id INTEGER, number VARCHAR(255) UNIQUE)",
+				"CREATE TABLE ride_contacts (ride_id INTEGER, role VARCHAR(255), number VARCHAR(255), PRIMARY KEY (ride_id, role), " +
+					"FOREIGN KEY (ride_id) REFERENCES rides(id))",
+			},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "message and call log",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN provider_id TEXT NOT NULL DEFAULT ''",
+				"CREATE TABLE messages (id INTEGER PRIMARY KEY, ride_id INTEGER, direction TEXT, provider_id TEXT, " +
+					"originator TEXT, recipient TEXT, body TEXT, created_at TEXT)",
+				"CREATE TABLE calls (id INTEGER PRIMARY KEY, ride_id INTEGER, provider_id TEXT, " +
+					"source TEXT, destination TEXT, transferred_to TEXT, created_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE calls",
+				"DROP TABLE messages",
+				"CREATE TABLE proxy_numbers_down (id INTEGER PRIMARY KEY, number TEXT UNIQUE, port_status TEXT NOT NULL DEFAULT 'active')",
+				"INSERT INTO proxy_numbers_down (id, number, port_status) SELECT id, number, port_status FROM proxy_numbers",
+				"DROP TABLE proxy_numbers",
+				"ALTER TABLE proxy_numbers_down RENAME TO proxy_numbers",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN provider_id TEXT NOT NULL DEFAULT ''",
+				"CREATE TABLE messages (id SERIAL PRIMARY KEY, ride_id INTEGER, direction TEXT, provider_id TEXT, " +
+					"originator TEXT, recipient TEXT, body TEXT, created_at TEXT)",
+				"CREATE TABLE calls (id SERIAL PRIMARY KEY, ride_id INTEGER, provider_id TEXT, " +
+					"source TEXT, destination TEXT, transferred_to TEXT, created_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE calls",
+				"DROP TABLE messages",
+				"ALTER TABLE proxy_numbers DROP COLUMN provider_id",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN provider_id VARCHAR(255) NOT NULL DEFAULT ''",
+				"CREATE TABLE messages (id INTEGER AUTO_INCREMENT PRIMARY KEY, ride_id INTEGER, direction VARCHAR(255), provider_id VARCHAR(255), " +
+					"originator VARCHAR(255), recipient VARCHAR(255), body TEXT, created_at VARCHAR(255))",
+				"CREATE TABLE calls (id INTEGER AUTO_INCREMENT PRIMARY KEY, ride_id INTEGER, provider_id VARCHAR(255), " +
+					"source VARCHAR(255), destination VARCHAR(255), transferred_to VARCHAR(255), created_at VARCHAR(255))",
+			},
+			Down: []string{
+				"DROP TABLE calls",
+				"DROP TABLE messages",
+				"ALTER TABLE proxy_numbers DROP COLUMN provider_id",
+			},
+		},
+	},
+	{
+		Version: 7,
+		Name:    "proxy number tags",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN tags TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE rides ADD COLUMN required_tags TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE rides_down (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, number_id INTEGER, customer_pin TEXT NOT NULL DEFAULT '', " +
+					"driver_pin TEXT NOT NULL DEFAULT '', FOREIGN KEY (customer_id) REFERENCES customers(id), " +
+					"FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+				"INSERT INTO rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin FROM rides",
+				"DROP TABLE rides",
+				"ALTER TABLE rides_down RENAME TO rides",
+				"CREATE TABLE proxy_numbers_down (id INTEGER PRIMARY KEY, number TEXT UNIQUE, " +
+					"port_status TEXT NOT NULL DEFAULT 'active', provider_id TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO proxy_numbers_down (id, number, port_status, provider_id) " +
+					"SELECT id, number, port_status, provider_id FROM proxy_numbers",
+				"DROP TABLE proxy_numbers",
+				"ALTER TABLE proxy_numbers_down RENAME TO proxy_numbers",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE rides DROP COLUMN required_tags",
+				"ALTER TABLE proxy_numbers DROP COLUMN tags",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN tags VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE rides ADD COLUMN required_tags VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE rides DROP COLUMN required_tags",
+				"ALTER TABLE proxy_numbers DROP COLUMN tags",
+			},
+		},
+	},
+	{
+		Version: 8,
+		Name:    "proxy number features",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN features TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE proxy_numbers_down (id INTEGER PRIMARY KEY, number TEXT UNIQUE, " +
+					"port_status TEXT NOT NULL DEFAULT 'active', provider_id TEXT NOT NULL DEFAULT '', " +
+					"tags TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO proxy_numbers_down (id, number, port_status, provider_id, tags) " +
+					"SELECT id, number, port_status, provider_id, tags FROM proxy_numbers",
+				"DROP TABLE proxy_numbers",
+				"ALTER TABLE proxy_numbers_down RENAME TO proxy_numbers",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE proxy_numbers DROP COLUMN features",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE proxy_numbers ADD COLUMN features VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE proxy_numbers DROP COLUMN features",
+			},
+		},
+	},
+	{
+		Version: 9,
+		Name:    "driver vehicles",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE drivers ADD COLUMN vehicle TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE drivers_down (id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+				"INSERT INTO drivers_down (id, name, number) SELECT id, name, number FROM drivers",
+				"DROP TABLE drivers",
+				"ALTER TABLE drivers_down RENAME TO drivers",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE drivers DROP COLUMN vehicle",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE drivers ADD COLUMN vehicle VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE drivers DROP COLUMN vehicle",
+			},
+		},
+	},
+	{
+		Version: 10,
+		Name:    "message delivery status",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE messages ADD COLUMN relayed_from TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE messages ADD COLUMN status TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE messages_down (id INTEGER PRIMARY KEY, ride_id INTEGER, direction TEXT, provider_id TEXT, " +
+					"originator TEXT, recipient TEXT, body TEXT, created_at TEXT)",
+				"INSERT INTO messages_down (id, ride_id, direction, provider_id, originator, recipient, body, created_at) " +
+					"SELECT id, ride_id, direction, provider_id, originator, recipient, body, created_at FROM messages",
+				"DROP TABLE messages",
+				"ALTER TABLE messages_down RENAME TO messages",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE messages DROP COLUMN status",
+				"ALTER TABLE messages DROP COLUMN relayed_from",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE messages ADD COLUMN relayed_from VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE messages ADD COLUMN status VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE messages DROP COLUMN status",
+				"ALTER TABLE messages DROP COLUMN relayed_from",
+			},
+		},
+	},
+	{
+		// Archive tables have the same columns as the tables they archive:
+		// a migration adding a column to rides, messages or calls must add
+		// it to their archive table too
+		Version: 11,
+		Name:    "archives",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE archived_rides AS SELECT * FROM rides WHERE 0",
+				"CREATE TABLE archived_messages AS SELECT * FROM messages WHERE 0",
+				"CREATE TABLE archived_calls AS SELECT * FROM calls WHERE 0",
+			},
+			Down: []string{
+				"DROP TABLE archived_calls",
+				"DROP TABLE archived_messages",
+				"DROP TABLE archived_rides",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE archived_rides AS SELECT * FROM rides WHERE false",
+				"CREATE TABLE archived_messages AS SELECT * FROM messages WHERE false",
+				"CREATE TABLE archived_calls AS SELECT * FROM calls WHERE false",
+			},
+		},
+	},
+	{
+		Version: 12,
+		Name:    "message templates",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE message_templates (id INTEGER PRIMARY KEY, name TEXT, body TEXT, created_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE message_templates",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE message_templates (id SERIAL PRIMARY KEY, name TEXT, body TEXT, created_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE message_templates (id INTEGER AUTO_INCREMENT PRIMARY KEY, name VARCHAR(255), body TEXT, created_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 13,
+		Name:    "quota usage",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE quota_usage (day TEXT, kind TEXT, used INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (day, kind))",
+			},
+			Down: []string{
+				"DROP TABLE quota_usage",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE quota_usage (day VARCHAR(255), kind VARCHAR(255), used INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (day, kind))",
+			},
+		},
+	},
+	{
+		Version: 14,
+		Name:    "settings and held messages",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE settings (name TEXT PRIMARY KEY, value TEXT)",
+				"CREATE TABLE held_messages (id INTEGER PRIMARY KEY, ride_id INTEGER, originator TEXT, recipient TEXT, body TEXT, " +
+					"relayed_from TEXT NOT NULL DEFAULT '', created_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE held_messages",
+				"DROP TABLE settings",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE settings (name TEXT PRIMARY KEY, value TEXT)",
+				"CREATE TABLE held_messages (id SERIAL PRIMARY KEY, ride_id INTEGER, originator TEXT, recipient TEXT, body TEXT, " +
+					"relayed_from TEXT NOT NULL DEFAULT '', created_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE settings (name VARCHAR(255) PRIMARY KEY, value VARCHAR(255))",
+				"CREATE TABLE held_messages (id INTEGER AUTO_INCREMENT PRIMARY KEY, ride_id INTEGER, originator VARCHAR(255), recipient VARCHAR(255), body TEXT, " +
+					"relayed_from VARCHAR(255) NOT NULL DEFAULT '', created_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 15,
+		Name:    "language preferences",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE language_preferences (number TEXT PRIMARY KEY, language TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE language_preferences",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE language_preferences (number VARCHAR(255) PRIMARY KEY, language VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 16,
+		Name:    "relationships",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE relationships (id INTEGER PRIMARY KEY, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"created_at TEXT, expires_at TEXT, ended_at TEXT NOT NULL DEFAULT '')",
+			},
+			Down: []string{
+				"DROP TABLE relationships",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE relationships (id SERIAL PRIMARY KEY, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"created_at TEXT, expires_at TEXT, ended_at TEXT NOT NULL DEFAULT '')",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE relationships (id INTEGER AUTO_INCREMENT PRIMARY KEY, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"created_at VARCHAR(255), expires_at VARCHAR(255), ended_at VARCHAR(255) NOT NULL DEFAULT '')",
+			},
+		},
+	},
+	{
+		Version: 17,
+		Name:    "proxy releases",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_releases (id INTEGER PRIMARY KEY, number_id INTEGER, customer_id INTEGER, driver_id INTEGER, released_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE proxy_releases",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_releases (id SERIAL PRIMARY KEY, number_id INTEGER, customer_id INTEGER, driver_id INTEGER, released_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_releases (id INTEGER AUTO_INCREMENT PRIMARY KEY, number_id INTEGER, customer_id INTEGER, driver_id INTEGER, released_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 18,
+		Name:    "proxy handoffs",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_handoffs (id INTEGER PRIMARY KEY, ride_id INTEGER, old_number_id INTEGER, new_number_id INTEGER, " +
+					"created_at TEXT, expires_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE proxy_handoffs",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_handoffs (id SERIAL PRIMARY KEY, ride_id INTEGER, old_number_id INTEGER, new_number_id INTEGER, " +
+					"created_at TEXT, expires_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_handoffs (id INTEGER AUTO_INCREMENT PRIMARY KEY, ride_id INTEGER, old_number_id INTEGER, new_number_id INTEGER, " +
+					"created_at VARCHAR(255), expires_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 19,
+		Name:    "participant preferences",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE participant_preferences (number TEXT PRIMARY KEY, quiet_start TEXT NOT NULL DEFAULT '', " +
+					"quiet_end TEXT NOT NULL DEFAULT '', channel TEXT NOT NULL DEFAULT 'any')",
+				"CREATE TABLE preference_links (token TEXT PRIMARY KEY, number TEXT, created_at TEXT, expires_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE preference_links",
+				"DROP TABLE participant_preferences",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE participant_preferences (number VARCHAR(255) PRIMARY KEY, quiet_start VARCHAR(255) NOT NULL DEFAULT '', " +
+					"quiet_end VARCHAR(255) NOT NULL DEFAULT '', channel VARCHAR(255) NOT NULL DEFAULT 'any')",
+				"CREATE TABLE preference_links (token VARCHAR(255) PRIMARY KEY, number VARCHAR(255), created_at VARCHAR(255), expires_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		// Filled in from the existing rides and relationships at startup
+		Version: 20,
+		Name:    "proxy reservations",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_reservations (id INTEGER PRIMARY KEY, number_id INTEGER, customer_id INTEGER, driver_id INTEGER, " +
+					"UNIQUE (customer_id, number_id), UNIQUE (driver_id, number_id))",
+			},
+			Down: []string{
+				"DROP TABLE proxy_reservations",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_reservations (id SERIAL PRIMARY KEY, number_id INTEGER, customer_id INTEGER, driver_id INTEGER, " +
+					"UNIQUE (customer_id, number_id), UNIQUE (driver_id, number_id))",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_reservations (id INTEGER AUTO_INCREMENT PRIMARY KEY, number_id INTEGER, customer_id INTEGER, driver_id INTEGER, " +
+					"UNIQUE (customer_id, number_id), UNIQUE (driver_id, number_id))",
+			},
+		},
+	},
+	{
+		Version: 21,
+		Name:    "ride status",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN status TEXT NOT NULL DEFAULT 'scheduled'",
+				"ALTER TABLE archived_rides ADD COLUMN status TEXT NOT NULL DEFAULT 'scheduled'",
+			},
+			Down: []string{
+				"CREATE TABLE archived_rides_down (id INT, start TEXT, destination TEXT, datetime TEXT, customer_id INT, " +
+					"driver_id INT, number_id INT, customer_pin TEXT, driver_pin TEXT, required_tags TEXT)",
+				"INSERT INTO archived_rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags FROM archived_rides",
+				"DROP TABLE archived_rides",
+				"ALTER TABLE archived_rides_down RENAME TO archived_rides",
+				"CREATE TABLE rides_down (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, number_id INTEGER, customer_pin TEXT NOT NULL DEFAULT '', " +
+					"driver_pin TEXT NOT NULL DEFAULT '', required_tags TEXT NOT NULL DEFAULT '', " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+				"INSERT INTO rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags FROM rides",
+				"DROP TABLE rides",
+				"ALTER TABLE rides_down RENAME TO rides",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE archived_rides DROP COLUMN status",
+				"ALTER TABLE rides DROP COLUMN status",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN status VARCHAR(255) NOT NULL DEFAULT 'scheduled'",
+				"ALTER TABLE archived_rides ADD COLUMN status VARCHAR(255) NOT NULL DEFAULT 'scheduled'",
+			},
+			Down: []string{
+				"ALTER TABLE archived_rides DROP COLUMN status",
+				"ALTER TABLE rides DROP COLUMN status",
+			},
+		},
+	},
+	{
+		Version: 22,
+		Name:    "ride labels and saved filters",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN labels TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN labels TEXT NOT NULL DEFAULT ''",
+				"CREATE TABLE saved_filters (id INTEGER PRIMARY KEY, owner TEXT, name TEXT, label TEXT NOT NULL DEFAULT '', " +
+					"status TEXT NOT NULL DEFAULT '', UNIQUE (owner, name))",
+			},
+			Down: []string{
+				"DROP TABLE saved_filters",
+				"CREATE TABLE archived_rides_down (id INT, start TEXT, destination TEXT, datetime TEXT, customer_id INT, " +
+					"driver_id INT, number_id INT, customer_pin TEXT, driver_pin TEXT, required_tags TEXT, " +
+					"status TEXT NOT NULL DEFAULT 'scheduled')",
+				"INSERT INTO archived_rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags, status) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags, status FROM archived_rides",
+				"DROP TABLE archived_rides",
+				"ALTER TABLE archived_rides_down RENAME TO archived_rides",
+				"CREATE TABLE rides_down (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, number_id INTEGER, customer_pin TEXT NOT NULL DEFAULT '', " +
+					"driver_pin TEXT NOT NULL DEFAULT '', required_tags TEXT NOT NULL DEFAULT '', " +
+					"status TEXT NOT NULL DEFAULT 'scheduled', FOREIGN KEY (customer_id) REFERENCES customers(id), " +
+					"FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+				"INSERT INTO rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags, status) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags, status FROM rides",
+				"DROP TABLE rides",
+				"ALTER TABLE rides_down RENAME TO rides",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN labels TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN labels TEXT NOT NULL DEFAULT ''",
+				"CREATE TABLE saved_filters (id SERIAL PRIMARY KEY, owner TEXT, name TEXT, label TEXT NOT NULL DEFAULT '', " +
+					"status TEXT NOT NULL DEFAULT '', UNIQUE (owner, name))",
+			},
+			Down: []string{
+				"DROP TABLE saved_filters",
+				"ALTER TABLE archived_rides DROP COLUMN labels",
+				"ALTER TABLE rides DROP COLUMN labels",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN labels VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN labels VARCHAR(255) NOT NULL DEFAULT ''",
+				"CREATE TABLE saved_filters (id INTEGER AUTO_INCREMENT PRIMARY KEY, owner VARCHAR(255), name VARCHAR(255), label VARCHAR(255) NOT NULL DEFAULT '', " +
+					"status VARCHAR(255) NOT NULL DEFAULT '', UNIQUE (owner, name))",
+			},
+			Down: []string{
+				"DROP TABLE saved_filters",
+				"ALTER TABLE archived_rides DROP COLUMN labels",
+				"ALTER TABLE rides DROP COLUMN labels",
+			},
+		},
+	},
+	{
+		Version: 23,
+		Name:    "proxy allocations",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_allocations (id INTEGER PRIMARY KEY, number_id INTEGER, allocated_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE proxy_allocations",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_allocations (id SERIAL PRIMARY KEY, number_id INTEGER, allocated_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE proxy_allocations (id INTEGER AUTO_INCREMENT PRIMARY KEY, number_id INTEGER, allocated_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 24,
+		Name:    "pair proxies",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE pair_proxies (id INTEGER PRIMARY KEY, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"updated_at TEXT, UNIQUE (customer_id, driver_id))",
+			},
+			Down: []string{
+				"DROP TABLE pair_proxies",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE pair_proxies (id SERIAL PRIMARY KEY, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"updated_at TEXT, UNIQUE (customer_id, driver_id))",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE pair_proxies (id INTEGER AUTO_INCREMENT PRIMARY KEY, customer_id INTEGER, driver_id INTEGER, number_id INTEGER, " +
+					"updated_at VARCHAR(255), UNIQUE (customer_id, driver_id))",
+			},
+		},
+	},
+	{
+		Version: 25,
+		Name:    "approvals and audit log",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE pending_actions (id INTEGER PRIMARY KEY, action TEXT, target TEXT, description TEXT, " +
+					"requested_by TEXT, requested_at TEXT, status TEXT NOT NULL DEFAULT 'pending', " +
+					"decided_by TEXT NOT NULL DEFAULT '', decided_at TEXT NOT NULL DEFAULT '')",
+				"CREATE TABLE audit_log (id INTEGER PRIMARY KEY, time TEXT, actor TEXT, event TEXT, detail TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE audit_log",
+				"DROP TABLE pending_actions",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE pending_actions (id SERIAL PRIMARY KEY, action TEXT, target TEXT, description TEXT, " +
+					"requested_by TEXT, requested_at TEXT, status TEXT NOT NULL DEFAULT 'pending', " +
+					"decided_by TEXT NOT NULL DEFAULT '', decided_at TEXT NOT NULL DEFAULT '')",
+				"CREATE TABLE audit_log (id SERIAL PRIMARY KEY, time TEXT, actor TEXT, event TEXT, detail TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE pending_actions (id INTEGER AUTO_INCREMENT PRIMARY KEY, action VARCHAR(255), target VARCHAR(255), description VARCHAR(255), " +
+					"requested_by VARCHAR(255), requested_at VARCHAR(255), status VARCHAR(255) NOT NULL DEFAULT 'pending', " +
+					"decided_by VARCHAR(255) NOT NULL DEFAULT '', decided_at VARCHAR(255) NOT NULL DEFAULT '')",
+				"CREATE TABLE audit_log (id INTEGER AUTO_INCREMENT PRIMARY KEY, time VARCHAR(255), actor VARCHAR(255), event VARCHAR(255), detail VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 26,
+		Name:    "ride muting",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN muted_by TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN muted_by TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE archived_rides_down (id INT, start TEXT, destination TEXT, datetime TEXT, customer_id INT, " +
+					"driver_id INT, number_id INT, customer_pin TEXT, driver_pin TEXT, required_tags TEXT, " +
+					"status TEXT NOT NULL DEFAULT 'scheduled', labels TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO archived_rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags, status, labels) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags, status, labels FROM archived_rides",
+				"DROP TABLE archived_rides",
+				"ALTER TABLE archived_rides_down RENAME TO archived_rides",
+				"CREATE TABLE rides_down (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, number_id INTEGER, customer_pin TEXT NOT NULL DEFAULT '', " +
+					"driver_pin TEXT NOT NULL DEFAULT '', required_tags TEXT NOT NULL DEFAULT '', " +
+					"status TEXT NOT NULL DEFAULT 'scheduled', labels TEXT NOT NULL DEFAULT '', " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+				"INSERT INTO rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags, status, labels) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags, status, labels FROM rides",
+				"DROP TABLE rides",
+				"ALTER TABLE rides_down RENAME TO rides",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE archived_rides DROP COLUMN muted_by",
+				"ALTER TABLE rides DROP COLUMN muted_by",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN muted_by VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN muted_by VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE archived_rides DROP COLUMN muted_by",
+				"ALTER TABLE rides DROP COLUMN muted_by",
+			},
+		},
+	},
+	{
+		// rides and numbers are comma-separated ride IDs and proxy numbers the
+		// incident affects; resolved_at is empty while it is open
+		Version: 27,
+		Name:    "incidents",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE incidents (id INTEGER PRIMARY KEY, kind TEXT, summary TEXT, " +
+					"rides TEXT NOT NULL DEFAULT '', numbers TEXT NOT NULL DEFAULT '', " +
+					"opened_at TEXT, resolved_at TEXT NOT NULL DEFAULT '')",
+			},
+			Down: []string{
+				"DROP TABLE incidents",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE incidents (id SERIAL PRIMARY KEY, kind TEXT, summary TEXT, " +
+					"rides TEXT NOT NULL DEFAULT '', numbers TEXT NOT NULL DEFAULT '', " +
+					"opened_at TEXT, resolved_at TEXT NOT NULL DEFAULT '')",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE incidents (id INTEGER AUTO_INCREMENT PRIMARY KEY, kind VARCHAR(255), summary VARCHAR(255), " +
+					"rides VARCHAR(255) NOT NULL DEFAULT '', numbers VARCHAR(255) NOT NULL DEFAULT '', " +
+					"opened_at VARCHAR(255), resolved_at VARCHAR(255) NOT NULL DEFAULT '')",
+			},
+		},
+	},
+	{
+		Version: 28,
+		Name:    "pending rides",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE pending_rides (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, required_tags TEXT NOT NULL DEFAULT '', labels TEXT NOT NULL DEFAULT '', " +
+					"queued_at TEXT, " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+			},
+			Down: []string{
+				"DROP TABLE pending_rides",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE pending_rides (id SERIAL PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, required_tags TEXT NOT NULL DEFAULT '', labels TEXT NOT NULL DEFAULT '', " +
+					"queued_at TEXT, " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE pending_rides (id INTEGER AUTO_INCREMENT PRIMARY KEY, start VARCHAR(255), destination VARCHAR(255), datetime VARCHAR(255), " +
+					"customer_id INTEGER, driver_id INTEGER, required_tags VARCHAR(255) NOT NULL DEFAULT '', labels VARCHAR(255) NOT NULL DEFAULT '', " +
+					"queued_at VARCHAR(255), " +
+					"FOREIGN KEY (customer_id) REFERENCES customers(id), FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+			},
+		},
+	},
+	{
+		Version: 29,
+		Name:    "people deactivation",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE customers ADD COLUMN deactivated INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE drivers ADD COLUMN deactivated INTEGER NOT NULL DEFAULT 0",
+			},
+			Down: []string{
+				"CREATE TABLE drivers_down (id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE, vehicle TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO drivers_down (id, name, number, vehicle) SELECT id, name, number, vehicle FROM drivers",
+				"DROP TABLE drivers",
+				"ALTER TABLE drivers_down RENAME TO drivers",
+				"CREATE TABLE customers_down (id INTEGER PRIMARY KEY, name TEXT, number TEXT UNIQUE)",
+				"INSERT INTO customers_down (id, name, number) SELECT id, name, number FROM customers",
+				"DROP TABLE customers",
+				"ALTER TABLE customers_down RENAME TO customers",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE drivers DROP COLUMN deactivated",
+				"ALTER TABLE customers DROP COLUMN deactivated",
+			},
+		},
+		MySQL: Statements{
+			Down: []string{
+				"ALTER TABLE drivers DROP COLUMN deactivated",
+				"ALTER TABLE customers DROP COLUMN deactivated",
+			},
+		},
+	},
+	{
+		// Counts and times of the texts and calls relayed in each ride, kept
+		// up to date as they are relayed so the ride board needn't count them
+		Version: 30,
+		Name:    "ride activity",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN relayed_texts INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE rides ADD COLUMN last_text_at TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE rides ADD COLUMN relayed_calls INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE rides ADD COLUMN last_call_at TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN relayed_texts INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE archived_rides ADD COLUMN last_text_at TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN relayed_calls INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE archived_rides ADD COLUMN last_call_at TEXT NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"CREATE TABLE archived_rides_down (id INT, start TEXT, destination TEXT, datetime TEXT, customer_id INT, " +
+					"driver_id INT, number_id INT, customer_pin TEXT, driver_pin TEXT, required_tags TEXT, " +
+					"status TEXT NOT NULL DEFAULT 'scheduled', labels TEXT NOT NULL DEFAULT '', " +
+					"muted_by TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO archived_rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags, status, labels, muted_by) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags, status, labels, muted_by FROM archived_rides",
+				"DROP TABLE archived_rides",
+				"ALTER TABLE archived_rides_down RENAME TO archived_rides",
+				"CREATE TABLE rides_down (id INTEGER PRIMARY KEY, start TEXT, destination TEXT, datetime TEXT, " +
+					"customer_id INTEGER, driver_id INTEGER, number_id INTEGER, customer_pin TEXT NOT NULL DEFAULT '', " +
+					"driver_pin TEXT NOT NULL DEFAULT '', required_tags TEXT NOT NULL DEFAULT '', " +
+					"status TEXT NOT NULL DEFAULT 'scheduled', labels TEXT NOT NULL DEFAULT '', " +
+					"muted_by TEXT NOT NULL DEFAULT '', FOREIGN KEY (customer_id) REFERENCES customers(id), " +
+					"FOREIGN KEY (driver_id) REFERENCES drivers(id))",
+				"INSERT INTO rides_down (id, start, destination, datetime, customer_id, driver_id, number_id, " +
+					"customer_pin, driver_pin, required_tags, status, labels, muted_by) " +
+					"SELECT id, start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, " +
+					"required_tags, status, labels, muted_by FROM rides",
+				"DROP TABLE rides",
+				"ALTER TABLE rides_down RENAME TO rides",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE archived_rides DROP COLUMN last_call_at",
+				"ALTER TABLE archived_rides DROP COLUMN relayed_calls",
+				"ALTER TABLE archived_rides DROP COLUMN last_text_at",
+				"ALTER TABLE archived_rides DROP COLUMN relayed_texts",
+				"ALTER TABLE rides DROP COLUMN last_call_at",
+				"ALTER TABLE rides DROP COLUMN relayed_calls",
+				"ALTER TABLE rides DROP COLUMN last_text_at",
+				"ALTER TABLE rides DROP COLUMN relayed_texts",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE rides ADD COLUMN relayed_texts INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE rides ADD COLUMN last_text_at VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE rides ADD COLUMN relayed_calls INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE rides ADD COLUMN last_call_at VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN relayed_texts INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE archived_rides ADD COLUMN last_text_at VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_rides ADD COLUMN relayed_calls INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE archived_rides ADD COLUMN last_call_at VARCHAR(255) NOT NULL DEFAULT ''",
+			},
+			Down: []string{
+				"ALTER TABLE archived_rides DROP COLUMN last_call_at",
+				"ALTER TABLE archived_rides DROP COLUMN relayed_calls",
+				"ALTER TABLE archived_rides DROP COLUMN last_text_at",
+				"ALTER TABLE archived_rides DROP COLUMN relayed_texts",
+				"ALTER TABLE rides DROP COLUMN last_call_at",
+				"ALTER TABLE rides DROP COLUMN relayed_calls",
+				"ALTER TABLE rides DROP COLUMN last_text_at",
+				"ALTER TABLE rides DROP COLUMN relayed_texts",
+			},
+		},
+	},
+	{
+		// The provider that sent or received each message: "messagebird", a
+		// failover provider's name, or empty for messages that weren't sent
+		Version: 31,
+		Name:    "message providers",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE messages ADD COLUMN provider TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_messages ADD COLUMN provider TEXT NOT NULL DEFAULT ''",
+				"UPDATE messages SET provider = 'messagebird' WHERE provider_id NOT IN ('', 'held', 'suppressed')",
+				"UPDATE archived_messages SET provider = 'messagebird' WHERE provider_id NOT IN ('', 'held', 'suppressed')",
+			},
+			Down: []string{
+				"CREATE TABLE archived_messages_down (id INT, ride_id INT, direction TEXT, provider_id TEXT, " +
+					"originator TEXT, recipient TEXT, body TEXT, created_at TEXT, relayed_from TEXT, status TEXT)",
+				"INSERT INTO archived_messages_down (id, ride_id, direction, provider_id, originator, recipient, body, " +
+					"created_at, relayed_from, status) " +
+					"SELECT id, ride_id, direction, provider_id, originator, recipient, body, created_at, relayed_from, " +
+					"status FROM archived_messages",
+				"DROP TABLE archived_messages",
+				"ALTER TABLE archived_messages_down RENAME TO archived_messages",
+				"CREATE TABLE messages_down (id INTEGER PRIMARY KEY, ride_id INTEGER, direction TEXT, provider_id TEXT, " +
+					"originator TEXT, recipient TEXT, body TEXT, created_at TEXT, relayed_from TEXT NOT NULL DEFAULT '', " +
+					"status TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO messages_down (id, ride_id, direction, provider_id, originator, recipient, body, " +
+					"created_at, relayed_from, status) " +
+					"SELECT id, ride_id, direction, provider_id, originator, recipient, body, created_at, relayed_from, status FROM messages",
+				"DROP TABLE messages",
+				"ALTER TABLE messages_down RENAME TO messages",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE archived_messages DROP COLUMN provider",
+				"ALTER TABLE messages DROP COLUMN provider",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE messages ADD COLUMN provider VARCHAR(255) NOT NULL DEFAULT ''",
+				"ALTER TABLE archived_messages ADD COLUMN provider VARCHAR(255) NOT NULL DEFAULT ''",
+				"UPDATE messages SET provider = 'messagebird' WHERE provider_id NOT IN ('', 'held', 'suppressed')",
+				"UPDATE archived_messages SET provider = 'messagebird' WHERE provider_id NOT IN ('', 'held', 'suppressed')",
+			},
+			Down: []string{
+				"ALTER TABLE archived_messages DROP COLUMN provider",
+				"ALTER TABLE messages DROP COLUMN provider",
+			},
+		},
+	},
+	{
+		Version: 32,
+		Name:    "ride contact channels",
+		SQLite: Statements{
+			Up: []string{
+				"ALTER TABLE ride_contacts ADD COLUMN channel TEXT NOT NULL DEFAULT 'sms'",
+			},
+			Down: []string{
+				"CREATE TABLE ride_contacts_down (ride_id INTEGER, role TEXT, number TEXT, PRIMARY KEY (ride_id, role), " +
+					"FOREIGN KEY (ride_id) REFERENCES rides(id))",
+				"INSERT INTO ride_contacts_down (ride_id, role, number) SELECT ride_id, role, number FROM ride_contacts",
+				"DROP TABLE ride_contacts",
+				"ALTER TABLE ride_contacts_down RENAME TO ride_contacts",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE ride_contacts DROP COLUMN channel",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"ALTER TABLE ride_contacts ADD COLUMN channel VARCHAR(255) NOT NULL DEFAULT 'sms'",
+			},
+			Down: []string{
+				"ALTER TABLE ride_contacts DROP COLUMN channel",
+			},
+		},
+	},
+	{
+		Version: 33,
+		Name:    "participant notes",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE participant_notes (id INTEGER PRIMARY KEY, role TEXT, person_id INTEGER, " +
+					"flag TEXT NOT NULL DEFAULT '', body TEXT NOT NULL DEFAULT '', author TEXT NOT NULL DEFAULT '', created_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE participant_notes",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE participant_notes (id SERIAL PRIMARY KEY, role TEXT, person_id INTEGER, " +
+					"flag TEXT NOT NULL DEFAULT '', body TEXT NOT NULL DEFAULT '', author TEXT NOT NULL DEFAULT '', created_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE participant_notes (id INTEGER AUTO_INCREMENT PRIMARY KEY, role VARCHAR(255), person_id INTEGER, " +
+					"flag VARCHAR(255) NOT NULL DEFAULT '', body TEXT NOT NULL, author VARCHAR(255) NOT NULL DEFAULT '', created_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 34,
+		Name:    "api keys",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE api_keys (id INTEGER PRIMARY KEY, name TEXT, key_hash TEXT, prefix TEXT, created_by TEXT, created_at TEXT, " +
+					"revoked_at TEXT NOT NULL DEFAULT '', last_used_at TEXT NOT NULL DEFAULT '')",
+			},
+			Down: []string{
+				"DROP TABLE api_keys",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE api_keys (id SERIAL PRIMARY KEY, name TEXT, key_hash TEXT, prefix TEXT, created_by TEXT, created_at TEXT, " +
+					"revoked_at TEXT NOT NULL DEFAULT '', last_used_at TEXT NOT NULL DEFAULT '')",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE api_keys (id INTEGER AUTO_INCREMENT PRIMARY KEY, name VARCHAR(255), key_hash VARCHAR(255), prefix VARCHAR(255), created_by VARCHAR(255), created_at VARCHAR(255), " +
+					"revoked_at VARCHAR(255) NOT NULL DEFAULT '', last_used_at VARCHAR(255) NOT NULL DEFAULT '')",
+			},
+		},
+	},
+	{
+		Version: 35,
+		Name:    "admin users and sessions",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT UNIQUE, password_hash TEXT, created_at TEXT)",
+				"CREATE TABLE sessions (id INTEGER PRIMARY KEY, token_hash TEXT UNIQUE, username TEXT, created_at TEXT, expires_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE sessions",
+				"DROP TABLE users",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE users (id SERIAL PRIMARY KEY, username TEXT UNIQUE, password_hash TEXT, created_at TEXT)",
+				"CREATE TABLE sessions (id SERIAL PRIMARY KEY, token_hash TEXT UNIQUE, username TEXT, created_at TEXT, expires_at TEXT)",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE users (id INTEGER AUTO_INCREMENT PRIMARY KEY, username VARCHAR(255) UNIQUE, password_hash VARCHAR(255), created_at VARCHAR(255))",
+				"CREATE TABLE sessions (id INTEGER AUTO_INCREMENT PRIMARY KEY, token_hash VARCHAR(255) UNIQUE, username VARCHAR(255), created_at VARCHAR(255), expires_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 36,
+		Name:    "driver shifts",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE shifts (id INTEGER PRIMARY KEY, driver_id INTEGER, started_at TEXT, ended_at TEXT NOT NULL DEFAULT '')",
+			},
+			Down: []string{
+				"DROP TABLE shifts",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE shifts (id SERIAL PRIMARY KEY, driver_id INTEGER, started_at TEXT, ended_at TEXT NOT NULL DEFAULT '')",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE shifts (id INTEGER AUTO_INCREMENT PRIMARY KEY, driver_id INTEGER, started_at VARCHAR(255), ended_at VARCHAR(255) NOT NULL DEFAULT '')",
+			},
+		},
+	},
+	{
+		Version: 37,
+		Name:    "consent registry",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE consents (id INTEGER PRIMARY KEY, number TEXT, purpose TEXT, status TEXT, source TEXT, recorded_at TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO consents (number, purpose, status, source) SELECT number, 'marketing', 'withdrawn', 'sms keyword' FROM opt_outs",
+			},
+			Down: []string{
+				"DROP TABLE consents",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE consents (id SERIAL PRIMARY KEY, number TEXT, purpose TEXT, status TEXT, source TEXT, recorded_at TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO consents (number, purpose, status, source) SELECT number, 'marketing', 'withdrawn', 'sms keyword' FROM opt_outs",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE consents (id INTEGER AUTO_INCREMENT PRIMARY KEY, number VARCHAR(255), purpose VARCHAR(255), status VARCHAR(255), source VARCHAR(255), recorded_at VARCHAR(255) NOT NULL DEFAULT '')",
+				"INSERT INTO consents (number, purpose, status, source) SELECT number, 'marketing', 'withdrawn', 'sms keyword' FROM opt_outs",
+			},
+		},
+	},
+	{
+		Version: 38,
+		Name:    "API key roles",
+		SQLite: Statements{
+			Up: []string{
+				// Keys from before roles could read everything the API serves
+				"ALTER TABLE api_keys ADD COLUMN role TEXT NOT NULL DEFAULT 'support'",
+			},
+			Down: []string{
+				"CREATE TABLE api_keys_down (id INTEGER PRIMARY KEY, name TEXT, key_hash TEXT, prefix TEXT, " +
+					"created_by TEXT, created_at TEXT, revoked_at TEXT NOT NULL DEFAULT '', " +
+					"last_used_at TEXT NOT NULL DEFAULT '')",
+				"INSERT INTO api_keys_down (id, name, key_hash, prefix, created_by, created_at, revoked_at, last_used_at) " +
+					"SELECT id, name, key_hash, prefix, created_by, created_at, revoked_at, last_used_at FROM api_keys",
+				"DROP TABLE api_keys",
+				"ALTER TABLE api_keys_down RENAME TO api_keys",
+			},
+		},
+		Postgres: Statements{
+			Down: []string{
+				"ALTER TABLE api_keys DROP COLUMN role",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				// Keys from before roles could read everything the API serves
+				"ALTER TABLE api_keys ADD COLUMN role VARCHAR(255) NOT NULL DEFAULT 'support'",
+			},
+			Down: []string{
+				"ALTER TABLE api_keys DROP COLUMN role",
+			},
+		},
+	},
+	{
+		Version: 39,
+		Name:    "processed inbound messages",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE processed_messages (message_id TEXT PRIMARY KEY, received_at TEXT)",
+			},
+			Down: []string{
+				"DROP TABLE processed_messages",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE processed_messages (message_id VARCHAR(255) PRIMARY KEY, received_at VARCHAR(255))",
+			},
+		},
+	},
+	{
+		Version: 40,
+		Name:    "ride observers",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE ride_observers (id INTEGER PRIMARY KEY, ride_id INTEGER NOT NULL, token TEXT UNIQUE, name TEXT NOT NULL DEFAULT '', " +
+					"number TEXT NOT NULL DEFAULT '', created_by TEXT NOT NULL DEFAULT '', created_at TEXT, expires_at TEXT, revoked_at TEXT NOT NULL DEFAULT '')",
+			},
+			Down: []string{
+				"DROP TABLE ride_observers",
+			},
+		},
+		Postgres: Statements{
+			Up: []string{
+				"CREATE TABLE ride_observers (id SERIAL PRIMARY KEY, ride_id INTEGER NOT NULL, token TEXT UNIQUE, name TEXT NOT NULL DEFAULT '', " +
+					"number TEXT NOT NULL DEFAULT '', created_by TEXT NOT NULL DEFAULT '', created_at TEXT, expires_at TEXT, revoked_at TEXT NOT NULL DEFAULT '')",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE ride_observers (id INTEGER AUTO_INCREMENT PRIMARY KEY, ride_id INTEGER NOT NULL, token VARCHAR(255) UNIQUE, name VARCHAR(255) NOT NULL DEFAULT '', " +
+					"number VARCHAR(255) NOT NULL DEFAULT '', created_by VARCHAR(255) NOT NULL DEFAULT '', created_at VARCHAR(255), expires_at VARCHAR(255), revoked_at VARCHAR(255) NOT NULL DEFAULT '')",
+			},
+		},
+	},
+	{
+		// Counted per tenant, sharing a database or not. The usage so far
+		// is the single tenant's of a server that isn't run by the tenants
+		// command. quota_usage stays for servers still counting in it
+		// during a rolling deploy.
+		Version: 41,
+		Name:    "quota usage by tenant",
+		SQLite: Statements{
+			Up: []string{
+				"CREATE TABLE tenant_quota_usage (tenant TEXT, day TEXT, kind TEXT, used INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (tenant, day, kind))",
+				"INSERT INTO tenant_quota_usage (tenant, day, kind, used) SELECT '', day, kind, used FROM quota_usage",
+			},
+			Down: []string{
+				"DROP TABLE tenant_quota_usage",
+			},
+		},
+		MySQL: Statements{
+			Up: []string{
+				"CREATE TABLE tenant_quota_usage (tenant VARCHAR(255), day VARCHAR(255), kind VARCHAR(255), used INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (tenant, day, kind))",
+				"INSERT INTO tenant_quota_usage (tenant, day, kind, used) SELECT '', day, kind, used FROM quota_usage",
+			},
+		},
+	},
+}
+
+// Latest returns the version of the newest migration
+func Latest() int {
+	if len(All) == 0 {
+		return 0
+	}
+	return All[len(All)-1].Version
+}
+
+// Applied returns the versions of the migrations applied to db, in order
+func Applied(db *sql.DB) ([]int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TEXT)")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Current returns the version db is at: that of the newest migration applied, or 0
+func Current(db *sql.DB) (int, error) {
+	versions, err := Applied(db)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	return versions[len(versions)-1], nil
+}
+
+// breakingStatements are the parts of statements that break older releases,
+// which only contract migrations may have
+var breakingStatements = []string{"DROP TABLE ", "DROP COLUMN ", "RENAME ", "ALTER COLUMN "}
+
+// Validate checks that the migrations that aren't contract migrations only
+// expand the schema: they don't drop or rename anything, and the columns
+// they add to existing tables have a default, so older releases can still
+// insert rows without them
+func Validate() error {
+	for _, m := range All {
+		if m.Contract {
+			continue
+		}
+		for _, dialect := range []string{SQLite, Postgres, MySQL} {
+			for _, s := range m.For(dialect).Up {
+				upper := strings.ToUpper(s)
+				for _, v := range breakingStatements {
+					if strings.Contains(upper, v) {
+						return fmt.Errorf("migration %d (%s) has %q in %s: mark it as a contract migration", m.Version, m.Name, strings.TrimSpace(v), dialect)
+					}
+				}
+				if strings.Contains(upper, " ADD COLUMN ") && strings.Contains(upper, "NOT NULL") && !strings.Contains(upper, "DEFAULT") {
+					return fmt.Errorf("migration %d (%s) adds a NOT NULL column without a default in %s, which older releases can't insert rows without", m.Version, m.Name, dialect)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ExpandTarget returns the version servers migrate db up to when they start:
+// the latest, short of the first contract migration db hasn't applied. That
+// migration is returned too, or nil if none is pending.
+func ExpandTarget(db *sql.DB) (int, *Migration, error) {
+	versions, err := Applied(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	applied := make(map[int]bool)
+	for _, v := range versions {
+		applied[v] = true
+	}
+	for i, m := range All {
+		if m.Contract && !applied[m.Version] {
+			if i == 0 {
+				return 0, &All[i], nil
+			}
+			return All[i-1].Version, &All[i], nil
+		}
+	}
+	return Latest(), nil, nil
+}
+
+// Up applies the migrations up to and including version target that db
+// hasn't applied yet, returning the ones it applied
+func Up(db *sql.DB, dialect string, target int) ([]Migration, error) {
+	versions, err := Applied(db)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	var done []Migration
+	for _, m := range All {
+		if m.Version > target || applied[m.Version] {
+			continue
+		}
+		err := run(db, m.For(dialect).Up, recordQueries[dialect],
+			m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Down reverts the applied migrations newer than version target, newest
+// first, returning the ones it reverted
+func Down(db *sql.DB, dialect string, target int) ([]Migration, error) {
+	versions, err := Applied(db)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]Migration)
+	for _, m := range All {
+		byVersion[m.Version] = m
+	}
+
+	var done []Migration
+	for i := len(versions) - 1; i >= 0 && versions[i] > target; i-- {
+		m, ok := byVersion[versions[i]]
+		if !ok {
+			return done, fmt.Errorf("migration %d is applied but unknown to this version of the application", versions[i])
+		}
+		err := run(db, m.For(dialect).Down, forgetQueries[dialect], m.Version)
+		if err != nil {
+			return done, fmt.Errorf("reverting migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// recordQueries record a migration as applied, in each dialect
+var recordQueries = map[string]string{
+	SQLite:   "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+	Postgres: "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+	MySQL:    "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+}
+
+// forgetQueries record a migration as reverted, in each dialect
+var forgetQueries = map[string]string{
+	SQLite:   "DELETE FROM schema_migrations WHERE version = ?",
+	Postgres: "DELETE FROM schema_migrations WHERE version = $1",
+	MySQL:    "DELETE FROM schema_migrations WHERE version = ?",
+}
+
+// run executes statements followed by record in one transaction
+func run(db *sql.DB, statements []string, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
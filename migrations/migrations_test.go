@@ -0,0 +1,121 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// withMigrations replaces All with list until t ends
+func withMigrations(t *testing.T, list []Migration) {
+	all := All
+	All = list
+	t.Cleanup(func() { All = all })
+}
+
+// testDBs numbers the in-memory databases opened by openTestDB
+var testDBs int64
+
+// openTestDB opens a new in-memory SQLite database, recording versions as
+// applied in it
+func openTestDB(t *testing.T, versions ...int) *sql.DB {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:migrations-test-%d?mode=memory&cache=shared", atomic.AddInt64(&testDBs, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := Applied(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		if _, err := db.Exec(recordQueries[SQLite], v, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestValidateReleasedMigrations(t *testing.T) {
+	if err := Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		migration Migration
+		problem   string // in the error, empty if the migration is valid
+	}{
+		{"new table", Migration{SQLite: Statements{Up: []string{"CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT NOT NULL)"}}}, ""},
+		{"column with a default", Migration{SQLite: Statements{Up: []string{"ALTER TABLE rides ADD COLUMN note TEXT NOT NULL DEFAULT ''"}}}, ""},
+		{"nullable column", Migration{SQLite: Statements{Up: []string{"ALTER TABLE rides ADD COLUMN note TEXT"}}}, ""},
+		{"dropped table in down", Migration{SQLite: Statements{Up: []string{"CREATE TABLE notes (id INTEGER)"}, Down: []string{"DROP TABLE notes"}}}, ""},
+		{"dropped table", Migration{SQLite: Statements{Up: []string{"DROP TABLE notes"}}}, `"DROP TABLE" in sqlite3`},
+		{"dropped column", Migration{SQLite: Statements{Up: []string{"alter table rides drop column note"}}}, `"DROP COLUMN" in sqlite3`},
+		{"renamed table", Migration{SQLite: Statements{Up: []string{"ALTER TABLE notes RENAME TO remarks"}}}, `"RENAME" in sqlite3`},
+		{"changed column", Migration{
+			SQLite:   Statements{Up: []string{"CREATE TABLE notes (id INTEGER)"}},
+			Postgres: Statements{Up: []string{"ALTER TABLE notes ALTER COLUMN id TYPE BIGINT"}},
+		}, `"ALTER COLUMN" in postgres`},
+		{"column without a default", Migration{
+			SQLite: Statements{Up: []string{"ALTER TABLE rides ADD COLUMN note TEXT NOT NULL DEFAULT ''"}},
+			MySQL:  Statements{Up: []string{"ALTER TABLE rides ADD COLUMN note TEXT NOT NULL"}},
+		}, "without a default in mysql"},
+		{"contract migration", Migration{SQLite: Statements{Up: []string{"DROP TABLE notes"}}, Contract: true}, ""},
+	}
+	for _, test := range tests {
+		m := test.migration
+		m.Version, m.Name = 1, test.name
+		withMigrations(t, []Migration{m})
+		err := Validate()
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+			t.Errorf("%s: Validate() = %v, want an error with %s", test.name, err, test.problem)
+		}
+	}
+}
+
+func TestExpandTarget(t *testing.T) {
+	withMigrations(t, []Migration{
+		{Version: 1, Name: "baseline"},
+		{Version: 2, Name: "notes"},
+		{Version: 3, Name: "drop notes", Contract: true},
+		{Version: 4, Name: "remarks"},
+		{Version: 5, Name: "drop remarks", Contract: true},
+	})
+	tests := []struct {
+		applied  []int
+		target   int
+		contract int // 0 if none is pending
+	}{
+		{nil, 2, 3},
+		{[]int{1, 2}, 2, 3},
+		{[]int{1, 2, 3}, 4, 5},
+		{[]int{1, 2, 3, 4, 5}, 5, 0},
+	}
+	for _, test := range tests {
+		target, contract, err := ExpandTarget(openTestDB(t, test.applied...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		if contract != nil {
+			got = contract.Version
+		}
+		if target != test.target || got != test.contract {
+			t.Errorf("applied %v: target %d, contract %d, want %d, %d", test.applied, target, got, test.target, test.contract)
+		}
+	}
+
+	withMigrations(t, []Migration{{Version: 1, Name: "drop everything", Contract: true}})
+	if target, contract, err := ExpandTarget(openTestDB(t)); err != nil || target != 0 || contract == nil || contract.Version != 1 {
+		t.Errorf("first migration a contract one: target %d, contract %v, %v, want 0 and migration 1", target, contract, err)
+	}
+}
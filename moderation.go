@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// ModerationRequest is a text a participant sent, before it is relayed to
+// the other participant of their ride
+type ModerationRequest struct {
+	Ride RideType
+	Role string // Of the sender, roleCustomer or roleDriver
+	From string // The number the text came from
+	Body string
+}
+
+// ModerationResult is what a moderator decided about a text
+type ModerationResult struct {
+	Block  bool
+	Body   string // The text to relay, which the moderator may have changed
+	Reason string // Why the text was blocked or changed, for the log
+}
+
+// Moderator enforces a content policy on the texts we relay. Moderators
+// run in the order they were registered, each getting the text the one
+// before it relayed; the first to block a text stops it.
+//
+// To add a moderator without touching the handlers, implement this
+// interface in a new file and register it from that file's init function:
+//
+//	func init() { registerModerator(myPolicyModerator{}) }
+type Moderator interface {
+	Moderate(req ModerationRequest) (ModerationResult, error)
+}
+
+var (
+	moderatorsMu sync.RWMutex
+	moderators   []Moderator
+)
+
+// registerModerator adds m to the moderators relayed texts go through
+func registerModerator(m Moderator) {
+	moderatorsMu.Lock()
+	defer moderatorsMu.Unlock()
+	moderators = append(moderators, m)
+}
+
+// moderationBlocksOnError reports whether texts are blocked when a
+// moderator fails, set with MODERATION_ON_ERROR=block. By default they are
+// relayed as the moderators before it left them.
+func moderationBlocksOnError() bool {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("MODERATION_ON_ERROR"))) == "block"
+}
+
+// moderateText runs req through the moderators, returning what they decided
+func moderateText(req ModerationRequest) ModerationResult {
+	moderatorsMu.RLock()
+	defer moderatorsMu.RUnlock()
+
+	result := ModerationResult{Body: req.Body}
+	var reasons []string
+	for _, m := range moderators {
+		req.Body = result.Body
+		r, err := m.Moderate(req)
+		if err != nil {
+			log.Printf("Moderator %T failed on a text for ride %d: %v", m, req.Ride.ID, err)
+			if moderationBlocksOnError() {
+				return ModerationResult{Block: true, Reason: fmt.Sprintf("moderator %T failed", m)}
+			}
+			continue
+		}
+		if r.Reason != "" {
+			reasons = append(reasons, r.Reason)
+		}
+		if r.Block {
+			return ModerationResult{Block: true, Reason: strings.Join(reasons, "; ")}
+		}
+		result.Body = r.Body
+	}
+	result.Reason = strings.Join(reasons, "; ")
+	return result
+}
+
+// moderateRelay runs the text msg's sender, with role in ride, wants to
+// relay through the moderators, returning the text to relay. If it is
+// blocked, the sender is told and ok is false.
+func moderateRelay(store RideStore, mb *messagebird.Client, msg InboundSMS, ride RideType, role string, payload string) (body string, ok bool) {
+	result := moderateText(ModerationRequest{Ride: ride, Role: role, From: msg.Originator, Body: payload})
+	if result.Block {
+		log.Printf("Not relaying message %s for ride %d: blocked by moderation (%s)", msg.ID, ride.ID, result.Reason)
+		replyTo(store, mb, msg, ride.ID, "Your message wasn't delivered: it goes against our content policy.")
+		return "", false
+	}
+	if result.Body != payload {
+		log.Printf("Relaying message %s for ride %d as changed by moderation (%s)", msg.ID, ride.ID, result.Reason)
+	}
+	return result.Body, true
+}
+
+// patternModerator blocks texts matching a regular expression, e.g. ones
+// sharing a phone number, which masking is meant to keep private
+type patternModerator struct {
+	Pattern *regexp.Regexp
+}
+
+// Moderate implements Moderator
+func (m patternModerator) Moderate(req ModerationRequest) (ModerationResult, error) {
+	if m.Pattern.MatchString(req.Body) {
+		return ModerationResult{Block: true, Reason: "matches MODERATION_BLOCK_PATTERN"}, nil
+	}
+	return ModerationResult{Body: req.Body}, nil
+}
+
+// defaultProfanity are the words profanityModerator looks for besides the
+// ones in MODERATION_PROFANITY_WORDS
+var defaultProfanity = []string{"fuck", "fucking", "shit", "bitch", "bastard", "asshole", "cunt", "dick", "wanker"}
+
+// profanityModerator masks or blocks texts with profanity in them
+type profanityModerator struct {
+	Words *regexp.Regexp // Matches any of the words, as a whole word
+	Block bool           // Block texts with profanity rather than mask it
+}
+
+// newProfanityModerator returns a moderator looking for words, matched as
+// whole words regardless of case
+func newProfanityModerator(words []string, block bool) profanityModerator {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return profanityModerator{Words: regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`), Block: block}
+}
+
+// Moderate implements Moderator
+func (m profanityModerator) Moderate(req ModerationRequest) (ModerationResult, error) {
+	if !m.Words.MatchString(req.Body) {
+		return ModerationResult{Body: req.Body}, nil
+	}
+	if m.Block {
+		return ModerationResult{Block: true, Reason: "profanity"}, nil
+	}
+	body := m.Words.ReplaceAllStringFunc(req.Body, func(word string) string {
+		letters := []rune(word)
+		return string(letters[:1]) + strings.Repeat("*", len(letters)-1)
+	})
+	return ModerationResult{Body: body, Reason: "profanity masked"}, nil
+}
+
+// httpModerator asks an external moderation service about each text
+type httpModerator struct {
+	URL    string
+	Client *http.Client
+}
+
+// httpModerationRequest is the JSON body httpModerator posts. It leaves out
+// the participants' numbers.
+type httpModerationRequest struct {
+	RideID int    `json:"ride_id"`
+	Role   string `json:"role"`
+	Body   string `json:"body"`
+}
+
+// httpModerationResponse is the JSON body the moderation service answers
+// with. A body left out or empty means the text is relayed unchanged.
+type httpModerationResponse struct {
+	Block  bool   `json:"block"`
+	Body   string `json:"body"`
+	Reason string `json:"reason"`
+}
+
+// Moderate implements Moderator
+func (m httpModerator) Moderate(req ModerationRequest) (ModerationResult, error) {
+	body, err := json.Marshal(httpModerationRequest{RideID: req.Ride.ID, Role: req.Role, Body: req.Body})
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	resp, err := m.Client.Post(m.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return ModerationResult{}, fmt.Errorf("%s responded with %s", m.URL, resp.Status)
+	}
+	var answer httpModerationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return ModerationResult{}, fmt.Errorf("%s answered with invalid JSON: %v", m.URL, err)
+	}
+	result := ModerationResult{Block: answer.Block, Body: answer.Body, Reason: answer.Reason}
+	if result.Body == "" {
+		result.Body = req.Body
+	}
+	return result, nil
+}
+
+// registerModerators registers the built-in moderators the environment
+// configures, in this order:
+//
+//	MODERATION_BLOCK_PATTERN   a regular expression texts are blocked for matching
+//	MODERATION_PROFANITY       "mask" or "block" profanity, with the words in
+//	                           MODERATION_PROFANITY_WORDS (comma-separated) added
+//	MODERATION_URL             a service texts are posted to, see httpModerator,
+//	                           answering within MODERATION_TIMEOUT
+func registerModerators() error {
+	if v := os.Getenv("MODERATION_BLOCK_PATTERN"); v != "" {
+		pattern, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("invalid MODERATION_BLOCK_PATTERN: %v", err)
+		}
+		registerModerator(patternModerator{Pattern: pattern})
+	}
+
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("MODERATION_PROFANITY"))); v {
+	case "":
+	case "mask", "block":
+		words := append([]string{}, defaultProfanity...)
+		for _, w := range strings.Split(os.Getenv("MODERATION_PROFANITY_WORDS"), ",") {
+			if w = strings.TrimSpace(w); w != "" {
+				words = append(words, w)
+			}
+		}
+		registerModerator(newProfanityModerator(words, v == "block"))
+	default:
+		return fmt.Errorf("invalid MODERATION_PROFANITY %q: use mask or block", v)
+	}
+
+	if url := strings.TrimSpace(os.Getenv("MODERATION_URL")); url != "" {
+		client := &http.Client{Timeout: envDuration("MODERATION_TIMEOUT", 3*time.Second)}
+		registerModerator(httpModerator{URL: url, Client: client})
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+)
+
+// Keywords a ride participant texts to pause and resume texts from the
+// other participant, e.g. when a customer keeps texting their driver
+const (
+	muteKeyword   = "MUTE"
+	unmuteKeyword = "UNMUTE"
+)
+
+// parseMuteRequest reports whether payload is the MUTE or UNMUTE keyword,
+// and which
+func parseMuteRequest(payload string) (muted bool, ok bool) {
+	switch strings.ToUpper(strings.TrimSpace(payload)) {
+	case muteKeyword:
+		return true, true
+	case unmuteKeyword:
+		return false, true
+	}
+	return false, false
+}
+
+// muted reports whether the participant of ride with role muted the other
+// participant, so their texts aren't relayed to role
+func (ride RideType) muted(role string) bool {
+	for _, v := range ride.MutedBy {
+		if v == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Mutes describes who muted whom in the ride, e.g. "customer muted driver",
+// for dispatchers
+func (ride RideType) Mutes() []string {
+	var mutes []string
+	for _, role := range []string{roleCustomer, roleDriver} {
+		if ride.muted(role) {
+			mutes = append(mutes, role+" muted "+otherRole(role))
+		}
+	}
+	return mutes
+}
+
+// muteStore is the part of RideStore that keeps who muted whom
+type muteStore interface {
+	// SetMutedBy records that the participants of the ride with ID rideID
+	// with roles muted the other participant, and no others
+	SetMutedBy(rideID int, roles []string) error
+}
+
+// SetMutedBy implements muteStore
+func (s *sqlStore) SetMutedBy(rideID int, roles []string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE rides SET muted_by = ? WHERE id = ?",
+		Postgres: "UPDATE rides SET muted_by = $1 WHERE id = $2",
+	}, strings.Join(roles, ","), rideID)
+	return err
+}
+
+// setMuted records whether the participant of ride with role muted the
+// other participant
+func setMuted(store RideStore, ride RideType, role string, muted bool) error {
+	var roles []string
+	for _, v := range []string{roleCustomer, roleDriver} {
+		if v == role && muted || v != role && ride.muted(v) {
+			roles = append(roles, v)
+		}
+	}
+	return store.SetMutedBy(ride.ID, roles)
+}
+
+// muteReply returns the reply to role's MUTE or UNMUTE text
+func muteReply(role string, muted bool) string {
+	if muted {
+		return "You won't get texts from your " + otherRole(role) + " for this ride. They won't be told. Reply " + unmuteKeyword + " to get them again."
+	}
+	return "You'll get texts from your " + otherRole(role) + " for this ride again."
+}
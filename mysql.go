@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// openMySQLStore opens the MySQL database at dsn, in the MySQL driver's
+// format, e.g. birdcar:secret@tcp(localhost:3306)/ridesharing
+func openMySQLStore(dsn string) (RideStore, *sql.DB, error) {
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := sql.OpenDB(connector)
+	return newSQLStore(db, migrations.MySQL, mysqlUniqueViolation), db, nil
+}
+
+// duplicateEntry is MySQL's error number for a duplicate key, ER_DUP_ENTRY
+const duplicateEntry = 1062
+
+// mysqlUniqueViolation reports whether the MySQL error err is a duplicate key
+func mysqlUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == duplicateEntry
+}
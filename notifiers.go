@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ride event types passed to notifiers
+const (
+	eventRideCreated    = "ride.created"
+	eventMessageRelayed = "message.relayed"
+	eventCallRouted     = "call.routed"
+	// The ride's Status is the one it moved to
+	eventRideStatusChanged = "ride.status_changed"
+)
+
+// RideEvent is something that happened to a ride
+type RideEvent struct {
+	Type string
+	Ride RideType
+	Time time.Time
+}
+
+// Notifier receives ride events, e.g. to update a CRM or an internal API.
+// Notifiers run in addition to the SMS notifications we send, and an error
+// returned by one is logged without affecting the ride.
+//
+// To add a notifier without touching the handlers, implement this interface
+// in a new file and register it from that file's init function:
+//
+//	func init() { registerNotifier(myCRMNotifier{}) }
+type Notifier interface {
+	Notify(event RideEvent) error
+}
+
+var (
+	notifiersMu sync.RWMutex
+	notifiers   []Notifier
+)
+
+// registerNotifier adds n to the notifiers that receive ride events
+func registerNotifier(n Notifier) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	notifiers = append(notifiers, n)
+}
+
+// notifyRideEvent passes an event to every registered notifier.
+// Notifiers run in the background so a slow one doesn't hold up our response.
+func notifyRideEvent(eventType string, ride RideType) {
+	// Messages and calls between regular riders outside a ride aren't ride events
+	if ride.ID == 0 {
+		return
+	}
+	event := RideEvent{Type: eventType, Ride: ride, Time: time.Now()}
+
+	notifiersMu.RLock()
+	defer notifiersMu.RUnlock()
+	for _, n := range notifiers {
+		go func(n Notifier) {
+			if err := n.Notify(event); err != nil {
+				log.Printf("Notifier %T failed for %s on ride %d: %v", n, event.Type, event.Ride.ID, err)
+			}
+		}(n)
+	}
+}
+
+// webhookNotifier posts ride events as JSON to a URL
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// webhookEvent is the JSON body posted by webhookNotifier.
+// It leaves out ride PINs, which only the participants should know.
+type webhookEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	RideID      int       `json:"ride_id"`
+	Start       string    `json:"start"`
+	Destination string    `json:"destination"`
+	DateTime    string    `json:"datetime"`
+	CustomerID  int       `json:"customer_id"`
+	DriverID    int       `json:"driver_id"`
+	ProxyNumber string    `json:"proxy_number"`
+}
+
+// Notify implements Notifier
+func (n webhookNotifier) Notify(event RideEvent) error {
+	body, err := json.Marshal(webhookEvent{
+		Type:        event.Type,
+		Time:        event.Time,
+		RideID:      event.Ride.ID,
+		Start:       event.Ride.Start,
+		Destination: event.Ride.Destination,
+		DateTime:    event.Ride.DateTime,
+		CustomerID:  event.Ride.ThisCustomer.ID,
+		DriverID:    event.Ride.ThisDriver.ID,
+		ProxyNumber: event.Ride.ThisProxyNumber.Number,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+// registerWebhookNotifiers registers a webhookNotifier for each URL in the
+// comma-separated RIDE_EVENT_WEBHOOK_URLS environment variable
+func registerWebhookNotifiers() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, url := range strings.Split(os.Getenv("RIDE_EVENT_WEBHOOK_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			registerNotifier(webhookNotifier{URL: url, Client: client})
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/lookup"
+)
+
+// numberLookupTTL is how long we trust a Lookup API answer about a number
+const numberLookupTTL = 24 * time.Hour
+
+// lookupCodeInvalidNumber is the error code the Lookup API answers with
+// when it can't parse a number
+const lookupCodeInvalidNumber = 21
+
+// textlessNumberTypes are the Lookup API number types that can't receive
+// texts, so participants with them couldn't get our notifications
+var textlessNumberTypes = map[string]string{
+	"fixed line":   "a landline",
+	"toll free":    "a toll-free number",
+	"premium rate": "a premium-rate number",
+	"shared cost":  "a shared-cost number",
+	"voice mail":   "a voicemail number",
+	"pager":        "a pager",
+}
+
+// numberLookupEnabled reports whether participant numbers are checked with
+// the Lookup API before a ride is created. Set NUMBER_LOOKUP=off to skip it.
+func numberLookupEnabled() bool {
+	return os.Getenv("NUMBER_LOOKUP") != "off"
+}
+
+// numberLookup is what the Lookup API told us about a number
+type numberLookup struct {
+	Type    string // e.g. "mobile" or "fixed line"
+	Invalid bool   // the number isn't a phone number at all
+	At      time.Time
+}
+
+var (
+	// numberLookupsMu guards numberLookups
+	numberLookupsMu sync.Mutex
+	// numberLookups caches Lookup API answers, by number
+	numberLookups = make(map[string]numberLookup)
+)
+
+// lookUpNumber asks the Lookup API about number, or returns its cached
+// answer from within numberLookupTTL
+func lookUpNumber(mb *messagebird.Client, number string) (numberLookup, error) {
+	now := time.Now()
+	numberLookupsMu.Lock()
+	cached, ok := numberLookups[number]
+	numberLookupsMu.Unlock()
+	if ok && now.Sub(cached.At) < numberLookupTTL {
+		return cached, nil
+	}
+
+	result := numberLookup{At: now}
+	l, err := lookup.Read(mb, number, &lookup.Params{CountryCode: defaultCountry()})
+	if errResp, ok := err.(messagebird.ErrorResponse); ok && len(errResp.Errors) > 0 && errResp.Errors[0].Code == lookupCodeInvalidNumber {
+		result.Invalid = true
+	} else if err != nil {
+		return result, err
+	} else {
+		result.Type = l.Type
+	}
+
+	numberLookupsMu.Lock()
+	numberLookups[number] = result
+	numberLookupsMu.Unlock()
+	return result, nil
+}
+
+// checkRideNumbers looks up the numbers of ride's customer and driver,
+// returning an error saying which one is invalid or can't receive texts.
+// If the Lookup API can't be reached the ride goes ahead: an outage at
+// MessageBird shouldn't stop bookings.
+func checkRideNumbers(mb *messagebird.Client, ride RideType) error {
+	for _, v := range []struct {
+		role   string
+		person Person
+	}{
+		{roleCustomer, ride.ThisCustomer},
+		{roleDriver, ride.ThisDriver},
+	} {
+		result, err := lookUpNumber(mb, v.person.Number)
+		if err != nil {
+			mbError(err)
+			log.Printf("Could not look up %s's number %s, creating the ride anyway: %v", v.person.Name, v.person.Number, err)
+			continue
+		}
+		if result.Invalid {
+			return fmt.Errorf("the %s %s's number %s is not a valid phone number: correct it before booking them", v.role, v.person.Name, v.person.Number)
+		}
+		if what, ok := textlessNumberTypes[result.Type]; ok {
+			return fmt.Errorf("the %s %s's number %s is %s, which can't receive texts: they need a mobile number to be booked", v.role, v.person.Name, v.person.Number, what)
+		}
+	}
+	return nil
+}
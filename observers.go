@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// observerLinkTTL returns how long a guest link works at most, set with
+// OBSERVER_LINK_TTL. It stops working when its ride ends in any case.
+func observerLinkTTL() time.Duration {
+	return envDuration("OBSERVER_LINK_TTL", 24*time.Hour)
+}
+
+// rideObserver is a guest an operator gave a read-only link to a ride's
+// status page, e.g. a parent following their child's ride. Texts and calls
+// from their number to the ride's proxy number reach the driver, whose
+// replies still go to the customer.
+type rideObserver struct {
+	ID        int
+	RideID    int
+	TokenHash string // hashSecret of the token in the guest link, which isn't kept
+	Name      string
+	Number    string
+	CreatedBy string // The admin who created the link
+	CreatedAt string // RFC 3339
+	ExpiresAt string // RFC 3339
+	RevokedAt string // RFC 3339, empty unless an operator revoked the link
+}
+
+// activeAt reports whether o's link works at now, if its ride hasn't ended
+func (o rideObserver) activeAt(now time.Time) bool {
+	return o.RevokedAt == "" && o.ExpiresAt > now.UTC().Format(time.RFC3339)
+}
+
+// observerColumns are the columns of ride_observers, in rideObserver's order
+const observerColumns = "id, ride_id, token, name, number, created_by, created_at, expires_at, revoked_at"
+
+// scanObserver scans a row of observerColumns
+func scanObserver(row interface{ Scan(...interface{}) error }) (rideObserver, error) {
+	var o rideObserver
+	err := row.Scan(&o.ID, &o.RideID, &o.TokenHash, &o.Name, &o.Number, &o.CreatedBy, &o.CreatedAt, &o.ExpiresAt, &o.RevokedAt)
+	return o, err
+}
+
+// observerStore is the part of RideStore that keeps the observers of rides
+// and their guest links
+type observerStore interface {
+	// RideObservers returns the observers of the ride with ID rideID,
+	// newest first
+	RideObservers(rideID int) ([]rideObserver, error)
+	// ObserverLinks returns the observers with number whose guest links
+	// weren't revoked and hadn't expired at now, newest first
+	ObserverLinks(number string, now time.Time) ([]rideObserver, error)
+	// FindObserver returns the observer whose guest link's token has
+	// tokenHash, or sql.ErrNoRows
+	FindObserver(tokenHash string) (rideObserver, error)
+	// AddObserver stores o, returning its ID
+	AddObserver(o rideObserver) (int, error)
+	// SetObserverToken replaces the token of the guest link of the
+	// observer with the given ID with the one with tokenHash
+	SetObserverToken(id int, tokenHash string) error
+	// RevokeObserver revokes the guest link of the observer with the given
+	// ID of the ride with ID rideID at at, reporting whether it was found
+	// and not revoked already
+	RevokeObserver(id int, rideID int, at time.Time) (bool, error)
+}
+
+// selectObservers returns the observers q, which selects observerColumns,
+// returns with args
+func (s *sqlStore) selectObservers(q sqlQuery, args ...interface{}) ([]rideObserver, error) {
+	rows, err := s.query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var observers []rideObserver
+	for rows.Next() {
+		o, err := scanObserver(rows)
+		if err != nil {
+			return nil, err
+		}
+		observers = append(observers, o)
+	}
+	return observers, rows.Err()
+}
+
+// RideObservers implements observerStore
+func (s *sqlStore) RideObservers(rideID int) ([]rideObserver, error) {
+	return s.selectObservers(sqlQuery{
+		SQLite:   "SELECT " + observerColumns + " FROM ride_observers WHERE ride_id = ? ORDER BY id DESC",
+		Postgres: "SELECT " + observerColumns + " FROM ride_observers WHERE ride_id = $1 ORDER BY id DESC",
+	}, rideID)
+}
+
+// ObserverLinks implements observerStore
+func (s *sqlStore) ObserverLinks(number string, now time.Time) ([]rideObserver, error) {
+	return s.selectObservers(sqlQuery{
+		SQLite:   "SELECT " + observerColumns + " FROM ride_observers WHERE number = ? AND revoked_at = '' AND expires_at > ? ORDER BY id DESC",
+		Postgres: "SELECT " + observerColumns + " FROM ride_observers WHERE number = $1 AND revoked_at = '' AND expires_at > $2 ORDER BY id DESC",
+	}, number, now.UTC().Format(time.RFC3339))
+}
+
+// FindObserver implements observerStore
+func (s *sqlStore) FindObserver(tokenHash string) (rideObserver, error) {
+	return scanObserver(s.queryRow(sqlQuery{
+		SQLite:   "SELECT " + observerColumns + " FROM ride_observers WHERE token = ?",
+		Postgres: "SELECT " + observerColumns + " FROM ride_observers WHERE token = $1",
+	}, tokenHash))
+}
+
+// AddObserver implements observerStore
+func (s *sqlStore) AddObserver(o rideObserver) (int, error) {
+	id, err := s.insertID(sqlQuery{
+		SQLite:   "INSERT INTO ride_observers (ride_id, token, name, number, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO ride_observers (ride_id, token, name, number, created_by, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+	}, o.RideID, o.TokenHash, o.Name, o.Number, o.CreatedBy, o.CreatedAt, o.ExpiresAt)
+	return int(id), err
+}
+
+// SetObserverToken implements observerStore
+func (s *sqlStore) SetObserverToken(id int, tokenHash string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE ride_observers SET token = ? WHERE id = ?",
+		Postgres: "UPDATE ride_observers SET token = $1 WHERE id = $2",
+	}, tokenHash, id)
+	return err
+}
+
+// RevokeObserver implements observerStore
+func (s *sqlStore) RevokeObserver(id int, rideID int, at time.Time) (bool, error) {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "UPDATE ride_observers SET revoked_at = ? WHERE id = ? AND ride_id = ? AND revoked_at = ''",
+		Postgres: "UPDATE ride_observers SET revoked_at = $1 WHERE id = $2 AND ride_id = $3 AND revoked_at = ''",
+	}, at.UTC().Format(time.RFC3339), id, rideID)
+	return n > 0, err
+}
+
+// newObserverToken returns a random token for a guest link
+func newObserverToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate guest link token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// addRideObserver stores a guest link to ride for the observer with name
+// and number, created by the admin createdBy, and returns the observer and
+// the token of their link. Only its hash is stored, so the link can't be
+// read back.
+func addRideObserver(store RideStore, ride RideType, name string, number string, createdBy string) (rideObserver, string, error) {
+	token, err := newObserverToken()
+	if err != nil {
+		return rideObserver{}, "", err
+	}
+	now := time.Now().UTC()
+	o := rideObserver{
+		RideID: ride.ID, TokenHash: hashSecret(token), Name: name, Number: number, CreatedBy: createdBy,
+		CreatedAt: now.Format(time.RFC3339), ExpiresAt: now.Add(observerLinkTTL()).Format(time.RFC3339),
+	}
+	o.ID, err = store.AddObserver(o)
+	return o, token, err
+}
+
+// renewObserverToken gives observer o a new guest link, which works until
+// the old one would have expired, and returns its token. The old link
+// stops working.
+func renewObserverToken(store RideStore, o rideObserver) (string, error) {
+	token, err := newObserverToken()
+	if err != nil {
+		return "", err
+	}
+	return token, store.SetObserverToken(o.ID, hashSecret(token))
+}
+
+// findObserverByToken returns the observer whose guest link has token, and
+// their ride, if the link works at now
+func findObserverByToken(dbdata *RideSharingDB, token string, now time.Time) (rideObserver, RideType, bool) {
+	if token == "" {
+		return rideObserver{}, RideType{}, false
+	}
+	o, err := dbdata.store.FindObserver(hashSecret(token))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return rideObserver{}, RideType{}, false
+	}
+	ride, ok := dbdata.Rides[o.RideID]
+	if !ok || ride.Status.Terminal() || !o.activeAt(now) {
+		return rideObserver{}, RideType{}, false
+	}
+	return o, ride, true
+}
+
+// findRideObserver returns the ride using proxyNumber that number observes,
+// newest first, and its observer, if their guest link works
+func findRideObserver(dbdata *RideSharingDB, proxyNumber string, number string) (RideType, rideObserver, bool) {
+	if number == "" {
+		return RideType{}, rideObserver{}, false
+	}
+	observers, err := dbdata.store.ObserverLinks(number, time.Now())
+	if err != nil {
+		log.Println(err)
+		return RideType{}, rideObserver{}, false
+	}
+	for _, o := range observers {
+		ride, ok := dbdata.Rides[o.RideID]
+		if ok && ride.ThisProxyNumber.Number == proxyNumber && !ride.Status.Terminal() {
+			return ride, o, true
+		}
+	}
+	return RideType{}, rideObserver{}, false
+}
+
+// observerLink returns the guest link with token on the host that received r
+func observerLink(r *http.Request, token string) string {
+	return webhookURL(r, "/observe") + "?token=" + url.QueryEscape(token)
+}
+
+// relayObserverText forwards msg to the driver of the ride its sender
+// observes on the proxy number it was sent to, and reports whether the
+// sender is an observer. Observers texting STATUS get a new guest link.
+func relayObserverText(r *http.Request, dbdata *RideSharingDB, mb *messagebird.Client, msg InboundSMS) bool {
+	ride, observer, ok := findRideObserver(dbdata, msg.Receiver, msg.Originator)
+	if !ok {
+		return false
+	}
+	logMessage(dbdata.store, ride.ID, directionInbound, msg.ID, msg.Originator, msg.Receiver, msg.Payload)
+	payload := strings.TrimSpace(msg.Payload)
+	switch {
+	case isStatusRequest(payload):
+		// Only the hash of their link's token is kept, so they get a new one
+		token, err := renewObserverToken(dbdata.store, observer)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		replyTo(dbdata.store, mb, msg, ride.ID, "Follow the ride here: "+observerLink(r, token))
+	case payload == "":
+	case ride.muted(roleDriver):
+		// Drivers who muted the customer's texts don't get their guests' either
+		log.Printf("Not relaying message %s for ride %d: the driver muted the customer", msg.ID, ride.ID)
+	case !relayQuotaLeft(dbdata):
+		log.Printf("Not relaying message %s for ride %d: the daily quota of %d relays has been reached", msg.ID, ride.ID, quotaLimit(quotaRelays))
+	default:
+		body, ok := moderateRelay(dbdata.store, mb, msg, ride, roleObserver, payload)
+		if !ok {
+			break
+		}
+		log.Printf("Relaying a text from observer %d of ride %d to the driver", observer.ID, ride.ID)
+		body = fmt.Sprintf("%s, following %s's ride: %s", observerName(observer), ride.ThisCustomer.Name, body)
+		id := sendRideMessage(dbdata.store, mb, ride.ID, ride.ThisProxyNumber.Number, ride.contactNumber(roleDriver), body, deliveryReportParams(), msg.Originator)
+		if id == "" {
+			notifyDeliveryFailure(dbdata.store, mb, ride, msg.Originator)
+		} else if id != heldMessageID {
+			markRideActive(dbdata.store, ride)
+		}
+	}
+	return true
+}
+
+// observerName returns the name observers are introduced to drivers by
+func observerName(o rideObserver) string {
+	if o.Name == "" {
+		return "A guest"
+	}
+	return o.Name
+}
+
+// routeObserverCall returns the call flow for call, from an observer of
+// ride, transferring it to the driver
+func routeObserverCall(store RideStore, ride RideType, observer rideObserver, call InboundCall, prompts voicePrompts) string {
+	driver := ride.contactNumber(roleDriver)
+	if !sendAllowed(driver) {
+		return prompts.failXML()
+	}
+	if textsOnly(store, driver) {
+		log.Printf("Not transferring call %s: %s only takes texts", call.CallID, driver)
+		return prompts.textsOnlyXML()
+	}
+	logCall(store, ride.ID, call, driver)
+	markRideActive(store, ride)
+	log.Printf("Transferring call %s from observer %d of ride %d to the driver", call.CallID, observer.ID, ride.ID)
+	return prompts.transferXML(driver)
+}
+
+// observePage is the data rendered by views/default/observe.gohtml
+type observePage struct {
+	Ride     RideType
+	Observer rideObserver
+	Message  string
+}
+
+// observeHandler shows observers who follow their guest link the status of
+// the ride, read-only, and the number to reach its driver at
+func observeHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		observer, ride, ok := findObserverByToken(dbdata, r.FormValue("token"), time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			renderParticipantTemplate(w, "observe.gohtml", observePage{
+				Message: "This link has expired: the ride has ended or its guest link was withdrawn.",
+			})
+			return
+		}
+		renderParticipantTemplate(w, "observe.gohtml", observePage{Ride: ride, Observer: observer})
+	}
+}
+
+// observersPage is the data rendered by views/default/observers.gohtml
+type observersPage struct {
+	Ride      RideType
+	Observers []rideObserver
+	Link      string // The guest link just created, if any
+	Message   string
+}
+
+// observersHandler lists the guest links of the ride given as the ride
+// query parameter, creates them, texting them to the observer from the
+// ride's proxy number, and revokes them
+func observersHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderDefaultTemplate(w, r, "observers.gohtml", observersPage{Message: fmt.Sprint(err)})
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("ride"))
+		ride, ok := dbdata.Rides[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		page := observersPage{Ride: ride}
+
+		if r.Method == "POST" {
+			page.Message, page.Link = changeObservers(dbdata.store, r, mb, ride)
+		}
+		observers, err := dbdata.store.RideObservers(ride.ID)
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		page.Observers = observers
+		renderDefaultTemplate(w, r, "observers.gohtml", page)
+	}
+}
+
+// changeObservers adds or revokes the guest link of ride the observers page
+// posted, returning the message to show and the link it created, if any
+func changeObservers(store RideStore, r *http.Request, mb *messagebird.Client, ride RideType) (string, string) {
+	author := dashboardUser(r)
+	switch r.FormValue("action") {
+	case "add":
+		if ride.Status.Terminal() {
+			return "The ride has ended.", ""
+		}
+		number, err := normalizeNumber(r.FormValue("number"), r.FormValue("country"))
+		if err != nil {
+			return fmt.Sprint(err), ""
+		}
+		if ride.ThisCustomer.hasNumber(number) || ride.ThisDriver.hasNumber(number) {
+			return "That number belongs to the ride's customer or driver.", ""
+		}
+		o, token, err := addRideObserver(store, ride, strings.TrimSpace(r.FormValue("name")), number, author)
+		if err != nil {
+			log.Println(err)
+			return fmt.Sprint(err), ""
+		}
+		link := observerLink(r, token)
+		log.Printf("%s created guest link %d to ride %d", author, o.ID, ride.ID)
+		reach := "Text or call this number to reach the driver."
+		if !ride.ThisProxyNumber.canSMS() {
+			// The notice comes from our sender ID, which can't be replied to
+			reach = fmt.Sprintf("Call %s to reach the driver.", ride.ThisProxyNumber.Number)
+		}
+		notice := fmt.Sprintf("Follow %s's BirdCar ride here: %s %s", ride.ThisCustomer.Name, link, reach)
+		if id := sendRideMessage(store, mb, ride.ID, ride.ThisProxyNumber.notificationOriginator(), number, notice, nil, ""); id == "" {
+			return "Guest link created, but it could not be texted: share it yourself.", link
+		}
+		return "Guest link created and texted to " + maskNumber(number) + ".", link
+	case "revoke":
+		id, _ := strconv.Atoi(r.FormValue("observer"))
+		revoked, err := store.RevokeObserver(id, ride.ID, time.Now())
+		if err != nil {
+			log.Println(err)
+			return fmt.Sprint(err), ""
+		}
+		if !revoked {
+			return fmt.Sprintf("Could not find guest link %q", r.FormValue("observer")), ""
+		}
+		log.Printf("%s revoked guest link %d to ride %d", author, id, ride.ID)
+		return "Guest link revoked.", ""
+	}
+	return fmt.Sprintf("Unknown action %q", r.FormValue("action")), ""
+}
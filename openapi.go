@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// openAPIPath is where the OpenAPI document describing the JSON API is
+// served, see openAPIHandler
+const openAPIPath = apiPrefix + "openapi.json"
+
+// maxAPIBody limits how much of a JSON API request body we read
+const maxAPIBody = 1 << 20
+
+// apiSchema is a JSON schema in the OpenAPI document. Request bodies are
+// validated against them with validate, which supports what's used here.
+type apiSchema struct {
+	Ref                  string                `json:"$ref,omitempty"` // Another schema in apiSchemas, e.g. "#/components/schemas/Ride"
+	Type                 string                `json:"type,omitempty"`
+	Description          string                `json:"description,omitempty"`
+	Enum                 []string              `json:"enum,omitempty"`
+	MinLength            int                   `json:"minLength,omitempty"`
+	Minimum              *int                  `json:"minimum,omitempty"`
+	Properties           map[string]*apiSchema `json:"properties,omitempty"`
+	Required             []string              `json:"required,omitempty"`
+	AdditionalProperties *bool                 `json:"additionalProperties,omitempty"`
+	Items                *apiSchema            `json:"items,omitempty"`
+}
+
+// schemaRef returns a reference to the schema called name in apiSchemas
+func schemaRef(name string) *apiSchema {
+	return &apiSchema{Ref: "#/components/schemas/" + name}
+}
+
+// schemaOf returns a schema of type with description
+func schemaOf(typ string, description string) *apiSchema {
+	return &apiSchema{Type: typ, Description: description}
+}
+
+// arrayOf returns a schema for lists of items
+func arrayOf(items *apiSchema, description string) *apiSchema {
+	return &apiSchema{Type: "array", Items: items, Description: description}
+}
+
+// positiveID returns a schema for IDs, which start at 1
+func positiveID(description string) *apiSchema {
+	one := 1
+	return &apiSchema{Type: "integer", Minimum: &one, Description: description}
+}
+
+// listOf returns a schema for a list response, e.g. {"rides": [...]}
+func listOf(field string, item string) *apiSchema {
+	return &apiSchema{
+		Type:       "object",
+		Properties: map[string]*apiSchema{field: arrayOf(schemaRef(item), "")},
+		Required:   []string{field},
+	}
+}
+
+// apiSchemas are the schemas of the JSON API's request and response bodies,
+// mirroring apiRide, apiPerson, assignmentProxy, apiRideRequest, apiMessage
+// and writeAPIError
+var apiSchemas = map[string]*apiSchema{
+	"Error": {
+		Type:       "object",
+		Properties: map[string]*apiSchema{"error": schemaOf("string", "What went wrong, e.g. \"Unknown ride 7\"")},
+		Required:   []string{"error"},
+	},
+	"Person": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"id":          positiveID(""),
+			"name":        schemaOf("string", ""),
+			"number":      schemaOf("string", "Phone number in international format without +, e.g. 319700000"),
+			"alt_numbers": arrayOf(schemaOf("string", ""), "Other numbers the person texts and calls from"),
+			"vehicle":     schemaOf("string", "Drivers only, e.g. Blue Toyota Prius"),
+			"deactivated": schemaOf("boolean", "Deactivated people can't be booked for new rides"),
+			"flags":       arrayOf(&apiSchema{Type: "string", Enum: participantFlags}, "Flags operators put on the person, e.g. vip"),
+			"shift":       &apiSchema{Type: "string", Enum: []string{shiftOn, shiftOff}, Description: "Drivers only, once they texted ON or OFF. Drivers off shift can't be booked for new rides"},
+		},
+		Required: []string{"id", "name", "number", "deactivated"},
+	},
+	"Participant": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"id":     positiveID(""),
+			"name":   schemaOf("string", ""),
+			"number": schemaOf("string", ""),
+		},
+		Required: []string{"id", "name", "number"},
+	},
+	"ProxyNumber": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"id":       positiveID(""),
+			"number":   schemaOf("string", ""),
+			"status":   schemaOf("string", "Whether the number can be used, e.g. active, pending or quarantined"),
+			"tags":     arrayOf(schemaOf("string", ""), "Tags rides can require, e.g. airport"),
+			"features": arrayOf(schemaOf("string", ""), "What the number supports, e.g. sms and voice"),
+		},
+		Required: []string{"id", "number", "status"},
+	},
+	"Ride": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"id":          positiveID("Left out while the ride waits for a proxy number"),
+			"start":       schemaOf("string", ""),
+			"destination": schemaOf("string", ""),
+			"datetime":    schemaOf("string", "Pickup time, e.g. 2020-04-01T14:30"),
+			"status": {
+				Type: "string",
+				Enum: []string{string(rideScheduled), string(rideActive), string(rideCompleted), string(rideCancelled), string(rideExpired)},
+			},
+			"customer":      schemaRef("Participant"),
+			"driver":        schemaRef("Participant"),
+			"proxy_number":  schemaRef("ProxyNumber"),
+			"required_tags": arrayOf(schemaOf("string", ""), "Tags the ride's proxy number must have"),
+			"labels":        arrayOf(schemaOf("string", ""), ""),
+			"relayed_texts": schemaOf("integer", "Texts relayed between the participants"),
+			"relayed_calls": schemaOf("integer", "Calls transferred between the participants"),
+			"last_activity": schemaOf("string", "When the last text or call was relayed, RFC 3339"),
+		},
+		Required: []string{"start", "destination", "datetime", "status", "customer", "driver", "relayed_texts", "relayed_calls"},
+	},
+	"RideRequest": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"customer_id": positiveID(""),
+			"driver_id":   positiveID(""),
+			"start":       {Type: "string", MinLength: 1},
+			"destination": {Type: "string", MinLength: 1},
+			"datetime":    {Type: "string", MinLength: 1, Description: "Pickup time, e.g. 2020-04-01T14:30"},
+			"proxy":       schemaOf("string", "Proxy number to use, rather than the first free one"),
+			"tags":        arrayOf(schemaOf("string", ""), "Tags the proxy number must have; left out means the default tags, an empty list none"),
+			"labels":      arrayOf(schemaOf("string", ""), ""),
+		},
+		Required:             []string{"customer_id", "driver_id", "start", "destination", "datetime"},
+		AdditionalProperties: new(bool),
+	},
+	"Booking": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"ride":    schemaRef("Ride"),
+			"waiting": schemaOf("boolean", "Whether the ride waits for a proxy number to free up"),
+			"warning": schemaOf("string", "Something the booker should know, e.g. that a participant is flagged abusive"),
+		},
+		Required: []string{"ride", "waiting"},
+	},
+	"RideList":        listOf("rides", "Ride"),
+	"CustomerList":    listOf("customers", "Person"),
+	"DriverList":      listOf("drivers", "Person"),
+	"ProxyNumberList": listOf("proxy_numbers", "ProxyNumber"),
+	"Message": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"id":          positiveID(""),
+			"ride_id":     positiveID("Left out for messages that don't belong to a ride, e.g. announcements"),
+			"direction":   {Type: "string", Enum: []string{directionInbound, directionOutbound}},
+			"originator":  schemaOf("string", "Masked, e.g. ******002, unless the redaction is none"),
+			"recipient":   schemaOf("string", "Masked unless the redaction is none"),
+			"body":        schemaOf("string", "Withheld, e.g. [42 characters withheld], if the redaction is full"),
+			"status":      schemaOf("string", "The last delivery status, e.g. delivered"),
+			"provider":    schemaOf("string", "Who sent the message, e.g. messagebird"),
+			"provider_id": schemaOf("string", ""),
+			"created_at":  schemaOf("string", "RFC 3339"),
+		},
+		Required: []string{"id", "direction", "originator", "recipient", "body", "created_at"},
+	},
+	"MessageList": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"messages":  arrayOf(schemaRef("Message"), "Newest first"),
+			"redaction": {Type: "string", Enum: redactionLevels},
+		},
+		Required: []string{"messages", "redaction"},
+	},
+}
+
+// apiResponse is a response an API operation may answer with
+type apiResponse struct {
+	Status      int
+	Description string
+	Schema      string // In apiSchemas; the body is an Error if empty
+}
+
+// apiOperation is an operation of the JSON API, see apiHandler. The
+// OpenAPI document is generated from them, and request bodies are checked
+// against them.
+type apiOperation struct {
+	Method    string
+	Path      string // Below apiPrefix, e.g. "rides/{id}"; parameters are IDs
+	ID        string
+	Summary   string
+	Query     []string // Optional string query parameters, e.g. "status"
+	Body      string   // Schema of the request body in apiSchemas, if the operation takes one
+	Responses []apiResponse
+}
+
+// apiOperations are the operations of the JSON API
+var apiOperations = []apiOperation{
+	{"GET", "rides", "listRides", "List rides, optionally by status and label", []string{"status", "label"}, "",
+		[]apiResponse{{200, "The rides", "RideList"}}},
+	{"POST", "rides", "bookRide", "Book a ride", nil, "RideRequest",
+		[]apiResponse{
+			{201, "The ride was booked", "Booking"},
+			{202, "The ride waits for a proxy number to free up", "Booking"},
+			{400, "The request is invalid", ""},
+			{409, "The ride can't be booked, e.g. because a participant is deactivated", ""},
+			{429, "Rides are booked too quickly", ""},
+		}},
+	{"GET", "rides/{id}", "getRide", "Get a ride", nil, "",
+		[]apiResponse{{200, "The ride", "Ride"}, {404, "There's no such ride", ""}}},
+	{"POST", "rides/{id}/cancel", "cancelRide", "Cancel a ride", nil, "",
+		[]apiResponse{{200, "The cancelled ride", "Ride"}, {404, "There's no such ride", ""}, {409, "The ride can't be cancelled", ""}}},
+	{"POST", "rides/{id}/complete", "completeRide", "Complete a ride", nil, "",
+		[]apiResponse{{200, "The completed ride", "Ride"}, {404, "There's no such ride", ""}, {409, "The ride can't be completed", ""}}},
+	{"GET", "customers", "listCustomers", "List customers", nil, "",
+		[]apiResponse{{200, "The customers", "CustomerList"}}},
+	{"GET", "drivers", "listDrivers", "List drivers", nil, "",
+		[]apiResponse{{200, "The drivers", "DriverList"}}},
+	{"GET", "proxy-numbers", "listProxyNumbers", "List the proxy number pool", nil, "",
+		[]apiResponse{{200, "The proxy numbers", "ProxyNumberList"}}},
+	{"GET", "messages", "listMessages",
+		"List logged messages, newest first, by ride, proxy number, direction and UTC date (e.g. 2020-04-01), up to limit (100 by default). " +
+			"Numbers and bodies are redacted unless a support API key asks for redaction numbers or none",
+		[]string{"ride", "proxy", "direction", "date", "limit", "redaction"}, "",
+		[]apiResponse{{200, "The messages", "MessageList"}, {400, "A filter is invalid", ""}, {403, "The API key's role doesn't allow the redaction", ""}}},
+}
+
+// matches reports whether op is the operation for method on the API path
+// parts, e.g. ["rides", "7"]
+func (op apiOperation) matches(method string, parts []string) bool {
+	want := strings.Split(op.Path, "/")
+	if method != op.Method || len(parts) != len(want) {
+		return false
+	}
+	for i, part := range want {
+		if !strings.HasPrefix(part, "{") && part != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// openAPIDocument returns the OpenAPI 3 document describing the JSON API
+func openAPIDocument() map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, op := range apiOperations {
+		path := "/" + op.Path
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		var params []map[string]interface{}
+		for _, part := range strings.Split(op.Path, "/") {
+			if strings.HasPrefix(part, "{") {
+				params = append(params, map[string]interface{}{
+					"name": strings.Trim(part, "{}"), "in": "path", "required": true, "schema": positiveID(""),
+				})
+			}
+		}
+		for _, name := range op.Query {
+			params = append(params, map[string]interface{}{"name": name, "in": "query", "schema": schemaOf("string", "")})
+		}
+		responses := map[string]interface{}{
+			"401":     jsonResponse("The API key is missing, wrong or revoked", "Error"),
+			"default": jsonResponse("An error", "Error"),
+		}
+		for _, resp := range op.Responses {
+			schema := resp.Schema
+			if schema == "" {
+				schema = "Error"
+			}
+			responses[fmt.Sprint(resp.Status)] = jsonResponse(resp.Description, schema)
+		}
+		operation := map[string]interface{}{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"responses":   responses,
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.Body != "" {
+			body := jsonResponse("", op.Body)
+			body["required"] = true
+			operation["requestBody"] = body
+		}
+		paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "BirdCar masked numbers API",
+			"version":     "1",
+			"description": "Book and manage rides whose customers and drivers reach each other through proxy numbers.",
+		},
+		"servers":  []map[string]string{{"url": publicURL() + appPath(strings.TrimSuffix(apiPrefix, "/"))}},
+		"security": []map[string][]string{{"bearerAuth": {}}},
+		"paths":    paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "description": "An API key an admin created at /admin/apikeys"},
+			},
+		},
+	}
+}
+
+// jsonResponse returns an OpenAPI response, or request body, with a JSON
+// body of the schema called name in apiSchemas
+func jsonResponse(description string, name string) map[string]interface{} {
+	v := map[string]interface{}{
+		"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef(name)}},
+	}
+	if description != "" {
+		v["description"] = description
+	}
+	return v
+}
+
+// openAPIHandler serves the OpenAPI document, so integrators can generate
+// clients. It's public: it only describes the API, which needs an API key.
+func openAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed here", r.Method))
+			return
+		}
+		writeAPI(w, http.StatusOK, openAPIDocument())
+	}
+}
+
+// checkAPIBody validates the body of r against the schema of the operation
+// for r's method and API path parts, if it takes one, putting the body back
+// for the handler to decode. The error says everything wrong with it.
+func checkAPIBody(r *http.Request, parts []string) error {
+	var op apiOperation
+	for _, v := range apiOperations {
+		if v.matches(r.Method, parts) {
+			op = v
+		}
+	}
+	if op.Body == "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxAPIBody))
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("the body is not JSON: %v", err)
+	}
+	if problems := schemaRef(op.Body).validate(v, ""); len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validate returns what's wrong with the decoded JSON value v, at path,
+// according to s, e.g. ["customer_id: must be an integer"]. Numbers must
+// have been decoded as json.Number.
+func (s *apiSchema) validate(v interface{}, path string) []string {
+	if s.Ref != "" {
+		return apiSchemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")].validate(v, path)
+	}
+	at := func(format string, args ...interface{}) []string {
+		problem := fmt.Sprintf(format, args...)
+		if path == "" {
+			return []string{problem}
+		}
+		return []string{path + ": " + problem}
+	}
+
+	switch s.Type {
+	case "object":
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return at("must be an object")
+		}
+		var problems []string
+		for _, name := range s.Required {
+			if _, ok := fields[name]; !ok {
+				problems = append(problems, at("%s is required", name)...)
+			}
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					problems = append(problems, at("unknown field %s", name)...)
+				}
+				continue
+			}
+			problems = append(problems, field.validate(fields[name], strings.TrimPrefix(path+"."+name, "."))...)
+		}
+		return problems
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return at("must be a list")
+		}
+		var problems []string
+		for i, item := range items {
+			problems = append(problems, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return at("must be a string")
+		}
+		if utf8.RuneCountInString(str) < s.MinLength {
+			return at("must not be empty")
+		}
+		if len(s.Enum) > 0 {
+			for _, allowed := range s.Enum {
+				if str == allowed {
+					return nil
+				}
+			}
+			return at("must be one of %s", strings.Join(s.Enum, ", "))
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		i, err := n.Int64()
+		if !ok || err != nil {
+			return at("must be an integer")
+		}
+		if s.Minimum != nil && i < int64(*s.Minimum) {
+			return at("must be at least %d", *s.Minimum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return at("must be true or false")
+		}
+	}
+	return nil
+}
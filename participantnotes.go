@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags operators can put on customers and drivers with a note, shown
+// wherever the participant is booked, see participantNote
+const (
+	flagVIP          = "vip"
+	flagPaymentIssue = "payment issue"
+	flagAbusive      = "abusive"
+)
+
+// participantFlags are the flags notes can carry, in the order they're offered
+var participantFlags = []string{flagVIP, flagPaymentIssue, flagAbusive}
+
+// participantNote is an internal note an operator attached to a customer or
+// driver. Participants never see notes.
+type participantNote struct {
+	ID        int
+	Role      string
+	PersonID  int
+	Flag      string // One of participantFlags; empty for plain notes
+	Body      string
+	Author    string // The admin who wrote the note
+	CreatedAt string // RFC 3339
+}
+
+// participantNoteStore is the part of RideStore that keeps the notes on
+// participants
+type participantNoteStore interface {
+	// ParticipantNotes returns the notes on the participant with role and
+	// ID personID, newest first
+	ParticipantNotes(role string, personID int) ([]participantNote, error)
+	// AddParticipantNote stores n, ignoring its ID
+	AddParticipantNote(n participantNote) error
+	// DeleteParticipantNote deletes the note with the given ID on the
+	// participant with role and ID personID, reporting whether it was found
+	DeleteParticipantNote(id int, role string, personID int) (bool, error)
+}
+
+// ParticipantNotes implements participantNoteStore
+func (s *sqlStore) ParticipantNotes(role string, personID int) ([]participantNote, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, role, person_id, flag, body, author, created_at FROM participant_notes WHERE role = ? AND person_id = ? ORDER BY id DESC",
+		Postgres: "SELECT id, role, person_id, flag, body, author, created_at FROM participant_notes WHERE role = $1 AND person_id = $2 ORDER BY id DESC",
+	}, role, personID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []participantNote
+	for rows.Next() {
+		var n participantNote
+		if err := rows.Scan(&n.ID, &n.Role, &n.PersonID, &n.Flag, &n.Body, &n.Author, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// AddParticipantNote implements participantNoteStore
+func (s *sqlStore) AddParticipantNote(n participantNote) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO participant_notes (role, person_id, flag, body, author, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO participant_notes (role, person_id, flag, body, author, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+	}, n.Role, n.PersonID, n.Flag, n.Body, n.Author, n.CreatedAt)
+	return err
+}
+
+// DeleteParticipantNote implements participantNoteStore
+func (s *sqlStore) DeleteParticipantNote(id int, role string, personID int) (bool, error) {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "DELETE FROM participant_notes WHERE id = ? AND role = ? AND person_id = ?",
+		Postgres: "DELETE FROM participant_notes WHERE id = $1 AND role = $2 AND person_id = $3",
+	}, id, role, personID)
+	return n > 0, err
+}
+
+// knownFlag reports whether flag is one of participantFlags
+func knownFlag(flag string) bool {
+	for _, v := range participantFlags {
+		if v == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// addFlag adds flag to the flags of p, once
+func (p *Person) addFlag(flag string) {
+	for _, v := range p.Flags {
+		if v == flag {
+			return
+		}
+	}
+	p.Flags = append(p.Flags, flag)
+}
+
+// flagsNotice tells the operator booking ride about the flags on its
+// participants, e.g. "The customer Caitlyn Carless is flagged vip.", or
+// returns an empty string if they have none
+func flagsNotice(ride RideType) string {
+	var notices []string
+	for _, role := range []string{roleCustomer, roleDriver} {
+		p := ride.participant(role)
+		if len(p.Flags) > 0 {
+			notices = append(notices, fmt.Sprintf("The %s %s is flagged %s.", role, p.Name, strings.Join(p.Flags, ", ")))
+		}
+	}
+	return strings.Join(notices, " ")
+}
+
+// participantNotesPage is the data rendered by views/default/participantnotes.gohtml
+type participantNotesPage struct {
+	Role    string
+	Person  Person
+	Notes   []participantNote
+	Flags   []string
+	Message string
+}
+
+// participantNotesHandler lists the notes on a customer or driver, given as
+// the role and id query parameters, and adds and removes them. Notes are
+// signed with the admin's user name.
+func participantNotesHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := participantNotesPage{Role: r.FormValue("role"), Flags: participantFlags}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+			renderDefaultTemplate(w, r, "participantnotes.gohtml", page)
+			return
+		}
+		people := dbdata.Customers
+		if page.Role == roleDriver {
+			people = dbdata.Drivers
+		} else if page.Role != roleCustomer {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid role: %q", page.Role)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		person, ok := people[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		page.Person = person
+
+		if r.Method == "POST" {
+			page.Message = changeParticipantNotes(dbdata.store, r, page.Role, person)
+		}
+		notes, err := dbdata.store.ParticipantNotes(page.Role, person.ID)
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+		}
+		page.Notes = notes
+		renderDefaultTemplate(w, r, "participantnotes.gohtml", page)
+	}
+}
+
+// changeParticipantNotes adds or removes the note on person the notes page
+// posted, returning the message to show
+func changeParticipantNotes(store RideStore, r *http.Request, role string, person Person) string {
+	author := dashboardUser(r)
+	switch r.FormValue("action") {
+	case "add":
+		flag := r.FormValue("flag")
+		body := strings.TrimSpace(r.FormValue("body"))
+		if flag != "" && !knownFlag(flag) {
+			return fmt.Sprintf("Unknown flag %q", flag)
+		}
+		if flag == "" && body == "" {
+			return "Write a note or pick a flag."
+		}
+		err := store.AddParticipantNote(participantNote{
+			Role:      role,
+			PersonID:  person.ID,
+			Flag:      flag,
+			Body:      body,
+			Author:    author,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			log.Println(err)
+			return fmt.Sprint(err)
+		}
+		log.Printf("%s added a note on %s %d (flag %q)", author, role, person.ID, flag)
+		return "Note added."
+	case "remove":
+		id, _ := strconv.Atoi(r.FormValue("note"))
+		deleted, err := store.DeleteParticipantNote(id, role, person.ID)
+		if err != nil {
+			log.Println(err)
+			return fmt.Sprint(err)
+		}
+		if !deleted {
+			return fmt.Sprintf("Could not find note %q", r.FormValue("note"))
+		}
+		log.Printf("%s removed note %d on %s %d", author, id, role, person.ID)
+		return "Note removed."
+	}
+	return fmt.Sprintf("Unknown action %q", r.FormValue("action"))
+}
+
+// rideParticipant is a participant of the ride on the ride page, with the
+// notes on them
+type rideParticipant struct {
+	Role   string
+	Person Person
+	Notes  []participantNote
+}
+
+// ridePage is the data rendered by views/default/ride.gohtml
+type ridePage struct {
+	Ride         RideType
+	Participants []rideParticipant
+}
+
+// rideDetailHandler serves /rides/{id}, the details of a ride, including
+// archived ones, with the notes on its customer and driver
+func rideDetailHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rides/"), "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		ride, err := findRideForExport(dbdata, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+
+		page := ridePage{Ride: ride}
+		for _, role := range []string{roleCustomer, roleDriver} {
+			p := rideParticipant{Role: role, Person: ride.participant(role)}
+			if p.Notes, err = dbdata.store.ParticipantNotes(role, p.Person.ID); err != nil {
+				log.Println(err)
+			}
+			page.Participants = append(page.Participants, p)
+		}
+		renderDefaultTemplate(w, r, "ride.gohtml", page)
+	}
+}
+
+// ridesHandler serves the pages of a ride: /rides/{id}, see
+// rideDetailHandler, and /rides/{id}/export, see rideExportHandler
+func ridesHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	detail, export := rideDetailHandler(dbdata), rideExportHandler(dbdata)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 1 {
+			detail(w, r)
+			return
+		}
+		export(w, r)
+	}
+}
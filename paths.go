@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// basePath returns the path prefix the application is mounted under, from
+// BASE_PATH (e.g. "/masking"), so it can live behind existing ingress rules.
+// It is empty when the application is mounted at the root.
+func basePath() string {
+	path := strings.Trim(os.Getenv("BASE_PATH"), "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// appPath returns the public path of one of our routes,
+// e.g. "/masking/createride" for "/createride" when BASE_PATH is /masking
+func appPath(path string) string {
+	return basePath() + path
+}
+
+// envPath returns the route path in the environment variable name, or def
+func envPath(name string, def string) string {
+	path := strings.TrimSpace(os.Getenv(name))
+	if path == "" {
+		return def
+	}
+	return "/" + strings.TrimLeft(path, "/")
+}
+
+// webhookToken returns the secret set with WEBHOOK_TOKEN for the webhook
+// routes to end in, e.g. "/webhook/3f9a0c..." rather than "/webhook". Only
+// MessageBird, whose flows are given the URLs, can reach the webhooks then:
+// a lighter alternative to MESSAGEBIRD_SIGNING_KEY, e.g. on trial accounts.
+// Without it, see setupWebhookToken.
+func webhookToken() string {
+	return strings.TrimSpace(os.Getenv("WEBHOOK_TOKEN"))
+}
+
+// webhookTokenSetting is the setting holding the webhook token generated
+// by setupWebhookToken
+const webhookTokenSetting = "webhook_token"
+
+// setupWebhookToken returns the token the webhook routes on store end in:
+// WEBHOOK_TOKEN, or else the one generated on the first start and kept in
+// store's settings, so servers sharing the database agree on it. Only if
+// MESSAGEBIRD_SIGNING_KEY verifies the webhook requests and no token was
+// generated before, the routes have none, so webhooks never go unverified.
+func setupWebhookToken(store RideStore) (string, error) {
+	if err := checkWebhookToken(); err != nil {
+		return "", err
+	}
+	if token := webhookToken(); token != "" {
+		return token, nil
+	}
+	token, err := store.Setting(webhookTokenSetting)
+	if err == nil || err != sql.ErrNoRows {
+		return token, err
+	}
+	if webhookSigningKey() != "" {
+		return "", nil
+	}
+	// Another server may be generating one at the same time, so ours is
+	// only kept if it's the first
+	if err := store.SetSetting(webhookTokenSetting, newWebhookToken(), false); err != nil {
+		return "", err
+	}
+	if token, err = store.Setting(webhookTokenSetting); err != nil {
+		return "", err
+	}
+	log.Println("Generated the webhook token and kept it in the database")
+	return token, nil
+}
+
+// webhookTokenPattern is what webhook tokens may look like: long enough not
+// to be guessed, and safe in a URL path
+var webhookTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,}$`)
+
+// checkWebhookToken reports whether WEBHOOK_TOKEN is unset or a valid token
+func checkWebhookToken() error {
+	if token := webhookToken(); token != "" && !webhookTokenPattern.MatchString(token) {
+		return fmt.Errorf("WEBHOOK_TOKEN must be at least 16 letters, digits, - or _, e.g. %s", newWebhookToken())
+	}
+	return nil
+}
+
+// newWebhookToken returns a random webhook token
+func newWebhookToken() string {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+// webhookPath returns the route of the webhook at base, ending in token if
+// there is one, see setupWebhookToken
+func webhookPath(base string, token string) string {
+	if token != "" {
+		return base + "/" + token
+	}
+	return base
+}
+
+// smsWebhookPath is the route MessageBird forwards inbound SMS to.
+// Set WEBHOOK_SMS_PATH to override the default.
+func smsWebhookPath(token string) string {
+	return webhookPath(envPath("WEBHOOK_SMS_PATH", "/webhook"), token)
+}
+
+// voiceWebhookPath is the route MessageBird forwards inbound calls to.
+// Set WEBHOOK_VOICE_PATH to override the default.
+func voiceWebhookPath(token string) string {
+	return webhookPath(envPath("WEBHOOK_VOICE_PATH", "/webhook-voice"), token)
+}
+
+// whatsAppWebhookPath is the route the Conversations API sends WhatsApp
+// messages to. Set WEBHOOK_WHATSAPP_PATH to override the default.
+func whatsAppWebhookPath(token string) string {
+	return webhookPath(envPath("WEBHOOK_WHATSAPP_PATH", "/webhook-whatsapp"), token)
+}
+
+// statusWebhookPath is the route MessageBird sends SMS status reports to.
+// Set WEBHOOK_STATUS_PATH to override the default.
+func statusWebhookPath(token string) string {
+	return webhookPath(envPath("WEBHOOK_STATUS_PATH", "/webhook-status"), token)
+}
+
+// mountAtBasePath serves handler under basePath, with the prefix stripped
+// from request paths so routes can be registered without it
+func mountAtBasePath(handler http.Handler) http.Handler {
+	prefix := basePath()
+	if prefix == "" {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, handler))
+	return mux
+}
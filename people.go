@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// numberOwner returns who number belongs to, e.g. "customer Caitlyn
+// Carless" or "proxy number 4", if it's anyone's but the person with role
+// and id: a number can only identify one person, and never a proxy number,
+// or we couldn't tell who texts or calls us
+func numberOwner(dbdata *RideSharingDB, number string, role string, id int) (string, bool) {
+	for _, v := range []struct {
+		role   string
+		people map[int]Person
+	}{
+		{roleCustomer, dbdata.Customers},
+		{roleDriver, dbdata.Drivers},
+	} {
+		for _, p := range v.people {
+			if p.hasNumber(number) && !(v.role == role && p.ID == id) {
+				return fmt.Sprintf("%s %s", v.role, p.Name), true
+			}
+		}
+	}
+	for _, v := range dbdata.ProxyNumbers {
+		if v.Number == number {
+			return fmt.Sprintf("proxy number %d", v.ID), true
+		}
+	}
+	return "", false
+}
+
+// bookable returns an error saying why the customer and driver with
+// customerID and driverID can't be booked together, e.g. because one of
+// them was deactivated
+func bookable(dbdata *RideSharingDB, customerID int, driverID int) error {
+	for _, v := range []struct {
+		role   string
+		id     int
+		people map[int]Person
+	}{
+		{roleCustomer, customerID, dbdata.Customers},
+		{roleDriver, driverID, dbdata.Drivers},
+	} {
+		p, ok := v.people[v.id]
+		switch {
+		case !ok:
+			return fmt.Errorf("could not find %s %d", v.role, v.id)
+		case p.Deactivated:
+			return fmt.Errorf("the %s %s is deactivated: activate them on the people page to book them", v.role, p.Name)
+		case p.OffShift():
+			return fmt.Errorf("the %s %s is off shift until they text %s to start their shift", v.role, p.Name, shiftStartKeyword)
+		}
+	}
+	return nil
+}
+
+// personRow is a customer or driver listed on the people page
+type personRow struct {
+	Person
+	Role      string
+	OpenRides int
+}
+
+// peopleGroup is the customers or the drivers on the people page
+type peopleGroup struct {
+	Title  string
+	Role   string
+	People []personRow
+}
+
+// peoplePage is the data rendered by views/default/people.gohtml
+type peoplePage struct {
+	Groups         []peopleGroup
+	DialPlans      []dialPlan
+	DefaultCountry string
+	ShiftNumber    string // The number drivers text ON and OFF to, if set
+	Message        string
+}
+
+// peopleRows returns people with role as rows of the people page, by ID
+func peopleRows(dbdata *RideSharingDB, role string, people map[int]Person) []personRow {
+	var rows []personRow
+	for _, p := range people {
+		row := personRow{Person: p, Role: role, OpenRides: openRidesOf(dbdata, role, p.ID)}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	return rows
+}
+
+// peopleAdminHandler lists the customers and drivers, and adds, edits,
+// deactivates and activates them. Deactivated people keep their rides and
+// relationships, but can't be booked for new ones.
+func peopleAdminHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := peoplePage{DialPlans: sortedDialPlans(), DefaultCountry: defaultCountry(), ShiftNumber: shiftNumber()}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+			renderDefaultTemplate(w, r, "people.gohtml", page)
+			return
+		}
+
+		if r.Method == "POST" {
+			page.Message = changePeople(dbdata, r)
+			if dbdata, err = dbdata.loadDB(); err != nil {
+				log.Println(err)
+				page.Message = fmt.Sprint(err)
+			}
+		}
+
+		page.Groups = []peopleGroup{
+			{"Customers", roleCustomer, peopleRows(dbdata, roleCustomer, dbdata.Customers)},
+			{"Drivers", roleDriver, peopleRows(dbdata, roleDriver, dbdata.Drivers)},
+		}
+		renderDefaultTemplate(w, r, "people.gohtml", page)
+	}
+}
+
+// changePeople makes the change to the customers or drivers the people page
+// posted, returning the message to show
+func changePeople(dbdata *RideSharingDB, r *http.Request) string {
+	role := r.FormValue("role")
+	people := dbdata.Customers
+	switch role {
+	case roleCustomer:
+	case roleDriver:
+		people = dbdata.Drivers
+	default:
+		return fmt.Sprintf("Something went wrong. Invalid role: %q", role)
+	}
+
+	action := r.FormValue("action")
+	var person Person
+	if action != "add" {
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		var ok bool
+		if person, ok = people[id]; !ok {
+			return fmt.Sprintf("Could not find %s %q", role, r.FormValue("id"))
+		}
+	}
+
+	switch action {
+	case "add", "edit":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			return fmt.Sprintf("Enter the %s's name.", role)
+		}
+		// Numbers are shown as we store them, so an unchanged one is kept
+		// even if it isn't valid in the default country
+		number := strings.TrimSpace(r.FormValue("number"))
+		if action == "add" || number != person.Number {
+			var err error
+			if number, err = normalizeNumber(number, r.FormValue("country")); err != nil {
+				return fmt.Sprintf("Invalid phone number: %v", err)
+			}
+		}
+		if owner, ok := numberOwner(dbdata, number, role, person.ID); ok {
+			return fmt.Sprintf("%s is already registered to %s.", number, owner)
+		}
+		vehicle := ""
+		if role == roleDriver {
+			vehicle = strings.TrimSpace(r.FormValue("vehicle"))
+		}
+
+		changed := Person{ID: person.ID, Name: name, Number: number, Vehicle: vehicle}
+		var err error
+		if action == "add" {
+			err = dbdata.store.AddPerson(role, changed)
+		} else {
+			err = dbdata.store.UpdatePerson(role, changed)
+		}
+		if err != nil {
+			log.Println(err)
+			return fmt.Sprint(err)
+		}
+		if action == "add" {
+			log.Printf("%s %s (%s) added", strings.Title(role), name, number)
+			return fmt.Sprintf("%s %s added.", strings.Title(role), name)
+		}
+		log.Printf("%s %d updated: %s (%s)", strings.Title(role), person.ID, name, number)
+		return fmt.Sprintf("%s %s updated.", strings.Title(role), name)
+	case "deactivate", "activate":
+		deactivated := action == "deactivate"
+		if person.Deactivated == deactivated {
+			return fmt.Sprintf("%s %s is already %sd.", strings.Title(role), person.Name, action)
+		}
+		if err := dbdata.store.SetDeactivated(role, person.ID, deactivated); err != nil {
+			log.Println(err)
+			return fmt.Sprint(err)
+		}
+		log.Printf("%s %s %sd", strings.Title(role), person.Name, action)
+		return fmt.Sprintf("%s %s %sd.", strings.Title(role), person.Name, action)
+	}
+	return fmt.Sprintf("Unknown action %q", action)
+}
+
+// peopleStore is the part of RideStore that keeps customers and drivers
+type peopleStore interface {
+	// SeedExampleData inserts the example customers, drivers and proxy numbers
+	SeedExampleData() error
+	// AddPerson adds p as a customer or driver, depending on role
+	AddPerson(role string, p Person) error
+	// UpdatePerson changes the name, number and, for drivers, vehicle of
+	// the person with role and p's ID
+	UpdatePerson(role string, p Person) error
+	// SetDeactivated deactivates or reactivates the person with role and id
+	SetDeactivated(role string, id int, deactivated bool) error
+}
+
+// AddPerson implements peopleStore
+func (s *sqlStore) AddPerson(role string, p Person) error {
+	if role == roleDriver {
+		_, err := s.exec(sqlQuery{
+			SQLite:   "INSERT INTO drivers (name, number, vehicle) VALUES (?, ?, ?)",
+			Postgres: "INSERT INTO drivers (name, number, vehicle) VALUES ($1, $2, $3)",
+		}, p.Name, p.Number, p.Vehicle)
+		return err
+	}
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO customers (name, number) VALUES (?, ?)",
+		Postgres: "INSERT INTO customers (name, number) VALUES ($1, $2)",
+	}, p.Name, p.Number)
+	return err
+}
+
+// UpdatePerson implements peopleStore
+func (s *sqlStore) UpdatePerson(role string, p Person) error {
+	if role == roleDriver {
+		_, err := s.exec(sqlQuery{
+			SQLite:   "UPDATE drivers SET name = ?, number = ?, vehicle = ? WHERE id = ?",
+			Postgres: "UPDATE drivers SET name = $1, number = $2, vehicle = $3 WHERE id = $4",
+		}, p.Name, p.Number, p.Vehicle, p.ID)
+		return err
+	}
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE customers SET name = ?, number = ? WHERE id = ?",
+		Postgres: "UPDATE customers SET name = $1, number = $2 WHERE id = $3",
+	}, p.Name, p.Number, p.ID)
+	return err
+}
+
+// SetDeactivated implements peopleStore
+func (s *sqlStore) SetDeactivated(role string, id int, deactivated bool) error {
+	flag := 0
+	if deactivated {
+		flag = 1
+	}
+	q := sqlQuery{
+		SQLite:   "UPDATE customers SET deactivated = ? WHERE id = ?",
+		Postgres: "UPDATE customers SET deactivated = $1 WHERE id = $2",
+	}
+	if role == roleDriver {
+		q = sqlQuery{
+			SQLite:   "UPDATE drivers SET deactivated = ? WHERE id = ?",
+			Postgres: "UPDATE drivers SET deactivated = $1 WHERE id = $2",
+		}
+	}
+	_, err := s.exec(q, flag, id)
+	return err
+}
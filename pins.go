@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pinDigits is the length of ride PINs. Rides booked before PINs grew from
+// legacyPINDigits keep their shorter PINs.
+const (
+	pinDigits       = 6
+	legacyPINDigits = 4
+)
+
+// pinMaxFailures returns how many wrong ride PINs a proxy number takes
+// within pinLockout before it takes no more, set with PIN_MAX_FAILURES
+func pinMaxFailures() int {
+	return envInt("PIN_MAX_FAILURES", 10)
+}
+
+// pinLockout returns how long wrong ride PINs count against their proxy
+// number, set with PIN_LOCKOUT. A proxy number that took too many takes
+// PINs again once the oldest of them is this old.
+func pinLockout() time.Duration {
+	return envDuration("PIN_LOCKOUT", 15*time.Minute)
+}
+
+// pinGuard counts the wrong ride PINs keyed in or texted to each proxy
+// number. PINs are guessed per proxy number, whichever phone or caller ID
+// they come from, so that is what they are limited by. Like probes, it
+// lives in memory: each instance counts the attempts it sees.
+type pinGuard struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time // Times of the wrong PINs within pinLockout, by proxy number
+}
+
+// pinAttempts counts the wrong ride PINs
+var pinAttempts = pinGuard{failures: make(map[string][]time.Time)}
+
+// locked reports whether proxyNumber took pinMaxFailures wrong PINs within
+// pinLockout of now
+func (g *pinGuard) locked(proxyNumber string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.recent(proxyNumber, now)) >= pinMaxFailures()
+}
+
+// fail records a wrong PIN for proxyNumber at now
+func (g *pinGuard) fail(proxyNumber string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failures[proxyNumber] = append(g.recent(proxyNumber, now), now)
+	if len(g.failures) >= maxBuckets {
+		for k := range g.failures {
+			if len(g.recent(k, now)) == 0 {
+				delete(g.failures, k)
+			}
+		}
+	}
+}
+
+// recent returns the wrong PINs for proxyNumber within pinLockout of now,
+// forgetting older ones. g.mu must be held.
+func (g *pinGuard) recent(proxyNumber string, now time.Time) []time.Time {
+	failures := g.failures[proxyNumber]
+	i := 0
+	for i < len(failures) && now.Sub(failures[i]) >= pinLockout() {
+		i++
+	}
+	if i > 0 {
+		failures = failures[i:]
+		g.failures[proxyNumber] = failures
+	}
+	return failures
+}
+
+// newRidePINs generates a PIN each for the customer and driver of a new ride
+// using proxyNumberID. The PINs are distinct from each other and from the PINs
+// of other rides using the same proxy number, so a PIN identifies exactly one
+// participant on that proxy.
+func newRidePINs(dbdata *RideSharingDB, proxyNumberID int) (customerPIN string, driverPIN string, err error) {
+	taken := make(map[string]bool)
+	for _, v := range dbdata.Rides {
+		if v.ThisProxyNumber.ID == proxyNumberID {
+			taken[v.CustomerPIN] = true
+			taken[v.DriverPIN] = true
+		}
+	}
+
+	newPIN := func() (string, error) {
+		max := big.NewInt(1)
+		for i := 0; i < pinDigits; i++ {
+			max.Mul(max, big.NewInt(10))
+		}
+		for {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			pin := fmt.Sprintf("%0*d", pinDigits, n)
+			if !taken[pin] {
+				taken[pin] = true
+				return pin, nil
+			}
+		}
+	}
+
+	if customerPIN, err = newPIN(); err != nil {
+		return "", "", fmt.Errorf("could not generate ride PIN: %v", err)
+	}
+	if driverPIN, err = newPIN(); err != nil {
+		return "", "", fmt.Errorf("could not generate ride PIN: %v", err)
+	}
+	return customerPIN, driverPIN, nil
+}
+
+// findRideByPIN finds the ride using proxyNumber with a participant
+// identified by pin, and returns the ride and that participant's role.
+// Wrong PINs count against proxyNumber, which takes none once it took
+// too many, see pinGuard.
+func findRideByPIN(dbdata *RideSharingDB, proxyNumber string, pin string) (RideType, string, bool) {
+	if !isPIN(pin) {
+		// e.g. a phone number keyed in instead
+		return RideType{}, "", false
+	}
+	now := time.Now()
+	if pinAttempts.locked(proxyNumber, now) {
+		log.Printf("Not checking ride PIN for proxy %s: it took %d wrong PINs within %s (PIN_MAX_FAILURES, PIN_LOCKOUT)",
+			proxyNumber, pinMaxFailures(), pinLockout())
+		return RideType{}, "", false
+	}
+	for _, v := range dbdata.Rides {
+		if v.ThisProxyNumber.Number != proxyNumber || v.Status.Terminal() {
+			continue
+		}
+		switch pin {
+		case v.CustomerPIN:
+			return v, roleCustomer, true
+		case v.DriverPIN:
+			return v, roleDriver, true
+		}
+	}
+	pinAttempts.fail(proxyNumber, now)
+	return RideType{}, "", false
+}
+
+// isPIN reports whether s has the digits of a ride PIN
+func isPIN(s string) bool {
+	return (len(s) == pinDigits || len(s) == legacyPINDigits) && isDigits(s)
+}
+
+// splitPINPrefix splits a message starting with a ride PIN, e.g. "1234 I'm outside",
+// into the PIN and the rest of the message. It returns an empty PIN if the
+// message doesn't start with one.
+func splitPINPrefix(payload string) (pin string, rest string) {
+	fields := strings.SplitN(strings.TrimSpace(payload), " ", 2)
+	if !isPIN(fields[0]) {
+		return "", payload
+	}
+	if len(fields) == 1 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitPINPrefix(t *testing.T) {
+	tests := []struct {
+		payload string
+		pin     string
+		rest    string
+	}{
+		{"123456 I'm outside", "123456", "I'm outside"},
+		{"  123456   I'm outside ", "123456", "I'm outside"},
+		{"123456", "123456", ""},
+		{"1234 booked before PINs grew", "1234", "booked before PINs grew"},
+		{"12345 five digits", "", "12345 five digits"},
+		{"1234567 seven digits", "", "1234567 seven digits"},
+		{"12a456 not digits", "", "12a456 not digits"},
+		{"I'm outside 123456", "", "I'm outside 123456"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		pin, rest := splitPINPrefix(test.payload)
+		if pin != test.pin || rest != test.rest {
+			t.Errorf("splitPINPrefix(%q) = %q, %q, want %q, %q", test.payload, pin, rest, test.pin, test.rest)
+		}
+	}
+}
+
+func TestNewRidePINs(t *testing.T) {
+	dbdata := &RideSharingDB{Rides: map[int]RideType{
+		1: {ID: 1, ThisProxyNumber: ProxyNumberType{ID: 7}, CustomerPIN: "000000", DriverPIN: "000001"},
+	}}
+	for i := 0; i < 100; i++ {
+		customer, driver, err := newRidePINs(dbdata, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pin := range []string{customer, driver} {
+			if len(pin) != pinDigits || !isDigits(pin) {
+				t.Fatalf("PIN %q isn't %d digits", pin, pinDigits)
+			}
+			if pin == "000000" || pin == "000001" {
+				t.Fatalf("PIN %q is taken by another ride on the proxy number", pin)
+			}
+		}
+		if customer == driver {
+			t.Fatalf("customer and driver both got PIN %q", customer)
+		}
+	}
+}
+
+func TestFindRideByPINLocksProxyAfterWrongPINs(t *testing.T) {
+	pinAttempts = pinGuard{failures: make(map[string][]time.Time)}
+	defer func() { pinAttempts = pinGuard{failures: make(map[string][]time.Time)} }()
+
+	dbdata := &RideSharingDB{Rides: map[int]RideType{
+		1: {ID: 1, ThisProxyNumber: ProxyNumberType{ID: 1, Number: "319700004"}, Status: rideScheduled, CustomerPIN: "111111", DriverPIN: "222222"},
+		2: {ID: 2, ThisProxyNumber: ProxyNumberType{ID: 2, Number: "319700005"}, Status: rideScheduled, CustomerPIN: "333333", DriverPIN: "444444"},
+	}}
+
+	if ride, role, ok := findRideByPIN(dbdata, "319700004", "222222"); !ok || ride.ID != 1 || role != roleDriver {
+		t.Fatalf("findRideByPIN(222222) = %d, %q, %v, want ride 1's driver", ride.ID, role, ok)
+	}
+	// Numbers keyed in instead of a PIN aren't wrong PINs
+	for i := 0; i < 2*pinMaxFailures(); i++ {
+		findRideByPIN(dbdata, "319700004", "31970000000")
+	}
+	if pinAttempts.locked("319700004", time.Now()) {
+		t.Fatal("phone numbers locked the proxy number")
+	}
+
+	for i := 0; i < pinMaxFailures(); i++ {
+		if _, _, ok := findRideByPIN(dbdata, "319700004", "999999"); ok {
+			t.Fatal("wrong PIN found a ride")
+		}
+	}
+	if _, _, ok := findRideByPIN(dbdata, "319700004", "111111"); ok {
+		t.Error("right PIN found a ride on a locked proxy number")
+	}
+	if _, _, ok := findRideByPIN(dbdata, "319700005", "333333"); !ok {
+		t.Error("wrong PINs for one proxy number locked another")
+	}
+
+	// Wrong PINs stop counting once they are pinLockout old
+	pinAttempts.mu.Lock()
+	for i := range pinAttempts.failures["319700004"] {
+		pinAttempts.failures["319700004"][i] = time.Now().Add(-pinLockout())
+	}
+	pinAttempts.mu.Unlock()
+	if _, _, ok := findRideByPIN(dbdata, "319700004", "111111"); !ok {
+		t.Error("proxy number stayed locked after pinLockout")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// Kinds of operator alerts, each with its own cooldown
+const (
+	alertPoolExhausted   = "pool.exhausted"
+	alertPoolUtilization = "pool.utilization"
+)
+
+// poolCheckInterval is how often we project proxy pool utilization to warn
+// operators before it runs dry
+const poolCheckInterval = 5 * time.Minute
+
+// poolAlertHorizon is how far ahead the utilization check looks
+const poolAlertHorizon = 24
+
+// noProxyError is the error returned when no proxy number can be assigned,
+// with Tags the tags the number needed
+type noProxyError struct {
+	Tags []string
+}
+
+func (e noProxyError) Error() string {
+	if len(e.Tags) > 0 {
+		return fmt.Sprintf("no available proxy numbers with tags %s", strings.Join(e.Tags, ", "))
+	}
+	return "no available proxy numbers"
+}
+
+// poolExhaustedTotal counts the rides and handoffs that found no proxy
+// number since the server started
+var poolExhaustedTotal int64
+
+// poolAlertUtilization returns the projected utilization, in percent, at
+// which operators are alerted, set with POOL_ALERT_UTILIZATION
+func poolAlertUtilization() int {
+	return envInt("POOL_ALERT_UTILIZATION", 80)
+}
+
+// operatorAlertCooldown returns how long an alert is held back after one of
+// the same kind was sent, so a dry pool doesn't page operators on every
+// ride. Set OPERATOR_ALERT_COOLDOWN (e.g. "30m") to override the default of
+// an hour.
+func operatorAlertCooldown() time.Duration {
+	return envDuration("OPERATOR_ALERT_COOLDOWN", time.Hour)
+}
+
+// operatorAlertChannels describes where operator alerts go besides the log,
+// e.g. for the startup log, or returns an empty string if nowhere
+func operatorAlertChannels() string {
+	var channels []string
+	if v := os.Getenv("OPERATOR_ALERT_NUMBER"); v != "" {
+		channels = append(channels, "SMS to "+v+" (OPERATOR_ALERT_NUMBER)")
+	}
+	if v := os.Getenv("OPERATOR_ALERT_EMAIL"); v != "" {
+		channels = append(channels, "email to "+v+" (OPERATOR_ALERT_EMAIL)")
+	}
+	if v := os.Getenv("OPERATOR_ALERT_WEBHOOK_URL"); v != "" {
+		channels = append(channels, "POST to "+v+" (OPERATOR_ALERT_WEBHOOK_URL)")
+	}
+	return strings.Join(channels, ", ")
+}
+
+var (
+	// operatorAlertsMu guards operatorAlertsSent
+	operatorAlertsMu sync.Mutex
+	// operatorAlertsSent is when an alert of each kind was last sent
+	operatorAlertsSent = make(map[string]time.Time)
+)
+
+// operatorAlert is an alert for operators, and the JSON body posted to
+// OPERATOR_ALERT_WEBHOOK_URL
+type operatorAlert struct {
+	Kind string    `json:"kind"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// alertOperator logs text and sends it to the operators, unless an alert of
+// the same kind was sent within the cooldown. Set OPERATOR_ALERT_NUMBER to
+// text it, OPERATOR_ALERT_EMAIL (with SMTP_ADDR) to email it, and
+// OPERATOR_ALERT_WEBHOOK_URL to post it as JSON, e.g. to a chat or paging
+// service. It sends in the background so it doesn't hold up our response.
+func alertOperator(store RideStore, mb *messagebird.Client, kind string, text string) {
+	now := time.Now()
+	operatorAlertsMu.Lock()
+	if last, ok := operatorAlertsSent[kind]; ok && now.Sub(last) < operatorAlertCooldown() {
+		operatorAlertsMu.Unlock()
+		return
+	}
+	operatorAlertsSent[kind] = now
+	operatorAlertsMu.Unlock()
+
+	log.Printf("Operator alert: %s", text)
+	go sendOperatorAlert(store, mb, operatorAlert{Kind: kind, Text: text, Time: now})
+}
+
+// sendOperatorAlert sends alert through each configured channel, logging
+// the ones that fail
+func sendOperatorAlert(store RideStore, mb *messagebird.Client, alert operatorAlert) {
+	if number := os.Getenv("OPERATOR_ALERT_NUMBER"); number != "" {
+		mbSender(store, mb, announcementOriginator(), []string{number}, alert.Text, nil)
+	}
+	if to := os.Getenv("OPERATOR_ALERT_EMAIL"); to != "" {
+		if err := emailOperatorAlert(to, alert); err != nil {
+			log.Printf("Could not email the operator alert to %s: %v", to, err)
+		}
+	}
+	if url := os.Getenv("OPERATOR_ALERT_WEBHOOK_URL"); url != "" {
+		if err := postOperatorAlert(url, alert); err != nil {
+			log.Printf("Could not post the operator alert to %s: %v", url, err)
+		}
+	}
+}
+
+// emailOperatorAlert emails alert to the comma-separated addresses in to
+// through the SMTP server at SMTP_ADDR (host:port), from ALERT_EMAIL_FROM,
+// authenticating with SMTP_USERNAME and SMTP_PASSWORD if they are set
+func emailOperatorAlert(to string, alert operatorAlert) error {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return fmt.Errorf("set SMTP_ADDR to the SMTP server to send it through")
+	}
+	from := os.Getenv("ALERT_EMAIL_FROM")
+	if from == "" {
+		from = "birdcar@localhost"
+	}
+	var recipients []string
+	for _, v := range strings.Split(to, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			recipients = append(recipients, v)
+		}
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), strings.Split(addr, ":")[0])
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: BirdCar alert: %s\r\n\r\n%s\r\n",
+		from, strings.Join(recipients, ", "), alert.Kind, alert.Text)
+	return smtp.SendMail(addr, auth, from, recipients, []byte(msg))
+}
+
+// postOperatorAlert posts alert as JSON to url
+func postOperatorAlert(url string, alert operatorAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// alertIfPoolExhausted alerts operators and opens an incident if err says
+// no proxy number was left for a ride, what describes, e.g. "a new ride".
+// ride is the ride being moved to another number, if any.
+func alertIfPoolExhausted(store RideStore, mb *messagebird.Client, err error, what string, ride RideType) {
+	if _, ok := err.(noProxyError); !ok {
+		return
+	}
+	atomic.AddInt64(&poolExhaustedTotal, 1)
+	reportPoolExhaustion(store, what, ride)
+	alertOperator(store, mb, alertPoolExhausted, fmt.Sprintf(
+		"BirdCar proxy pool exhausted: %s found %v. Add proxy numbers on the numbers page.", what, err))
+}
+
+// peakPoolSlot returns the hour with the highest utilization among slots,
+// the earliest if several share it
+func peakPoolSlot(slots []poolSlot) poolSlot {
+	var peak poolSlot
+	for i, v := range slots {
+		if i == 0 || v.Utilization() > peak.Utilization() {
+			peak = v
+		}
+	}
+	return peak
+}
+
+// checkPoolUtilization alerts operators when the projected utilization of
+// the proxy pool reaches POOL_ALERT_UTILIZATION within poolAlertHorizon hours
+func checkPoolUtilization(store RideStore, mb *messagebird.Client, now time.Time) error {
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		return err
+	}
+	peak := peakPoolSlot(projectPoolUsage(dbdata, now, poolAlertHorizon))
+	if peak.Utilization() < poolAlertUtilization() {
+		return nil
+	}
+	alertOperator(store, mb, alertPoolUtilization, fmt.Sprintf(
+		"BirdCar proxy pool at %d%% from %s: %d of %d proxy numbers in use. Add proxy numbers before it runs dry.",
+		peak.Utilization(), peak.Start.Format("Mon 2 Jan 15:04"), peak.ProxiesInUse, peak.PoolSize))
+	return nil
+}
+
+// pollPoolUtilization runs checkPoolUtilization now and then every interval
+// until ctx is done. It is meant to be run in its own goroutine.
+func pollPoolUtilization(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	logPoolUtilization(store, mb)
+	every(ctx, interval, func() { logPoolUtilization(store, mb) })
+}
+
+// logPoolUtilization runs checkPoolUtilization, logging why if it can't
+func logPoolUtilization(store RideStore, mb *messagebird.Client) {
+	if err := checkPoolUtilization(store, mb, time.Now()); err != nil {
+		log.Printf("Proxy pool utilization check: %v", err)
+	}
+}
+
+// metricsHandler serves gauges of the proxy pool and the SMS canary in the
+// Prometheus text format, for monitoring to graph and alert on
+func metricsHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		slots := projectPoolUsage(dbdata, time.Now(), poolAlertHorizon)
+		now, peak := slots[0], peakPoolSlot(slots)
+		canary := lastCanary()
+		var canarySuccess float64
+		if !canary.LastSuccess.IsZero() {
+			canarySuccess = float64(canary.LastSuccess.Unix())
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range []struct {
+			Name, Type, Help string
+			Value            float64
+		}{
+			{"birdcar_proxy_pool_size", "gauge", "Proxy numbers that can be assigned to rides.", float64(now.PoolSize)},
+			{"birdcar_proxy_numbers_in_use", "gauge", "Proxy numbers used by rides in the next hour.", float64(now.ProxiesInUse)},
+			{"birdcar_proxy_pool_utilization_ratio", "gauge", "Share of the proxy pool used by rides in the next hour.", float64(now.Utilization()) / 100},
+			{"birdcar_proxy_pool_peak_utilization_ratio", "gauge", "Highest hourly share of the proxy pool used by rides in the next 24 hours.", float64(peak.Utilization()) / 100},
+			{"birdcar_proxy_pool_exhausted_total", "counter", "Rides and handoffs that found no proxy number since the server started.", float64(atomic.LoadInt64(&poolExhaustedTotal))},
+			{"birdcar_canary_failures_total", "counter", "SMS canary texts that didn't come back in time since the server started.", float64(canary.Failures)},
+			{"birdcar_canary_last_success_timestamp_seconds", "gauge", "When an SMS canary text last came back, as a Unix time, or 0.", canarySuccess},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.Name, m.Help, m.Name, m.Type, m.Name, m.Value)
+		}
+	}
+}
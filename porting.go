@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// Port status values for proxy numbers.
+// A number that is still being ported into our MessageBird account is "pending"
+// and must not be assigned to rides until MessageBird reports it as active.
+const (
+	portStatusPending = "pending"
+	portStatusActive  = "active"
+)
+
+// portPollInterval is how often we ask MessageBird about pending numbers
+const portPollInterval = 5 * time.Minute
+
+// numbersAPIRoot is the base URL of the MessageBird Numbers API
+const numbersAPIRoot = "https://numbers.messagebird.com/v1"
+
+// mbPhoneNumber is the subset of the Numbers API phone number object we use
+type mbPhoneNumber struct {
+	Number   string   `json:"number"`
+	Country  string   `json:"country"`
+	Features []string `json:"features"`
+	Status   string   `json:"status"`
+}
+
+// pollPortingStatus checks pending proxy numbers every interval until ctx
+// is done, and flips them to active once they show up in our MessageBird
+// account. It is meant to be run in its own goroutine.
+func pollPortingStatus(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	every(ctx, interval, func() { checkPendingPorts(store, mb) })
+}
+
+// checkPendingPorts looks up every pending proxy number with the Numbers API
+// and marks the ones MessageBird reports as active.
+func checkPendingPorts(store RideStore, mb *messagebird.Client) {
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, v := range dbdata.ProxyNumbers {
+		if v.PortStatus != portStatusPending {
+			continue
+		}
+		var owned mbPhoneNumber
+		err := mb.Request(&owned, http.MethodGet, numbersAPIRoot+"/phone-numbers/"+v.Number, nil)
+		if err != nil {
+			// The number isn't in our account yet; try again on the next tick
+			mbError(err)
+			continue
+		}
+		if owned.Status != portStatusActive {
+			continue
+		}
+		if err := store.SetPortStatus(v.ID, portStatusActive); err != nil {
+			// Still pending, so it is checked again on the next tick
+			log.Println(err)
+			continue
+		}
+		storeFeatures(store, v, owned.Features)
+		log.Printf("Proxy number %s finished porting and is now active", v.Number)
+	}
+}
+
+// portNumberHandler registers a number that is being ported into our
+// MessageBird account. The number is stored as pending, and won't be assigned
+// to rides until pollPortingStatus marks it active.
+func portNumberHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				return
+			}
+			number, err := normalizeNumber(r.FormValue("number"), r.FormValue("country"))
+			if err != nil {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Invalid proxy number: %v", err))
+				return
+			}
+			_, err = dbdata.store.AddProxyNumber(number, portStatusPending, parseTags(r.FormValue("tags")))
+			if err != nil {
+				log.Println(err)
+				renderLanding(w, r, dbdata, fmt.Sprint(err))
+				return
+			}
+		}
+
+		message := ""
+		dbdata, err = dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderLanding(w, r, dbdata, message)
+	}
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits,
+// which is how we store phone numbers (MSISDNs without the leading '+')
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// preferencesKeyword, texted to any proxy number, gets the sender a link to
+// their preferences page
+const preferencesKeyword = "SETTINGS"
+
+// How participants want to be reached on their ride's proxy number
+const (
+	channelAny       = "any" // texts and calls
+	channelTextsOnly = "sms" // calls to them are refused, asking the caller to text instead
+)
+
+// participantPreferences are the settings participants choose for
+// themselves on their preferences page. Their language is kept with the
+// ones chosen by texting LANGUAGE, see setLanguage.
+type participantPreferences struct {
+	Number     string
+	QuietStart string // "15:04" local time, or empty for no quiet hours
+	QuietEnd   string
+	Channel    string
+}
+
+// preferencesLinkTTL returns how long a preferences link works after it is
+// sent. Set PREFERENCES_LINK_TTL (e.g. "1h") to override the default of 24 hours.
+func preferencesLinkTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PREFERENCES_LINK_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// preferenceStore is the part of RideStore that keeps the preferences
+// participants chose, and the links they change them with
+type preferenceStore interface {
+	// Preferences returns the preferences of the owner of number, or the
+	// defaults if they haven't chosen any
+	Preferences(number string) (participantPreferences, error)
+	// SavePreferences stores p, replacing any earlier preferences for its
+	// number
+	SavePreferences(p participantPreferences) error
+	// AddPreferencesLink stores the token with tokenHash as a link to the
+	// preferences of the owner of number, from now until expires
+	AddPreferencesLink(tokenHash string, number string, now time.Time, expires time.Time) error
+	// PreferencesLinkNumber returns the number the preferences link whose
+	// token has tokenHash was sent to, or sql.ErrNoRows if there is no such
+	// link or it had expired at now
+	PreferencesLinkNumber(tokenHash string, now time.Time) (string, error)
+}
+
+// Preferences implements preferenceStore
+func (s *sqlStore) Preferences(number string) (participantPreferences, error) {
+	p := participantPreferences{Number: number, Channel: channelAny}
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT quiet_start, quiet_end, channel FROM participant_preferences WHERE number = ?",
+		Postgres: "SELECT quiet_start, quiet_end, channel FROM participant_preferences WHERE number = $1",
+	}, number).Scan(&p.QuietStart, &p.QuietEnd, &p.Channel)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	return p, err
+}
+
+// SavePreferences implements preferenceStore
+func (s *sqlStore) SavePreferences(p participantPreferences) error {
+	_, err := s.exec(sqlQuery{
+		SQLite: "INSERT INTO participant_preferences (number, quiet_start, quiet_end, channel) VALUES (?, ?, ?, ?) " +
+			"ON CONFLICT (number) DO UPDATE SET quiet_start = excluded.quiet_start, quiet_end = excluded.quiet_end, channel = excluded.channel",
+		Postgres: "INSERT INTO participant_preferences (number, quiet_start, quiet_end, channel) VALUES ($1, $2, $3, $4) " +
+			"ON CONFLICT (number) DO UPDATE SET quiet_start = excluded.quiet_start, quiet_end = excluded.quiet_end, channel = excluded.channel",
+		MySQL: "INSERT INTO participant_preferences (number, quiet_start, quiet_end, channel) VALUES (?, ?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE quiet_start = VALUES(quiet_start), quiet_end = VALUES(quiet_end), channel = VALUES(channel)",
+	}, p.Number, p.QuietStart, p.QuietEnd, p.Channel)
+	return err
+}
+
+// AddPreferencesLink implements preferenceStore
+func (s *sqlStore) AddPreferencesLink(tokenHash string, number string, now time.Time, expires time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO preference_links (token, number, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		Postgres: "INSERT INTO preference_links (token, number, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+	}, tokenHash, number, now.UTC().Format(time.RFC3339), expires.UTC().Format(time.RFC3339))
+	return err
+}
+
+// PreferencesLinkNumber implements preferenceStore
+func (s *sqlStore) PreferencesLinkNumber(tokenHash string, now time.Time) (string, error) {
+	var number string
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT number FROM preference_links WHERE token = ? AND expires_at > ?",
+		Postgres: "SELECT number FROM preference_links WHERE token = $1 AND expires_at > $2",
+	}, tokenHash, now.UTC().Format(time.RFC3339)).Scan(&number)
+	return number, err
+}
+
+// parseClock parses a time of day like "22:30" into minutes after midnight
+func parseClock(s string) (int, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// inQuietHours reports whether now falls in p's quiet hours. Quiet hours
+// may span midnight, e.g. from 22:00 to 07:00.
+func (p participantPreferences) inQuietHours(now time.Time) bool {
+	start, ok := parseClock(p.QuietStart)
+	if !ok {
+		return false
+	}
+	end, ok := parseClock(p.QuietEnd)
+	if !ok || start == end {
+		return false
+	}
+	local := now.Local()
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// textsOnly reports whether number's owner asked not to be called
+func textsOnly(store RideStore, number string) bool {
+	p, err := store.Preferences(number)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return p.Channel == channelTextsOnly
+}
+
+// newPreferencesLink stores a new token letting the owner of number change
+// their preferences until it expires, and returns it. Only its hash is
+// stored, so whoever reads the database can't use it.
+func newPreferencesLink(store RideStore, number string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate preferences token: %v", err)
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	if err := store.AddPreferencesLink(hashSecret(token), number, now, now.Add(preferencesLinkTTL())); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// preferencesLinkNumber returns the number the preferences link token was
+// sent to, if the token exists and hasn't expired at now
+func preferencesLinkNumber(store RideStore, token string, now time.Time) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	number, err := store.PreferencesLinkNumber(hashSecret(token), now)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return "", false
+	}
+	return number, true
+}
+
+// preferencesReply returns the reply to preferencesKeyword texted by
+// originator, with a link to their preferences page on the host that received r
+func preferencesReply(store RideStore, r *http.Request, originator string) string {
+	token, err := newPreferencesLink(store, originator)
+	if err != nil {
+		log.Println(err)
+		return "Sorry, we could not create a link to your settings. Please try again later."
+	}
+	link := webhookURL(r, "/preferences") + "?token=" + url.QueryEscape(token)
+	return "Choose your language, quiet hours and how we reach you here: " + link
+}
+
+// preferencesPage is the data rendered by views/default/preferences.gohtml
+type preferencesPage struct {
+	Token       string
+	Language    string
+	Languages   []string
+	Preferences participantPreferences
+	Marketing   bool // Whether they get announcements, see consent.go
+	Message     string
+}
+
+// catalogLanguages returns the languages we have messages in, sorted
+func catalogLanguages() []string {
+	languages := []string{defaultLanguage()}
+	for lang := range messageCatalog {
+		if lang != defaultLanguage() {
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages[1:])
+	return languages
+}
+
+// preferencesHandler shows participants who follow the link we texted them
+// their preferences, and saves the ones they submit
+func preferencesHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		number, ok := preferencesLinkNumber(store, token, time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			renderParticipantTemplate(w, "preferences.gohtml", preferencesPage{
+				Message: fmt.Sprintf("This link has expired. Text %s to your BirdCar number for a new one.", preferencesKeyword),
+			})
+			return
+		}
+
+		page := preferencesPage{Token: token, Languages: catalogLanguages(), Language: participantLanguage(store, number)}
+		prefs, err := store.Preferences(number)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		marketing, err := currentConsent(store, number, consentMarketing)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		page.Marketing = marketing.Granted()
+
+		if r.Method == "POST" {
+			lang := strings.ToLower(r.FormValue("language"))
+			prefs.QuietStart = strings.TrimSpace(r.FormValue("quiet_start"))
+			prefs.QuietEnd = strings.TrimSpace(r.FormValue("quiet_end"))
+			prefs.Channel = r.FormValue("channel")
+			_, startOK := parseClock(prefs.QuietStart)
+			_, endOK := parseClock(prefs.QuietEnd)
+			switch {
+			case !supportedLanguage(lang):
+				page.Message = fmt.Sprintf("Sorry, we don't have messages in %q yet.", lang)
+			case (prefs.QuietStart != "" || prefs.QuietEnd != "") && !(startOK && endOK):
+				page.Message = "Please enter both quiet hours as hours and minutes, e.g. 22:00 and 07:00, or leave both empty."
+			case prefs.Channel != channelAny && prefs.Channel != channelTextsOnly:
+				page.Message = fmt.Sprintf("Unknown channel %q", prefs.Channel)
+			default:
+				if err := store.SetLanguage(number, lang); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+					break
+				}
+				if err := store.SavePreferences(prefs); err != nil {
+					log.Println(err)
+					page.Message = fmt.Sprint(err)
+					break
+				}
+				// Only changes are recorded, so the registry shows when consent was given
+				if wanted := r.FormValue("announcements") == "on"; wanted != page.Marketing {
+					if err := recordConsent(store, number, consentMarketing, wanted, consentSourcePreferences); err != nil {
+						log.Println(err)
+						page.Message = fmt.Sprint(err)
+						break
+					}
+					page.Marketing = wanted
+				}
+				log.Printf("Preferences of %s updated", number)
+				page.Language = lang
+				page.Message = "Your preferences have been saved."
+			}
+		}
+
+		page.Preferences = prefs
+		renderParticipantTemplate(w, "preferences.gohtml", page)
+	}
+}
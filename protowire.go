@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Protocol buffer wire types, see
+// https://protobuf.dev/programming-guides/encoding/
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	// wireAbsent marks a field left out of a message, which has its
+	// default value
+	wireAbsent = -1
+)
+
+// protoMessage builds an encoded protocol buffer message. Like proto3, it
+// leaves out fields with their default value.
+type protoMessage []byte
+
+func (m *protoMessage) varint(v uint64) {
+	for v >= 0x80 {
+		*m = append(*m, byte(v)|0x80)
+		v >>= 7
+	}
+	*m = append(*m, byte(v))
+}
+
+func (m *protoMessage) key(field int, wire int) {
+	m.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// int adds an int64 or enum field
+func (m *protoMessage) int(field int, v int) {
+	if v != 0 {
+		m.key(field, wireVarint)
+		m.varint(uint64(v))
+	}
+}
+
+func (m *protoMessage) bool(field int, v bool) {
+	if v {
+		m.int(field, 1)
+	}
+}
+
+func (m *protoMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// strings adds a repeated string field
+func (m *protoMessage) strings(field int, list []string) {
+	for _, s := range list {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// bytes adds a bytes field or an embedded message, even when empty
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.key(field, wireBytes)
+	m.varint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// protoField is a field of a decoded protocol buffer message
+type protoField struct {
+	Num    int
+	Wire   int
+	Varint uint64 // For varint fields
+	Bytes  []byte // For length-delimited fields
+}
+
+// int returns the value of an int64 or enum field
+func (f protoField) int() (int, error) {
+	if f.Wire != wireVarint && f.Wire != wireAbsent {
+		return 0, fmt.Errorf("field %d is not a varint", f.Num)
+	}
+	return int(int64(f.Varint)), nil
+}
+
+func (f protoField) bool() (bool, error) {
+	n, err := f.int()
+	return n != 0, err
+}
+
+func (f protoField) string() (string, error) {
+	if f.Wire != wireBytes && f.Wire != wireAbsent {
+		return "", fmt.Errorf("field %d is not length-delimited", f.Num)
+	}
+	return string(f.Bytes), nil
+}
+
+var errProtoTruncated = errors.New("truncated protocol buffer message")
+
+// readVarint reads a varint from the start of b, returning it and its length
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errProtoTruncated
+}
+
+// parseProto splits an encoded protocol buffer message into its fields, in
+// the order they were encoded. Fixed-size fields are skipped, none of our
+// messages have them.
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		f := protoField{Num: int(key >> 3), Wire: int(key & 7)}
+		if f.Num <= 0 {
+			return nil, fmt.Errorf("invalid field number %d", f.Num)
+		}
+		switch f.Wire {
+		case wireVarint:
+			if f.Varint, n, err = readVarint(b); err != nil {
+				return nil, err
+			}
+		case wireBytes:
+			size, l, err := readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(len(b)-l) {
+				return nil, errProtoTruncated
+			}
+			f.Bytes = b[l : l+int(size)]
+			n = l + int(size)
+		case wireFixed64:
+			n = 8
+		case wireFixed32:
+			n = 4
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", f.Wire, f.Num)
+		}
+		if n > len(b) {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		if f.Wire == wireVarint || f.Wire == wireBytes {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProtoMessageEncoding(t *testing.T) {
+	// The examples of https://protobuf.dev/programming-guides/encoding/
+	tests := []struct {
+		name  string
+		build func(m *protoMessage)
+		want  []byte
+	}{
+		{"int", func(m *protoMessage) { m.int(1, 150) }, []byte{0x08, 0x96, 0x01}},
+		{"string", func(m *protoMessage) { m.string(2, "testing") }, append([]byte{0x12, 0x07}, "testing"...)},
+		{"bool", func(m *protoMessage) { m.bool(3, true) }, []byte{0x18, 0x01}},
+		{"repeated string", func(m *protoMessage) { m.strings(4, []string{"a", "bc"}) }, []byte{0x22, 0x01, 'a', 0x22, 0x02, 'b', 'c'}},
+		{"embedded message", func(m *protoMessage) { m.bytes(3, protoMessage{0x08, 0x96, 0x01}) }, []byte{0x1a, 0x03, 0x08, 0x96, 0x01}},
+		{"empty embedded message", func(m *protoMessage) { m.bytes(3, nil) }, []byte{0x1a, 0x00}},
+		{"default int", func(m *protoMessage) { m.int(1, 0) }, nil},
+		{"default bool", func(m *protoMessage) { m.bool(1, false) }, nil},
+		{"default string", func(m *protoMessage) { m.string(1, "") }, nil},
+		{"negative int", func(m *protoMessage) { m.int(1, -2) },
+			[]byte{0x08, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+	for _, test := range tests {
+		var m protoMessage
+		test.build(&m)
+		if !bytes.Equal(m, test.want) {
+			t.Errorf("%s: encoded % x, want % x", test.name, []byte(m), test.want)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	var inner protoMessage
+	inner.int(1, 7)
+	inner.string(2, "Caitlyn Carless")
+	var m protoMessage
+	m.int(1, 1<<40)
+	m.int(2, -2)
+	m.bool(3, true)
+	m.string(4, "Schiphol Airport")
+	m.strings(5, []string{"airport", "", "night"})
+	m.bytes(6, inner)
+	m.string(200, "a field number of two bytes")
+
+	fields, err := parseProto(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 9 {
+		t.Fatalf("decoded %d fields, want 9", len(fields))
+	}
+	if n, err := grpcField(fields, 1).int(); err != nil || n != 1<<40 {
+		t.Errorf("field 1 = %d, %v, want %d", n, err, 1<<40)
+	}
+	if n, err := grpcField(fields, 2).int(); err != nil || n != -2 {
+		t.Errorf("field 2 = %d, %v, want -2", n, err)
+	}
+	if b, err := grpcField(fields, 3).bool(); err != nil || !b {
+		t.Errorf("field 3 = %v, %v, want true", b, err)
+	}
+	if s, err := grpcField(fields, 4).string(); err != nil || s != "Schiphol Airport" {
+		t.Errorf("field 4 = %q, %v, want %q", s, err, "Schiphol Airport")
+	}
+	var tags []string
+	for _, f := range fields {
+		if f.Num == 5 {
+			s, _ := f.string()
+			tags = append(tags, s)
+		}
+	}
+	if len(tags) != 3 || tags[0] != "airport" || tags[1] != "" || tags[2] != "night" {
+		t.Errorf("repeated field 5 = %q, want the 3 strings in order", tags)
+	}
+	if s, err := grpcField(fields, 200).string(); err != nil || s != "a field number of two bytes" {
+		t.Errorf("field 200 = %q, %v", s, err)
+	}
+
+	embedded, err := parseProto(grpcField(fields, 6).Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := grpcField(embedded, 1).int(); n != 7 {
+		t.Errorf("embedded field 1 = %d, want 7", n)
+	}
+	if s, _ := grpcField(embedded, 2).string(); s != "Caitlyn Carless" {
+		t.Errorf("embedded field 2 = %q, want %q", s, "Caitlyn Carless")
+	}
+}
+
+func TestProtoAbsentFieldsHaveDefaults(t *testing.T) {
+	f := grpcField(nil, 1)
+	if n, err := f.int(); err != nil || n != 0 {
+		t.Errorf("absent int = %d, %v, want 0", n, err)
+	}
+	if b, err := f.bool(); err != nil || b {
+		t.Errorf("absent bool = %v, %v, want false", b, err)
+	}
+	if s, err := f.string(); err != nil || s != "" {
+		t.Errorf("absent string = %q, %v, want empty", s, err)
+	}
+}
+
+func TestProtoWrongWireType(t *testing.T) {
+	fields, err := parseProto([]byte{0x08, 0x01, 0x12, 0x01, 'a'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := grpcField(fields, 1).string(); err == nil {
+		t.Error("read a varint field as a string")
+	}
+	if _, err := grpcField(fields, 2).int(); err == nil {
+		t.Error("read a string field as an int")
+	}
+}
+
+func TestParseProtoSkipsFixedFields(t *testing.T) {
+	b := []byte{
+		0x09, 1, 2, 3, 4, 5, 6, 7, 8, // field 1, fixed64
+		0x15, 1, 2, 3, 4, // field 2, fixed32
+		0x18, 0x05, // field 3, varint 5
+	}
+	fields, err := parseProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields[0].Num != 3 || fields[0].Varint != 5 {
+		t.Errorf("fields = %+v, want only field 3", fields)
+	}
+}
+
+func TestParseProtoRejectsMalformedMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"truncated key", []byte{0x80}},
+		{"truncated varint", []byte{0x08, 0x96}},
+		{"varint longer than 10 bytes", []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"length past the end", []byte{0x12, 0x05, 'a', 'b'}},
+		{"truncated length", []byte{0x12}},
+		{"truncated fixed64", []byte{0x09, 1, 2, 3}},
+		{"truncated fixed32", []byte{0x15, 1}},
+		{"field number 0", []byte{0x00, 0x01}},
+		{"group wire type", []byte{0x0b}},
+	}
+	for _, test := range tests {
+		if fields, err := parseProto(test.b); err == nil {
+			t.Errorf("%s: parsed % x into %+v, want an error", test.name, test.b, fields)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// portStatusMissing marks an active proxy number that isn't in our
+// MessageBird account, e.g. because it was cancelled in the dashboard.
+// New rides don't get it, as texts and calls to it can't reach us.
+const portStatusMissing = "missing"
+
+// provisioningCheckInterval is how often we compare the proxy numbers with
+// the numbers in our MessageBird account
+const provisioningCheckInterval = time.Hour
+
+// ownedNumbersPageSize is how many numbers we list per Numbers API request
+const ownedNumbersPageSize = 100
+
+// loadOwnedNumbers returns the numbers in our MessageBird account, by number
+func loadOwnedNumbers(mb *messagebird.Client) (map[string]mbPhoneNumber, error) {
+	owned := make(map[string]mbPhoneNumber)
+	for offset := 0; ; {
+		var page struct {
+			Items      []mbPhoneNumber `json:"items"`
+			TotalCount int             `json:"totalCount"`
+		}
+		query := url.Values{"limit": {strconv.Itoa(ownedNumbersPageSize)}, "offset": {strconv.Itoa(offset)}}
+		if err := mb.Request(&page, http.MethodGet, numbersAPIRoot+"/phone-numbers?"+query.Encode(), nil); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Items {
+			owned[v.Number] = v
+		}
+		offset += len(page.Items)
+		if len(page.Items) == 0 || offset >= page.TotalCount {
+			return owned, nil
+		}
+	}
+}
+
+// provisioningReport is what checkProvisioning found
+type provisioningReport struct {
+	Missing      []ProxyNumberType // Active numbers the account doesn't have, now marked missing
+	StillMissing []ProxyNumberType // Numbers marked missing before that the account still doesn't have
+	Disabled     []ProxyNumberType // Disabled numbers the account doesn't have
+	Restored     []ProxyNumberType // Missing numbers back in the account, active again
+}
+
+// String summarizes the report, e.g. for the proxy pool page
+func (report provisioningReport) String() string {
+	var parts []string
+	for _, v := range []struct {
+		proxies []ProxyNumberType
+		what    string
+	}{
+		{report.Missing, "newly missing from the MessageBird account"},
+		{report.StillMissing, "still missing from the MessageBird account"},
+		{report.Disabled, "disabled and missing from the MessageBird account"},
+		{report.Restored, "back in the MessageBird account and active again"},
+	} {
+		if len(v.proxies) == 0 {
+			continue
+		}
+		var numbers []string
+		for _, proxy := range v.proxies {
+			numbers = append(numbers, proxy.Number)
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", strings.Join(numbers, ", "), v.what))
+	}
+	if len(parts) == 0 {
+		return "Every active and disabled proxy number is in the MessageBird account."
+	}
+	return "Proxy numbers " + strings.Join(parts, "; ") + "."
+}
+
+// checkProvisioning compares the proxy numbers with the numbers in our
+// MessageBird account. Active numbers the account doesn't have are marked
+// missing, so new rides don't get them, and missing numbers that are back
+// are made active again. Pending numbers are still being ported, and
+// quarantined ones are out of service anyway, so neither is checked.
+func checkProvisioning(store RideStore, mb *messagebird.Client) (provisioningReport, error) {
+	var report provisioningReport
+	owned, err := loadOwnedNumbers(mb)
+	if err != nil {
+		return report, err
+	}
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		return report, err
+	}
+
+	for _, v := range dbdata.ProxyNumbers {
+		_, ok := owned[v.Number]
+		switch {
+		case !ok && v.PortStatus == portStatusActive:
+			if err := store.ChangePortStatus(v.ID, portStatusActive, portStatusMissing); err != nil {
+				return report, err
+			}
+			u := proxyUsageOf(dbdata, v.ID)
+			log.Printf("Proxy number %s is not in the MessageBird account: new rides won't get it. "+
+				"Quarantine it to move its %d open rides to other numbers.", v.Number, u.OpenRides)
+			report.Missing = append(report.Missing, v)
+		case !ok && v.PortStatus == portStatusMissing:
+			report.StillMissing = append(report.StillMissing, v)
+		case !ok && v.PortStatus == portStatusDisabled:
+			report.Disabled = append(report.Disabled, v)
+		case ok && v.PortStatus == portStatusMissing:
+			if err := store.ChangePortStatus(v.ID, portStatusMissing, portStatusActive); err != nil {
+				return report, err
+			}
+			log.Printf("Proxy number %s is back in the MessageBird account and active again", v.Number)
+			report.Restored = append(report.Restored, v)
+		}
+	}
+	return report, nil
+}
+
+// pollProvisioning runs checkProvisioning now and then every interval until
+// ctx is done. It is meant to be run in its own goroutine.
+func pollProvisioning(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	logProvisioning(store, mb)
+	every(ctx, interval, func() { logProvisioning(store, mb) })
+}
+
+// logProvisioning runs checkProvisioning, which logs what it changes,
+// logging why if it can't
+func logProvisioning(store RideStore, mb *messagebird.Client) {
+	if _, err := checkProvisioning(store, mb); err != nil {
+		mbError(err)
+		log.Printf("Could not check the proxy numbers against the MessageBird account: %v", err)
+	}
+}
+
+// MissingProxies returns the proxy numbers that aren't in the MessageBird account
+func (page PageData) MissingProxies() []ProxyNumberType {
+	var missing []ProxyNumberType
+	for _, v := range page.ProxyNumbers {
+		if v.PortStatus == portStatusMissing {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// portStatusDisabled marks a proxy number an operator took out of the pool.
+// Unlike a quarantined one, it keeps its rides and relationships until they
+// end, but gets no new ones.
+const portStatusDisabled = "disabled"
+
+// proxyUsage is what uses a proxy number
+type proxyUsage struct {
+	Rides         int // Rides of any status that weren't archived
+	OpenRides     int // Rides that aren't over
+	Relationships int // Live relationships
+	Handoffs      int // Rides that moved off it whose old number is still bridged
+}
+
+// InUse reports whether texts or calls to the proxy number are still routed
+func (u proxyUsage) InUse() bool {
+	return u.OpenRides > 0 || u.Relationships > 0 || u.Handoffs > 0
+}
+
+// proxyUsageOf returns what uses the proxy number with ID proxyID
+func proxyUsageOf(dbdata *RideSharingDB, proxyID int) proxyUsage {
+	var u proxyUsage
+	for _, ride := range dbdata.Rides {
+		if ride.ThisProxyNumber.ID != proxyID {
+			continue
+		}
+		u.Rides++
+		if !ride.Status.Terminal() {
+			u.OpenRides++
+		}
+	}
+	now := time.Now()
+	for _, rel := range dbdata.Relationships {
+		if rel.ThisProxyNumber.ID == proxyID && !rel.expired(now) {
+			u.Relationships++
+		}
+	}
+	for _, v := range dbdata.Handoffs {
+		if v.OldProxy.ID == proxyID {
+			u.Handoffs++
+		}
+	}
+	return u
+}
+
+// addProxy adds number to the pool as an active proxy number with tags,
+// reporting false if the pool already has it
+func addProxy(store RideStore, number string, tags []string) (bool, error) {
+	return store.AddProxyNumber(number, portStatusActive, tags)
+}
+
+// deleteProxy removes proxy from the pool, along with the reservations,
+// releases and pair mappings that refer to it. It refuses while rides that
+// weren't archived, live relationships or handoffs use the number: deleting
+// it would leave them unroutable.
+func deleteProxy(dbdata *RideSharingDB, proxy ProxyNumberType) error {
+	u := proxyUsageOf(dbdata, proxy.ID)
+	switch {
+	case u.InUse():
+		return fmt.Errorf("proxy number %s is in use by %d rides, %d relationships and %d handoffs: disable it and wait for them to end",
+			proxy.Number, u.OpenRides, u.Relationships, u.Handoffs)
+	case u.Rides > 0:
+		return fmt.Errorf("proxy number %s still has %d ended rides: archive them first", proxy.Number, u.Rides)
+	}
+
+	return dbdata.store.DeleteProxyNumber(proxy.ID)
+}
+
+// proxyRow is a proxy number listed on the proxy pool page
+type proxyRow struct {
+	ProxyNumberType
+	Usage proxyUsage
+}
+
+// proxiesPage is the data rendered by views/default/proxies.gohtml
+type proxiesPage struct {
+	Proxies        []proxyRow
+	DialPlans      []dialPlan
+	DefaultCountry string
+	Message        string
+}
+
+// proxiesAdminHandler lists the proxy number pool with what uses each
+// number, and adds, disables, enables and deletes numbers. It also checks
+// the pool against the MessageBird account on demand, see checkProvisioning.
+func proxiesAdminHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := proxiesPage{DialPlans: sortedDialPlans(), DefaultCountry: defaultCountry()}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			page.Message = fmt.Sprint(err)
+			renderDefaultTemplate(w, r, "proxies.gohtml", page)
+			return
+		}
+
+		if r.Method == "POST" && r.FormValue("action") == "verify" {
+			report, err := checkProvisioning(dbdata.store, mb)
+			if err != nil {
+				mbError(err)
+				page.Message = fmt.Sprintf("Could not check the pool against the MessageBird account: %v", err)
+			} else {
+				page.Message = report.String()
+			}
+			if dbdata, err = dbdata.loadDB(); err != nil {
+				log.Println(err)
+				page.Message = fmt.Sprint(err)
+			}
+		} else if r.Method == "POST" {
+			page.Message = changeProxyPool(dbdata, r)
+			if dbdata, err = dbdata.loadDB(); err != nil {
+				log.Println(err)
+				page.Message = fmt.Sprint(err)
+			}
+		}
+
+		for _, v := range dbdata.ProxyNumbers {
+			page.Proxies = append(page.Proxies, proxyRow{v, proxyUsageOf(dbdata, v.ID)})
+		}
+		sort.Slice(page.Proxies, func(i, j int) bool { return page.Proxies[i].ID < page.Proxies[j].ID })
+		renderDefaultTemplate(w, r, "proxies.gohtml", page)
+	}
+}
+
+// changeProxyPool makes the change to the pool the proxy pool page posted,
+// returning the message to show
+func changeProxyPool(dbdata *RideSharingDB, r *http.Request) string {
+	action := r.FormValue("action")
+	if action == "add" {
+		number, err := normalizeNumber(r.FormValue("number"), r.FormValue("country"))
+		if err != nil {
+			return fmt.Sprintf("Invalid proxy number: %v", err)
+		}
+		added, err := addProxy(dbdata.store, number, parseTags(r.FormValue("tags")))
+		if err != nil {
+			log.Println(err)
+			return fmt.Sprint(err)
+		}
+		if !added {
+			return fmt.Sprintf("Proxy number %s is already in the pool.", number)
+		}
+		log.Printf("Proxy number %s added", number)
+		return fmt.Sprintf("Proxy number %s added.", number)
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	proxy, ok := dbdata.ProxyNumbers[id]
+	if !ok {
+		return fmt.Sprintf("Unknown proxy number %q", r.FormValue("id"))
+	}
+	switch action {
+	case "disable", "enable":
+		from, to := portStatusActive, portStatusDisabled
+		if action == "enable" {
+			from, to = portStatusDisabled, portStatusActive
+		}
+		if proxy.PortStatus != from {
+			return fmt.Sprintf("Proxy number %s is %s, only %s numbers can be %sd.", proxy.Number, proxy.PortStatus, from, action)
+		}
+		if err := dbdata.store.ChangePortStatus(proxy.ID, from, to); err != nil {
+			log.Println(err)
+			return fmt.Sprint(err)
+		}
+		log.Printf("Proxy number %s %sd", proxy.Number, action)
+		return fmt.Sprintf("Proxy number %s %sd.", proxy.Number, action)
+	case "delete":
+		return performAdminAction(dbdata, dashboardUser(r), actionDeleteProxy, strconv.Itoa(proxy.ID))
+	}
+	return fmt.Sprintf("Unknown action %q", action)
+}
+
+// proxyNumberStore is the part of RideStore that keeps the proxy number pool
+type proxyNumberStore interface {
+	// AddProxyNumber adds number to the pool with status and tags,
+	// reporting false if the pool already has it
+	AddProxyNumber(number string, status string, tags []string) (bool, error)
+	// DeleteProxyNumber removes the proxy number with id from the pool,
+	// along with the reservations, releases and pair mappings that refer to it
+	DeleteProxyNumber(id int) error
+	// SetPortStatus sets the status of the proxy number with id
+	SetPortStatus(id int, status string) error
+	// ChangePortStatus sets the status of the proxy number with id to to,
+	// if it is from
+	ChangePortStatus(id int, from string, to string) error
+	// SetProxyFeatures stores the features MessageBird lists for the proxy
+	// number with id
+	SetProxyFeatures(id int, features []string) error
+	// SetProviderID stores MessageBird's ID for the proxy number with id
+	SetProviderID(id int, providerID string) error
+}
+
+// AddProxyNumber implements proxyNumberStore
+func (s *sqlStore) AddProxyNumber(number string, status string, tags []string) (bool, error) {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "INSERT INTO proxy_numbers (number, port_status, tags) VALUES (?, ?, ?) ON CONFLICT (number) DO NOTHING",
+		Postgres: "INSERT INTO proxy_numbers (number, port_status, tags) VALUES ($1, $2, $3) ON CONFLICT (number) DO NOTHING",
+		MySQL:    "INSERT INTO proxy_numbers (number, port_status, tags) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE number = number",
+	}, number, status, strings.Join(tags, ","))
+	return n > 0, err
+}
+
+// DeleteProxyNumber implements proxyNumberStore
+func (s *sqlStore) DeleteProxyNumber(id int) error {
+	return s.inTx(func(tx sqlTx) error {
+		return tx.execAll(
+			statement(sqlQuery{
+				SQLite:   "DELETE FROM proxy_reservations WHERE number_id = ?",
+				Postgres: "DELETE FROM proxy_reservations WHERE number_id = $1",
+			}, id),
+			statement(sqlQuery{
+				SQLite:   "DELETE FROM proxy_releases WHERE number_id = ?",
+				Postgres: "DELETE FROM proxy_releases WHERE number_id = $1",
+			}, id),
+			statement(sqlQuery{
+				SQLite:   "DELETE FROM pair_proxies WHERE number_id = ?",
+				Postgres: "DELETE FROM pair_proxies WHERE number_id = $1",
+			}, id),
+			statement(sqlQuery{
+				SQLite:   "DELETE FROM proxy_numbers WHERE id = ?",
+				Postgres: "DELETE FROM proxy_numbers WHERE id = $1",
+			}, id),
+		)
+	})
+}
+
+// SetPortStatus implements proxyNumberStore
+func (s *sqlStore) SetPortStatus(id int, status string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE proxy_numbers SET port_status = ? WHERE id = ?",
+		Postgres: "UPDATE proxy_numbers SET port_status = $1 WHERE id = $2",
+	}, status, id)
+	return err
+}
+
+// ChangePortStatus implements proxyNumberStore
+func (s *sqlStore) ChangePortStatus(id int, from string, to string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE proxy_numbers SET port_status = ? WHERE id = ? AND port_status = ?",
+		Postgres: "UPDATE proxy_numbers SET port_status = $1 WHERE id = $2 AND port_status = $3",
+	}, to, id, from)
+	return err
+}
+
+// SetProxyFeatures implements proxyNumberStore
+func (s *sqlStore) SetProxyFeatures(id int, features []string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE proxy_numbers SET features = ? WHERE id = ?",
+		Postgres: "UPDATE proxy_numbers SET features = $1 WHERE id = $2",
+	}, strings.Join(features, ","), id)
+	return err
+}
+
+// SetProviderID implements proxyNumberStore
+func (s *sqlStore) SetProviderID(id int, providerID string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE proxy_numbers SET provider_id = ? WHERE id = ?",
+		Postgres: "UPDATE proxy_numbers SET provider_id = $1 WHERE id = $2",
+	}, providerID, id)
+	return err
+}
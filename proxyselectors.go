@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxySelector decides which proxy number a new ride gets among the
+// candidates that can be assigned to it, which are sorted by ID
+type ProxySelector interface {
+	Select(dbdata *RideSharingDB, candidates []ProxyNumberType) ProxyNumberType
+}
+
+// Proxy selection strategies, see proxySelector
+const (
+	selectRandom            = "random"
+	selectRoundRobin        = "round-robin"
+	selectLeastRecentlyUsed = "least-recently-used"
+	selectLeastActive       = "least-active"
+)
+
+// roundRobin is shared by every round-robin selection, so it can remember
+// where it left off
+var roundRobin = new(roundRobinSelector)
+
+// proxySelectionStrategy returns the strategy set with PROXY_SELECTION,
+// defaulting to random
+func proxySelectionStrategy() string {
+	strategy := strings.ToLower(strings.TrimSpace(os.Getenv("PROXY_SELECTION")))
+	switch strategy {
+	case selectRandom, selectRoundRobin, selectLeastRecentlyUsed, selectLeastActive:
+		return strategy
+	case "":
+	default:
+		log.Printf("Unknown PROXY_SELECTION %q, picking proxy numbers at random", strategy)
+	}
+	return selectRandom
+}
+
+// proxySelector returns the selector of the configured strategy
+func proxySelector() ProxySelector {
+	switch proxySelectionStrategy() {
+	case selectRoundRobin:
+		return roundRobin
+	case selectLeastRecentlyUsed:
+		return leastRecentlyUsedSelector{}
+	case selectLeastActive:
+		return leastActiveSelector{}
+	}
+	return randomSelector{}
+}
+
+// randomSelector picks any candidate, spreading rides over the pool
+type randomSelector struct{}
+
+// Select implements ProxySelector
+func (randomSelector) Select(dbdata *RideSharingDB, candidates []ProxyNumberType) ProxyNumberType {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// roundRobinSelector cycles through the pool by ID, picking the first
+// candidate after the number it picked last. It starts over from the lowest
+// ID when the server restarts.
+type roundRobinSelector struct {
+	mu   sync.Mutex
+	last int
+}
+
+// Select implements ProxySelector
+func (s *roundRobinSelector) Select(dbdata *RideSharingDB, candidates []ProxyNumberType) ProxyNumberType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := candidates[0]
+	for _, v := range candidates {
+		if v.ID > s.last {
+			next = v
+			break
+		}
+	}
+	s.last = next.ID
+	return next
+}
+
+// leastRecentlyUsedSelector picks the candidate whose latest ride was booked
+// longest ago, preferring numbers that never had one, so numbers rest as
+// long as possible between rides
+type leastRecentlyUsedSelector struct{}
+
+// Select implements ProxySelector
+func (leastRecentlyUsedSelector) Select(dbdata *RideSharingDB, candidates []ProxyNumberType) ProxyNumberType {
+	// Ride IDs grow with time, so the highest is the latest booking
+	latest := make(map[int]int)
+	for _, ride := range dbdata.Rides {
+		if ride.ID > latest[ride.ThisProxyNumber.ID] {
+			latest[ride.ThisProxyNumber.ID] = ride.ID
+		}
+	}
+	best := candidates[0]
+	for _, v := range candidates[1:] {
+		if latest[v.ID] < latest[best.ID] {
+			best = v
+		}
+	}
+	return best
+}
+
+// leastActiveSelector picks the candidate carrying the fewest rides that
+// aren't over and live relationships, evening out the load on the pool
+type leastActiveSelector struct{}
+
+// Select implements ProxySelector
+func (leastActiveSelector) Select(dbdata *RideSharingDB, candidates []ProxyNumberType) ProxyNumberType {
+	active := make(map[int]int)
+	for _, ride := range dbdata.Rides {
+		if !ride.Status.Terminal() {
+			active[ride.ThisProxyNumber.ID]++
+		}
+	}
+	now := time.Now()
+	for _, rel := range dbdata.Relationships {
+		if !rel.expired(now) {
+			active[rel.ThisProxyNumber.ID]++
+		}
+	}
+	best := candidates[0]
+	for _, v := range candidates[1:] {
+		if active[v.ID] < active[best.ID] {
+			best = v
+		}
+	}
+	return best
+}
+
+// sortProxyNumbers sorts numbers by ID
+func sortProxyNumbers(numbers []ProxyNumberType) {
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i].ID < numbers[j].ID })
+}
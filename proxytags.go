@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Proxy number tags with a meaning to the allocator.
+// Any other tag, e.g. "region:NL", only matches rides that require it.
+const (
+	tagSMSOnly   = "sms-only"   // the number can't take calls
+	tagVoiceOnly = "voice-only" // the number can't send or receive SMS
+)
+
+// Capabilities a ride can require in its tag set. A number has a capability
+// when MessageBird lists it as a feature of the number, unless it is tagged
+// sms-only or voice-only.
+const (
+	capabilitySMS   = "sms"
+	capabilityVoice = "voice"
+)
+
+// parseTags splits a comma-separated list of tags, e.g. "premium, region:NL",
+// into sorted, lower-case tags without duplicates
+func parseTags(list string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// hasTag reports whether the proxy number is tagged with tag
+func (proxy ProxyNumberType) hasTag(tag string) bool {
+	for _, v := range proxy.Tags {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// canSMS reports whether the proxy number can send and receive SMS
+func (proxy ProxyNumberType) canSMS() bool {
+	return !proxy.hasTag(tagVoiceOnly) && proxy.hasFeature(capabilitySMS)
+}
+
+// notificationOriginator returns the sender of notifications about rides on
+// the proxy number: the number itself, so participants can reply to them, or
+// our own sender ID if it is voice-only, in which case the templates ask
+// participants to call it instead
+func (proxy ProxyNumberType) notificationOriginator() string {
+	if !proxy.canSMS() {
+		return announcementOriginator()
+	}
+	return proxy.Number
+}
+
+// canCall reports whether the proxy number can take calls
+func (proxy ProxyNumberType) canCall() bool {
+	return !proxy.hasTag(tagSMSOnly) && proxy.hasFeature(capabilityVoice)
+}
+
+// satisfies reports whether the proxy number meets every tag in required
+func (proxy ProxyNumberType) satisfies(required []string) bool {
+	for _, tag := range required {
+		switch tag {
+		case capabilitySMS:
+			if !proxy.canSMS() {
+				return false
+			}
+		case capabilityVoice:
+			if !proxy.canCall() {
+				return false
+			}
+		default:
+			if !proxy.hasTag(tag) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reservedFor reports whether the proxy number carries a reserved tag, such
+// as "premium", that is missing from required. Reserved numbers are only
+// assigned automatically to rides that ask for them.
+func (proxy ProxyNumberType) reservedFor(required []string) bool {
+	for _, tag := range reservedProxyTags() {
+		if !proxy.hasTag(tag) {
+			continue
+		}
+		found := false
+		for _, v := range required {
+			if v == tag {
+				found = true
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedProxyTags returns the tags in PROXY_RESERVED_TAGS (default "premium")
+func reservedProxyTags() []string {
+	if tags, ok := os.LookupEnv("PROXY_RESERVED_TAGS"); ok {
+		return parseTags(tags)
+	}
+	return []string{"premium"}
+}
+
+// defaultRideTags returns the tags new rides require unless the operator
+// chooses others, from RIDE_REQUIRED_TAGS (default "sms,voice")
+func defaultRideTags() []string {
+	if tags, ok := os.LookupEnv("RIDE_REQUIRED_TAGS"); ok {
+		return parseTags(tags)
+	}
+	return []string{capabilitySMS, capabilityVoice}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// outboundSMS is an SMS message waiting in the notification queue
+type outboundSMS struct {
+	Originator string
+	Recipient  string
+	Body       string
+	Purpose    string    // consentMarketing for announcements, else transactional
+	Store      RideStore // Where the recipient's consent is and the message is logged
+}
+
+// maxSendAttempts is how often the queue tries a message that is rate limited
+const maxSendAttempts = 5
+
+// notificationQueue buffers outbound SMS messages and sends them from a
+// single worker paced by a throttle, so that bulk sends don't trip
+// MessageBird's rate limits or keep the HTTP request that queued them waiting.
+type notificationQueue struct {
+	mb       *messagebird.Client
+	pending  chan outboundSMS
+	throttle *adaptiveThrottle
+
+	mu      sync.RWMutex
+	closed  bool          // No more messages are taken, see drain
+	done    chan struct{} // Closed once run returned
+	abandon chan struct{} // Closed once drain gave up on the messages left
+}
+
+// newNotificationQueue returns a queue holding up to size messages,
+// sending at the pace set by throttle. Call run to start sending.
+func newNotificationQueue(mb *messagebird.Client, size int, throttle *adaptiveThrottle) *notificationQueue {
+	return &notificationQueue{
+		mb:       mb,
+		pending:  make(chan outboundSMS, size),
+		throttle: throttle,
+		done:     make(chan struct{}),
+		abandon:  make(chan struct{}),
+	}
+}
+
+// enqueue adds msg to the queue without blocking.
+// It returns an error if the queue is full.
+func (q *notificationQueue) enqueue(msg outboundSMS) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return fmt.Errorf("notification queue is shutting down, could not queue message to %s", msg.Recipient)
+	}
+	select {
+	case q.pending <- msg:
+		return nil
+	default:
+		return fmt.Errorf("notification queue is full, could not queue message to %s", msg.Recipient)
+	}
+}
+
+// run sends queued messages at the pace of q.throttle. Messages that are
+// rejected because we hit MessageBird's rate limit are retried after the
+// throttle backs off, rather than dropped. Sending pauses while maintenance
+// mode is on. Marketing messages are dropped if the recipient withdrew their
+// consent since they were queued. It returns once drain emptied the queue
+// or gave up on it.
+// It is meant to be run in its own goroutine.
+func (q *notificationQueue) run() {
+	defer close(q.done)
+	for msg := range q.pending {
+		for maintenanceOn(msg.Store) && !q.abandoned() {
+			time.Sleep(maintenanceCheckInterval)
+		}
+		if q.abandoned() {
+			return
+		}
+		if msg.Purpose == consentMarketing && !consentGiven(msg.Store, msg.Recipient, consentMarketing) {
+			continue
+		}
+		var id string
+		for attempt := 1; attempt <= maxSendAttempts; attempt++ {
+			q.throttle.wait()
+			sent := time.Now()
+			id = mbSender(msg.Store, q.mb, msg.Originator, []string{msg.Recipient}, msg.Body, nil)
+			if id != "" || !q.throttle.rateLimitedSince(sent) {
+				break
+			}
+			log.Printf("Rate limited sending to %s, attempt %d of %d", msg.Recipient, attempt, maxSendAttempts)
+		}
+		logMessage(msg.Store, 0, directionOutbound, id, msg.Originator, msg.Recipient, msg.Body)
+	}
+}
+
+// abandoned reports whether drain gave up on the messages left in q
+func (q *notificationQueue) abandoned() bool {
+	select {
+	case <-q.abandon:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain stops q from taking new messages and waits for run to send the ones
+// already queued, or for ctx to be done, in which case the rest are dropped
+// and run returns once it is done with the message it is sending
+func (q *notificationQueue) drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		if !q.abandoned() {
+			close(q.abandon)
+		}
+		q.mu.Unlock()
+		return fmt.Errorf("%d queued message(s) not sent: %v", len(q.pending), ctx.Err())
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Kinds of usage we enforce daily quotas on
+const (
+	quotaRides  = "rides"  // rides created
+	quotaRelays = "relays" // messages relayed between participants
+)
+
+// quotaEnv maps each kind of usage to the environment variable holding its daily quota
+var quotaEnv = map[string]string{
+	quotaRides:  "RIDE_DAILY_QUOTA",
+	quotaRelays: "RELAY_DAILY_QUOTA",
+}
+
+// quotaLimit returns the daily quota for kind, or 0 if it is unlimited.
+// Hosted deployments set RIDE_DAILY_QUOTA and RELAY_DAILY_QUOTA to their plan's limits,
+// which each tenant gets in full.
+func quotaLimit(kind string) int {
+	return envInt(quotaEnv[kind], 0)
+}
+
+// quotaDay returns the day usage at t counts towards. Days are in UTC.
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// quotaStore is the part of RideStore that counts the usage against the
+// daily quotas, per tenant, see tenants.go
+type quotaStore interface {
+	// ConsumeQuota records one use of kind on day by tenant, reporting
+	// false without recording it if limit uses were recorded already. A
+	// limit of 0 is unlimited.
+	ConsumeQuota(tenant string, day string, kind string, limit int) (bool, error)
+	// RefundQuota takes back one use of kind recorded on day by tenant
+	RefundQuota(tenant string, day string, kind string) error
+	// QuotaUsage returns how often tenant used each kind of usage on day
+	QuotaUsage(tenant string, day string) (map[string]int, error)
+}
+
+// ConsumeQuota implements quotaStore
+func (s *sqlStore) ConsumeQuota(tenant string, day string, kind string, limit int) (bool, error) {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO tenant_quota_usage (tenant, day, kind, used) VALUES (?, ?, ?, 0) ON CONFLICT (tenant, day, kind) DO NOTHING",
+		Postgres: "INSERT INTO tenant_quota_usage (tenant, day, kind, used) VALUES ($1, $2, $3, 0) ON CONFLICT (tenant, day, kind) DO NOTHING",
+		MySQL:    "INSERT INTO tenant_quota_usage (tenant, day, kind, used) VALUES (?, ?, ?, 0) ON DUPLICATE KEY UPDATE used = used",
+	}, tenant, day, kind)
+	if err != nil {
+		return false, err
+	}
+	if limit == 0 {
+		_, err := s.exec(sqlQuery{
+			SQLite:   "UPDATE tenant_quota_usage SET used = used + 1 WHERE tenant = ? AND day = ? AND kind = ?",
+			Postgres: "UPDATE tenant_quota_usage SET used = used + 1 WHERE tenant = $1 AND day = $2 AND kind = $3",
+		}, tenant, day, kind)
+		return err == nil, err
+	}
+	// The quota is checked in the same statement that counts the use,
+	// so concurrent requests can't overshoot it
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "UPDATE tenant_quota_usage SET used = used + 1 WHERE tenant = ? AND day = ? AND kind = ? AND used < ?",
+		Postgres: "UPDATE tenant_quota_usage SET used = used + 1 WHERE tenant = $1 AND day = $2 AND kind = $3 AND used < $4",
+	}, tenant, day, kind, limit)
+	return n > 0, err
+}
+
+// RefundQuota implements quotaStore
+func (s *sqlStore) RefundQuota(tenant string, day string, kind string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE tenant_quota_usage SET used = used - 1 WHERE tenant = ? AND day = ? AND kind = ? AND used > 0",
+		Postgres: "UPDATE tenant_quota_usage SET used = used - 1 WHERE tenant = $1 AND day = $2 AND kind = $3 AND used > 0",
+	}, tenant, day, kind)
+	return err
+}
+
+// QuotaUsage implements quotaStore
+func (s *sqlStore) QuotaUsage(tenant string, day string) (map[string]int, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT kind, used FROM tenant_quota_usage WHERE tenant = ? AND day = ?",
+		Postgres: "SELECT kind, used FROM tenant_quota_usage WHERE tenant = $1 AND day = $2",
+	}, tenant, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	used := make(map[string]int)
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, err
+		}
+		used[kind] = n
+	}
+	return used, rows.Err()
+}
+
+// consumeQuota records one use of kind on day by dbdata's tenant,
+// reporting false without recording it if the day's quota is used up
+func consumeQuota(dbdata *RideSharingDB, day string, kind string) (bool, error) {
+	return dbdata.store.ConsumeQuota(dbdata.tenant, day, kind, quotaLimit(kind))
+}
+
+// refundQuota gives back a use of kind consumed on day by dbdata's tenant,
+// e.g. for a ride that couldn't be booked after all
+func refundQuota(dbdata *RideSharingDB, day string, kind string) {
+	if err := dbdata.store.RefundQuota(dbdata.tenant, day, kind); err != nil {
+		log.Printf("Could not refund the %s quota of %s: %v", kind, day, err)
+	}
+}
+
+// quotaUsage is the consumption of one kind of usage today
+type quotaUsage struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit,omitempty"` // 0 means unlimited
+}
+
+// loadQuotaUsage returns today's consumption of every kind of usage by
+// dbdata's tenant
+func loadQuotaUsage(dbdata *RideSharingDB) (map[string]quotaUsage, error) {
+	usage := make(map[string]quotaUsage)
+	for kind := range quotaEnv {
+		usage[kind] = quotaUsage{Limit: quotaLimit(kind)}
+	}
+	used, err := dbdata.store.QuotaUsage(dbdata.tenant, quotaDay(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	for kind, n := range used {
+		if u, ok := usage[kind]; ok {
+			u.Used = n
+			usage[kind] = u
+		}
+	}
+	return usage, nil
+}
+
+// quotaHandler reports the tenant's consumption today against the daily
+// quotas as JSON, e.g.
+//
+//	{"tenant":"eu.birdcar.example.com","day":"2020-06-01","usage":{"relays":{"used":12},"rides":{"used":3,"limit":50}}}
+//
+// The tenant is left out when the server isn't run by the tenants command.
+func quotaHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usage, err := loadQuotaUsage(dbdata)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Tenant string                `json:"tenant,omitempty"`
+			Day    string                `json:"day"`
+			Usage  map[string]quotaUsage `json:"usage"`
+		}{dbdata.tenant, quotaDay(time.Now()), usage})
+	}
+}
+
+// relayQuotaLeft consumes one relay from the tenant's quota today,
+// reporting whether the message may be relayed. Messages are relayed if
+// usage can't be recorded.
+func relayQuotaLeft(dbdata *RideSharingDB) bool {
+	ok, err := consumeQuota(dbdata, quotaDay(time.Now()), quotaRelays)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	return ok
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaIsCountedPerTenant(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		openTestDB(t, kind)
+		setenv(t, "RIDE_DAILY_QUOTA", "1")
+		// Tenants sharing a database
+		eu, us := newRideSharingDB(appStore), newRideSharingDB(appStore)
+		eu.tenant, us.tenant = "eu.birdcar.test", "us.birdcar.test"
+		day := quotaDay(time.Now())
+
+		for i, c := range []struct {
+			dbdata *RideSharingDB
+			refund bool
+			want   bool
+		}{
+			{eu, false, true},
+			{eu, false, false},
+			{us, false, true},
+			{eu, true, true}, // The first ride's quota was refunded
+			{eu, false, false},
+		} {
+			if c.refund {
+				refundQuota(c.dbdata, day, quotaRides)
+			}
+			ok, err := consumeQuota(c.dbdata, day, quotaRides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != c.want {
+				t.Errorf("%s: ride %d of %s admitted: %v, want %v", kind, i+1, c.dbdata.tenant, ok, c.want)
+			}
+		}
+
+		usage, err := loadQuotaUsage(us)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u := usage[quotaRides]; u.Used != 1 || u.Limit != 1 {
+			t.Errorf("%s: %s used %d of %d rides, want 1 of 1", kind, us.tenant, u.Used, u.Limit)
+		}
+	}
+}
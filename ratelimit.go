@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of tracked keys above which idle buckets are pruned
+const maxBuckets = 10000
+
+// rateLimiter is a token bucket rate limiter keyed by an arbitrary string,
+// e.g. a client IP address. Each key gets its own bucket.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // maximum tokens a bucket can hold
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute events per key,
+// with bursts of up to perMinute events.
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from key's bucket, reporting false if the bucket is empty
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops buckets that would be full by now, since forgetting them
+// doesn't change the limiter's behavior. l.mu must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// clientIP returns the IP address of the client that sent r. Requests
+// from the proxies in TRUSTED_PROXIES, e.g. the tenant router, are from
+// the client their X-Forwarded-For header names last.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && trustedProxy(host) {
+		hops := strings.Split(forwarded, ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether ip is in TRUSTED_PROXIES, a comma-separated
+// list of IP addresses
+func trustedProxy(ip string) bool {
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if strings.TrimSpace(v) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitKey returns who r counts against a rate limit as: the API key or
+// dashboard user it is authenticated as, see dashboardUser, or else its
+// client IP. Users behind one NAT then don't share a bucket. Only use it on
+// routes that authenticate users, as it trusts basic auth users.
+func rateLimitKey(r *http.Request) string {
+	if user := dashboardUser(r); user != "" {
+		return "user " + user
+	}
+	return "ip " + clientIP(r)
+}
+
+// rateLimitByIP refuses requests from client IPs that used up their bucket
+// in limiter with 429 Too Many Requests
+func rateLimitByIP(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allow(clientIP(r)) {
+			log.Printf("Refused %s %s from %s: too many requests", r.Method, r.URL.Path, clientIP(r))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimitBySender refuses webhook requests from senders, the number in
+// field (e.g. "originator"), that used up their bucket in limiter with 429
+// Too Many Requests, which MessageBird retries later. A flood from one
+// number, spoofed or not, can't run up our SMS bill or fill the database.
+func rateLimitBySender(limiter *rateLimiter, field string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields, err := peekWebhookFields(r)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		if sender := senderKey(fields, field); sender != "" && !limiter.allow(sender) {
+			log.Printf("Refused %s %s from %s: too many requests from %s", r.Method, r.URL.Path, clientIP(r), sender)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// senderKey returns the bucket of the sender in field of a webhook's
+// fields: their number, or for withheld callers, who can't be told apart
+// by it, their call to the proxy number. Withheld callers redialing get
+// a new bucket, so the ride PINs they may key in are limited by proxy
+// number instead, see pinGuard. It returns an empty key for withheld
+// senders of anything but a call.
+func senderKey(fields func(string) string, field string) string {
+	sender := fields(field)
+	if !isWithheldCaller(sender) {
+		return sender
+	}
+	if callID := fields("callID"); callID != "" {
+		return "call " + callID + " to " + fields("destination")
+	}
+	return ""
+}
+
+// peekWebhookFields returns the fields of a webhook request, see
+// webhookFields, leaving its body for the handler to read
+func peekWebhookFields(r *http.Request) (func(string) string, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxWebhookBody))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	peek := r.Clone(r.Context())
+	peek.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return webhookFields(peek)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurstThenRefills(t *testing.T) {
+	l := newRateLimiter(3)
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("event %d of the burst refused", i+1)
+		}
+	}
+	if l.allow("a") {
+		t.Fatal("event after the burst allowed")
+	}
+	if !l.allow("b") {
+		t.Fatal("another key shares a's bucket")
+	}
+
+	// 3 per minute is a token every 20 seconds
+	l.mu.Lock()
+	l.buckets["a"].last = l.buckets["a"].last.Add(-20 * time.Second)
+	l.mu.Unlock()
+	if !l.allow("a") {
+		t.Error("bucket didn't refill")
+	}
+	if l.allow("a") {
+		t.Error("bucket refilled more than a token")
+	}
+
+	// Buckets never hold more than the burst
+	l.mu.Lock()
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+	l.mu.Unlock()
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.allow("a") {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("full bucket allowed %d events, want 3", allowed)
+	}
+}
+
+func TestRateLimiterPrunesFullBuckets(t *testing.T) {
+	l := newRateLimiter(60)
+	l.allow("idle")
+	l.buckets["idle"].last = time.Now().Add(-time.Minute)
+	l.allow("busy")
+	l.prune(time.Now())
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket, full by now, wasn't pruned")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("bucket that isn't full yet was pruned")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	withBasicAuth := httptest.NewRequest(http.MethodPost, "/createride", nil)
+	withBasicAuth.SetBasicAuth("dispatch", "secret")
+	withSession := httptest.NewRequest(http.MethodPost, "/createride", nil)
+	withSession = withSession.WithContext(context.WithValue(withSession.Context(), sessionUserKey{}, "alice"))
+	withAPIKey := httptest.NewRequest(http.MethodPost, "/api/rides", nil)
+	withAPIKey = withAPIKey.WithContext(context.WithValue(withAPIKey.Context(), apiKeyContextKey{}, apiKey{Name: "booking-site"}))
+	anonymous := httptest.NewRequest(http.MethodPost, "/createride", nil)
+	anonymous.RemoteAddr = "203.0.113.7:51234"
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{"basic auth", withBasicAuth, "user dispatch"},
+		{"session", withSession, "user alice"},
+		{"API key", withAPIKey, "user api key booking-site"},
+		{"anonymous", anonymous, "ip 203.0.113.7"},
+	}
+	for _, test := range tests {
+		if got := rateLimitKey(test.r); got != test.want {
+			t.Errorf("%s: rateLimitKey = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSenderKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		form   url.Values
+		field  string
+		wantID string
+	}{
+		{"caller", url.Values{"source": {"319700000"}, "callID": {"c1"}, "destination": {"319700004"}}, "source", "319700000"},
+		{"withheld caller", url.Values{"source": {"Restricted"}, "callID": {"c1"}, "destination": {"319700004"}}, "source", "call c1 to 319700004"},
+		{"anonymous caller", url.Values{"source": {"anonymous"}, "callID": {"c2"}, "destination": {"319700004"}}, "source", "call c2 to 319700004"},
+		{"no caller ID", url.Values{"callID": {"c3"}, "destination": {"319700005"}}, "source", "call c3 to 319700005"},
+		{"texter", url.Values{"originator": {"319700000"}, "recipient": {"319700004"}}, "originator", "319700000"},
+		{"no originator", url.Values{"recipient": {"319700004"}}, "originator", ""},
+	}
+	for _, test := range tests {
+		if got := senderKey(test.form.Get, test.field); got != test.wantID {
+			t.Errorf("%s: senderKey = %q, want %q", test.name, got, test.wantID)
+		}
+	}
+}
+
+func TestRateLimitBySenderKeepsWithheldCallersApart(t *testing.T) {
+	limiter := newRateLimiter(1)
+	handler := rateLimitBySender(limiter, "source", func(w http.ResponseWriter, r *http.Request) {
+		// The handler still gets to read the body
+		if r.FormValue("callID") == "" {
+			t.Error("handler got no callID")
+		}
+	})
+	call := func(callID string) int {
+		form := url.Values{"source": {"Restricted"}, "callID": {callID}, "destination": {"319700004"}}
+		r := httptest.NewRequest(http.MethodPost, voiceWebhookPath(""), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	if code := call("abusive"); code != http.StatusOK {
+		t.Fatalf("first call answered %d", code)
+	}
+	if code := call("abusive"); code != http.StatusTooManyRequests {
+		t.Errorf("second request of the same call answered %d, want 429", code)
+	}
+	if code := call("legitimate"); code != http.StatusOK {
+		t.Errorf("another withheld caller answered %d, want 200", code)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// relationshipCheckInterval is how often the server ends expired relationships
+const relationshipCheckInterval = time.Hour
+
+// RelationshipType templates a long-lived masked link between a regular
+// customer and driver. They keep the same proxy number across rides, and can
+// reach each other through it between rides too.
+type RelationshipType struct {
+	ID              int
+	ThisCustomer    Person
+	ThisDriver      Person
+	ThisProxyNumber ProxyNumberType
+	CreatedAt       string
+	ExpiresAt       string // RFC 3339; every ride between the pair renews it
+}
+
+// relationshipTTL returns how long a relationship lasts after it is created
+// or after the pair's latest ride. Set RELATIONSHIP_TTL (e.g. "720h") to
+// override the default of 90 days.
+func relationshipTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RELATIONSHIP_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 90 * 24 * time.Hour
+}
+
+// expired reports whether rel had expired at now
+func (rel RelationshipType) expired(now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, rel.ExpiresAt)
+	return err != nil || !now.Before(expires)
+}
+
+// Expires returns the expiry date of rel for display
+func (rel RelationshipType) Expires() string {
+	expires, err := time.Parse(time.RFC3339, rel.ExpiresAt)
+	if err != nil {
+		return rel.ExpiresAt
+	}
+	return expires.Local().Format("2006-01-02")
+}
+
+// ride returns a stand-in ride for messages and calls between the pair
+// outside their rides. Its ID is 0, so nothing is recorded against a ride.
+func (rel RelationshipType) ride() RideType {
+	return RideType{
+		ThisCustomer:    rel.ThisCustomer,
+		ThisDriver:      rel.ThisDriver,
+		ThisProxyNumber: rel.ThisProxyNumber,
+	}
+}
+
+// findRelationship returns the live relationship between customerID and driverID
+func findRelationship(dbdata *RideSharingDB, customerID int, driverID int) (RelationshipType, bool) {
+	now := time.Now()
+	for _, v := range dbdata.Relationships {
+		if v.ThisCustomer.ID == customerID && v.ThisDriver.ID == driverID && !v.expired(now) {
+			return v, true
+		}
+	}
+	return RelationshipType{}, false
+}
+
+// hasRelationshipOn reports whether customerID and driverID have a live
+// relationship using the proxy number with ID proxyID
+func hasRelationshipOn(dbdata *RideSharingDB, customerID int, driverID int, proxyID int) bool {
+	rel, ok := findRelationship(dbdata, customerID, driverID)
+	return ok && rel.ThisProxyNumber.ID == proxyID
+}
+
+// findRelationshipParticipant finds the live relationship using proxyNumber
+// that number belongs to, returning its stand-in ride and the role of the
+// participant number belongs to
+func findRelationshipParticipant(dbdata *RideSharingDB, proxyNumber string, number string) (RideType, string, bool) {
+	now := time.Now()
+	for _, v := range dbdata.Relationships {
+		if v.ThisProxyNumber.Number != proxyNumber || v.expired(now) {
+			continue
+		}
+		switch {
+		case v.ThisCustomer.hasNumber(number):
+			return v.ride(), roleCustomer, true
+		case v.ThisDriver.hasNumber(number):
+			return v.ride(), roleDriver, true
+		}
+	}
+	return RideType{}, "", false
+}
+
+// relationshipStore is the part of RideStore that keeps the relationships
+// between regular riders
+type relationshipStore interface {
+	// AddRelationship starts a relationship between customerID and driverID
+	// on the proxy number with ID proxyID, from now until expires
+	AddRelationship(customerID int, driverID int, proxyID int, now time.Time, expires time.Time) error
+	// SetRelationshipExpiry makes the relationship with the given ID last
+	// until expires
+	SetRelationshipExpiry(id int, expires time.Time) error
+	// EndRelationship ends the relationship with the given ID at now,
+	// releasing its proxy number, see cooldown.go. Relationships that
+	// already ended are left alone.
+	EndRelationship(id int, now time.Time) error
+}
+
+// AddRelationship implements relationshipStore
+func (s *sqlStore) AddRelationship(customerID int, driverID int, proxyID int, now time.Time, expires time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO relationships (customer_id, driver_id, number_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO relationships (customer_id, driver_id, number_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+	}, customerID, driverID, proxyID, now.UTC().Format(time.RFC3339), expires.UTC().Format(time.RFC3339))
+	return err
+}
+
+// SetRelationshipExpiry implements relationshipStore
+func (s *sqlStore) SetRelationshipExpiry(id int, expires time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE relationships SET expires_at = ? WHERE id = ?",
+		Postgres: "UPDATE relationships SET expires_at = $1 WHERE id = $2",
+	}, expires.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// EndRelationship implements relationshipStore
+func (s *sqlStore) EndRelationship(id int, now time.Time) error {
+	return s.inTx(func(tx sqlTx) error {
+		n, err := tx.rowsAffected(sqlQuery{
+			SQLite:   "UPDATE relationships SET ended_at = ? WHERE id = ? AND ended_at = ''",
+			Postgres: "UPDATE relationships SET ended_at = $1 WHERE id = $2 AND ended_at = ''",
+		}, now.UTC().Format(time.RFC3339), id)
+		if err != nil || n == 0 {
+			return err
+		}
+		var proxyID, customerID, driverID int
+		err = tx.queryRow(sqlQuery{
+			SQLite:   "SELECT number_id, customer_id, driver_id FROM relationships WHERE id = ?",
+			Postgres: "SELECT number_id, customer_id, driver_id FROM relationships WHERE id = $1",
+		}, id).Scan(&proxyID, &customerID, &driverID)
+		if err != nil {
+			return err
+		}
+		return tx.execAll(releaseStatement(proxyID, customerID, driverID, now))
+	})
+}
+
+// relationshipProxy picks the proxy number for a new relationship: the one
+// of the pair's latest ride if nobody else uses it with either of them, or
+// else any available number
+func relationshipProxy(dbdata *RideSharingDB, customerID int, driverID int) (ProxyNumberType, error) {
+	latest := 0
+	for _, v := range dbdata.Rides {
+		if v.ThisCustomer.ID == customerID && v.ThisDriver.ID == driverID && v.ID > latest {
+			latest = v.ID
+		}
+	}
+	if latest > 0 {
+		proxy := dbdata.Rides[latest].ThisProxyNumber
+		if proxyFree(dbdata, customerID, driverID, proxy, true) {
+			return proxy, nil
+		}
+	}
+	return getAvailableProxyNumber(dbdata, customerID, driverID, defaultRideTags())
+}
+
+// createRelationship starts a relationship between customerID and driverID
+func createRelationship(dbdata *RideSharingDB, customerID int, driverID int) (ProxyNumberType, error) {
+	if err := bookable(dbdata, customerID, driverID); err != nil {
+		return ProxyNumberType{}, err
+	}
+	if _, ok := findRelationship(dbdata, customerID, driverID); ok {
+		return ProxyNumberType{}, fmt.Errorf("%s and %s are already regular riders",
+			dbdata.Customers[customerID].Name, dbdata.Drivers[driverID].Name)
+	}
+	proxy, err := relationshipProxy(dbdata, customerID, driverID)
+	if err != nil {
+		return proxy, err
+	}
+	now := time.Now()
+	return proxy, dbdata.store.AddRelationship(customerID, driverID, proxy.ID, now, now.Add(relationshipTTL()))
+}
+
+// renewRelationship extends rel to last relationshipTTL after from,
+// unless it already lasts longer
+func renewRelationship(store RideStore, rel RelationshipType, from time.Time) error {
+	expires := from.Add(relationshipTTL()).UTC()
+	if current, err := time.Parse(time.RFC3339, rel.ExpiresAt); err == nil && current.After(expires) {
+		return nil
+	}
+	return store.SetRelationshipExpiry(rel.ID, expires)
+}
+
+// endRelationship ends the relationship with the given ID. Its proxy number
+// stays with the pair's existing rides, and is otherwise released.
+func endRelationship(store RideStore, id int) error {
+	if err := store.EndRelationship(id, time.Now()); err != nil {
+		return err
+	}
+	return store.SyncReservations()
+}
+
+// endExpiredRelationships ends relationships that have expired,
+// returning how many it ended
+func endExpiredRelationships(dbdata *RideSharingDB) (int, error) {
+	ended := 0
+	now := time.Now()
+	for _, v := range dbdata.Relationships {
+		if !v.expired(now) {
+			continue
+		}
+		if err := endRelationship(dbdata.store, v.ID); err != nil {
+			return ended, err
+		}
+		ended++
+	}
+	return ended, nil
+}
+
+// pollRelationships ends expired relationships every interval until ctx is
+// done. It is meant to be run in its own goroutine.
+func pollRelationships(ctx context.Context, store RideStore, interval time.Duration) {
+	every(ctx, interval, func() {
+		dbdata, err := newRideSharingDB(store).loadDB()
+		if err != nil {
+			log.Printf("Relationship check: could not load database: %v", err)
+			return
+		}
+		ended, err := endExpiredRelationships(dbdata)
+		if err != nil {
+			log.Printf("Relationship check: %v", err)
+		}
+		if ended > 0 {
+			log.Printf("Relationship check: ended %d expired relationships", ended)
+		}
+	})
+}
+
+// loadRelationships returns the relationships that haven't ended, with
+// their participants and proxy numbers taken from the given maps
+func (s *sqlStore) loadRelationships(customers map[int]Person, drivers map[int]Person, proxies map[int]ProxyNumberType) (map[int]RelationshipType, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, customer_id, driver_id, number_id, created_at, expires_at FROM relationships WHERE ended_at = ''",
+		Postgres: "SELECT id, customer_id, driver_id, number_id, created_at, expires_at FROM relationships WHERE ended_at = ''",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	relationships := make(map[int]RelationshipType)
+	for rows.Next() {
+		var rel RelationshipType
+		var customerID, driverID, numberID int
+		if err := rows.Scan(&rel.ID, &customerID, &driverID, &numberID, &rel.CreatedAt, &rel.ExpiresAt); err != nil {
+			return nil, err
+		}
+		rel.ThisCustomer = customers[customerID]
+		rel.ThisDriver = drivers[driverID]
+		rel.ThisProxyNumber = proxies[numberID]
+		relationships[rel.ID] = rel
+	}
+	return relationships, rows.Err()
+}
+
+// relationshipsHandler lets operators start, renew and end relationships
+// between regular riders
+func relationshipsHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		message := ""
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				return
+			}
+			switch r.FormValue("action") {
+			case "create":
+				customerID, err1 := strconv.Atoi(r.FormValue("customer"))
+				driverID, err2 := strconv.Atoi(r.FormValue("driver"))
+				if err1 != nil || err2 != nil {
+					renderLanding(w, r, dbdata, "Something went wrong. Invalid customer or driver id.")
+					return
+				}
+				proxy, err := createRelationship(dbdata, customerID, driverID)
+				if err != nil {
+					log.Println(err)
+					message = fmt.Sprintf("Could not make them regular riders: %v", err)
+				} else {
+					message = fmt.Sprintf("%s and %s are now regular riders on proxy number %s.",
+						dbdata.Customers[customerID].Name, dbdata.Drivers[driverID].Name, proxy.Number)
+				}
+			case "renew", "end":
+				id, _ := strconv.Atoi(r.FormValue("id"))
+				rel, ok := dbdata.Relationships[id]
+				if !ok {
+					renderLanding(w, r, dbdata, fmt.Sprintf("Unknown relationship %q", r.FormValue("id")))
+					return
+				}
+				if r.FormValue("action") == "renew" {
+					err = renewRelationship(dbdata.store, rel, time.Now())
+				} else {
+					err = endRelationship(dbdata.store, rel.ID)
+				}
+				if err != nil {
+					log.Println(err)
+					message = fmt.Sprint(err)
+				}
+			}
+		}
+
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderLanding(w, r, dbdata, message)
+	}
+}
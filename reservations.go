@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// rideAttempts is how many proxy numbers bookRide tries before
+// giving up, when other rides keep reserving the ones it picks
+const rideAttempts = 3
+
+// errProxyTaken is returned when another ride reserved a proxy number for
+// the customer or driver of a new ride before it could
+var errProxyTaken = errors.New("the proxy number was just taken by another ride")
+
+// proxyReservation reserves a proxy number for a customer and driver. The
+// proxy_reservations table allows one reservation per customer and proxy
+// number and one per driver and proxy number, so concurrent requests can't
+// give a participant two rides with other people on the same number. A
+// reservation is held as long as a ride or live relationship of the pair
+// uses the number.
+type proxyReservation struct {
+	ProxyID    int
+	CustomerID int
+	DriverID   int
+}
+
+// reservationStore is the part of RideStore that books rides on proxy
+// numbers reserved for their participants
+type reservationStore interface {
+	// InsertRide reserves the proxy number of ride for its customer and
+	// driver and inserts the ride in one transaction, returning the new
+	// ride's ID. It returns errProxyTaken if another ride reserved the
+	// number first.
+	InsertRide(ride RideType) (int, error)
+	// MoveRide moves ride to proxy, reserving proxy for its customer and
+	// driver, and records that they released their old number. The
+	// reservation of the old number is dropped by SyncReservations.
+	MoveRide(ride RideType, proxy ProxyNumberType) error
+	// SyncReservations drops the reservations no ride or live relationship
+	// holds any more, so their proxy numbers can be given to other pairs,
+	// and adds missing ones for rides created before reservations existed.
+	// Rides that share a number with another pair's can't be reserved; the
+	// doctor command reports and repairs them.
+	SyncReservations() error
+}
+
+// reserveProxy reserves r within tx, returning errProxyTaken if the customer
+// or driver holds the number with someone else. Reserving a number the pair
+// already holds succeeds. A reservation made by another transaction since
+// the query that looks for one also returns errProxyTaken, when inserting
+// r violates the table's unique constraints.
+func (s *sqlStore) reserveProxy(tx sqlTx, r proxyReservation) error {
+	rows, err := tx.query(sqlQuery{
+		SQLite:   "SELECT customer_id, driver_id FROM proxy_reservations WHERE number_id = ? AND (customer_id = ? OR driver_id = ?)",
+		Postgres: "SELECT customer_id, driver_id FROM proxy_reservations WHERE number_id = $1 AND (customer_id = $2 OR driver_id = $3)",
+	}, r.ProxyID, r.CustomerID, r.DriverID)
+	if err != nil {
+		return err
+	}
+	held := false
+	for rows.Next() {
+		var customerID, driverID int
+		if err := rows.Scan(&customerID, &driverID); err != nil {
+			rows.Close()
+			return err
+		}
+		if customerID != r.CustomerID || driverID != r.DriverID {
+			rows.Close()
+			return errProxyTaken
+		}
+		held = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || held {
+		return err
+	}
+	_, err = tx.exec(insertReservation, r.ProxyID, r.CustomerID, r.DriverID)
+	if err != nil && s.IsUniqueViolation(err) {
+		return errProxyTaken
+	}
+	return err
+}
+
+// insertReservation inserts a proxyReservation
+var insertReservation = sqlQuery{
+	SQLite:   "INSERT INTO proxy_reservations (number_id, customer_id, driver_id) VALUES (?, ?, ?)",
+	Postgres: "INSERT INTO proxy_reservations (number_id, customer_id, driver_id) VALUES ($1, $2, $3)",
+}
+
+// InsertRide implements reservationStore
+func (s *sqlStore) InsertRide(ride RideType) (int, error) {
+	return s.insertRide(ride)
+}
+
+// insertRide inserts ride like InsertRide, executing statements in the
+// same transaction
+func (s *sqlStore) insertRide(ride RideType, statements ...dbStatement) (int, error) {
+	var rideID int64
+	err := s.inTx(func(tx sqlTx) error {
+		err := s.reserveProxy(tx, proxyReservation{ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID})
+		if err != nil {
+			return err
+		}
+		rideID, err = tx.insertID(sqlQuery{
+			SQLite:   "INSERT INTO rides (start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, required_tags, labels) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			Postgres: "INSERT INTO rides (start, destination, datetime, customer_id, driver_id, number_id, customer_pin, driver_pin, required_tags, labels) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		},
+			ride.Start,
+			ride.Destination,
+			ride.DateTime,
+			ride.ThisCustomer.ID,
+			ride.ThisDriver.ID,
+			ride.ThisProxyNumber.ID,
+			ride.CustomerPIN,
+			ride.DriverPIN,
+			strings.Join(ride.RequiredTags, ","),
+			strings.Join(ride.Labels, ","),
+		)
+		if err != nil {
+			return err
+		}
+		statements = append(statements,
+			allocationStatement(ride.ThisProxyNumber.ID),
+			pairProxyStatement(ride.ThisCustomer.ID, ride.ThisDriver.ID, ride.ThisProxyNumber.ID),
+		)
+		return tx.execAll(statements...)
+	})
+	return int(rideID), err
+}
+
+// MoveRide implements reservationStore
+func (s *sqlStore) MoveRide(ride RideType, proxy ProxyNumberType) error {
+	return s.moveRide(ride, proxy, time.Now())
+}
+
+// moveRide moves ride to proxy like MoveRide, with its participants
+// releasing their old number at releasedAt, which may be in the future, and
+// executing statements in the same transaction
+func (s *sqlStore) moveRide(ride RideType, proxy ProxyNumberType, releasedAt time.Time, statements ...dbStatement) error {
+	return s.inTx(func(tx sqlTx) error {
+		if err := s.reserveProxy(tx, proxyReservation{proxy.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID}); err != nil {
+			return err
+		}
+		statements = append([]dbStatement{
+			statement(sqlQuery{
+				SQLite:   "UPDATE rides SET number_id = ? WHERE id = ?",
+				Postgres: "UPDATE rides SET number_id = $1 WHERE id = $2",
+			}, proxy.ID, ride.ID),
+			allocationStatement(proxy.ID),
+			pairProxyStatement(ride.ThisCustomer.ID, ride.ThisDriver.ID, proxy.ID),
+			releaseStatement(ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID, releasedAt),
+		}, statements...)
+		return tx.execAll(statements...)
+	})
+}
+
+// heldReservations returns the reservations the rides that aren't over and
+// the live relationships in the database hold
+func heldReservations(tx sqlTx, now time.Time) (map[proxyReservation]bool, error) {
+	held := make(map[proxyReservation]bool)
+	rows, err := tx.query(sqlQuery{
+		SQLite:   "SELECT number_id, customer_id, driver_id FROM rides WHERE status IN (?, ?)",
+		Postgres: "SELECT number_id, customer_id, driver_id FROM rides WHERE status IN ($1, $2)",
+	}, string(rideScheduled), string(rideActive))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var r proxyReservation
+		if err := rows.Scan(&r.ProxyID, &r.CustomerID, &r.DriverID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		held[r] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.query(sqlQuery{
+		SQLite:   "SELECT number_id, customer_id, driver_id, expires_at FROM relationships WHERE ended_at = ''",
+		Postgres: "SELECT number_id, customer_id, driver_id, expires_at FROM relationships WHERE ended_at = ''",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r proxyReservation
+		var rel RelationshipType
+		if err := rows.Scan(&r.ProxyID, &r.CustomerID, &r.DriverID, &rel.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if !rel.expired(now) {
+			held[r] = true
+		}
+	}
+	return held, rows.Err()
+}
+
+// SyncReservations implements reservationStore
+func (s *sqlStore) SyncReservations() error {
+	return s.inTx(func(tx sqlTx) error {
+		// Read the reservations first: a ride inserted after this query is
+		// then seen as held, rather than its reservation as stale
+		reserved := make(map[proxyReservation]int)
+		rows, err := tx.query(sqlQuery{
+			SQLite:   "SELECT id, number_id, customer_id, driver_id FROM proxy_reservations",
+			Postgres: "SELECT id, number_id, customer_id, driver_id FROM proxy_reservations",
+		})
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var r proxyReservation
+			if err := rows.Scan(&id, &r.ProxyID, &r.CustomerID, &r.DriverID); err != nil {
+				rows.Close()
+				return err
+			}
+			reserved[r] = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		held, err := heldReservations(tx, time.Now())
+		if err != nil {
+			return err
+		}
+
+		type participant struct{ ProxyID, ID int }
+		customers := make(map[participant]bool)
+		drivers := make(map[participant]bool)
+		for r, id := range reserved {
+			if !held[r] {
+				_, err := tx.exec(sqlQuery{
+					SQLite:   "DELETE FROM proxy_reservations WHERE id = ?",
+					Postgres: "DELETE FROM proxy_reservations WHERE id = $1",
+				}, id)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			customers[participant{r.ProxyID, r.CustomerID}] = true
+			drivers[participant{r.ProxyID, r.DriverID}] = true
+		}
+		for r := range held {
+			if _, ok := reserved[r]; ok {
+				continue
+			}
+			c, d := participant{r.ProxyID, r.CustomerID}, participant{r.ProxyID, r.DriverID}
+			if customers[c] || drivers[d] {
+				log.Printf("Could not reserve proxy number %d for customer %d and driver %d: it is reserved for one of them with someone else. Run the doctor command to repair it.",
+					r.ProxyID, r.CustomerID, r.DriverID)
+				continue
+			}
+			if _, err := tx.exec(insertReservation, r.ProxyID, r.CustomerID, r.DriverID); err != nil {
+				return err
+			}
+			customers[c] = true
+			drivers[d] = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+)
+
+func TestIsUniqueViolation(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		openTestDB(t, kind)
+		dupNumber := appStore.AddPerson(roleCustomer, Person{Name: "Someone", Number: "319700000"})
+		_, missing := appStore.Setting("nothing")
+		tests := []struct {
+			name string
+			err  error
+			want bool
+		}{
+			{"duplicate number", dupNumber, true},
+			{"wrapped", fmt.Errorf("inserting: %w", dupNumber), true},
+			{"other error", missing, false},
+			{"no error", nil, false},
+		}
+		if kind == "sqlite" {
+			_, dupID := appStore.(*sqlStore).db.Exec("INSERT INTO customers (id, name, number) VALUES (1, 'Someone', '319700099')")
+			tests = append(tests, struct {
+				name string
+				err  error
+				want bool
+			}{"duplicate id", dupID, true})
+		}
+		for _, test := range tests {
+			if got := appStore.IsUniqueViolation(test.err); got != test.want {
+				t.Errorf("%s: IsUniqueViolation(%s: %v) = %v, want %v", kind, test.name, test.err, got, test.want)
+			}
+		}
+	}
+
+	// The errors the PostgreSQL and MySQL drivers return
+	tests := []struct {
+		name            string
+		uniqueViolation func(err error) bool
+		err             error
+		want            bool
+	}{
+		{"postgres unique violation", postgresUniqueViolation, &pgconn.PgError{Code: "23505"}, true},
+		{"postgres wrapped", postgresUniqueViolation, fmt.Errorf("inserting: %w", &pgconn.PgError{Code: "23505"}), true},
+		{"postgres foreign key violation", postgresUniqueViolation, &pgconn.PgError{Code: "23503"}, false},
+		{"mysql duplicate entry", mysqlUniqueViolation, &mysql.MySQLError{Number: 1062}, true},
+		{"mysql lock wait timeout", mysqlUniqueViolation, &mysql.MySQLError{Number: 1205}, false},
+	}
+	for _, test := range tests {
+		if got := test.uniqueViolation(test.err); got != test.want {
+			t.Errorf("%s: IsUniqueViolation = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConcurrentReservations(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		openTestDB(t, kind)
+		const drivers = 8
+		for i := 3; i <= drivers; i++ {
+			if err := appStore.AddPerson(roleDriver, Person{Name: fmt.Sprint("Driver ", i), Number: fmt.Sprint(319700090 + i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dbdata, err := newRideSharingDB(appStore).loadDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Drivers race to book rides on proxy number 1 with customer 1:
+		// only one of them may get it, and the others must be told it was
+		// taken
+		errs := make(chan error, drivers)
+		var start sync.WaitGroup
+		start.Add(1)
+		for driverID := 1; driverID <= drivers; driverID++ {
+			ride := RideType{
+				Start:           "Amsterdam Centraal",
+				Destination:     "Schiphol Airport",
+				DateTime:        "2030-01-02T10:00",
+				ThisCustomer:    dbdata.Customers[1],
+				ThisDriver:      dbdata.Drivers[driverID],
+				ThisProxyNumber: dbdata.ProxyNumbers[1],
+			}
+			go func() {
+				start.Wait()
+				_, err := appStore.InsertRide(ride)
+				errs <- err
+			}()
+		}
+		start.Done()
+
+		reserved := 0
+		for i := 0; i < drivers; i++ {
+			switch err := <-errs; err {
+			case nil:
+				reserved++
+			case errProxyTaken:
+			default:
+				t.Errorf("%s: InsertRide: %v", kind, err)
+			}
+		}
+		if reserved != 1 {
+			t.Errorf("%s: %d drivers reserved the proxy number, want 1", kind, reserved)
+		}
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			t.Fatal(err)
+		}
+		if len(dbdata.Rides) != 1 {
+			t.Errorf("%s: %d rides on the proxy number, want 1", kind, len(dbdata.Rides))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Kinds of relayed ride activity, see recordRideActivity
+const (
+	activityText = "text"
+	activityCall = "call"
+)
+
+// RideActivity is how much the participants of a ride have reached each
+// other through its proxy number. It's counted as texts and calls are
+// relayed, see recordRideActivity, so the ride board can show it without
+// going through the message and call logs.
+type RideActivity struct {
+	Texts    int    // Texts relayed between the participants
+	Calls    int    // Calls transferred between the participants
+	LastText string // When the last text was relayed, RFC 3339; empty if none was
+	LastCall string // When the last call was transferred, RFC 3339; empty if none was
+}
+
+// Last returns when the last text or call was relayed, RFC 3339, or an
+// empty string if none was
+func (a RideActivity) Last() string {
+	// RFC 3339 times in UTC sort as strings
+	if a.LastCall > a.LastText {
+		return a.LastCall
+	}
+	return a.LastText
+}
+
+// rideActivityStore is the part of RideStore that counts the texts and
+// calls relayed in rides
+type rideActivityStore interface {
+	// CountRideActivity counts a text or call, kind, relayed in the ride
+	// with ID rideID at at
+	CountRideActivity(rideID int, kind string, at time.Time) error
+}
+
+// CountRideActivity implements rideActivityStore
+func (s *sqlStore) CountRideActivity(rideID int, kind string, at time.Time) error {
+	q := sqlQuery{
+		SQLite:   "UPDATE rides SET relayed_texts = relayed_texts + 1, last_text_at = ? WHERE id = ?",
+		Postgres: "UPDATE rides SET relayed_texts = relayed_texts + 1, last_text_at = $1 WHERE id = $2",
+	}
+	if kind == activityCall {
+		q = sqlQuery{
+			SQLite:   "UPDATE rides SET relayed_calls = relayed_calls + 1, last_call_at = ? WHERE id = ?",
+			Postgres: "UPDATE rides SET relayed_calls = relayed_calls + 1, last_call_at = $1 WHERE id = $2",
+		}
+	}
+	_, err := s.exec(q, at.UTC().Format(time.RFC3339), rideID)
+	return err
+}
+
+// recordRideActivity counts a text or call, kind, relayed in the ride with
+// ID rideID. Texts and calls outside rides, with rideID 0, aren't counted.
+func recordRideActivity(store RideStore, rideID int, kind string) {
+	if rideID == 0 {
+		return
+	}
+	if err := store.CountRideActivity(rideID, kind, time.Now()); err != nil {
+		log.Printf("Could not count the %s relayed in ride %d: %v", kind, rideID, err)
+	}
+}
+
+// silentRideAfter returns how long a ride under way can go without a text
+// or call before the ride board flags it as silent, set with
+// RIDE_SILENT_AFTER (e.g. "10m")
+func silentRideAfter() time.Duration {
+	return envDuration("RIDE_SILENT_AFTER", 15*time.Minute)
+}
+
+// noisyRideThreshold returns how many texts and calls make the ride board
+// flag a ride as noisy, set with RIDE_NOISY_THRESHOLD
+func noisyRideThreshold() int {
+	return envInt("RIDE_NOISY_THRESHOLD", 30)
+}
+
+// Silent reports whether the ride is under way, from its pickup time until
+// its expected end, but its participants haven't texted or called each
+// other for silentRideAfter, e.g. because the driver can't find the customer
+// and neither reached out
+func (ride RideType) Silent() bool {
+	if ride.Status.Terminal() {
+		return false
+	}
+	start, err := parseRideTime(ride.DateTime)
+	now := time.Now()
+	if err != nil || now.Before(start) || !now.Before(start.Add(rideDuration())) {
+		return false
+	}
+	quietSince := start
+	if last, err := time.Parse(time.RFC3339, ride.Activity.Last()); err == nil && last.After(quietSince) {
+		quietSince = last
+	}
+	return now.Sub(quietSince) >= silentRideAfter()
+}
+
+// Noisy reports whether the participants of the ride have texted and called
+// each other unusually often, e.g. because they are arguing or lost
+func (ride RideType) Noisy() bool {
+	return ride.Activity.Texts+ride.Activity.Calls >= noisyRideThreshold()
+}
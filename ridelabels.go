@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rideFilter selects the rides shown on the dashboard. Empty fields match
+// every ride.
+type rideFilter struct {
+	Label  string     `json:"label,omitempty"`
+	Status RideStatus `json:"status,omitempty"`
+}
+
+// savedFilter is a rideFilter a dashboard user saved under a name
+type savedFilter struct {
+	Name   string     `json:"name"`
+	Filter rideFilter `json:"filter"`
+}
+
+// parseRideFilter returns the filter in the label and status form values
+func parseRideFilter(values url.Values) rideFilter {
+	f := rideFilter{Status: RideStatus(strings.TrimSpace(values.Get("status")))}
+	if labels := parseTags(values.Get("label")); len(labels) > 0 {
+		f.Label = labels[0]
+	}
+	return f
+}
+
+// matches reports whether ride is selected by f
+func (f rideFilter) matches(ride RideType) bool {
+	if f.Status != "" && ride.Status != f.Status {
+		return false
+	}
+	if f.Label == "" {
+		return true
+	}
+	for _, v := range ride.Labels {
+		if v == f.Label {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether f selects some rides rather than all of them
+func (f rideFilter) Active() bool {
+	return f.Label != "" || f.Status != ""
+}
+
+// Query returns f as a dashboard URL query, e.g. "label=airport&status=active"
+func (f rideFilter) Query() string {
+	values := url.Values{}
+	if f.Label != "" {
+		values.Set("label", f.Label)
+	}
+	if f.Status != "" {
+		values.Set("status", string(f.Status))
+	}
+	return values.Encode()
+}
+
+// dashboardUser returns who is using the dashboard, e.g. for their saved
+// filters: the signed-in user, or the HTTP basic auth user, see
+// requireAdmin. Calls to the API act as their API key, e.g. "api key
+// dispatch".
+func dashboardUser(r *http.Request) string {
+	if user, ok := r.Context().Value(sessionUserKey{}).(string); ok {
+		return user
+	}
+	if name := apiKeyName(r); name != "" {
+		return "api key " + name
+	}
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// rideLabelStore is the part of RideStore that keeps the labels of rides
+// and the filters dispatchers saved
+type rideLabelStore interface {
+	// SetRideLabels replaces the labels of the ride with ID rideID
+	SetRideLabels(rideID int, labels []string) error
+	// SavedFilters returns the filters owner saved, by name
+	SavedFilters(owner string) ([]savedFilter, error)
+	// SaveFilter stores f for owner, replacing any filter of theirs with
+	// the same name
+	SaveFilter(owner string, f savedFilter) error
+	// DeleteFilter removes owner's filter called name
+	DeleteFilter(owner string, name string) error
+}
+
+// SetRideLabels implements rideLabelStore
+func (s *sqlStore) SetRideLabels(rideID int, labels []string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "UPDATE rides SET labels = ? WHERE id = ?",
+		Postgres: "UPDATE rides SET labels = $1 WHERE id = $2",
+	}, strings.Join(labels, ","), rideID)
+	return err
+}
+
+// SavedFilters implements rideLabelStore
+func (s *sqlStore) SavedFilters(owner string) ([]savedFilter, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT name, label, status FROM saved_filters WHERE owner = ? ORDER BY name",
+		Postgres: "SELECT name, label, status FROM saved_filters WHERE owner = $1 ORDER BY name",
+	}, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []savedFilter
+	for rows.Next() {
+		var v savedFilter
+		if err := rows.Scan(&v.Name, &v.Filter.Label, &v.Filter.Status); err != nil {
+			return nil, err
+		}
+		filters = append(filters, v)
+	}
+	return filters, rows.Err()
+}
+
+// SaveFilter implements rideLabelStore
+func (s *sqlStore) SaveFilter(owner string, f savedFilter) error {
+	_, err := s.exec(sqlQuery{
+		SQLite: "INSERT INTO saved_filters (owner, name, label, status) VALUES (?, ?, ?, ?) " +
+			"ON CONFLICT (owner, name) DO UPDATE SET label = excluded.label, status = excluded.status",
+		Postgres: "INSERT INTO saved_filters (owner, name, label, status) VALUES ($1, $2, $3, $4) " +
+			"ON CONFLICT (owner, name) DO UPDATE SET label = excluded.label, status = excluded.status",
+		MySQL: "INSERT INTO saved_filters (owner, name, label, status) VALUES (?, ?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE label = VALUES(label), status = VALUES(status)",
+	}, owner, f.Name, f.Filter.Label, string(f.Filter.Status))
+	return err
+}
+
+// DeleteFilter implements rideLabelStore
+func (s *sqlStore) DeleteFilter(owner string, name string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "DELETE FROM saved_filters WHERE owner = ? AND name = ?",
+		Postgres: "DELETE FROM saved_filters WHERE owner = $1 AND name = $2",
+	}, owner, name)
+	return err
+}
+
+// validateSavedFilter checks f before it is saved
+func validateSavedFilter(f savedFilter) error {
+	if f.Name == "" {
+		return fmt.Errorf("the filter needs a name")
+	}
+	if !f.Filter.Active() {
+		return fmt.Errorf("choose a label or status to filter on")
+	}
+	if f.Filter.Status != "" && !f.Filter.Status.known() {
+		return fmt.Errorf("unknown ride status %q", f.Filter.Status)
+	}
+	return nil
+}
+
+// BoardRides returns the rides the dashboard filter selects, by ID
+func (page PageData) BoardRides() []RideType {
+	var rides []RideType
+	for _, v := range page.Rides {
+		if page.Filter.matches(v) {
+			rides = append(rides, v)
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool { return rides[i].ID < rides[j].ID })
+	return rides
+}
+
+// RideLabels returns the sorted labels used by any ride
+func (page PageData) RideLabels() []string {
+	var all []string
+	for _, v := range page.Rides {
+		all = append(all, v.Labels...)
+	}
+	return parseTags(strings.Join(all, ","))
+}
+
+// RideStatuses returns the statuses a ride can have, for the status filter
+func (page PageData) RideStatuses() []RideStatus {
+	return rideStatuses
+}
+
+// renderBoard renders the landing page showing the rides filter selects
+// and the filters its user saved
+func renderBoard(w http.ResponseWriter, r *http.Request, dbdata *RideSharingDB, message string, filter rideFilter) {
+	saved, err := dbdata.store.SavedFilters(dashboardUser(r))
+	if err != nil {
+		log.Println(err)
+		message = fmt.Sprint(err)
+	}
+	renderLandingPage(w, r, PageData{
+		RideSharingDB: *dbdata,
+		Message:       message,
+		Filter:        filter,
+		SavedFilters:  saved,
+	})
+}
+
+// rideLabelsHandler replaces the labels of a ride, e.g. airport or vip
+func rideLabelsHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		message := ""
+		if r.Method == "POST" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			if _, ok := dbdata.Rides[id]; !ok {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Unknown ride %q", r.FormValue("id")))
+				return
+			}
+			if err := dbdata.store.SetRideLabels(id, parseTags(r.FormValue("labels"))); err != nil {
+				log.Println(err)
+				message = fmt.Sprint(err)
+			}
+		}
+
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderBoard(w, r, dbdata, message, parseRideFilter(r.Form))
+	}
+}
+
+// filtersHandler saves the dashboard's current filter under a name, or
+// deletes a saved filter, for the dashboard user
+func filtersHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+			return
+		}
+		message := ""
+		filter := parseRideFilter(r.Form)
+		if r.Method == "POST" {
+			owner := dashboardUser(r)
+			name := strings.TrimSpace(r.FormValue("name"))
+			switch r.FormValue("action") {
+			case "save":
+				f := savedFilter{Name: name, Filter: filter}
+				if err := validateSavedFilter(f); err != nil {
+					message = fmt.Sprint(err)
+				} else if err := dbdata.store.SaveFilter(owner, f); err != nil {
+					log.Println(err)
+					message = fmt.Sprint(err)
+				} else {
+					message = fmt.Sprintf("Filter %q saved.", name)
+				}
+			case "delete":
+				if err := dbdata.store.DeleteFilter(owner, name); err != nil {
+					log.Println(err)
+					message = fmt.Sprint(err)
+				}
+			}
+		}
+		renderBoard(w, r, dbdata, message, filter)
+	}
+}
+
+// filtersAPIHandler lists the admin user's saved filters on GET /api/filters,
+// saves one on POST (form values name, label and status) and deletes one on
+// DELETE /api/filters?name=..., e.g.
+//
+//	{"filters":[{"name":"Airport runs","filter":{"label":"airport","status":"scheduled"}}]}
+func filtersAPIHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := dashboardUser(r)
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			f := savedFilter{Name: strings.TrimSpace(r.FormValue("name")), Filter: parseRideFilter(r.Form)}
+			if err := validateSavedFilter(f); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			if err := store.SaveFilter(owner, f); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "Server encountered an error: %v", err)
+				return
+			}
+		case http.MethodDelete:
+			if err := store.DeleteFilter(owner, r.FormValue("name")); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "Server encountered an error: %v", err)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		filters, err := store.SavedFilters(owner)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		if filters == nil {
+			filters = []savedFilter{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Filters []savedFilter `json:"filters"`
+		}{filters})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// RideStatus is where a ride is in its lifecycle:
+//
+//	scheduled ──> active ──> completed
+//	    │           │
+//	    │           └──────> cancelled
+//	    ├──────────────────> completed
+//	    ├──────────────────> cancelled
+//	    └──────────────────> expired
+//
+// Rides are scheduled when booked and become active when their participants
+// first reach each other through the proxy number. When the ride's time is
+// up, active rides are completed and scheduled ones, which nobody used,
+// expire. Operators can complete or cancel rides before then.
+//
+// Completed, cancelled and expired rides are terminal: they release their
+// proxy number, and texts and calls to it are no longer relayed for them.
+type RideStatus string
+
+// Ride statuses
+const (
+	rideScheduled RideStatus = "scheduled"
+	rideActive    RideStatus = "active"
+	rideCompleted RideStatus = "completed"
+	rideCancelled RideStatus = "cancelled"
+	rideExpired   RideStatus = "expired"
+)
+
+// rideStatuses are all the statuses, in lifecycle order
+var rideStatuses = []RideStatus{rideScheduled, rideActive, rideCompleted, rideCancelled, rideExpired}
+
+// rideStatusInterval is how often the server completes and expires rides whose time is up
+const rideStatusInterval = time.Minute
+
+// rideEndGrace returns how long after a ride's expected end it is completed
+// or expired, for rides that run late. Set RIDE_END_GRACE (e.g. "30m") to
+// override the default of none.
+func rideEndGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RIDE_END_GRACE")); err == nil && d > 0 {
+		return d
+	}
+	return 0
+}
+
+// rideClosedNotifications reports whether participants are texted when their
+// ride is completed or expires because its time is up. Set
+// NOTIFY_RIDE_CLOSED=true to text them.
+func rideClosedNotifications() bool {
+	return os.Getenv("NOTIFY_RIDE_CLOSED") == "true"
+}
+
+// rideTransitions are the statuses each status can move to
+var rideTransitions = map[RideStatus][]RideStatus{
+	rideScheduled: {rideActive, rideCompleted, rideCancelled, rideExpired},
+	rideActive:    {rideCompleted, rideCancelled},
+}
+
+// Terminal reports whether a ride with status s is over
+func (s RideStatus) Terminal() bool {
+	return len(rideTransitions[s]) == 0
+}
+
+// known reports whether s is one of rideStatuses
+func (s RideStatus) known() bool {
+	for _, v := range rideStatuses {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// canBecome reports whether a ride with status s may move to next
+func (s RideStatus) canBecome(next RideStatus) bool {
+	for _, v := range rideTransitions[s] {
+		if v == next {
+			return true
+		}
+	}
+	return false
+}
+
+// rideStore is the part of RideStore that moves rides through their
+// lifecycle
+type rideStore interface {
+	// TransitionRide moves ride to status next, failing if its status
+	// changed since ride was loaded. Rides that reach a terminal status
+	// release their proxy number, see cooldown.go.
+	TransitionRide(ride RideType, next RideStatus) error
+	// DeleteRide deletes the ride with the given ID and the numbers its
+	// participants contacted us from
+	DeleteRide(id int) error
+}
+
+// TransitionRide implements rideStore
+func (s *sqlStore) TransitionRide(ride RideType, next RideStatus) error {
+	return s.inTx(func(tx sqlTx) error {
+		n, err := tx.rowsAffected(sqlQuery{
+			SQLite:   "UPDATE rides SET status = ? WHERE id = ? AND status = ?",
+			Postgres: "UPDATE rides SET status = $1 WHERE id = $2 AND status = $3",
+		}, string(next), ride.ID, string(ride.Status))
+		if err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("ride %d is no longer %s", ride.ID, ride.Status)
+		}
+		if !next.Terminal() {
+			return nil
+		}
+		// Hold the number back from the participants' next rides
+		return tx.execAll(releaseStatement(ride.ThisProxyNumber.ID, ride.ThisCustomer.ID, ride.ThisDriver.ID, time.Now()))
+	})
+}
+
+// DeleteRide implements rideStore
+func (s *sqlStore) DeleteRide(id int) error {
+	return s.inTx(func(tx sqlTx) error {
+		return tx.execAll(
+			statement(sqlQuery{
+				SQLite:   "DELETE FROM ride_contacts WHERE ride_id = ?",
+				Postgres: "DELETE FROM ride_contacts WHERE ride_id = $1",
+			}, id),
+			statement(sqlQuery{
+				SQLite:   "DELETE FROM rides WHERE id = ?",
+				Postgres: "DELETE FROM rides WHERE id = $1",
+			}, id),
+		)
+	})
+}
+
+// transitionRide moves ride to status next. It fails if the transition isn't
+// allowed, or if the ride's status changed since ride was loaded. Rides that
+// reach a terminal status release their proxy number.
+func transitionRide(store RideStore, ride RideType, next RideStatus) error {
+	if !ride.Status.canBecome(next) {
+		return fmt.Errorf("ride %d is %s and can't become %s", ride.ID, ride.Status, next)
+	}
+	if err := store.TransitionRide(ride, next); err != nil {
+		return err
+	}
+	log.Printf("Ride %d is %s", ride.ID, next)
+
+	ride.Status = next
+	notifyRideEvent(eventRideStatusChanged, ride)
+	if next.Terminal() {
+		if err := store.SyncReservations(); err != nil {
+			log.Println(err)
+		}
+		wakeWaitingRides()
+	}
+	return nil
+}
+
+// markRideActive records that the participants of ride reached each other,
+// if it was still scheduled
+func markRideActive(store RideStore, ride RideType) {
+	if ride.ID == 0 || ride.Status != rideScheduled {
+		return
+	}
+	if err := transitionRide(store, ride, rideActive); err != nil {
+		log.Println(err)
+	}
+}
+
+// notifyRideEnded texts both participants of ride the notification template tmpl
+func notifyRideEnded(store RideStore, mb *messagebird.Client, ride RideType, tmpl string) {
+	for _, role := range []string{roleCustomer, roleDriver} {
+		body := renderNotification(store, tmpl, newNotificationData(store, ride, role))
+		sendRideMessage(store, mb, ride.ID, ride.ThisProxyNumber.notificationOriginator(), ride.contactNumber(role), body, nil, "")
+	}
+}
+
+// endRides completes the active rides and expires the scheduled rides whose
+// time, plus the grace period, was up at now, returning how many it ended.
+// Rides with datetimes we can't parse are left alone.
+func endRides(dbdata *RideSharingDB, mb *messagebird.Client, now time.Time) (int, error) {
+	ended := 0
+	for _, v := range dbdata.Rides {
+		start, err := parseRideTime(v.DateTime)
+		if err != nil || v.Status.Terminal() || start.Add(rideDuration()+rideEndGrace()).After(now) {
+			continue
+		}
+		next := rideExpired
+		if v.Status == rideActive {
+			next = rideCompleted
+		}
+		if err := transitionRide(dbdata.store, v, next); err != nil {
+			return ended, err
+		}
+		ended++
+		if rideClosedNotifications() {
+			v.Status = next
+			notifyRideEnded(dbdata.store, mb, v, templateRideClosed)
+		}
+	}
+	return ended, nil
+}
+
+// pollRideStatuses ends rides whose time is up every interval until ctx is
+// done, texting their participants through mb if configured to.
+// It is meant to be run in its own goroutine.
+func pollRideStatuses(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	every(ctx, interval, func() {
+		dbdata, err := newRideSharingDB(store).loadDB()
+		if err != nil {
+			log.Printf("Ride status check: could not load database: %v", err)
+			return
+		}
+		if _, err := endRides(dbdata, mb, time.Now()); err != nil {
+			log.Printf("Ride status check: %v", err)
+		}
+	})
+}
+
+// rideEndNotifications are the templates of the texts telling both
+// participants that an operator ended their ride, by the status it ended with
+var rideEndNotifications = map[RideStatus]string{
+	rideCancelled: templateRideCancelled,
+}
+
+// endRide moves ride, which hasn't ended, to the terminal status next and
+// tells its participants, e.g. when an operator completes or cancels it
+func endRide(store RideStore, mb *messagebird.Client, ride RideType, next RideStatus) error {
+	if err := transitionRide(store, ride, next); err != nil {
+		return err
+	}
+	ride.Status = next
+	if tmpl, ok := rideEndNotifications[next]; ok {
+		notifyRideEnded(store, mb, ride, tmpl)
+	}
+	return nil
+}
+
+// endRideHandler moves a ride that hasn't ended to the terminal status
+// next, see endRide
+func endRideHandler(dbdata *RideSharingDB, mb *messagebird.Client, next RideStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
+			return
+		}
+
+		message := ""
+		if r.Method == "POST" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			ride, ok := dbdata.Rides[id]
+			if !ok {
+				renderLanding(w, r, dbdata, fmt.Sprintf("Unknown ride %q", r.FormValue("id")))
+				return
+			}
+			if err := endRide(dbdata.store, mb, ride, next); err != nil {
+				log.Println(err)
+				message = fmt.Sprint(err)
+			} else {
+				message = fmt.Sprintf("Ride %d %s.", ride.ID, next)
+			}
+		}
+
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderLanding(w, r, dbdata, message)
+	}
+}
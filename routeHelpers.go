@@ -5,7 +5,11 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	messagebird "github.com/messagebird/go-rest-api"
 	"github.com/messagebird/go-rest-api/sms"
@@ -13,80 +17,245 @@ import (
 
 // Helpers
 
-func renderDefaultTemplate(w http.ResponseWriter, thisView string, data interface{}) {
-	renderthis := []string{thisView, "views/layouts/default.gohtml"}
-	t, err := template.ParseFiles(renderthis...)
+func renderDefaultTemplate(w http.ResponseWriter, r *http.Request, thisView string, data interface{}) {
+	renderLayout(w, csrfToken(r), "layouts/default.gohtml", thisView, data)
+}
+
+// renderParticipantTemplate renders pages participants see, which don't
+// carry the admin layout's heading
+func renderParticipantTemplate(w http.ResponseWriter, thisView string, data interface{}) {
+	renderLayout(w, "", "layouts/participant.gohtml", thisView, data)
+}
+
+// renderLayout renders thisView within layout, both from the configured
+// views theme, see views.go. Its forms carry csrfToken.
+func renderLayout(w http.ResponseWriter, csrfToken string, layout string, thisView string, data interface{}) {
+	t, err := views.lookup(layout, thisView)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// The cached view is cloned, as views can't be changed once executed
+	t, err = t.Clone()
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Funcs(template.FuncMap{"csrfField": func() template.HTML { return csrfField(csrfToken) }})
 	err = t.ExecuteTemplate(w, "default", data)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// getAvailableProxyNumber returns the a proxy number not already part of
-// a customer+proxy && driver+proxy combination
-func getAvailableProxyNumber(dbdata *RideSharingDB, customerID int, driverID int) (ProxyNumberType, error) {
-	// If no rides, then return a random Proxy Number.
-	if len(dbdata.Rides) == 0 {
-		// Because Go doesn't read maps in sequence, we can use a for loop to select a random number
-		for _, v := range dbdata.ProxyNumbers {
-			return v, nil
-		}
-		// If we're here, then we've failed to get a proxy number; return error
-		return (ProxyNumberType{}), fmt.Errorf("no available proxy numbers")
+// PageData is the data rendered by views/default/landing.gohtml.
+// It is built for each request so that one user's message never shows up on
+// another user's page.
+type PageData struct {
+	RideSharingDB
+	Message        string        // For misc messages to be displayed in rendered page
+	CaptchaSiteKey string        // Renders a CAPTCHA on the create ride form when set
+	Filter         rideFilter    // Selects the rides shown, see ridelabels.go
+	SavedFilters   []savedFilter // The dashboard user's saved filters
+}
+
+// ProxyTags returns the sorted tags used by any proxy number
+func (page PageData) ProxyTags() []string {
+	var all []string
+	for _, v := range page.ProxyNumbers {
+		all = append(all, v.Tags...)
 	}
+	return parseTags(strings.Join(all, ","))
+}
+
+// DefaultRideTags returns the tags new rides require unless the operator chooses others
+func (page PageData) DefaultRideTags() string {
+	return strings.Join(defaultRideTags(), ", ")
+}
+
+// renderLanding renders the landing page from dbdata with message shown at the top
+func renderLanding(w http.ResponseWriter, r *http.Request, dbdata *RideSharingDB, message string) {
+	renderLandingPage(w, r, PageData{RideSharingDB: *dbdata, Message: message})
+}
 
-	// Checks if []int contains an int
-	containsNumGrp := func(arr [][]int, findme []int) bool {
-		for _, v := range arr {
-			if reflect.DeepEqual(v, findme) {
-				return true
+// renderLandingPage renders the landing page from page
+func renderLandingPage(w http.ResponseWriter, r *http.Request, page PageData) {
+	page.CaptchaSiteKey = os.Getenv("CAPTCHA_SITE_KEY")
+	renderDefaultTemplate(w, r, "landing.gohtml", page)
+}
+
+// proxyAvailable reports whether proxy can be assigned to a new ride between
+// customerID and driverID. Numbers still being ported into our account can't
+// be used yet, and the customer+proxy and driver+proxy combinations must not
+// exist yet in order for our number masking system to work, unless the
+// customer and driver are regular riders on proxy. Numbers either of them
+// released recently are held back, see cooldown.go.
+func proxyAvailable(dbdata *RideSharingDB, customerID int, driverID int, proxy ProxyNumberType) bool {
+	return proxyFree(dbdata, customerID, driverID, proxy, hasRelationshipOn(dbdata, customerID, driverID, proxy.ID))
+}
+
+// proxyFree reports whether proxy can be used between customerID and driverID.
+// If samePair is set, the pair's own rides on proxy don't count against it.
+// Relationships of either of them with someone else on proxy always do.
+func proxyFree(dbdata *RideSharingDB, customerID int, driverID int, proxy ProxyNumberType, samePair bool) bool {
+	if proxy.PortStatus != portStatusActive || coolingDown(dbdata, customerID, driverID, proxy.ID) {
+		return false
+	}
+	now := time.Now()
+	for _, rel := range dbdata.Relationships {
+		if rel.ThisProxyNumber.ID != proxy.ID || rel.expired(now) ||
+			(rel.ThisCustomer.ID == customerID && rel.ThisDriver.ID == driverID) {
+			continue
+		}
+		if rel.ThisCustomer.ID == customerID || rel.ThisDriver.ID == driverID {
+			return false
+		}
+	}
+	for _, ride := range dbdata.Rides {
+		if ride.Status.Terminal() || (samePair && ride.ThisCustomer.ID == customerID && ride.ThisDriver.ID == driverID) {
+			continue
+		}
+		for _, numGrp := range ride.NumGrp {
+			if reflect.DeepEqual(numGrp, []int{customerID, proxy.ID}) || reflect.DeepEqual(numGrp, []int{driverID, proxy.ID}) {
+				return false
 			}
 		}
-		return false
 	}
+	return true
+}
 
-	// rideProxySets is a slice of sets (also a slice) of proxy numbers,
-	// e.g. []int{customerID,proxyNumber} or []int{driverID,proxyNumber}
-	// These sets must be unique in order for our number masking system to work
-	var rideProxySets [][]int
-	for _, v1 := range dbdata.Rides {
-		rideProxySets = append(rideProxySets, v1.NumGrp...)
+// getAvailableProxyNumber returns a proxy number that meets the required tags
+// and is not already part of a customer+proxy && driver+proxy combination.
+// Numbers with a reserved tag are skipped unless required asks for it.
+// The configured ProxySelector picks among the numbers that qualify.
+func getAvailableProxyNumber(dbdata *RideSharingDB, customerID int, driverID int, required []string) (ProxyNumberType, error) {
+	var candidates []ProxyNumberType
+	for _, v := range dbdata.ProxyNumbers {
+		if v.satisfies(required) && !v.reservedFor(required) && proxyAvailable(dbdata, customerID, driverID, v) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) > 0 {
+		sortProxyNumbers(candidates)
+		return proxySelector().Select(dbdata, candidates), nil
 	}
 
-	// Once we have a list of all proxy sets that exist,
-	// we iterate through our list of proxy numbers and
-	// check if sets formed by the current POST request (passed into this function)
-	// can form a proxy set that does not exist yet.
-	for _, v2 := range dbdata.ProxyNumbers {
-		// Check if both customer/driver+proxy number sets do not exist in current proxy sets
-		if !containsNumGrp(rideProxySets, []int{customerID, v2.ID}) && !containsNumGrp(rideProxySets, []int{driverID, v2.ID}) {
-			return v2, nil
+	// If we end up here, then we've failed to get a proxy number
+	return (ProxyNumberType{}), noProxyError{Tags: required}
+}
+
+// selectProxyNumber picks the proxy number for a new ride that requires the
+// given tags. choice is the "proxy" value of the create ride form: empty to
+// pick any suitable number, or "id:<id>" for a specific number, e.g. a
+// reserved premium number.
+func selectProxyNumber(dbdata *RideSharingDB, customerID int, driverID int, choice string, required []string) (ProxyNumberType, error) {
+	if choice == "" {
+		// Regular riders keep their proxy number
+		if rel, ok := findRelationship(dbdata, customerID, driverID); ok {
+			if proxy := rel.ThisProxyNumber; proxy.satisfies(required) && proxyAvailable(dbdata, customerID, driverID, proxy) {
+				return proxy, nil
+			}
 		}
+		// Pairs riding together again keep the number they shared last
+		if proxy, ok := stickyProxy(dbdata, customerID, driverID, required); ok {
+			return proxy, nil
+		}
+		return getAvailableProxyNumber(dbdata, customerID, driverID, required)
+	}
+	if !strings.HasPrefix(choice, "id:") {
+		return (ProxyNumberType{}), fmt.Errorf("invalid proxy selection %q", choice)
+	}
+	proxyID, err := strconv.Atoi(strings.TrimPrefix(choice, "id:"))
+	if err != nil {
+		return (ProxyNumberType{}), fmt.Errorf("invalid proxy selection %q", choice)
+	}
+	proxy, ok := dbdata.ProxyNumbers[proxyID]
+	if !ok {
+		return (ProxyNumberType{}), fmt.Errorf("unknown proxy number id %d", proxyID)
+	}
+	if !proxy.satisfies(required) {
+		return (ProxyNumberType{}), fmt.Errorf("proxy number %s does not have the required tags %s", proxy.Number, strings.Join(required, ", "))
+	}
+	if !proxyAvailable(dbdata, customerID, driverID, proxy) {
+		return (ProxyNumberType{}), fmt.Errorf("proxy number %s is not available for this customer and driver", proxy.Number)
 	}
+	return proxy, nil
+}
 
-	// If we end up here, then we've failed to get a proxy number
-	return (ProxyNumberType{}), fmt.Errorf("no available proxy numbers")
+// rideTimeLayouts are the datetime formats we accept for rides,
+// starting with the format submitted by a datetime-local input
+var rideTimeLayouts = []string{
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	time.RFC3339,
+}
+
+// parseRideTime parses a ride's datetime in the local time zone
+func parseRideTime(datetime string) (time.Time, error) {
+	for _, layout := range rideTimeLayouts {
+		if t, err := time.ParseInLocation(layout, datetime, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse ride date and time %q", datetime)
 }
 
-func checkIfCustomer(dbdata *RideSharingDB, checkme string) bool {
-	for _, v := range dbdata.Customers {
-		if v.Number == checkme {
-			return true
+// rideDuration returns how long we expect a ride to take.
+// Set RIDE_DURATION (e.g. "45m") to override the default of one hour.
+func rideDuration() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RIDE_DURATION")); err == nil && d > 0 {
+		return d
+	}
+	return time.Hour
+}
+
+// findDriverConflict returns an existing ride for driverID that overlaps
+// a new ride starting at start, assuming every ride takes rideDuration.
+// Rides that are over or have datetimes we can't parse are ignored.
+func findDriverConflict(dbdata *RideSharingDB, driverID int, start time.Time) (RideType, bool) {
+	duration := rideDuration()
+	end := start.Add(duration)
+	for _, v := range dbdata.Rides {
+		if v.ThisDriver.ID != driverID || v.Status.Terminal() {
+			continue
+		}
+		otherStart, err := parseRideTime(v.DateTime)
+		if err != nil {
+			continue
+		}
+		if start.Before(otherStart.Add(duration)) && otherStart.Before(end) {
+			return v, true
 		}
 	}
-	return false
+	return RideType{}, false
 }
 
-func checkIfDriver(dbdata *RideSharingDB, checkme string) bool {
-	for _, v := range dbdata.Drivers {
-		if v.Number == checkme {
-			return true
+// findRideParticipant finds the ride using proxyNumber that number belongs to,
+// matching the registered and alternate numbers of its customer and driver.
+// It returns the ride and the role of the participant number belongs to.
+// Regular riders share a proxy number across rides, so their latest ride is
+// picked, or a stand-in for their relationship if they have no ride.
+// Rides that moved off proxyNumber are found within the handoff grace period.
+// Rides that are over are ignored.
+func findRideParticipant(dbdata *RideSharingDB, proxyNumber string, number string) (RideType, string, bool) {
+	var found RideType
+	var role string
+	for _, v := range dbdata.Rides {
+		if v.ThisProxyNumber.Number != proxyNumber || v.ID < found.ID || v.Status.Terminal() {
+			continue
+		}
+		switch {
+		case v.ThisCustomer.hasNumber(number):
+			found, role = v, roleCustomer
+		case v.ThisDriver.hasNumber(number):
+			found, role = v, roleDriver
 		}
 	}
-	return false
+	if role != "" {
+		return found, role, true
+	}
+	if ride, role, ok := findRelationshipParticipant(dbdata, proxyNumber, number); ok {
+		return ride, role, true
+	}
+	return findHandoffParticipant(dbdata, proxyNumber, number)
 }
 
 // mbError handles MessageBird REST API errors
@@ -104,7 +273,20 @@ func mbError(err error) {
 }
 
 // mbSender sends SMS messages
-func mbSender(mb *messagebird.Client, originator string, recipient []string, msgbody string, params *sms.Params) {
+// It returns the ID MessageBird assigned to the message, or an empty string if sending failed.
+// In soft launch mode, recipients outside the allowlist are skipped, and if
+// none are left it returns suppressedMessageID without sending anything.
+// The same goes for recipients who withdrew consent, see consent.go.
+// While MessageBird keeps failing, messages go through the failover
+// provider instead, if one is configured, see failover.go.
+func mbSender(store RideStore, mb *messagebird.Client, originator string, recipient []string, msgbody string, params *sms.Params) string {
+	recipient = consentedRecipients(store, allowedRecipients(recipient))
+	if len(recipient) == 0 {
+		return suppressedMessageID
+	}
+	if failoverSMSProvider != nil && failedOver(time.Now()) {
+		return sendThroughFailover(originator, recipient, msgbody, params)
+	}
 	msg, err := sms.Create(
 		mb,
 		originator,
@@ -115,7 +297,11 @@ func mbSender(mb *messagebird.Client, originator string, recipient []string, msg
 	if err != nil {
 		mbError(err)
 		log.Printf("Could not send sms notification to %s", recipient)
-	} else {
-		log.Print(msg)
+		if failoverSMSProvider != nil && isProviderFailure(err) && recordSMSFailure(time.Now()) {
+			return sendThroughFailover(originator, recipient, msgbody, params)
+		}
+		return ""
 	}
+	log.Print(msg)
+	return msg.ID
 }
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	messagebird "github.com/messagebird/go-rest-api"
 )
@@ -13,112 +15,318 @@ import (
 // loads database int dbdata struct and displays the default view
 func landing(dbdata *RideSharingDB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := dbdata.loadDB()
+		dbdata, err := dbdata.loadDB()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "Server encountered an error: %v", err)
 			return
 		}
-		renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+		renderBoard(w, r, dbdata, "", parseRideFilter(r.URL.Query()))
 	}
 }
 
 // createRideHandler returns a handler that:
 // - loads database into dbdata struct
-// - checks proxy numbers that are not already in use
 // - parses POST requests submitted to this route for new ride
-// - Prepares and executes a SQL statement for the new ride, inserting ride data
-// - sends an sms notification to the customer and driver for that ride
+// - books the ride, see bookRide
 // - reloads database and updates view
-func createRideHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+// Because every ride costs two SMS sends and a proxy number, POST requests
+// are rate limited per user, see rateLimitKey, and, if configured, must pass a CAPTCHA.
+func createRideHandler(dbdata *RideSharingDB, mb *messagebird.Client, limiter *rateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := dbdata.loadDB()
+		dbdata, err := dbdata.loadDB()
 		if err != nil {
 			log.Println(err)
-			dbdata.Message = fmt.Sprint(err)
-			renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
 			return
 		}
 
+		// Shown once the page is re-rendered, e.g. when a ride was created
+		// but its schedule couldn't be checked
+		var warning string
+
 		if r.Method == "POST" {
+			if !limiter.allow(rateLimitKey(r)) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				renderLanding(w, r, dbdata, "You're creating rides too quickly. Please wait a minute and try again.")
+				return
+			}
 			if err := r.ParseForm(); err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
 				return
 			}
-			customerID := r.FormValue("customer")
-			driverID := r.FormValue("driver")
-			startLocation := r.FormValue("start")
-			destinationLocation := r.FormValue("destination")
-			dateTime := r.FormValue("datetime")
+			if captchaEnabled() {
+				if err := verifyCaptcha(r); err != nil {
+					renderLanding(w, r, dbdata, fmt.Sprint(err))
+					return
+				}
+			}
 
 			// Convert ids from form values to ints which are used in our data model
-			// Also to prepare to send SMS notifications to customer and driver for new ride
-			customerIDint, err := strconv.Atoi(customerID)
+			customerIDint, err := strconv.Atoi(r.FormValue("customer"))
 			if err != nil {
-				dbdata.Message = fmt.Sprintf("Something went wrong. Invalid Customer id: %v", err)
-				renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+				renderLanding(w, r, dbdata, fmt.Sprintf("Something went wrong. Invalid Customer id: %v", err))
 				return
 			}
-			driverIDint, err := strconv.Atoi(driverID)
+			driverIDint, err := strconv.Atoi(r.FormValue("driver"))
 			if err != nil {
-				dbdata.Message = fmt.Sprintf("Something went wrong. Invalid Driver id: %v", err)
-				renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+				renderLanding(w, r, dbdata, fmt.Sprintf("Something went wrong. Invalid Driver id: %v", err))
 				return
 			}
+			req := rideRequest{
+				CustomerID:  customerIDint,
+				DriverID:    driverIDint,
+				Start:       r.FormValue("start"),
+				Destination: r.FormValue("destination"),
+				DateTime:    r.FormValue("datetime"),
+				Proxy:       r.FormValue("proxy"),
+				Labels:      parseTags(r.FormValue("labels")),
+			}
+			if _, ok := r.Form["tags"]; ok {
+				req.Tags = parseTags(r.FormValue("tags"))
+			}
 
-			// Check for an available proxy number
-			availableProxy, err := getAvailableProxyNumber(dbdata, customerIDint, driverIDint)
-			if err != nil {
-				dbdata.Message = fmt.Sprintf("We encountered an error: %v", err)
-				log.Println(err)
-				renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+			booking, bookErr := bookRide(dbdata, mb, req)
+			if bookErr != nil {
+				if e, ok := bookErr.(bookingError); ok {
+					w.WriteHeader(e.Status)
+				}
+				if dbdata, err = dbdata.loadDB(); err != nil {
+					log.Println(err)
+				}
+				renderLanding(w, r, dbdata, bookErr.Error())
 				return
 			}
-
-			// Prepare SQL statement for new ride entry and insert into database
-			q := fmt.Sprintf(
-				"INSERT INTO rides (start,destination,datetime,customer_id,driver_id,number_id) VALUES ('%s','%s','%s','%s','%s','%d')",
-				startLocation,
-				destinationLocation,
-				dateTime,
-				customerID,
-				driverID,
-				availableProxy.ID,
-			)
-			query := []string{q}
-			dbInsert(query)
-
-			// Notify this customer
-			mbSender(
-				mb,
-				availableProxy.Number,
-				[]string{dbdata.Customers[customerIDint].Number},
-				fmt.Sprintf("%s will pick you up at %s. Reply to this message to contact the driver.", dbdata.Drivers[driverIDint].Name, dateTime),
-				nil,
-			)
-
-			// Notify this driver
-			mbSender(
-				mb,
-				availableProxy.Number,
-				[]string{dbdata.Drivers[driverIDint].Number},
-				fmt.Sprintf("%s will pick you up at %s. Reply to this message to contact the driver.", dbdata.Customers[customerIDint].Name, dateTime),
-				nil,
-			)
+			warning = booking.Warning
+			if booking.Waiting {
+				warning = strings.TrimSpace("No proxy number is free for this ride, so it is waiting for one. Its customer and driver are texted as soon as it gets one. " + warning)
+			}
 		}
 
 		// Re-load db just before we render the page
-		err = dbdata.loadDB()
+		dbdata, err = dbdata.loadDB()
 		if err != nil {
 			log.Println(err)
-			dbdata.Message = fmt.Sprint(err)
-			renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+			renderLanding(w, r, dbdata, fmt.Sprint(err))
 			return
 		}
+		renderLanding(w, r, dbdata, warning)
+	}
+}
+
+// rideRequest is a ride to book, from the create ride form or the API
+type rideRequest struct {
+	CustomerID  int
+	DriverID    int
+	Start       string
+	Destination string
+	DateTime    string
+	Proxy       string   // The proxy number the operator chose, see selectProxyNumber
+	Tags        []string // Tags the proxy number must have; nil for defaultRideTags
+	Labels      []string
+}
+
+// rideBooking is a ride bookRide booked
+type rideBooking struct {
+	Ride    RideType // Without a proxy number or ID while it is waiting for one
+	Waiting bool     // No proxy number was free, so the ride waits for one, see waitingrides.go
+	Warning string   // For the operator, e.g. that the ride is relay-only; empty if none
+}
+
+// warn adds warning, if any, to the booking's warnings
+func (b *rideBooking) warn(warning string) {
+	if warning == "" {
+		return
+	}
+	if b.Warning != "" {
+		b.Warning += " "
+	}
+	b.Warning += warning
+}
+
+// bookingError is why bookRide couldn't book a ride, as the message to
+// show, with the HTTP status to answer with
+type bookingError struct {
+	Status  int
+	Message string
+}
+
+func (e bookingError) Error() string {
+	return e.Message
+}
+
+// internalBookingError logs err and returns it as a bookingError
+func internalBookingError(err error) bookingError {
+	log.Println(err)
+	return bookingError{http.StatusInternalServerError, fmt.Sprintf("We encountered an error: %v", err)}
+}
+
+// bookRide books req for the create ride form and the API:
+// - checks the customer and driver can be booked, see people.go
+// - checks the driver isn't booked at the same time
+// - checks the customer's and driver's numbers can receive texts, see numberlookup.go
+// - picks a proxy number that is not already in use by either of them
+// - inserts the ride, reserving its proxy number
+// - sends an sms notification to the customer and driver for that ride
+// - warns the operator about flags on the customer and driver, see participantnotes.go
+// - queues the ride if no proxy number is free, see waitingrides.go
+// It reloads dbdata as it goes. Errors are bookingErrors. A ride that
+// consumed the daily ride quota but wasn't booked gives it back.
+func bookRide(dbdata *RideSharingDB, mb *messagebird.Client, req rideRequest) (booking rideBooking, err error) {
+	if err := bookable(dbdata, req.CustomerID, req.DriverID); err != nil {
+		return booking, bookingError{http.StatusBadRequest, fmt.Sprintf("Ride not created: %v", err)}
+	}
+
+	// Make sure the driver isn't already booked for this time.
+	// If we can't tell, create the ride anyway but warn the operator.
+	if start, err := parseRideTime(req.DateTime); err != nil {
+		booking.Warning = fmt.Sprintf("Ride created, but we could not check %s's schedule for conflicts: %v", dbdata.Drivers[req.DriverID].Name, err)
+	} else if conflict, ok := findDriverConflict(dbdata, req.DriverID, start); ok {
+		return booking, bookingError{http.StatusConflict, fmt.Sprintf(
+			"%s already has ride %d (%s to %s) at %s, which overlaps this ride.",
+			conflict.ThisDriver.Name, conflict.ID, conflict.Start, conflict.Destination, conflict.DateTime,
+		)}
+	}
+
+	// Check for an available proxy number meeting the ride's required tags,
+	// or the one the operator chose
+	requiredTags := req.Tags
+	if requiredTags == nil {
+		requiredTags = defaultRideTags()
+	}
+
+	// Reserve the proxy number and insert the ride in one transaction.
+	// If a concurrent request took the number for our customer or
+	// driver first, reload and pick another.
+	ride := RideType{
+		Start:        req.Start,
+		Destination:  req.Destination,
+		DateTime:     req.DateTime,
+		ThisCustomer: dbdata.Customers[req.CustomerID],
+		ThisDriver:   dbdata.Drivers[req.DriverID],
+		RequiredTags: requiredTags,
+		Labels:       req.Labels,
+		Status:       rideScheduled,
+	}
+	// Participants who can't receive texts would never hear about the ride
+	if numberLookupEnabled() {
+		if err := checkRideNumbers(mb, ride); err != nil {
+			return booking, bookingError{http.StatusBadRequest, fmt.Sprintf("Ride not created: %v", err)}
+		}
+	}
+	day, admitted := quotaDay(time.Now()), false
+	defer func() {
+		if err != nil && admitted {
+			refundQuota(dbdata, day, quotaRides)
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		ride.ThisProxyNumber, err = selectProxyNumber(dbdata, req.CustomerID, req.DriverID, req.Proxy, requiredTags)
+		if _, ok := err.(noProxyError); ok {
+			// The ride waits for a number to free up, see waitingrides.go
+			log.Println(err)
+			alertIfPoolExhausted(dbdata.store, mb, err, "a new ride", RideType{})
+			if attempt == 1 {
+				if err := admitRide(dbdata, day); err != nil {
+					return booking, err
+				}
+				admitted = true
+			}
+			if err := queueRide(dbdata.store, ride); err != nil {
+				return booking, internalBookingError(err)
+			}
+			booking.Ride, booking.Waiting = ride, true
+			booking.warn(flagsNotice(ride))
+			return booking, nil
+		}
+		if err != nil {
+			return booking, internalBookingError(err)
+		}
+
+		// PINs let participants reach each other from a phone other than their registered one
+		ride.CustomerPIN, ride.DriverPIN, err = newRidePINs(dbdata, ride.ThisProxyNumber.ID)
+		if err != nil {
+			return booking, internalBookingError(err)
+		}
+
+		if attempt == 1 {
+			if err := admitRide(dbdata, day); err != nil {
+				return booking, err
+			}
+			admitted = true
+		}
+
+		// Insert the new ride into the database
+		ride.ID, err = dbdata.store.InsertRide(ride)
+		if err != errProxyTaken || attempt == rideAttempts {
+			break
+		}
+		log.Printf("Proxy number %s was taken by another ride, picking another", ride.ThisProxyNumber.Number)
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		return booking, internalBookingError(err)
+	}
+	booking.warn(startRide(dbdata, mb, ride))
+	booking.warn(flagsNotice(ride))
+	booking.Ride = ride
+	return booking, nil
+}
+
+// admitRide checks the cap on new rides and the tenant's ride quota for
+// day, consuming one ride of it, returning a bookingError saying why if the
+// ride can't be created
+func admitRide(dbdata *RideSharingDB, day string) error {
+	if capped, limit, err := allocationCapReached(dbdata.store); err != nil {
+		return internalBookingError(err)
+	} else if capped {
+		return bookingError{http.StatusTooManyRequests, fmt.Sprintf("Proxy numbers are being allocated unusually fast, so new rides are capped at %d per %s. Please try again later.", limit, allocationWindow())}
+	}
+	if ok, err := consumeQuota(dbdata, day, quotaRides); err != nil {
+		return internalBookingError(err)
+	} else if !ok {
+		return bookingError{http.StatusTooManyRequests, fmt.Sprintf("The daily quota of %d rides has been reached. Please try again tomorrow.", quotaLimit(quotaRides))}
+	}
+	return nil
+}
 
-		renderDefaultTemplate(w, "views/landing.gohtml", dbdata)
+// startRide renews the relationship of regular riders riding on their
+// number and texts the participants of ride, which was just inserted with
+// its proxy number. It returns a warning for the operator if the ride is
+// relay-only, or an empty string.
+func startRide(dbdata *RideSharingDB, mb *messagebird.Client, ride RideType) string {
+	availableProxy := ride.ThisProxyNumber
+	var warning string
+	if !availableProxy.canCall() {
+		warning = fmt.Sprintf("Ride is relay-only: proxy number %s can't receive calls, so participants can only reach each other by SMS.", availableProxy.Number)
 	}
+
+	// Every ride between regular riders keeps their relationship going
+	if rel, ok := findRelationship(dbdata, ride.ThisCustomer.ID, ride.ThisDriver.ID); ok && rel.ThisProxyNumber.ID == availableProxy.ID {
+		from := time.Now()
+		if start, err := parseRideTime(ride.DateTime); err == nil && start.After(from) {
+			from = start
+		}
+		if err := renewRelationship(dbdata.store, rel, from); err != nil {
+			log.Println(err)
+		}
+	}
+
+	originator := availableProxy.notificationOriginator()
+
+	// Notify this customer
+	customerMsg := renderNotification(dbdata.store, templateRideCreatedCustomer, newNotificationData(dbdata.store, ride, roleCustomer))
+	sendRideMessage(dbdata.store, mb, ride.ID, originator, ride.ThisCustomer.Number, customerMsg, nil, "")
+
+	// Notify this driver
+	driverMsg := renderNotification(dbdata.store, templateRideCreatedDriver, newNotificationData(dbdata.store, ride, roleDriver))
+	sendRideMessage(dbdata.store, mb, ride.ID, originator, ride.ThisDriver.Number, driverMsg, nil, "")
+
+	notifyRideEvent(eventRideCreated, ride)
+	return warning
 }
 
 /* This is the shape of the r.Form submitted when MessageBird forwards an SMS as a POST request to a URL.
@@ -129,14 +337,10 @@ map[message_id:[7a76afeaef3743d28d0e2d93621235ca] originator:[16132093477] refer
 // This handler:
 // - Loads the database into dbdata struct
 // - Checks if we're receiving a POST request
-// - If we're receiving a post request,
-// -- Loop through rides in dbdata and checks if we're receiving this message from a valid proxy number.
-// -- If proxy number is valid, check sender is a customer or driver
-// -- If proxy number is not valid, display an error
-// -- If we can't find the sender in our customer or driver database, display an error
+// - If we're receiving a post request, relays the message, see relayInboundText
 func messageHookHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := dbdata.loadDB()
+		dbdata, err := dbdata.loadDB()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "Server encountered an error: %v", err)
@@ -145,53 +349,177 @@ func messageHookHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.Hand
 
 		if r.Method == "POST" {
 			// Read response from MessageBird REST API servers
-			if err := r.ParseForm(); err != nil {
+			msg, err := parseInboundSMS(r)
+			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				fmt.Fprintf(w, "Invalid inbound sms. error: %v", err)
 				return
 			}
-			originator := r.FormValue("originator")
-			receiver := r.FormValue("receiver")
-			payload := r.FormValue("payload")
-
-			// Check rides for proxy number used
-			// Proxy number should be unique in list of rides
-			for _, v := range dbdata.Rides {
-				if v.ThisProxyNumber.Number == receiver {
-					switch {
-					case checkIfCustomer(dbdata, originator):
-						// forward message to driver
-						mbSender(
-							mb,
-							receiver,
-							[]string{v.ThisDriver.Number},
-							payload,
-							nil,
-						)
-						return
-					case checkIfDriver(dbdata, originator):
-						// forward message to customer
-						mbSender(
-							mb,
-							receiver,
-							[]string{v.ThisCustomer.Number},
-							payload,
-							nil,
-						)
-						return
-					default:
-						log.Printf("Could not find ride for customer/driver %s that uses proxy %s", originator, receiver)
-					}
-				} else {
-					log.Printf("Unknown proxy number: %s", receiver)
+			// MessageBird retries webhooks; relay each message once. If we
+			// can't tell, relaying twice beats dropping the message.
+			if id := msg.dedupKey(); id != "" {
+				first, err := firstDelivery(dbdata.store, id)
+				if err != nil {
+					log.Printf("Could not check whether sms %s was already processed: %v", id, err)
+				} else if !first {
+					log.Printf("Skipping sms %s from %s: already processed", id, msg.Originator)
+					fmt.Fprint(w, "OK")
+					return
 				}
 			}
+			relayInboundText(r, dbdata, mb, msg)
 			// Return any response, MessageBird won't parse this
 			fmt.Fprint(w, "OK")
 		}
 	}
 }
 
+// relayInboundText handles a text a participant sent us, on any channel:
+// - Find the ride using this proxy number whose customer or driver sent the message
+// - If the sender isn't part of a ride, check whether the message starts with a ride PIN
+// - Forward the message to the other participant of that ride, on the channel they last texted on
+// - Moderators (see moderation.go) may block or change the message first
+// - If the sender observes a ride on this proxy number with a guest link, forward the message to its driver
+// - If the sender's ride on this proxy number ended recently, tell them the conversation ended
+// - If we can't find a ride for the sender, apply the unknown sender policy (see unknownsenders.go)
+// Replies to the sender go on the channel the text came in on.
+func relayInboundText(r *http.Request, dbdata *RideSharingDB, mb *messagebird.Client, msg InboundSMS) {
+	originator := msg.Originator
+	receiver := msg.Receiver
+	payload := msg.Payload
+
+	// Self-test messages only prove the webhook is reachable
+	if key, ok := smsProbeKey(payload); ok && probes.complete(key) {
+		log.Printf("Self-test sms from %s to %s received", originator, receiver)
+		return
+	}
+
+	// Don't relay through numbers that can't send SMS
+	if proxy, ok := findProxyNumber(dbdata, receiver); ok && !proxy.canSMS() {
+		log.Printf("Ignoring sms from %s: proxy %s can't send SMS", originator, receiver)
+		return
+	}
+
+	// Participants can opt out of (and back into) announcements
+	// by texting a keyword to any proxy number
+	switch strings.ToUpper(strings.TrimSpace(payload)) {
+	case optOutKeyword:
+		if err := setOptOut(dbdata.store, originator, true); err != nil {
+			log.Println(err)
+		}
+		reply := "You will no longer receive BirdCar announcements. Reply START to resubscribe."
+		replyTo(dbdata.store, mb, msg, 0, reply)
+		return
+	case optInKeyword:
+		if err := setOptOut(dbdata.store, originator, false); err != nil {
+			log.Println(err)
+		}
+		reply := "You are subscribed to BirdCar announcements again."
+		replyTo(dbdata.store, mb, msg, 0, reply)
+		return
+	}
+
+	// Drivers clock in and out by texting a keyword to the shift number or
+	// any proxy number
+	if handleShiftText(dbdata, mb, msg) {
+		return
+	}
+
+	// Participants can ask for a link to their preferences page
+	if strings.ToUpper(strings.TrimSpace(payload)) == preferencesKeyword {
+		reply := preferencesReply(dbdata.store, r, originator)
+		replyTo(dbdata.store, mb, msg, 0, reply)
+		return
+	}
+
+	// Participants can choose the language of our messages, e.g. "LANGUAGE NL"
+	if lang, ok := parseLanguageRequest(payload); ok {
+		reply := fmt.Sprintf("Sorry, we don't have messages in %q yet.", lang)
+		if supportedLanguage(lang) {
+			if err := dbdata.store.SetLanguage(originator, lang); err != nil {
+				log.Println(err)
+			}
+			reply = languageSetReply(lang)
+		}
+		replyTo(dbdata.store, mb, msg, 0, reply)
+		return
+	}
+
+	// Find the ride the sender belongs to on this proxy number.
+	// Participants texting from another phone start their message with their ride PIN.
+	ride, role, ok := findRideParticipant(dbdata, receiver, originator)
+	if !ok {
+		if pin, rest := splitPINPrefix(payload); pin != "" {
+			if ride, role, ok = findRideByPIN(dbdata, receiver, pin); ok {
+				payload = rest
+			}
+		}
+	}
+	if !ok && relayObserverText(r, dbdata, mb, msg) {
+		// Guests following the ride reach its driver, see observers.go
+		return
+	}
+	if ok {
+		logMessage(dbdata.store, ride.ID, directionInbound, msg.ID, originator, receiver, msg.Payload)
+		// Replies from the other participant go to the phone this message came from
+		recordTextedFrom(dbdata.store, ride, role, originator, msg.channel())
+		if muted, isMute := parseMuteRequest(payload); isMute {
+			// Pause or resume texts from the other participant, who isn't told
+			reply := muteReply(role, muted)
+			if err := setMuted(dbdata.store, ride, role, muted); err != nil {
+				log.Println(err)
+				reply = "Sorry, something went wrong. Please try again."
+			}
+			replyTo(dbdata.store, mb, msg, ride.ID, reply)
+		} else if isStatusRequest(payload) {
+			// Answer with the ride details without bothering the other participant
+			reply := rideStatusReply(dbdata.store, ride, role)
+			replyTo(dbdata.store, mb, msg, ride.ID, reply)
+		} else if payload != "" && ride.muted(otherRole(role)) {
+			log.Printf("Not relaying message %s for ride %d: the %s muted the %s", msg.ID, ride.ID, otherRole(role), role)
+		} else if payload != "" && !relayQuotaLeft(dbdata) {
+			log.Printf("Not relaying message %s for ride %d: the daily quota of %d relays has been reached", msg.ID, ride.ID, quotaLimit(quotaRelays))
+		} else if payload != "" {
+			// Operators' content policies may block or change the text
+			if body, ok := moderateRelay(dbdata.store, mb, msg, ride, role, payload); ok {
+				forwardTo := ride.contactNumber(otherRole(role))
+				id := sendRideMessage(dbdata.store, mb, ride.ID, ride.ThisProxyNumber.Number, forwardTo, body, deliveryReportParams(), originator)
+				if id == heldMessageID {
+					// Let the sender know their message will arrive late
+					reply := renderNotification(dbdata.store, templateMaintenance, newNotificationData(dbdata.store, ride, role))
+					replyTo(dbdata.store, mb, msg, ride.ID, reply)
+				} else if id == "" {
+					notifyDeliveryFailure(dbdata.store, mb, ride, originator)
+				} else {
+					markRideActive(dbdata.store, ride)
+					notifyRideEvent(eventMessageRelayed, ride)
+				}
+			}
+		}
+		if receiver != ride.ThisProxyNumber.Number {
+			// The ride was handed off to a new proxy number; remind the sender to use it
+			reply := renderNotification(dbdata.store, templateProxyChanged, newNotificationData(dbdata.store, ride, role))
+			replyTo(dbdata.store, mb, msg, ride.ID, reply)
+		}
+	} else if releasedParticipant(dbdata, receiver, originator) {
+		// Late texts for a ride that ended recently
+		logMessage(dbdata.store, 0, directionInbound, msg.ID, originator, receiver, msg.Payload)
+		data := newNotificationData(dbdata.store, RideType{}, "")
+		data.Language = participantLanguage(dbdata.store, originator)
+		reply := renderNotification(dbdata.store, templateConversationEnded, data)
+		replyTo(dbdata.store, mb, msg, 0, reply)
+	} else {
+		handleUnknownSender(dbdata, mb, msg)
+	}
+}
+
+// replyTo answers msg with body on the channel it came in on, logging the
+// reply with the ride it is about, if any
+func replyTo(store RideStore, mb *messagebird.Client, msg InboundSMS, rideID int, body string) {
+	id := sendText(store, mb, msg.channel(), msg.Receiver, msg.Originator, body, nil)
+	logMessage(store, rideID, directionOutbound, id, msg.Receiver, msg.Originator, body)
+}
+
 /* This is the shape of the r.Form submitted when MessageBird forwards a call as a GET request to a URL.
 map[callID:[2894efe1-63b7-4d37-b006-3aab7fcd4d49] destination:[14708000894] numberID:[272cca7c-c2d6-4781-9e92-168ba0520639] source:[Restricted] variables:[{}]]
 */
@@ -202,59 +530,130 @@ map[callID:[2894efe1-63b7-4d37-b006-3aab7fcd4d49] destination:[14708000894] numb
 // - load database into dbdata struct
 // - Parse form data submitted via GET request
 // - Check rides for proxy number being called by caller
-// - Check if caller is a customer or driver, and load the appropriate number to forward the call to
+// - Check if caller is the customer or driver of that ride, and load the other participant's number to forward the call to
+// - If the caller observes the ride with a guest link, forward the call to the driver
+// - If the caller withheld their number or isn't part of the ride, ask them to key in their number or ride PIN and fetch this call flow again
+// - If the customer calls with flash calls on, wait to see whether they hang up and text them the ride status if so, see flashcalls.go
 // - If we can't find the proxy number, customer number, or driver number, answer the call with message that call has failed
 // - If we successfully find the customer or driver number, forward the call to that number.
-func voiceHookHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+func voiceHookHandler(dbdata *RideSharingDB, mb *messagebird.Client, prompts voicePrompts) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// XML-only response
 		w.Header().Set("Content-Type", "application/xml")
 
-		err := dbdata.loadDB()
+		dbdata, err := dbdata.loadDB()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "Server encountered an error: %v", err)
 			return
 		}
 
-		if err := r.ParseForm(); err != nil {
+		call, err := parseInboundCall(r)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+			fmt.Fprintf(w, "Invalid inbound call. error: %v", err)
+			return
+		}
+		proxyNumber := call.Destination
+		caller := call.Source
+		// Prompts are spoken to the caller, in their language if we know it
+		callerPrompts := prompts.forLanguage(defaultLanguage())
+		if !isWithheldCaller(caller) {
+			callerPrompts = prompts.forLanguage(participantLanguage(dbdata.store, caller))
+		}
+
+		// Self-test calls only prove the webhook is reachable
+		if probes.complete(callProbeKey(caller, proxyNumber)) {
+			log.Printf("Self-test call %s from %s to %s received", call.CallID, caller, proxyNumber)
+			fmt.Fprint(w, hangupXML())
+			return
+		}
+
+		if maintenanceOn(dbdata.store) {
+			log.Printf("Maintenance mode: not routing call %s from %s", call.CallID, caller)
+			fmt.Fprint(w, callerPrompts.maintenanceXML())
+			return
+		}
+
+		// Relay-only proxy numbers don't take calls
+		if proxy, ok := findProxyNumber(dbdata, proxyNumber); ok && !proxy.canCall() {
+			log.Printf("Rejecting call %s from %s: proxy %s can't take calls", call.CallID, caller, proxyNumber)
+			fmt.Fprint(w, callerPrompts.failXML())
 			return
 		}
-		proxyNumber := r.FormValue("destination")
-		caller := r.FormValue("source")
-
-		var forwardToThisNumber string
-
-		transactionFailXML := fmt.Sprint("<?xml version='1.0' encoding='UTF-8'?>" +
-			"<Say language='en-GB' voice='female'>Sorry, we cannot identify your transaction. " +
-			"Please make sure you have call in from the number you registered.</Say><Hangup />")
-
-		for _, v := range dbdata.Rides {
-			if v.ThisProxyNumber.Number == proxyNumber {
-				switch {
-				case checkIfCustomer(dbdata, caller):
-					// Forward call to driver
-					forwardToThisNumber = v.ThisDriver.Number
-				case checkIfDriver(dbdata, caller):
-					// Forward call to customer
-					forwardToThisNumber = v.ThisCustomer.Number
-				default:
-					// Speaks transaction fail message and returns
-					fmt.Fprint(w, transactionFailXML)
-					log.Printf("Transfer to %s failed.", forwardToThisNumber)
+
+		// Forward the call to the other participant of the ride using this proxy number.
+		// Callers who withhold their number or call from another phone are asked to
+		// key in their registered number or ride PIN instead.
+		var ride RideType
+		var role string
+		ok := false
+		if !isWithheldCaller(caller) {
+			ride, role, ok = findRideParticipant(dbdata, proxyNumber, caller)
+			if !ok && releasedParticipant(dbdata, proxyNumber, caller) {
+				log.Printf("Call %s from %s to %s came in after their ride on it ended", call.CallID, caller, proxyNumber)
+				fmt.Fprint(w, callerPrompts.endedXML())
+				return
+			}
+			if !ok {
+				// Guests following the ride reach its driver, see observers.go
+				if ride, observer, found := findRideObserver(dbdata, proxyNumber, caller); found {
+					fmt.Fprint(w, routeObserverCall(dbdata.store, ride, observer, call, callerPrompts))
 					return
 				}
-			} else {
-				// Speaks transaction fail message and returns
-				fmt.Fprint(w, transactionFailXML)
-				log.Printf("Transfer to %s failed.", forwardToThisNumber)
+			}
+		}
+		if !ok {
+			entered, asked := call.Variables[identityVar]
+			if !asked {
+				log.Printf("Could not identify caller %s on call %s to %s, asking caller to identify", caller, call.CallID, proxyNumber)
+				fmt.Fprint(w, callerPrompts.identifyCallerXML(webhookURL(r, voiceWebhookPath(dbdata.webhookToken))))
+				return
+			}
+			ride, role, ok = findRideByPIN(dbdata, proxyNumber, strings.TrimRight(entered, "#"))
+			if !ok {
+				ride, role, ok = findRideParticipant(dbdata, proxyNumber, enteredNumber(entered))
+			}
+		}
+		if !ok {
+			if line := operatorLine(); line != "" && sendAllowed(line) {
+				// Logged against the proxy number, with no ride, for follow-up
+				logCall(dbdata.store, 0, call, line)
+				log.Printf("Could not find ride for caller %s that uses proxy %s, transferring call to the operator line", caller, proxyNumber)
+				fmt.Fprint(w, callerPrompts.operatorXML(line))
 				return
 			}
+			// Speaks transaction fail message and returns
+			fmt.Fprint(w, callerPrompts.failXML())
+			log.Printf("Could not find ride for caller %s that uses proxy %s", caller, proxyNumber)
+			return
+		}
+		if !isWithheldCaller(caller) {
+			// Relay replies in this ride to the phone the caller is using
+			recordLastUsed(dbdata.store, ride, role, caller)
+		} else {
+			callerPrompts = prompts.forLanguage(participantLanguage(dbdata.store, ride.contactNumber(role)))
+		}
+		// Customers who hang up within the flash call window get the ride status by text
+		if role == roleCustomer && !isWithheldCaller(caller) && startFlashCall(dbdata, w, r, mb, ride, call) {
+			return
+		}
+		forwardToThisNumber := ride.contactNumber(otherRole(role))
+		if !sendAllowed(forwardToThisNumber) {
+			fmt.Fprint(w, callerPrompts.failXML())
+			return
+		}
+		if textsOnly(dbdata.store, forwardToThisNumber) {
+			log.Printf("Not transferring call %s: %s only takes texts", call.CallID, forwardToThisNumber)
+			fmt.Fprint(w, callerPrompts.textsOnlyXML())
+			return
 		}
+		logCall(dbdata.store, ride.ID, call, forwardToThisNumber)
+		recordProviderNumberID(dbdata.store, ride.ThisProxyNumber, call.NumberID)
+		markRideActive(dbdata.store, ride)
+		notifyRideEvent(eventCallRouted, ride)
 		// If we get to this point, assume all is in order and attempt to transfer the call
 		log.Println("Transferring call to ", forwardToThisNumber)
-		fmt.Fprintf(w, "<?xml version='1.0' encoding='UTF-8'?><Transfer destination='%s' make='true' />", forwardToThisNumber)
+		fmt.Fprint(w, callerPrompts.transferXML(forwardToThisNumber))
 	}
 }
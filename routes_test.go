@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+func TestCreateRideHandlerRendersRejectedBookings(t *testing.T) {
+	openTestDB(t, "memory")
+	handler := createRideHandler(newRideSharingDB(appStore), messagebird.New("test"), newRateLimiter(10))
+
+	form := url.Values{
+		"customer":    {"99"},
+		"driver":      {"1"},
+		"start":       {"Amsterdam Centraal"},
+		"destination": {"Schiphol Airport"},
+		"datetime":    {"2030-01-02T10:00"},
+	}
+	r := httptest.NewRequest("POST", "/createride", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "Ride not created") {
+		t.Errorf("page doesn't say the ride wasn't created:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schemaCacheTTL is how long the columns of a table are remembered. Columns
+// another server's migration added are read once it has passed.
+const schemaCacheTTL = time.Minute
+
+// cachedColumns are the columns of a table, as of when they were read
+type cachedColumns struct {
+	Columns map[string]bool
+	ReadAt  time.Time
+}
+
+var (
+	// schemaMu guards schemaCache
+	schemaMu sync.Mutex
+	// schemaCache holds the columns of the tables read by selectColumns, by
+	// database and table
+	schemaCache = make(map[*sql.DB]map[string]cachedColumns)
+)
+
+// tableColumns returns the columns table has in s
+func (s *sqlStore) tableColumns(table string) (map[string]bool, error) {
+	schemaMu.Lock()
+	cached, ok := schemaCache[s.db][table]
+	schemaMu.Unlock()
+	if ok && time.Since(cached.ReadAt) < schemaCacheTTL {
+		return cached.Columns, nil
+	}
+
+	rows, err := s.db.Query("SELECT * FROM " + table + " LIMIT 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]bool)
+	for _, v := range names {
+		columns[strings.ToLower(v)] = true
+	}
+
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	if schemaCache[s.db] == nil {
+		schemaCache[s.db] = make(map[string]cachedColumns)
+	}
+	schemaCache[s.db][table] = cachedColumns{columns, time.Now()}
+	return columns, nil
+}
+
+// forgetSchema drops the cached columns, e.g. after migrating
+func forgetSchema() {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	schemaCache = make(map[*sql.DB]map[string]cachedColumns)
+}
+
+// sharedColumns returns the columns tables a and b both have in s, sorted,
+// e.g. to copy rows from a to b while a rolling deploy has added a column
+// to only one of them so far
+func (s *sqlStore) sharedColumns(a string, b string) ([]string, error) {
+	columnsA, err := s.tableColumns(a)
+	if err != nil {
+		return nil, err
+	}
+	columnsB, err := s.tableColumns(b)
+	if err != nil {
+		return nil, err
+	}
+	var shared []string
+	for v := range columnsA {
+		if columnsB[v] {
+			shared = append(shared, v)
+		}
+	}
+	sort.Strings(shared)
+	return shared, nil
+}
+
+// scanColumn is a column selectColumns reads, with where to scan it to
+type scanColumn struct {
+	Name string
+	Dest interface{}
+}
+
+// selectColumns queries the given columns of table, followed by rest, e.g.
+// "WHERE id > ?", and returns the rows with what to scan each of them
+// into. Columns the schema doesn't have yet are left out, so their
+// destinations keep their value: reset them before scanning each row.
+// Columns that aren't named are never read, so columns a newer release
+// added don't break older ones.
+func (s *sqlStore) selectColumns(table string, columns []scanColumn, rest sqlQuery, args ...interface{}) (*sql.Rows, []interface{}, error) {
+	have, err := s.tableColumns(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	var dests []interface{}
+	for _, c := range columns {
+		if have[c.Name] {
+			names = append(names, c.Name)
+			dests = append(dests, c.Dest)
+		}
+	}
+	// Only identifiers known to the schema are spliced into the query
+	q := "SELECT " + strings.Join(names, ", ") + " FROM " + table
+	if rest := s.text(rest); rest != "" {
+		q += " " + rest
+	}
+	rows, err := s.db.Query(q, args...)
+	return rows, dests, err
+}
+
+// scanEach scans rows into dest one at a time, calling reset before and each
+// after every row, and closes rows. Rows that don't scan are logged and kept,
+// with the columns that did scan.
+func scanEach(rows *sql.Rows, dest []interface{}, reset func(), each func()) error {
+	defer rows.Close()
+	for rows.Next() {
+		reset()
+		if err := rows.Scan(dest...); err != nil {
+			log.Println(err)
+		}
+		each()
+	}
+	return rows.Err()
+}
+
+// selectEach queries the given columns of table like selectColumns, and
+// scans the rows with scanEach
+func (s *sqlStore) selectEach(table string, columns []scanColumn, rest sqlQuery, reset func(), each func(), args ...interface{}) error {
+	rows, dest, err := s.selectColumns(table, columns, rest, args...)
+	if err != nil {
+		return err
+	}
+	return scanEach(rows, dest, reset, each)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/voice"
+)
+
+// selfTestTimeout is how long a self-test waits for the webhook round trip
+const selfTestTimeout = time.Minute
+
+// selfTestPrefix starts the body of self-test SMS messages
+const selfTestPrefix = "BirdCar self-test "
+
+// probeRegistry tracks self-tests waiting for MessageBird to call our webhooks
+type probeRegistry struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+// probes holds the self-tests in progress
+var probes = probeRegistry{pending: make(map[string]chan struct{})}
+
+// start registers a probe and returns a channel that is closed when it completes
+func (p *probeRegistry) start(key string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done := make(chan struct{})
+	p.pending[key] = done
+	return done
+}
+
+// complete marks the probe with key as completed, reporting whether one was waiting
+func (p *probeRegistry) complete(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done, ok := p.pending[key]
+	if ok {
+		close(done)
+		delete(p.pending, key)
+	}
+	return ok
+}
+
+// cancel forgets the probe with key, e.g. after it timed out
+func (p *probeRegistry) cancel(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, key)
+}
+
+// smsProbeKey returns the probe key for a self-test SMS body, if it is one
+func smsProbeKey(payload string) (string, bool) {
+	if !strings.HasPrefix(payload, selfTestPrefix) {
+		return "", false
+	}
+	return "sms:" + strings.TrimPrefix(payload, selfTestPrefix), true
+}
+
+// callProbeKey returns the probe key for a self-test call from source to destination
+func callProbeKey(source string, destination string) string {
+	return "call:" + source + ">" + destination
+}
+
+// selfTestPage is the data rendered by views/default/selftest.gohtml
+type selfTestPage struct {
+	ProxyNumbers map[int]ProxyNumberType
+	TestNumber   string
+	Message      string
+
+	// URLs to configure in the flows of our MessageBird numbers
+	SMSWebhookURL    string
+	VoiceWebhookURL  string
+	StatusWebhookURL string
+}
+
+// runSelfTest sends an SMS or places a call from proxy to testNumber and
+// waits up to timeout for MessageBird to forward it to our webhook.
+// testNumber must be a number in our MessageBird account with flows
+// pointing at this application.
+func runSelfTest(store RideStore, mb *messagebird.Client, kind string, proxy ProxyNumberType, testNumber string, timeout time.Duration) error {
+	var key string
+	var send func() error
+	switch kind {
+	case "sms":
+		token := make([]byte, 8)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		body := selfTestPrefix + hex.EncodeToString(token)
+		key, _ = smsProbeKey(body)
+		send = func() error {
+			if mbSender(store, mb, proxy.Number, []string{testNumber}, body, nil) == "" {
+				return fmt.Errorf("could not send self-test sms from %s to %s", proxy.Number, testNumber)
+			}
+			return nil
+		}
+	case "voice":
+		key = callProbeKey(proxy.Number, testNumber)
+		send = func() error {
+			if !sendAllowed(testNumber) {
+				return fmt.Errorf("%s is not in SEND_ALLOWLIST", testNumber)
+			}
+			callflow := voice.CallFlow{
+				Title: "BirdCar self-test",
+				Steps: []voice.CallFlowStep{&voice.CallFlowPauseStep{Length: time.Second}},
+			}
+			if _, err := voice.InitiateCall(mb, proxy.Number, testNumber, callflow, nil); err != nil {
+				mbError(err)
+				return fmt.Errorf("could not place self-test call from %s to %s: %v", proxy.Number, testNumber, err)
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown self-test %q", kind)
+	}
+
+	done := probes.start(key)
+	defer probes.cancel(key)
+	if err := send(); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("the %s webhook was not called within %v; check the flow configured for %s", kind, timeout, testNumber)
+	}
+}
+
+// selfTestHandler lets an operator check end-to-end configuration after a
+// deploy: it sends a test SMS or places a test call through a proxy number to
+// the number in SELFTEST_NUMBER and reports whether our webhook received it.
+func selfTestHandler(dbdata *RideSharingDB, mb *messagebird.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+		page := selfTestPage{
+			ProxyNumbers: dbdata.ProxyNumbers,
+			TestNumber:   os.Getenv("SELFTEST_NUMBER"),
+
+			SMSWebhookURL:    webhookURL(r, smsWebhookPath(dbdata.webhookToken)),
+			VoiceWebhookURL:  webhookURL(r, voiceWebhookPath(dbdata.webhookToken)),
+			StatusWebhookURL: webhookURL(r, statusWebhookPath(dbdata.webhookToken)),
+		}
+
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Error parsing the form submitted. error: %v", err)
+				return
+			}
+			proxyID, _ := strconv.Atoi(r.FormValue("proxy"))
+			proxy, ok := dbdata.ProxyNumbers[proxyID]
+			switch {
+			case page.TestNumber == "":
+				page.Message = "Set SELFTEST_NUMBER to run self-tests."
+			case !ok:
+				page.Message = fmt.Sprintf("Unknown proxy number %q", r.FormValue("proxy"))
+			default:
+				kind := r.FormValue("kind")
+				if err := runSelfTest(dbdata.store, mb, kind, proxy, page.TestNumber, selfTestTimeout); err != nil {
+					log.Printf("Self-test failed: %v", err)
+					page.Message = fmt.Sprintf("Self-test failed: %v", err)
+				} else {
+					page.Message = fmt.Sprintf("Self-test passed: the %s webhook received our test from %s.", kind, proxy.Number)
+				}
+			}
+		}
+
+		renderDefaultTemplate(w, r, "selftest.gohtml", page)
+	}
+}
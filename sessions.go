@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	loginPath         = "/login"
+	logoutPath        = "/logout"
+	sessionCookieName = "birdcar_session"
+)
+
+// sessionLifetime returns how long dashboard users stay signed in, set with
+// SESSION_LIFETIME (e.g. "8h")
+func sessionLifetime() time.Duration {
+	return envDuration("SESSION_LIFETIME", 12*time.Hour)
+}
+
+// sessionUserKey is the request context key of the user whose session a
+// request carries
+type sessionUserKey struct{}
+
+// sessionUser returns the user signed in with the session cookie r carries,
+// if the session hasn't expired
+func sessionUser(store RideStore, r *http.Request) (string, bool) {
+	if user, ok := r.Context().Value(sessionUserKey{}).(string); ok {
+		return user, true
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	user, err := store.SessionUser(hashSecret(cookie.Value), time.Now().UTC())
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return "", false
+	}
+	return user, true
+}
+
+// startSession signs user in, setting the session cookie on w
+func startSession(store RideStore, w http.ResponseWriter, r *http.Request, user string) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(secret)
+	now := time.Now().UTC()
+	expires := now.Add(sessionLifetime())
+	if err := store.StartSession(hashSecret(token), user, now, expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessionCookie(r, token, expires))
+	return nil
+}
+
+// sessionStore is the part of RideStore that keeps the sessions of
+// dashboard users, by the hashes of their tokens
+type sessionStore interface {
+	// SessionUser returns the user signed in with the session whose token
+	// hashes to tokenHash, if it hasn't expired by now
+	SessionUser(tokenHash string, now time.Time) (string, error)
+	// StartSession signs user in with the session whose token hashes to
+	// tokenHash, dropping the sessions expired by now
+	StartSession(tokenHash string, user string, now time.Time, expires time.Time) error
+	// EndSession signs out the session whose token hashes to tokenHash
+	EndSession(tokenHash string) error
+}
+
+// SessionUser implements sessionStore
+func (s *sqlStore) SessionUser(tokenHash string, now time.Time) (string, error) {
+	var user string
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT username FROM sessions WHERE token_hash = ? AND expires_at > ?",
+		Postgres: "SELECT username FROM sessions WHERE token_hash = $1 AND expires_at > $2",
+	}, tokenHash, now.Format(time.RFC3339)).Scan(&user)
+	return user, err
+}
+
+// StartSession implements sessionStore
+func (s *sqlStore) StartSession(tokenHash string, user string, now time.Time, expires time.Time) error {
+	// Expired sessions are dropped as users sign in
+	_, err := s.exec(sqlQuery{
+		SQLite:   "DELETE FROM sessions WHERE expires_at <= ?",
+		Postgres: "DELETE FROM sessions WHERE expires_at <= $1",
+	}, now.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(sqlQuery{
+		SQLite:   "INSERT INTO sessions (token_hash, username, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		Postgres: "INSERT INTO sessions (token_hash, username, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+	}, tokenHash, user, now.Format(time.RFC3339), expires.Format(time.RFC3339))
+	return err
+}
+
+// EndSession implements sessionStore
+func (s *sqlStore) EndSession(tokenHash string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "DELETE FROM sessions WHERE token_hash = ?",
+		Postgres: "DELETE FROM sessions WHERE token_hash = $1",
+	}, tokenHash)
+	return err
+}
+
+// sessionCookie returns the session cookie holding token. Browsers don't
+// send it along with forms other sites post, so they can't act as the
+// signed-in user.
+func sessionCookie(r *http.Request, token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     appPath("/"),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// secureCookies reports whether cookies set in response to r should only be
+// sent over HTTPS: when r came over TLS or PUBLIC_URL is an https URL
+func secureCookies(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(publicURL(), "https://")
+}
+
+// withSessionUser returns r, noting that it is made by user
+func withSessionUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, user))
+}
+
+// loginRedirect sends the browser to the login page, to come back to r's
+// page once signed in
+func loginRedirect(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, appPath(loginPath)+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+}
+
+// localPath returns next if it is a page of the dashboard to go to after
+// signing in, or else the ride board. Other sites can't be redirected to.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") || next == loginPath {
+		return "/"
+	}
+	return next
+}
+
+// loginPage is the data rendered by views/default/login.gohtml
+type loginPage struct {
+	User    string
+	Next    string
+	Message string
+}
+
+// loginHandler signs dashboard users in, see checkLogin. Attempts are rate
+// limited per client IP by limiter.
+func loginHandler(store RideStore, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := loginPage{User: r.FormValue("user"), Next: localPath(r.FormValue("next"))}
+		if r.Method != "POST" {
+			renderDefaultTemplate(w, r, "login.gohtml", page)
+			return
+		}
+		if !limiter.allow(clientIP(r)) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			page.Message = "Too many attempts. Please wait a minute and try again."
+			renderDefaultTemplate(w, r, "login.gohtml", page)
+			return
+		}
+		if !checkLogin(store, page.User, r.FormValue("password")) {
+			log.Printf("Failed dashboard login as %q from %s", page.User, clientIP(r))
+			w.WriteHeader(http.StatusUnauthorized)
+			page.Message = "Wrong user name or password."
+			renderDefaultTemplate(w, r, "login.gohtml", page)
+			return
+		}
+		if err := startSession(store, w, r, page.User); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			page.Message = fmt.Sprint(err)
+			renderDefaultTemplate(w, r, "login.gohtml", page)
+			return
+		}
+		log.Printf("%s signed in to the dashboard", page.User)
+		http.Redirect(w, r, appPath(page.Next), http.StatusSeeOther)
+	}
+}
+
+// logoutHandler signs the dashboard user out
+func logoutHandler(store RideStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			if err := store.EndSession(hashSecret(cookie.Value)); err != nil {
+				log.Println(err)
+			}
+		}
+		cookie := sessionCookie(r, "", time.Time{})
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+		http.Redirect(w, r, appPath(loginPath), http.StatusSeeOther)
+	}
+}
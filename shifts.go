@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// Keywords drivers text to clock in and out of their shift, see
+// handleShiftText
+const (
+	shiftStartKeyword = "ON"
+	shiftEndKeyword   = "OFF"
+)
+
+// Shift states of a driver, see Person.Shift
+const (
+	shiftOn  = "on shift"
+	shiftOff = "off shift"
+)
+
+// shiftNumber returns the number drivers text ON and OFF to, set with
+// SHIFT_NUMBER. Its inbound SMS flow posts to /webhook like the proxy
+// numbers. Drivers can also text the keywords to any proxy number.
+func shiftNumber() string {
+	return strings.TrimSpace(os.Getenv("SHIFT_NUMBER"))
+}
+
+// parseShiftRequest reports whether payload is the ON or OFF keyword, and
+// which
+func parseShiftRequest(payload string) (on bool, ok bool) {
+	switch strings.ToUpper(strings.TrimSpace(payload)) {
+	case shiftStartKeyword:
+		return true, true
+	case shiftEndKeyword:
+		return false, true
+	}
+	return false, false
+}
+
+// OffShift reports whether p is a driver who clocked out and hasn't clocked
+// back in. Drivers who never texted ON or OFF can be booked any time.
+func (p Person) OffShift() bool {
+	return p.Shift == shiftOff
+}
+
+// findDriverByNumber returns the driver number belongs to
+func findDriverByNumber(dbdata *RideSharingDB, number string) (Person, bool) {
+	for _, v := range dbdata.Drivers {
+		if v.hasNumber(number) {
+			return v, true
+		}
+	}
+	return Person{}, false
+}
+
+// handleShiftText clocks the driver who sent msg in or out if it is the ON
+// or OFF keyword, sent to the shift number or a proxy number, and reports
+// whether it did. Anyone else texting the shift number is told it is only
+// for drivers.
+func handleShiftText(dbdata *RideSharingDB, mb *messagebird.Client, msg InboundSMS) bool {
+	toShiftNumber := shiftNumber() != "" && msg.Receiver == shiftNumber()
+	on, ok := parseShiftRequest(msg.Payload)
+	driver, isDriver := findDriverByNumber(dbdata, msg.Originator)
+	if !toShiftNumber && !(ok && isDriver) {
+		return false
+	}
+	logMessage(dbdata.store, 0, directionInbound, msg.ID, msg.Originator, msg.Receiver, msg.Payload)
+
+	var reply string
+	switch {
+	case !isDriver:
+		reply = "This number is for BirdCar drivers. Your number isn't registered to a driver."
+	case !ok:
+		reply = fmt.Sprintf("Reply %s to start your shift or %s to end it.", shiftStartKeyword, shiftEndKeyword)
+	case driver.Deactivated:
+		reply = "Your driver account is deactivated. Please contact dispatch."
+	default:
+		var err error
+		if reply, err = setShift(dbdata, driver, on); err != nil {
+			log.Println(err)
+			reply = "Sorry, something went wrong. Please try again."
+		}
+	}
+	replyTo(dbdata.store, mb, msg, 0, reply)
+	return true
+}
+
+// setShift clocks driver in or out, returning the reply to their text
+func setShift(dbdata *RideSharingDB, driver Person, on bool) (string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if on {
+		if driver.Shift == shiftOn {
+			return fmt.Sprintf("You're already on shift since %s.", formatViewDate(driver.ShiftSince)), nil
+		}
+		if err := dbdata.store.StartShift(driver.ID, now); err != nil {
+			return "", err
+		}
+		log.Printf("Driver %d started their shift", driver.ID)
+		return fmt.Sprintf("Your shift has started: you can be booked for rides. Reply %s to end it.", shiftEndKeyword), nil
+	}
+
+	if driver.Shift == shiftOff {
+		return "You're already off shift.", nil
+	}
+	if err := dbdata.store.EndShift(driver.ID, now); err != nil {
+		return "", err
+	}
+	log.Printf("Driver %d ended their shift", driver.ID)
+	reply := fmt.Sprintf("Your shift has ended: you won't be booked for new rides. Reply %s to start a new one.", shiftStartKeyword)
+	if n := openRidesOf(dbdata, roleDriver, driver.ID); n > 0 {
+		reply += fmt.Sprintf(" You still have %d ride(s) booked; contact dispatch if you can't drive them.", n)
+	}
+	return reply, nil
+}
+
+// shiftStore is the part of RideStore that keeps drivers' shifts
+type shiftStore interface {
+	// StartShift starts a shift of the driver with the given ID at now
+	StartShift(driverID int, now string) error
+	// EndShift ends the open shift of the driver with the given ID at now,
+	// recording an empty one if they never clocked in
+	EndShift(driverID int, now string) error
+}
+
+// StartShift implements shiftStore
+func (s *sqlStore) StartShift(driverID int, now string) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO shifts (driver_id, started_at) VALUES (?, ?)",
+		Postgres: "INSERT INTO shifts (driver_id, started_at) VALUES ($1, $2)",
+	}, driverID, now)
+	return err
+}
+
+// EndShift implements shiftStore
+func (s *sqlStore) EndShift(driverID int, now string) error {
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "UPDATE shifts SET ended_at = ? WHERE driver_id = ? AND ended_at = ''",
+		Postgres: "UPDATE shifts SET ended_at = $1 WHERE driver_id = $2 AND ended_at = ''",
+	}, now, driverID)
+	if err != nil || n > 0 {
+		return err
+	}
+	// Drivers who never clocked in go off shift too
+	_, err = s.exec(sqlQuery{
+		SQLite:   "INSERT INTO shifts (driver_id, started_at, ended_at) VALUES (?, ?, ?)",
+		Postgres: "INSERT INTO shifts (driver_id, started_at, ended_at) VALUES ($1, $2, $3)",
+	}, driverID, now, now)
+	return err
+}
+
+// openRidesOf returns how many rides that haven't ended the participant
+// with role and id has
+func openRidesOf(dbdata *RideSharingDB, role string, id int) int {
+	n := 0
+	for _, ride := range dbdata.Rides {
+		if !ride.Status.Terminal() && ride.participant(role).ID == id {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// workerGroup runs the work the server does in the background: the
+// pollers, the notification queue's worker and the release of held
+// messages. Shutting down stops it before closing the database they use.
+type workerGroup struct {
+	ctx  context.Context // Done once the server shuts down
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// background is the server's background work
+var background = newWorkerGroup()
+
+// newWorkerGroup returns a workerGroup running no work yet
+func newWorkerGroup() *workerGroup {
+	ctx, stop := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, stop: stop}
+}
+
+// start runs task in its own goroutine. task should return soon after its
+// ctx is done.
+func (g *workerGroup) start(task func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		task(g.ctx)
+	}()
+}
+
+// shutdown cancels the context of the tasks started and waits for them to return
+func (g *workerGroup) shutdown() {
+	g.stop()
+	g.wg.Wait()
+}
+
+// every calls f every interval until ctx is done
+func every(ctx context.Context, interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+// shutdownTimeout returns how long shutting down may take, set with
+// SHUTDOWN_TIMEOUT. Requests and queued texts still going by then are cut off.
+func shutdownTimeout() time.Duration {
+	return envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+}
+
+// waitForShutdownSignal blocks until the process is interrupted or told to
+// terminate, e.g. by a deploy, and returns the signal
+func waitForShutdownSignal() os.Signal {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	// A second signal stops us straight away
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	return sig
+}
+
+// shutdown stops the pollers and servers taking requests and waits for the
+// requests in flight, which may be sending texts, then sends the texts left
+// in queue, all within shutdownTimeout. Errors along the way are logged.
+// The stores are closed with closeStores once the background work using
+// them has returned.
+func shutdown(servers []*http.Server, queue *notificationQueue, closeStores func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	background.stop()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Could not finish the requests to %s: %v", srv.Addr, err)
+		}
+	}
+	if err := queue.drain(ctx); err != nil {
+		log.Printf("Could not empty the notification queue: %v", err)
+	}
+	background.shutdown()
+	return closeStores()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerGroupShutdownWaitsForTasks(t *testing.T) {
+	g := newWorkerGroup()
+	var ticks, returned int32
+	for i := 0; i < 3; i++ {
+		g.start(func(ctx context.Context) {
+			every(ctx, time.Millisecond, func() { atomic.AddInt32(&ticks, 1) })
+			// Work done after the context is cancelled must finish before
+			// shutdown returns, as it may still use the database
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&returned, 1)
+		})
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		g.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown didn't return")
+	}
+	if n := atomic.LoadInt32(&returned); n != 3 {
+		t.Errorf("%d tasks returned before shutdown did, want 3", n)
+	}
+	if atomic.LoadInt32(&ticks) == 0 {
+		t.Error("tasks never ticked")
+	}
+
+	after := atomic.LoadInt32(&ticks)
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&ticks); n != after {
+		t.Errorf("tasks ticked %d times after shutdown", n-after)
+	}
+}
+
+func TestEveryStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		every(ctx, time.Hour, func() { t.Error("f called after ctx was done") })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("every didn't return")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// simulatedSMS is an SMS the simulator accepted for sending
+type simulatedSMS struct {
+	ID         string
+	Originator string
+	Recipient  string
+	Body       string
+}
+
+// messageBirdSimulator stands in for the MessageBird REST API. Use it as the
+// transport of a MessageBird client's HTTPClient: it accepts SMS messages
+// and records them instead of sending them, answers number lookups as if
+// every number were a mobile one, and rejects every other request.
+type messageBirdSimulator struct {
+	mu   sync.Mutex
+	next int
+	sent []simulatedSMS
+}
+
+// RoundTrip implements http.RoundTripper
+func (s *messageBirdSimulator) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/lookup/") {
+		return simulatorResponse(req, http.StatusOK, map[string]interface{}{
+			"phoneNumber": 0,
+			"type":        "mobile",
+		})
+	}
+	if req.Method != http.MethodPost || req.URL.Path != "/messages" {
+		return simulatorResponse(req, http.StatusNotFound, map[string]interface{}{
+			"errors": []map[string]interface{}{
+				{"code": 20, "description": fmt.Sprintf("%s %s is not simulated", req.Method, req.URL.Path)},
+			},
+		})
+	}
+
+	var msg struct {
+		Originator string   `json:"originator"`
+		Body       string   `json:"body"`
+		Recipients []string `json:"recipients"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.next++
+	id := fmt.Sprintf("sim-%d", s.next)
+	for _, recipient := range msg.Recipients {
+		s.sent = append(s.sent, simulatedSMS{ID: id, Originator: msg.Originator, Recipient: recipient, Body: msg.Body})
+	}
+	s.mu.Unlock()
+
+	return simulatorResponse(req, http.StatusCreated, map[string]interface{}{
+		"id":         id,
+		"originator": msg.Originator,
+		"body":       msg.Body,
+	})
+}
+
+// take returns the messages sent since it was last called
+func (s *messageBirdSimulator) take() []simulatedSMS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := s.sent
+	s.sent = nil
+	return sent
+}
+
+// simulatorResponse returns a JSON response to req
+func simulatorResponse(req *http.Request, status int, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(b)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// suppressedMessageID is logged as the MessageBird ID of messages that soft
+// launch mode kept from being sent
+const suppressedMessageID = "suppressed"
+
+// sendAllowlist returns the numbers in the comma-separated SEND_ALLOWLIST.
+// Setting it turns on soft launch mode: we only text and call numbers in the
+// list, so testing with production-like data can't reach real people.
+// It returns nil when soft launch mode is off.
+func sendAllowlist() map[string]bool {
+	list := os.Getenv("SEND_ALLOWLIST")
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, number := range strings.Split(list, ",") {
+		if number = strings.TrimSpace(number); number != "" {
+			allowed[number] = true
+		}
+	}
+	return allowed
+}
+
+// sendAllowed reports whether we may text or call number.
+// Suppressed sends are logged.
+func sendAllowed(number string) bool {
+	allowed := sendAllowlist()
+	if allowed == nil || allowed[number] {
+		return true
+	}
+	log.Printf("Soft launch mode: suppressed send to %s, which is not in SEND_ALLOWLIST", number)
+	return false
+}
+
+// allowedRecipients returns the recipients we may text
+func allowedRecipients(recipients []string) []string {
+	var allowed []string
+	for _, number := range recipients {
+		if sendAllowed(number) {
+			allowed = append(allowed, number)
+		}
+	}
+	return allowed
+}
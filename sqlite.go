@@ -0,0 +1,47 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// openSQLiteStore opens the SQLite file at url, ./ridesharing.db if url is empty
+func openSQLiteStore(url string) (RideStore, *sql.DB, error) {
+	if url == "" {
+		url = "./ridesharing.db"
+	}
+	db, err := sql.Open("sqlite3", sqliteDSN(url))
+	if err != nil {
+		return nil, nil, err
+	}
+	return newSQLStore(db, migrations.SQLite, sqliteUniqueViolation), db, nil
+}
+
+// sqliteDSN returns the data source name to open the SQLite file at url
+// with. Transactions take the write lock when they begin, so concurrent ones
+// wait for each other, up to the busy timeout, rather than failing with
+// "database is locked" when both read and then write, e.g. reserveProxy's.
+func sqliteDSN(url string) string {
+	if strings.Contains(url, "_txlock=") {
+		return url
+	}
+	if strings.Contains(url, "?") {
+		return url + "&_txlock=immediate"
+	}
+	return url + "?_txlock=immediate"
+}
+
+// sqliteUniqueViolation reports whether the SQLite error err is a unique
+// constraint failing
+func sqliteUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// openSQLiteStore fails: go-sqlite3 is a cgo package, so binaries built
+// with CGO_ENABLED=0 can only use the other stores, see openStore
+func openSQLiteStore(url string) (RideStore, *sql.DB, error) {
+	return nil, nil, errors.New("sqlite support requires cgo")
+}
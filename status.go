@@ -0,0 +1,19 @@
+package main
+
+import "strings"
+
+// statusKeyword is texted by a ride participant to get the ride details
+const statusKeyword = "STATUS"
+
+// isStatusRequest reports whether payload is the STATUS keyword
+func isStatusRequest(payload string) bool {
+	return strings.ToUpper(strings.TrimSpace(payload)) == statusKeyword
+}
+
+// rideStatusReply renders the STATUS reply for the participant of ride with role
+func rideStatusReply(store RideStore, ride RideType, role string) string {
+	if role == roleDriver {
+		return renderNotification(store, templateStatusDriver, newNotificationData(store, ride, role))
+	}
+	return renderNotification(store, templateStatusCustomer, newNotificationData(store, ride, role))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+)
+
+// ridePair is a customer and driver who ride together
+type ridePair struct {
+	CustomerID int
+	DriverID   int
+}
+
+// pairProxyStatement records that customerID and driverID now share the
+// proxy number with ID proxyID, so their next ride together gets it again
+// and the threads in their phones keep working
+func pairProxyStatement(customerID int, driverID int, proxyID int) dbStatement {
+	return statement(sqlQuery{
+		SQLite: "INSERT INTO pair_proxies (customer_id, driver_id, number_id, updated_at) VALUES (?, ?, ?, ?) " +
+			"ON CONFLICT (customer_id, driver_id) DO UPDATE SET number_id = excluded.number_id, updated_at = excluded.updated_at",
+		Postgres: "INSERT INTO pair_proxies (customer_id, driver_id, number_id, updated_at) VALUES ($1, $2, $3, $4) " +
+			"ON CONFLICT (customer_id, driver_id) DO UPDATE SET number_id = excluded.number_id, updated_at = excluded.updated_at",
+		MySQL: "INSERT INTO pair_proxies (customer_id, driver_id, number_id, updated_at) VALUES (?, ?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE number_id = VALUES(number_id), updated_at = VALUES(updated_at)",
+	}, customerID, driverID, proxyID, time.Now().UTC().Format(time.RFC3339))
+}
+
+// loadPairProxies returns the proxy number ID each pair last shared
+func (s *sqlStore) loadPairProxies() (map[ridePair]int, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT customer_id, driver_id, number_id FROM pair_proxies",
+		Postgres: "SELECT customer_id, driver_id, number_id FROM pair_proxies",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pairs := make(map[ridePair]int)
+	for rows.Next() {
+		var pair ridePair
+		var proxyID int
+		if err := rows.Scan(&pair.CustomerID, &pair.DriverID, &proxyID); err != nil {
+			return nil, err
+		}
+		pairs[pair] = proxyID
+	}
+	return pairs, rows.Err()
+}
+
+// stickyProxy returns the proxy number customerID and driverID last shared,
+// if a new ride of theirs requiring the given tags can use it again
+func stickyProxy(dbdata *RideSharingDB, customerID int, driverID int, required []string) (ProxyNumberType, bool) {
+	proxyID, ok := dbdata.PairProxies[ridePair{customerID, driverID}]
+	if !ok {
+		return ProxyNumberType{}, false
+	}
+	proxy, ok := dbdata.ProxyNumbers[proxyID]
+	if !ok || !proxy.satisfies(required) || proxy.reservedFor(required) || !proxyAvailable(dbdata, customerID, driverID, proxy) {
+		return ProxyNumberType{}, false
+	}
+	return proxy, true
+}
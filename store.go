@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/messagebirdguides/masked-numbers-guide-go/migrations"
+)
+
+// RideStore is the database the application keeps its data in: a SQLite
+// file by default, PostgreSQL, MySQL or memory, see openStore. Features
+// read and write their data through their own part of it, e.g. optOutStore
+// in announcements.go, whose methods sqlStore implements with their SQL
+// written out for each dialect, see sqlQuery, and memoryStore on maps.
+type RideStore interface {
+	// Load reads the customers, drivers, proxy numbers, rides and
+	// relationships
+	Load() (*RideSharingDB, error)
+	// IsUniqueViolation reports whether err is a statement failing because
+	// it would give two rows the same PRIMARY KEY or UNIQUE values
+	IsUniqueViolation(err error) bool
+	// Ping checks that the database can be reached
+	Ping() error
+	// Close closes the store once nothing uses it anymore
+	Close() error
+
+	migrationStore
+	peopleStore
+	proxyNumberStore
+	rideStore
+	reservationStore
+	optOutStore
+	contactStore
+	messageLogStore
+	deliveryReportStore
+	templateStore
+	archiveStore
+	quotaStore
+	settingStore
+	maintenanceStore
+	languageStore
+	relationshipStore
+	handoffStore
+	preferenceStore
+	allocationStore
+	approvalStore
+	incidentStore
+	waitingRideStore
+	muteStore
+	rideActivityStore
+	rideLabelStore
+	trafficStore
+	consentStore
+	apiKeyStore
+	observerStore
+	participantNoteStore
+	exportStore
+	sessionStore
+	shiftStore
+	webhookDedupStore
+	userStore
+}
+
+// databaseURL returns where the application keeps its data, set with -db
+// or DATABASE_URL: a postgres://, mysql:// or memory: URL, or the path of a
+// SQLite file
+func databaseURL() string {
+	return appConfig.DatabaseURL
+}
+
+// databaseReplicaURL returns the read replica of the database at
+// DATABASE_URL that reports are read from, set with DATABASE_REPLICA_URL,
+// or an empty string to read them from the primary
+func databaseReplicaURL() string {
+	return os.Getenv("DATABASE_REPLICA_URL")
+}
+
+// openStore opens the store at url: a PostgreSQL database for postgres:// and
+// postgresql:// URLs, a MySQL database for mysql:// URLs, an in-memory
+// store for memory:<name> URLs, or else a SQLite file, ./ridesharing.db
+// if url is empty. The connection pool is sized with DB_MAX_OPEN_CONNS
+// (default 10), DB_MAX_IDLE_CONNS (default 5) and DB_CONN_MAX_LIFETIME
+// (default 1h).
+func openStore(url string) (RideStore, error) {
+	var store RideStore
+	var db *sql.DB
+	var err error
+	switch {
+	case strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://"):
+		store, db, err = openPostgresStore(url)
+	case strings.HasPrefix(url, "mysql://"):
+		store, db, err = openMySQLStore(strings.TrimPrefix(url, "mysql://"))
+	case strings.HasPrefix(url, "memory:"):
+		// There's no connection pool to size
+		return openMemoryStore(strings.TrimPrefix(url, "memory:")), nil
+	default:
+		store, db, err = openSQLiteStore(url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 10))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 5))
+	db.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", time.Hour))
+	return store, nil
+}
+
+// sqlQuery is a statement written out for each dialect. MySQL runs
+// SQLite's unless the query has one of its own, e.g. for upserts: both take ? placeholders, where PostgreSQL's
+// are numbered, $1, $2 and so on. PostgreSQL INSERTs whose new row's id is
+// wanted end in RETURNING id, see insertID.
+type sqlQuery struct {
+	SQLite   string
+	Postgres string
+	MySQL    string
+}
+
+// dbStatement is a query with the values bound to its placeholders
+type dbStatement struct {
+	Query sqlQuery
+	Args  []interface{}
+}
+
+// statement returns q with args bound to its placeholders. Values are never
+// spliced into the query text, so quotes in them are safe.
+func statement(q sqlQuery, args ...interface{}) dbStatement {
+	return dbStatement{Query: q, Args: args}
+}
+
+// sqlConn is where a sqlRunner runs its queries: a *sql.DB or a *sql.Tx
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlRunner runs queries in its dialect, on the connection pool or within
+// a transaction
+type sqlRunner struct {
+	conn    sqlConn
+	dialect string
+}
+
+// text returns the statement q has for r's dialect
+func (r sqlRunner) text(q sqlQuery) string {
+	switch r.dialect {
+	case migrations.Postgres:
+		return q.Postgres
+	case migrations.MySQL:
+		if q.MySQL != "" {
+			return q.MySQL
+		}
+	}
+	return q.SQLite
+}
+
+// exec executes q with args
+func (r sqlRunner) exec(q sqlQuery, args ...interface{}) (sql.Result, error) {
+	return r.conn.Exec(r.text(q), args...)
+}
+
+// execAll executes statements in order, stopping at the first that fails
+func (r sqlRunner) execAll(statements ...dbStatement) error {
+	for _, s := range statements {
+		if _, err := r.exec(s.Query, s.Args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query runs q with args
+func (r sqlRunner) query(q sqlQuery, args ...interface{}) (*sql.Rows, error) {
+	return r.conn.Query(r.text(q), args...)
+}
+
+// queryRow runs q, which returns at most one row, with args
+func (r sqlRunner) queryRow(q sqlQuery, args ...interface{}) *sql.Row {
+	return r.conn.QueryRow(r.text(q), args...)
+}
+
+// insertID executes the INSERT q with args and returns the id of the new
+// row. PostgreSQL doesn't report the last insert id, so its statement
+// returns it instead.
+func (r sqlRunner) insertID(q sqlQuery, args ...interface{}) (int64, error) {
+	if r.dialect == migrations.Postgres {
+		var id int64
+		err := r.conn.QueryRow(q.Postgres, args...).Scan(&id)
+		return id, err
+	}
+	res, err := r.exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// rowsAffected executes q with args and returns how many rows it changed
+func (r sqlRunner) rowsAffected(q sqlQuery, args ...interface{}) (int64, error) {
+	res, err := r.exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// placeholders returns n placeholders separated by commas, for the
+// arguments of a query from position first on, e.g. "?, ?, ?", or
+// "$2, $3, $4" in PostgreSQL, to match a list of values with IN
+func (r sqlRunner) placeholders(first int, n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = "?"
+		if r.dialect == migrations.Postgres {
+			list[i] = "$" + strconv.Itoa(first+i)
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// built returns the query text, which was built for r's dialect, e.g. with
+// placeholders, as the query of every dialect. Only identifiers known to the
+// schema may be spliced into text.
+func (r sqlRunner) built(text string) sqlQuery {
+	return sqlQuery{SQLite: text, Postgres: text, MySQL: text}
+}
+
+// sqlStore implements RideStore for the databases we reach through
+// database/sql, each running the statements of its own dialect
+type sqlStore struct {
+	sqlRunner
+	db              *sql.DB
+	uniqueViolation func(err error) bool // see IsUniqueViolation
+}
+
+// newSQLStore returns the store of db, whose statements are in dialect and
+// whose driver fails statements with errors uniqueViolation recognizes
+// when they violate a unique constraint
+func newSQLStore(db *sql.DB, dialect string, uniqueViolation func(err error) bool) *sqlStore {
+	return &sqlStore{sqlRunner{db, dialect}, db, uniqueViolation}
+}
+
+// IsUniqueViolation implements RideStore
+func (s *sqlStore) IsUniqueViolation(err error) bool {
+	return s.uniqueViolation(err)
+}
+
+// Ping implements RideStore
+func (s *sqlStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close implements RideStore
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlTx is a transaction of a sqlStore
+type sqlTx struct {
+	sqlRunner
+}
+
+// inTx runs f within a transaction, which is committed if f succeeds and
+// rolled back otherwise
+func (s *sqlStore) inTx(f func(tx sqlTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(sqlTx{sqlRunner{tx, s.dialect}}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrationStore is the part of RideStore that moves the schema between
+// the versions of the migrations package
+type migrationStore interface {
+	// AppliedMigrations returns the versions of the migrations applied, in order
+	AppliedMigrations() ([]int, error)
+	// SchemaVersion returns the version of the newest migration applied, or 0
+	SchemaVersion() (int, error)
+	// ExpandTarget returns the version servers migrate up to when they
+	// start, see migrations.ExpandTarget
+	ExpandTarget() (int, *migrations.Migration, error)
+	// MigrateUp applies the pending migrations up to version target
+	MigrateUp(target int) ([]migrations.Migration, error)
+	// MigrateDown reverts the migrations newer than version target
+	MigrateDown(target int) ([]migrations.Migration, error)
+}
+
+// AppliedMigrations implements migrationStore
+func (s *sqlStore) AppliedMigrations() ([]int, error) {
+	return migrations.Applied(s.db)
+}
+
+// SchemaVersion implements migrationStore
+func (s *sqlStore) SchemaVersion() (int, error) {
+	return migrations.Current(s.db)
+}
+
+// ExpandTarget implements migrationStore
+func (s *sqlStore) ExpandTarget() (int, *migrations.Migration, error) {
+	return migrations.ExpandTarget(s.db)
+}
+
+// MigrateUp implements migrationStore
+func (s *sqlStore) MigrateUp(target int) ([]migrations.Migration, error) {
+	return migrations.Up(s.db, s.dialect, target)
+}
+
+// MigrateDown implements migrationStore
+func (s *sqlStore) MigrateDown(target int) ([]migrations.Migration, error) {
+	return migrations.Down(s.db, s.dialect, target)
+}
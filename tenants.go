@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/messagebirdguides/masked-numbers-guide-go/config"
+)
+
+// tenant is a fleet whose data is kept in a database of its own, e.g. one
+// in the EU for an EU fleet, and whose dashboard and webhooks are served at
+// a host name of its own
+type tenant struct {
+	Host        string // e.g. "eu.birdcar.example.com"
+	DatabaseURL string // see openStore
+}
+
+// parseTenants parses the tenants in TENANTS: comma-separated host=database
+// pairs, e.g. "eu.birdcar.example.com=postgres://eu-db/birdcar,
+// us.birdcar.example.com=postgres://us-db/birdcar"
+func parseTenants(s string) ([]tenant, error) {
+	var tenants []tenant
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		pair := strings.SplitN(v, "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+			return nil, fmt.Errorf("TENANTS entry %q isn't host=database", v)
+		}
+		host := strings.ToLower(strings.TrimSpace(pair[0]))
+		if seen[host] {
+			return nil, fmt.Errorf("TENANTS has host %q twice", host)
+		}
+		seen[host] = true
+		tenants = append(tenants, tenant{Host: host, DatabaseURL: strings.TrimSpace(pair[1])})
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("set TENANTS to the host=database pairs of the tenants")
+	}
+	return tenants, nil
+}
+
+// runTenants implements the tenants command, which serves every tenant in
+// TENANTS from one server. Each tenant has a store of its own, opened on
+// the tenant's database, with the routes and background work of a server
+// on it, so its data is never read into or written from another tenant's
+// routes. Requests are routed to the tenant by their Host header, so point
+// each tenant's host name, and the webhooks of its proxy numbers, at the
+// server. The MessageBird client and the notification queue are shared.
+func runTenants(args []string) int {
+	flags := flag.NewFlagSet("tenants", flag.ExitOnError)
+	cfg := config.Flags(flags)
+	flags.Parse(args)
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("Invalid configuration:", err)
+		return 2
+	}
+	appConfig = cfg
+
+	tenants, err := parseTenants(os.Getenv("TENANTS"))
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if os.Getenv("DATABASE_REPLICA_URL") != "" {
+		log.Println("Ignoring DATABASE_REPLICA_URL: tenants read their reports from their own database")
+	}
+	if grpcAddr() != "" {
+		log.Println("Ignoring GRPC_ADDR: the gRPC ride service isn't routed to tenants")
+	}
+
+	stores := make(map[string]RideStore) // By host
+	closeStores := func() error {
+		var failed error
+		for _, store := range stores {
+			if err := store.Close(); err != nil {
+				failed = err
+			}
+		}
+		return failed
+	}
+	mb, queue := startMessaging(cfg)
+	routes := make(map[string]http.Handler)
+	for _, t := range tenants {
+		store, err := openStore(t.DatabaseURL)
+		if err != nil {
+			fmt.Println("Could not open the database of tenant", t.Host+":", err)
+			closeStores()
+			return 1
+		}
+		stores[t.Host] = store
+		initExampleDB(store)
+		dbdata := newRideSharingDB(store)
+		dbdata.tenant = t.Host
+		if dbdata.webhookToken, err = setupWebhookToken(store); err != nil {
+			fmt.Println("Could not set up the webhook token of tenant", t.Host+":", err)
+			closeStores()
+			return 1
+		}
+		routes[t.Host] = mountAtBasePath(newRouter(dbdata, dbdata, mb, queue))
+		startPollers(store, mb, cfg.Messaging)
+		log.Printf("Serving tenant %s from its own database", t.Host)
+	}
+	logSettings()
+
+	server := &http.Server{Addr: cfg.Addr, Handler: tenantRouter(routes)}
+	log.Println("Routing tenants on", cfg.Addr)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := waitForShutdownSignal()
+	log.Printf("Received %s, shutting down within %s (SHUTDOWN_TIMEOUT)", sig, shutdownTimeout())
+	if err := shutdown([]*http.Server{server}, queue, closeStores); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	log.Println("Shut down")
+	return 0
+}
+
+// tenantRouter returns a handler passing requests to the routes of their
+// host, ignoring its port
+func tenantRouter(routes map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		route, ok := routes[strings.ToLower(host)]
+		if !ok {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+		route.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+func TestTenantRouterSelectsTheStoreOfTheHost(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	mb := messagebird.New("test")
+	queue := newNotificationQueue(mb, 10, newAdaptiveThrottle(0, 0))
+	stores := make(map[string]RideStore)
+	routes := make(map[string]http.Handler)
+	for _, host := range []string{"eu.birdcar.test", "us.birdcar.test"} {
+		store := openMemoryStore(fmt.Sprintf("tenant-test-%d", atomic.AddInt64(&testStores, 1)))
+		t.Cleanup(func() { store.Close() })
+		initExampleDB(store)
+		dbdata := newRideSharingDB(store)
+		stores[host], routes[host] = store, newRouter(dbdata, dbdata, mb, queue)
+	}
+	key, err := createAPIKey(stores["eu.birdcar.test"], "reports", apiRoleReporting, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]int{
+		"eu.birdcar.test:8080": http.StatusOK,
+		"US.birdcar.test":      http.StatusUnauthorized, // The key is the EU tenant's
+		"birdcar.test":         http.StatusNotFound,
+	} {
+		r := httptest.NewRequest("GET", apiPrefix+"rides", nil)
+		r.Host = host
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		tenantRouter(routes).ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d: %s", host, w.Code, want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// adaptiveThrottle paces outbound MessageBird API calls. It starts at a base
+// interval between calls, backs off when MessageBird answers 429 Too Many
+// Requests or reports that no requests are left, and speeds back up as calls
+// succeed, so bursts are slowed down instead of failing.
+type adaptiveThrottle struct {
+	mu          sync.Mutex
+	base        time.Duration // fastest pace, used while we're not rate limited
+	max         time.Duration // slowest pace we back off to
+	interval    time.Duration // current minimum time between two calls
+	next        time.Time     // earliest time of the next call
+	lastLimited time.Time     // when we last got a 429
+}
+
+// newAdaptiveThrottle returns a throttle allowing one call per base interval,
+// backing off to at most one call per max
+func newAdaptiveThrottle(base time.Duration, max time.Duration) *adaptiveThrottle {
+	return &adaptiveThrottle{base: base, max: max, interval: base}
+}
+
+// wait blocks until the caller may make its next call
+func (t *adaptiveThrottle) wait() {
+	t.mu.Lock()
+	now := time.Now()
+	at := t.next
+	if at.Before(now) {
+		at = now
+	}
+	t.next = at.Add(t.interval)
+	t.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// rateLimitedSince reports whether we got a 429 after since
+func (t *adaptiveThrottle) rateLimitedSince(since time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastLimited.After(since)
+}
+
+// observe adjusts the pace to a response from MessageBird
+func (t *adaptiveThrottle) observe(resp *http.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		t.lastLimited = now
+		t.interval *= 2
+		if t.interval > t.max {
+			t.interval = t.max
+		}
+		pause := t.interval
+		if d, ok := retryAfter(resp.Header.Get("Retry-After"), now); ok {
+			pause = d
+		}
+		t.pauseUntil(now.Add(pause))
+		log.Printf("MessageBird rate limit hit, pausing sends for %v and slowing to one per %v", pause, t.interval)
+	case resp.StatusCode < 300:
+		// Speed back up gradually
+		t.interval -= t.interval / 10
+		if t.interval < t.base {
+			t.interval = t.base
+		}
+	}
+
+	// Some responses tell us how many requests are left before we'll be limited
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if d, ok := retryAfter(resp.Header.Get("X-RateLimit-Reset"), now); ok {
+			t.pauseUntil(now.Add(d))
+		}
+	}
+}
+
+// pauseUntil holds off further calls until at. The caller must hold t.mu.
+func (t *adaptiveThrottle) pauseUntil(at time.Time) {
+	if at.After(t.next) {
+		t.next = at
+	}
+}
+
+// retryAfter parses a Retry-After or X-RateLimit-Reset header value: a number
+// of seconds, a Unix timestamp, or an HTTP date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		// Values this large are timestamps rather than delays
+		if secs > 1000000000 {
+			return time.Unix(secs, 0).Sub(now), true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
+
+// throttleTransport passes every MessageBird response to a throttle, and
+// records the calls that fail for incidents, see incidents.go.
+// The SDK doesn't expose status codes or headers, so we watch them here.
+type throttleTransport struct {
+	next     http.RoundTripper
+	throttle *adaptiveThrottle
+}
+
+// RoundTrip implements http.RoundTripper
+func (t throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.throttle.observe(resp)
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		recordProviderFailure(time.Now())
+	}
+	return resp, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// What we do with texts to a proxy number from someone we can't match to a
+// ride or relationship on it, see unknownSenderPolicy
+const (
+	unknownSenderDrop    = "drop"    // log the message and ignore it
+	unknownSenderReply   = "reply"   // answer with the unknown_sender template
+	unknownSenderForward = "forward" // pass the message on to SUPPORT_INBOX_NUMBER
+)
+
+// unknownSenderPolicy returns the policy for texts from unknown senders, set
+// with UNKNOWN_SENDER_POLICY. It defaults to dropping them.
+func unknownSenderPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("UNKNOWN_SENDER_POLICY")))
+	switch policy {
+	case unknownSenderDrop, unknownSenderReply:
+		return policy
+	case unknownSenderForward:
+		if supportInbox() != "" {
+			return policy
+		}
+		log.Printf("UNKNOWN_SENDER_POLICY is %q but SUPPORT_INBOX_NUMBER is not set, dropping texts from unknown senders", policy)
+	case "":
+	default:
+		log.Printf("Unknown UNKNOWN_SENDER_POLICY %q, dropping texts from unknown senders", policy)
+	}
+	return unknownSenderDrop
+}
+
+// supportInbox returns the number texts from unknown senders are forwarded to
+func supportInbox() string {
+	return strings.TrimSpace(os.Getenv("SUPPORT_INBOX_NUMBER"))
+}
+
+// operatorLine returns the number calls to a proxy number from someone we
+// can't match to a ride on it are transferred to, from OPERATOR_LINE_NUMBER.
+// If it is empty we hang up on them.
+func operatorLine() string {
+	return strings.TrimSpace(os.Getenv("OPERATOR_LINE_NUMBER"))
+}
+
+// handleUnknownSender applies unknownSenderPolicy to msg, a text we couldn't
+// match to a ride or relationship on its proxy number
+func handleUnknownSender(dbdata *RideSharingDB, mb *messagebird.Client, msg InboundSMS) {
+	policy := unknownSenderPolicy()
+	if policy == unknownSenderDrop {
+		log.Printf("Could not find ride for customer/driver %s that uses proxy %s", msg.Originator, msg.Receiver)
+		return
+	}
+	logMessage(dbdata.store, 0, directionInbound, msg.ID, msg.Originator, msg.Receiver, msg.Payload)
+
+	switch policy {
+	case unknownSenderReply:
+		proxy, _ := findProxyNumber(dbdata, msg.Receiver)
+		data := newNotificationData(dbdata.store, RideType{ThisProxyNumber: proxy}, "")
+		data.Language = participantLanguage(dbdata.store, msg.Originator)
+		reply := renderNotification(dbdata.store, templateUnknownSender, data)
+		replyTo(dbdata.store, mb, msg, 0, reply)
+	case unknownSenderForward:
+		if !relayQuotaLeft(dbdata) {
+			log.Printf("Not forwarding message %s from unknown sender %s: the daily quota of %d relays has been reached", msg.ID, msg.Originator, quotaLimit(quotaRelays))
+			return
+		}
+		// Not logged as a relay: the sender isn't a participant to tell about failed deliveries
+		body := fmt.Sprintf("From %s to %s: %s", msg.Originator, msg.Receiver, msg.Payload)
+		if id := sendRideMessage(dbdata.store, mb, 0, msg.Receiver, supportInbox(), body, nil, ""); id == "" {
+			log.Printf("Could not forward message %s from unknown sender %s to the support inbox", msg.ID, msg.Originator)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Passwords are hashed with PBKDF2-HMAC-SHA256, stored as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" in base64
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 310000
+	minPasswordLength  = 10
+)
+
+// hashPassword returns the hash of password to store in users
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwordIterations, sha256.Size, sha256.New)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches hash, from hashPassword
+func checkPassword(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2.Key([]byte(password), salt, iterations, len(want), sha256.New)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// checkLogin reports whether user can sign in to the dashboard with
+// password: an admin account, see adminAccounts, or a user added with the
+// users command
+func checkLogin(store RideStore, user string, password string) bool {
+	if user == "" || password == "" {
+		return false
+	}
+	if want, ok := adminAccounts()[user]; ok {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	}
+	hash, err := store.PasswordHash(user)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// usersExist reports whether any user was added with the users command
+func usersExist(store RideStore) bool {
+	exist, err := store.UsersExist()
+	if err != nil {
+		log.Println(err)
+	}
+	return exist
+}
+
+// runUsers implements the users command, which manages who can sign in to
+// the dashboard besides the admin accounts in ADMIN_PASSWORD and ADMIN_USERS:
+// "users list", "users add <name>", "users passwd <name>" and
+// "users remove <name>". Passwords are read from standard input, e.g.
+// "go run *.go users add alice < password.txt". Changing or removing a
+// user's password signs them out. It returns the exit status.
+func runUsers(args []string) int {
+	command := "list"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if err := openDB(databaseURL()); err != nil {
+		fmt.Println("Could not open database:", err)
+		return 1
+	}
+	if err := migrateDB(appStore); err != nil {
+		fmt.Println("Could not migrate the database:", err)
+		return 1
+	}
+
+	if command == "list" {
+		users, err := appStore.Users()
+		if err != nil {
+			fmt.Println("Could not list the users:", err)
+			return 1
+		}
+		for _, u := range users {
+			fmt.Printf("%-20s added %s\n", u.Name, u.CreatedAt)
+		}
+		return 0
+	}
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		fmt.Printf("Usage: users %s <name>\n", command)
+		return 1
+	}
+	name := strings.TrimSpace(args[0])
+
+	var err error
+	switch command {
+	case "add", "passwd":
+		if _, ok := adminAccounts()[name]; ok {
+			fmt.Printf("%s is an admin account set in the environment: pick another name\n", name)
+			return 1
+		}
+		fmt.Printf("Password for %s: ", name)
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		fmt.Println()
+		password = strings.TrimRight(password, "\r\n")
+		if len(password) < minPasswordLength {
+			fmt.Printf("Passwords need at least %d characters.\n", minPasswordLength)
+			return 1
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			fmt.Println("Could not hash the password:", err)
+			return 1
+		}
+		if command == "add" {
+			err = appStore.AddUser(name, hash, time.Now().UTC())
+		} else {
+			err = changedUser(name)(appStore.SetPassword(name, hash))
+		}
+		if err != nil {
+			fmt.Printf("Could not save %s: %v\n", name, err)
+			return 1
+		}
+	case "remove":
+		err = changedUser(name)(appStore.RemoveUser(name))
+	default:
+		fmt.Printf("Unknown users command %q: use list, add, passwd or remove\n", command)
+		return 1
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("Done.")
+	return 0
+}
+
+// changedUser returns the error of changing the user called name, given
+// whether they were found
+func changedUser(name string) func(found bool, err error) error {
+	return func(found bool, err error) error {
+		if err == nil && !found {
+			err = fmt.Errorf("there is no user called %s", name)
+		}
+		return err
+	}
+}
+
+// userAccount is a user added with the users command
+type userAccount struct {
+	Name      string
+	CreatedAt string
+}
+
+// userStore is the part of RideStore that keeps the users added with the
+// users command
+type userStore interface {
+	// PasswordHash returns the password hash of the user called name
+	PasswordHash(name string) (string, error)
+	// UsersExist reports whether any user was added
+	UsersExist() (bool, error)
+	// Users returns the users, by name
+	Users() ([]userAccount, error)
+	// AddUser adds the user called name with the password hash, at
+	AddUser(name string, hash string, at time.Time) error
+	// SetPassword changes the password hash of the user called name and
+	// signs them out, reporting whether they were found
+	SetPassword(name string, hash string) (bool, error)
+	// RemoveUser removes the user called name and signs them out, reporting
+	// whether they were found
+	RemoveUser(name string) (bool, error)
+}
+
+// PasswordHash implements userStore
+func (s *sqlStore) PasswordHash(name string) (string, error) {
+	var hash string
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT password_hash FROM users WHERE username = ?",
+		Postgres: "SELECT password_hash FROM users WHERE username = $1",
+	}, name).Scan(&hash)
+	return hash, err
+}
+
+// UsersExist implements userStore
+func (s *sqlStore) UsersExist() (bool, error) {
+	var id int
+	err := s.queryRow(sqlQuery{
+		SQLite:   "SELECT id FROM users LIMIT 1",
+		Postgres: "SELECT id FROM users LIMIT 1",
+	}).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Users implements userStore
+func (s *sqlStore) Users() ([]userAccount, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT username, created_at FROM users ORDER BY username",
+		Postgres: "SELECT username, created_at FROM users ORDER BY username",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []userAccount
+	for rows.Next() {
+		var u userAccount
+		if err := rows.Scan(&u.Name, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// AddUser implements userStore
+func (s *sqlStore) AddUser(name string, hash string, at time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)",
+		Postgres: "INSERT INTO users (username, password_hash, created_at) VALUES ($1, $2, $3)",
+	}, name, hash, at.Format(time.RFC3339))
+	return err
+}
+
+// SetPassword implements userStore
+func (s *sqlStore) SetPassword(name string, hash string) (bool, error) {
+	return s.changeUser(name, statement(sqlQuery{
+		SQLite:   "UPDATE users SET password_hash = ? WHERE username = ?",
+		Postgres: "UPDATE users SET password_hash = $1 WHERE username = $2",
+	}, hash, name))
+}
+
+// RemoveUser implements userStore
+func (s *sqlStore) RemoveUser(name string) (bool, error) {
+	return s.changeUser(name, statement(sqlQuery{
+		SQLite:   "DELETE FROM users WHERE username = ?",
+		Postgres: "DELETE FROM users WHERE username = $1",
+	}, name))
+}
+
+// changeUser executes change, which updates or deletes the user called
+// name, and signs them out if it found them
+func (s *sqlStore) changeUser(name string, change dbStatement) (bool, error) {
+	found := false
+	err := s.inTx(func(tx sqlTx) error {
+		n, err := tx.rowsAffected(change.Query, change.Args...)
+		if err != nil || n == 0 {
+			return err
+		}
+		found = true
+		_, err = tx.exec(sqlQuery{
+			SQLite:   "DELETE FROM sessions WHERE username = ?",
+			Postgres: "DELETE FROM sessions WHERE username = $1",
+		}, name)
+		return err
+	})
+	return found, err
+}
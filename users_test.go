@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, passwordScheme+"$310000$") {
+		t.Errorf("hash %q doesn't record the scheme and iterations", hash)
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Error("hashing a password twice gave the same hash: salts aren't random")
+	}
+
+	// "password", salted with "salt", hashed once
+	known := passwordScheme + "$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs"
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{hash, "correct horse", true},
+		{hash, "correct horse ", false},
+		{hash, "", false},
+		{known, "password", true},
+		{known, "Password", false},
+		{strings.Replace(known, "$1$", "$2$", 1), "password", false},
+		{"bcrypt$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{passwordScheme + "$0$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{passwordScheme + "$x$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{passwordScheme + "$1$!!$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", "password", false},
+		{passwordScheme + "$1$c2FsdA$!!", "password", false},
+		{passwordScheme + "$1$c2FsdA", "password", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if got := checkPassword(test.hash, test.password); got != test.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", test.hash, test.password, got, test.want)
+		}
+	}
+}
+
+func TestRequireAdminChecksBasicAuthAgainstUsers(t *testing.T) {
+	openTestDB(t, "memory")
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appStore.AddUser("alice", hash, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	handler := requireAdmin(appStore, func(w http.ResponseWriter, r *http.Request) {})
+
+	// Scripts post without the CSRF token of a form
+	tests := []struct {
+		user     string
+		password string
+		want     int
+	}{
+		{"alice", "correct horse", http.StatusOK},
+		{"alice", "wrong horse", http.StatusUnauthorized},
+		{"bob", "correct horse", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/admin/people", nil)
+		r.SetBasicAuth(test.user, test.password)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s with password %q: status %d, want %d", test.user, test.password, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+// viewDateLayout is how views show dates unless they ask for another layout
+const viewDateLayout = "Mon 2 Jan 15:04"
+
+// templateFuncs are available in every view:
+//
+//	{{ path "/createride" }}         a link to our routes that works under BASE_PATH
+//	{{ date .DateTime }}             a ride time, RFC 3339 timestamp or time.Time as "Mon 2 Jan 15:04"
+//	{{ date .DateTime "15:04" }}     the same in another layout
+//	{{ mask .ThisCustomer.Number }}  a phone number with all but its last three digits masked
+//	{{ untilPickup .DateTime }}      how long until a ride's pickup, e.g. "in 1h 30m" or "20m ago"
+//	{{ fromNow .Activity.Last }}     how long until or since a time, see viewTime, in the same way
+//	{{ statusBadge .Status }}        a ride or proxy number status, or a flag like "silent", as a colored badge
+//	{{ csrfField }}                  the hidden CSRF token field every form that posts needs, see csrf.go
+var templateFuncs = template.FuncMap{
+	"path":        appPath,
+	"date":        formatViewDate,
+	"mask":        maskNumber,
+	"untilPickup": untilPickup,
+	"fromNow":     fromNow,
+	"statusBadge": statusBadge,
+	"csrfField":   func() template.HTML { return "" }, // Bound to the request's token by renderLayout
+}
+
+// viewTime returns the time value holds: a time.Time, or a string in one of
+// the ride time layouts, which include RFC 3339
+func viewTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case string:
+		t, err := parseRideTime(v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// formatViewDate formats value, see viewTime, in the local time zone with
+// layout, or viewDateLayout if it's omitted. Values that aren't times are
+// shown as they are.
+func formatViewDate(value interface{}, layout ...string) string {
+	t, ok := viewTime(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	if len(layout) > 0 {
+		return t.Local().Format(layout[0])
+	}
+	return t.Local().Format(viewDateLayout)
+}
+
+// maskNumber masks all but the last three digits of number, e.g. "******002"
+func maskNumber(number string) string {
+	if len(number) <= 3 {
+		return number
+	}
+	return strings.Repeat("*", len(number)-3) + number[len(number)-3:]
+}
+
+// untilPickup describes how long until a ride picks up at datetime, e.g.
+// "in 1h 30m", or how long ago it did, e.g. "20m ago". It's empty for
+// datetimes we can't parse.
+func untilPickup(datetime string) string {
+	return fromNow(datetime)
+}
+
+// fromNow describes how long until value, see viewTime, e.g. "in 1h 30m",
+// or how long ago it was, e.g. "20m ago". It's empty for values that
+// aren't times.
+func fromNow(value interface{}) string {
+	t, ok := viewTime(value)
+	if !ok {
+		return ""
+	}
+	d := time.Until(t)
+	switch {
+	case d >= time.Minute:
+		return "in " + roughDuration(d)
+	case d > -time.Minute:
+		return "now"
+	}
+	return roughDuration(-d) + " ago"
+}
+
+// roughDuration formats d in its two largest units, e.g. "2d 3h", "1h 30m"
+// or "45m"
+func roughDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days, hours, minutes := int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour), int(d%time.Hour/time.Minute)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// statusBadgeColors are the background colors of status badges, by status.
+// Ride and port statuses share "active". Participant flags are shown as
+// badges too. Statuses missing here get a gray badge.
+var statusBadgeColors = map[string]string{
+	string(rideScheduled): "#ddf",
+	string(rideActive):    "#cfc",
+	string(rideCancelled): "#fcc",
+	portStatusPending:     "#ffd",
+	portStatusQuarantined: "#fcc",
+	portStatusMissing:     "#fcc",
+	"silent":              "#ffd",
+	"noisy":               "#fdb",
+	flagVIP:               "#fe9",
+	flagPaymentIssue:      "#ffd",
+	flagAbusive:           "#fcc",
+	shiftOn:               "#cfc",
+	shiftOff:              "#ddd",
+}
+
+// statusBadge shows status, e.g. a RideStatus, a proxy number's port status
+// or a ride's activity flag, as a colored badge. Themes can restyle it through its classes,
+// e.g. "badge badge-active".
+func statusBadge(status interface{}) template.HTML {
+	s := fmt.Sprint(status)
+	color, ok := statusBadgeColors[s]
+	if !ok {
+		color = "#ddd"
+	}
+	return template.HTML(fmt.Sprintf(`<span class="badge badge-%s" style="padding:0 0.4em;border-radius:0.3em;background:%s">%s</span>`,
+		template.HTMLEscapeString(strings.Replace(s, " ", "-", -1)), color, template.HTMLEscapeString(s)))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultViewTheme is the theme holding every view, which other themes fall back to
+const defaultViewTheme = "default"
+
+// viewsDir returns the directory holding the view themes, one subdirectory
+// each. Set -views or VIEWS_DIR to override the default of ./views.
+func viewsDir() string {
+	return appConfig.ViewsDir
+}
+
+// viewTheme returns the theme pages are rendered with. Set VIEWS_THEME to a
+// subdirectory of the views directory, e.g. "minimal" or one of your own, to
+// reskin the pages. A theme only needs the views it changes: the others are
+// taken from the default theme.
+func viewTheme() string {
+	if theme := os.Getenv("VIEWS_THEME"); theme != "" {
+		return theme
+	}
+	return defaultViewTheme
+}
+
+// viewsReload reports whether views are parsed on every request, so edits
+// show up without a restart. Set VIEWS_RELOAD=true while working on a theme.
+func viewsReload() bool {
+	return os.Getenv("VIEWS_RELOAD") == "true"
+}
+
+// resolveView returns the file of the view name, e.g. "landing.gohtml" or
+// "layouts/default.gohtml", in the configured theme or else the default one
+func resolveView(name string) (string, error) {
+	for _, theme := range []string{viewTheme(), defaultViewTheme} {
+		file := filepath.Join(viewsDir(), theme, filepath.FromSlash(name))
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("view %s not found in theme %s or %s of %s", name, viewTheme(), defaultViewTheme, viewsDir())
+}
+
+// checkViewTheme reports an error if the configured theme doesn't exist
+func checkViewTheme() error {
+	dir := filepath.Join(viewsDir(), viewTheme())
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("views theme %s not found: %s is not a directory", viewTheme(), dir)
+	}
+	return nil
+}
+
+// viewCache holds views parsed with their layout, so each page is parsed once
+type viewCache struct {
+	mu        sync.Mutex
+	templates map[[2]string]*template.Template
+}
+
+// views caches the views of every page rendered
+var views = &viewCache{templates: make(map[[2]string]*template.Template)}
+
+// lookup returns view parsed with layout, resolving both in the configured theme
+func (c *viewCache) lookup(layout string, view string) (*template.Template, error) {
+	key := [2]string{layout, view}
+	reload := viewsReload()
+	if !reload {
+		c.mu.Lock()
+		t, ok := c.templates[key]
+		c.mu.Unlock()
+		if ok {
+			return t, nil
+		}
+	}
+
+	var files []string
+	for _, name := range []string{view, layout} {
+		file, err := resolveView(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	t, err := template.New("").Funcs(templateFuncs).ParseFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+	if !reload {
+		c.mu.Lock()
+		c.templates[key] = t
+		c.mu.Unlock()
+	}
+	return t, nil
+}
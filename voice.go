@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// identityVar is the call flow variable that holds the digits (a phone number
+// or ride PIN) a caller we can't identify keys in
+const identityVar = "identity"
+
+// isWithheldCaller reports whether source is a withheld caller ID rather than
+// a phone number we can look up
+func isWithheldCaller(source string) bool {
+	switch strings.ToLower(source) {
+	case "", "restricted", "anonymous", "unknown", "private", "withheld":
+		return true
+	}
+	return false
+}
+
+// enteredNumber normalizes digits keyed in by a caller to the format we store
+// numbers in, dropping the end key and an international "00" prefix
+func enteredNumber(digits string) string {
+	digits = strings.TrimRight(digits, "#")
+	return strings.TrimPrefix(digits, "00")
+}
+
+// voicePrompt is something we say to a caller: either text spoken by
+// MessageBird's text-to-speech, or a hosted audio file played instead.
+// Language and Voice override those of the prompts it belongs to, for
+// prompts a translation falls back to.
+type voicePrompt struct {
+	Text     string
+	AudioURL string
+	Language string
+	Voice    string
+}
+
+// voicePrompts holds the prompts used by the voice webhook.
+// Operators can override each prompt with environment variables:
+// VOICE_<NAME>_TEXT for text-to-speech or VOICE_<NAME>_AUDIO_URL for a hosted
+// audio file, where NAME is FAIL, IDENTIFY, CONNECTING, HOLD, MAINTENANCE, ENDED, TEXTS_ONLY or OPERATOR. VOICE_LANGUAGE
+// and VOICE_GENDER set the text-to-speech language and voice.
+// Translations hold the prompts in other languages, see loadVoicePromptFiles.
+type voicePrompts struct {
+	Language     string
+	Voice        string
+	Translations map[string]voicePrompts
+
+	Fail        voicePrompt // Played before hanging up on a call we can't route
+	Identify    voicePrompt // Asks a caller we can't identify for their PIN or number
+	Connecting  voicePrompt // Played before transferring the call, if set
+	Hold        voicePrompt // Played after Connecting, e.g. ringback or hold music, if set
+	Maintenance voicePrompt // Played before hanging up while maintenance mode is on
+	Ended       voicePrompt // Played before hanging up on someone whose ride on the number ended recently
+	TextsOnly   voicePrompt // Played before hanging up on a call to someone who only takes texts
+	Operator    voicePrompt // Played before transferring a caller we can't match to a ride to the operator line
+}
+
+// loadVoicePrompts returns the default prompts, overridden by any set in the environment
+func loadVoicePrompts() voicePrompts {
+	prompts := voicePrompts{
+		Language: "en-GB",
+		Voice:    "female",
+		Fail: voicePrompt{Text: "Sorry, we cannot identify your transaction. " +
+			"Please make sure you have call in from the number you registered."},
+		Identify: voicePrompt{Text: "We could not find your ride from the number you are calling from. " +
+			"Please enter your ride PIN, or the phone number you registered with including the country code, followed by the hash key."},
+		Maintenance: voicePrompt{Text: "Sorry, this service is temporarily unavailable for maintenance. Please try again later."},
+		Ended:       voicePrompt{Text: "Your ride has ended, so we can no longer connect calls through this number. Goodbye."},
+		TextsOnly:   voicePrompt{Text: "The person you are calling prefers not to take calls. Please send them a text message at this number instead."},
+		Operator:    voicePrompt{Text: "We could not find your ride. Please hold while we connect you to our support team."},
+	}
+	if v := os.Getenv("VOICE_LANGUAGE"); v != "" {
+		prompts.Language = v
+	}
+	if v := os.Getenv("VOICE_GENDER"); v != "" {
+		prompts.Voice = v
+	}
+	for name, prompt := range prompts.byName() {
+		if v := os.Getenv("VOICE_" + name + "_AUDIO_URL"); v != "" {
+			*prompt = voicePrompt{AudioURL: v}
+		} else if v := os.Getenv("VOICE_" + name + "_TEXT"); v != "" {
+			*prompt = voicePrompt{Text: v}
+		}
+	}
+	prompts.Translations = loadVoicePromptFiles(voicePromptsDir(), prompts)
+	return prompts
+}
+
+// byName returns the prompts by the NAME used in environment variables and prompt files
+func (prompts *voicePrompts) byName() map[string]*voicePrompt {
+	return map[string]*voicePrompt{
+		"FAIL":        &prompts.Fail,
+		"IDENTIFY":    &prompts.Identify,
+		"CONNECTING":  &prompts.Connecting,
+		"HOLD":        &prompts.Hold,
+		"MAINTENANCE": &prompts.Maintenance,
+		"ENDED":       &prompts.Ended,
+		"TEXTS_ONLY":  &prompts.TextsOnly,
+		"OPERATOR":    &prompts.Operator,
+	}
+}
+
+// voicePromptsDir returns the directory of the voice prompt files.
+// Set VOICE_PROMPTS_DIR to override the default of ./voiceprompts.
+func voicePromptsDir() string {
+	if dir := os.Getenv("VOICE_PROMPTS_DIR"); dir != "" {
+		return dir
+	}
+	return "voiceprompts"
+}
+
+// voicePromptFile is the JSON format of a file of voice prompts in one
+// language, keyed by prompt NAME, e.g.
+//
+//	{"language": "nl-NL", "voice": "female",
+//	 "prompts": {"FAIL": {"text": "..."}, "ENDED": {"audio_url": "https://..."}}}
+type voicePromptFile struct {
+	Language string `json:"language"`
+	Voice    string `json:"voice"`
+	Prompts  map[string]struct {
+		Text     string `json:"text"`
+		AudioURL string `json:"audio_url"`
+	} `json:"prompts"`
+}
+
+// loadVoicePromptFiles loads the translations of defaults in dir, one
+// <language>.json file per language of our messages, e.g. nl.json. Prompts
+// a file leaves out are played from defaults, in their own language.
+// Languages MessageBird can't speak, such as many right-to-left ones, can
+// use recordings: audio_url prompts play the same in any language.
+func loadVoicePromptFiles(dir string, defaults voicePrompts) map[string]voicePrompts {
+	translations := make(map[string]voicePrompts)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Println(err)
+		return translations
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("Could not read voice prompts %s: %v", path, err)
+			continue
+		}
+		var file voicePromptFile
+		if err := json.Unmarshal(b, &file); err != nil {
+			log.Printf("Could not parse voice prompts %s: %v", path, err)
+			continue
+		}
+
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))
+		t := voicePrompts{Language: file.Language, Voice: file.Voice}
+		if t.Language == "" {
+			t.Language = lang
+		}
+		if t.Voice == "" {
+			t.Voice = defaults.Voice
+		}
+		fallbacks := defaults.byName()
+		for name, prompt := range t.byName() {
+			p, ok := file.Prompts[name]
+			switch {
+			case ok && p.AudioURL != "":
+				*prompt = voicePrompt{AudioURL: p.AudioURL}
+			case ok && p.Text != "":
+				*prompt = voicePrompt{Text: stripBidiControls(p.Text)}
+			default:
+				*prompt = *fallbacks[name]
+				if prompt.Language == "" {
+					prompt.Language, prompt.Voice = defaults.Language, defaults.Voice
+				}
+			}
+		}
+		for name := range file.Prompts {
+			if _, ok := fallbacks[name]; !ok {
+				log.Printf("Unknown voice prompt %s in %s", name, path)
+			}
+		}
+		translations[lang] = t
+	}
+	if len(translations) > 0 {
+		langs := make([]string, 0, len(translations))
+		for lang := range translations {
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+		log.Printf("Voice prompts in %s loaded from %s", strings.Join(langs, ", "), dir)
+	}
+	return translations
+}
+
+// stripBidiControls removes the invisible direction marks editors insert
+// around right-to-left text, which text-to-speech would otherwise trip over
+func stripBidiControls(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u061C', r == '\u200E', r == '\u200F',
+			r >= '\u202A' && r <= '\u202E', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// forLanguage returns the prompts to play to someone who reads lang, or the
+// default prompts if we have none in lang
+func (prompts voicePrompts) forLanguage(lang string) voicePrompts {
+	if t, ok := prompts.Translations[lang]; ok {
+		return t
+	}
+	return prompts
+}
+
+// stepXML returns the call flow step for prompt, or an empty string if the
+// prompt isn't set. attrs are added to the step, e.g. to capture key presses.
+func (prompts voicePrompts) stepXML(prompt voicePrompt, attrs string) string {
+	language, voice := prompts.Language, prompts.Voice
+	if prompt.Language != "" {
+		language, voice = prompt.Language, prompt.Voice
+	}
+	switch {
+	case prompt.AudioURL != "":
+		return fmt.Sprintf("<Play media='%s'%s />", html.EscapeString(prompt.AudioURL), attrs)
+	case prompt.Text != "":
+		return fmt.Sprintf("<Say language='%s' voice='%s'%s>%s</Say>",
+			html.EscapeString(language), html.EscapeString(voice), attrs, html.EscapeString(prompt.Text))
+	}
+	return ""
+}
+
+// hangupXML returns a call flow that hangs up without saying anything
+func hangupXML() string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow><Hangup /></CallFlow>"
+}
+
+// failXML returns a call flow playing the Fail prompt and hanging up
+func (prompts voicePrompts) failXML() string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.Fail, "") +
+		"<Hangup /></CallFlow>"
+}
+
+// maintenanceXML returns a call flow playing the Maintenance prompt and hanging up
+func (prompts voicePrompts) maintenanceXML() string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.Maintenance, "") +
+		"<Hangup /></CallFlow>"
+}
+
+// endedXML returns a call flow playing the Ended prompt and hanging up
+func (prompts voicePrompts) endedXML() string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.Ended, "") +
+		"<Hangup /></CallFlow>"
+}
+
+// textsOnlyXML returns a call flow playing the TextsOnly prompt and hanging up
+func (prompts voicePrompts) textsOnlyXML() string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.TextsOnly, "") +
+		"<Hangup /></CallFlow>"
+}
+
+// operatorXML returns a call flow playing the Operator prompt and
+// transferring the call to the operator line
+func (prompts voicePrompts) operatorXML(line string) string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.Operator, "") +
+		fmt.Sprintf("<Transfer destination='%s' make='true' />", html.EscapeString(line)) +
+		"</CallFlow>"
+}
+
+// identifyCallerXML returns a call flow asking the caller to key in their
+// ride PIN or the number they registered with, followed by '#'. MessageBird stores the keys
+// pressed in the identity variable, then fetches the call flow from fetchURL
+// again with that variable set.
+func (prompts voicePrompts) identifyCallerXML(fetchURL string) string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.Identify, fmt.Sprintf(" onKeypressVar='%s' endKey='#'", identityVar)) +
+		"<Pause length='10s' />" +
+		fmt.Sprintf("<FetchCallFlow url='%s' />", html.EscapeString(fetchURL)) +
+		"</CallFlow>"
+}
+
+// transferXML returns a call flow playing the Connecting and Hold prompts,
+// if set, and transferring the call to destination
+func (prompts voicePrompts) transferXML(destination string) string {
+	return "<?xml version='1.0' encoding='UTF-8'?><CallFlow>" +
+		prompts.stepXML(prompts.Connecting, "") +
+		prompts.stepXML(prompts.Hold, "") +
+		fmt.Sprintf("<Transfer destination='%s' make='true' />", html.EscapeString(destination)) +
+		"</CallFlow>"
+}
+
+// webhookURL returns the absolute URL of one of our routes on the host that
+// received r, for call flows that need to call back into our application
+func webhookURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, appPath(path))
+}
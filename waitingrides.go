@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	messagebird "github.com/messagebird/go-rest-api"
+)
+
+// waitingRideInterval is how often rides waiting for a proxy number are
+// retried, besides whenever a ride ends
+const waitingRideInterval = 30 * time.Second
+
+// WaitingRide is a ride created while no proxy number was free for it. It
+// becomes a ride, and its participants are texted, once one frees up.
+type WaitingRide struct {
+	ID           int // pending_rides ID, not a ride ID
+	Start        string
+	Destination  string
+	DateTime     string
+	ThisCustomer Person
+	ThisDriver   Person
+	RequiredTags []string
+	Labels       []string
+	QueuedAt     string // RFC 3339
+}
+
+// ride returns the ride the waiting ride becomes, still without a proxy number
+func (waiting WaitingRide) ride() RideType {
+	return RideType{
+		Start:        waiting.Start,
+		Destination:  waiting.Destination,
+		DateTime:     waiting.DateTime,
+		ThisCustomer: waiting.ThisCustomer,
+		ThisDriver:   waiting.ThisDriver,
+		RequiredTags: waiting.RequiredTags,
+		Labels:       waiting.Labels,
+		Status:       rideScheduled,
+	}
+}
+
+// ended reports whether the waiting ride would have ended by now, so it no
+// longer needs a proxy number. Rides whose time we can't parse wait until
+// an operator cancels them.
+func (waiting WaitingRide) ended(now time.Time) bool {
+	start, err := parseRideTime(waiting.DateTime)
+	return err == nil && !start.Add(rideDuration()).After(now)
+}
+
+// loadWaitingRides returns the rides waiting for a proxy number, oldest first
+func (s *sqlStore) loadWaitingRides(customers map[int]Person, drivers map[int]Person) ([]WaitingRide, error) {
+	rows, err := s.query(sqlQuery{
+		SQLite:   "SELECT id, start, destination, datetime, customer_id, driver_id, required_tags, labels, queued_at FROM pending_rides ORDER BY id",
+		Postgres: "SELECT id, start, destination, datetime, customer_id, driver_id, required_tags, labels, queued_at FROM pending_rides ORDER BY id",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var waiting []WaitingRide
+	for rows.Next() {
+		var v WaitingRide
+		var requiredTags, labels string
+		err := rows.Scan(&v.ID, &v.Start, &v.Destination, &v.DateTime, &v.ThisCustomer.ID, &v.ThisDriver.ID, &requiredTags, &labels, &v.QueuedAt)
+		if err != nil {
+			return nil, err
+		}
+		v.ThisCustomer = customers[v.ThisCustomer.ID]
+		v.ThisDriver = drivers[v.ThisDriver.ID]
+		v.RequiredTags = parseTags(requiredTags)
+		v.Labels = parseTags(labels)
+		waiting = append(waiting, v)
+	}
+	return waiting, rows.Err()
+}
+
+// waitingRideStore is the part of RideStore that keeps the rides waiting
+// for a proxy number
+type waitingRideStore interface {
+	// QueueRide stores ride to wait for a proxy number, queued at now
+	QueueRide(ride RideType, now time.Time) error
+	// InsertWaitingRide inserts ride, which waited as the waiting ride with
+	// ID waitingID, like InsertRide, and stops it waiting
+	InsertWaitingRide(ride RideType, waitingID int) (int, error)
+	// DeleteWaitingRide stops the waiting ride with the given ID waiting,
+	// reporting whether it still was
+	DeleteWaitingRide(id int) (bool, error)
+}
+
+// deleteWaitingRide deletes a waiting ride by ID
+var deleteWaitingRide = sqlQuery{
+	SQLite:   "DELETE FROM pending_rides WHERE id = ?",
+	Postgres: "DELETE FROM pending_rides WHERE id = $1",
+}
+
+// QueueRide implements waitingRideStore
+func (s *sqlStore) QueueRide(ride RideType, now time.Time) error {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "INSERT INTO pending_rides (start, destination, datetime, customer_id, driver_id, required_tags, labels, queued_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		Postgres: "INSERT INTO pending_rides (start, destination, datetime, customer_id, driver_id, required_tags, labels, queued_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+	},
+		ride.Start, ride.Destination, ride.DateTime, ride.ThisCustomer.ID, ride.ThisDriver.ID,
+		strings.Join(ride.RequiredTags, ","), strings.Join(ride.Labels, ","), now.UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+// InsertWaitingRide implements waitingRideStore
+func (s *sqlStore) InsertWaitingRide(ride RideType, waitingID int) (int, error) {
+	return s.insertRide(ride, statement(deleteWaitingRide, waitingID))
+}
+
+// DeleteWaitingRide implements waitingRideStore
+func (s *sqlStore) DeleteWaitingRide(id int) (bool, error) {
+	n, err := s.rowsAffected(deleteWaitingRide, id)
+	return n > 0, err
+}
+
+// queueRide stores ride, which no proxy number is free for, to wait for one
+func queueRide(store RideStore, ride RideType) error {
+	err := store.QueueRide(ride, time.Now())
+	if err == nil {
+		log.Printf("No proxy number free for %s and %s's ride at %s: it is waiting for one", ride.ThisCustomer.Name, ride.ThisDriver.Name, ride.DateTime)
+	}
+	return err
+}
+
+// waitingRidesWake wakes pollWaitingRides before its next tick
+var waitingRidesWake = make(chan struct{}, 1)
+
+// wakeWaitingRides has pollWaitingRides retry the waiting rides now, e.g.
+// because a ride ended and released its proxy number
+func wakeWaitingRides() {
+	select {
+	case waitingRidesWake <- struct{}{}:
+	default:
+	}
+}
+
+// assignWaitingRides gives the rides waiting for a proxy number one, oldest
+// first, and texts their participants. Rides that would have ended by now
+// are dropped. While new rides are capped, waiting rides keep waiting.
+func assignWaitingRides(store RideStore, mb *messagebird.Client, now time.Time) error {
+	dbdata, err := newRideSharingDB(store).loadDB()
+	if err != nil {
+		return err
+	}
+	for _, waiting := range dbdata.WaitingRides {
+		if waiting.ended(now) {
+			if _, err := store.DeleteWaitingRide(waiting.ID); err != nil {
+				return err
+			}
+			log.Printf("%s and %s's ride at %s ended before a proxy number was free for it", waiting.ThisCustomer.Name, waiting.ThisDriver.Name, waiting.DateTime)
+			continue
+		}
+		if capped, _, err := allocationCapReached(store); err != nil || capped {
+			return err
+		}
+
+		ride := waiting.ride()
+		proxy, err := selectProxyNumber(dbdata, ride.ThisCustomer.ID, ride.ThisDriver.ID, "", ride.RequiredTags)
+		if _, ok := err.(noProxyError); ok {
+			// Rides needing other tags, or with other participants, may still get one
+			continue
+		} else if err != nil {
+			return err
+		}
+		ride.ThisProxyNumber = proxy
+		ride.CustomerPIN, ride.DriverPIN, err = newRidePINs(dbdata, proxy.ID)
+		if err != nil {
+			return err
+		}
+		ride.ID, err = store.InsertWaitingRide(ride, waiting.ID)
+		if err == errProxyTaken {
+			// A new ride took it first: try again next time
+			return nil
+		} else if err != nil {
+			return err
+		}
+		log.Printf("%s and %s's waiting ride got proxy number %s as ride %d", ride.ThisCustomer.Name, ride.ThisDriver.Name, proxy.Number, ride.ID)
+		if warning := startRide(dbdata, mb, ride); warning != "" {
+			log.Printf("Ride %d: %s", ride.ID, warning)
+		}
+
+		// The next rides can't have the number this one got
+		if dbdata, err = dbdata.loadDB(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollWaitingRides runs assignWaitingRides every interval, and when woken
+// by wakeWaitingRides, until ctx is done. It is meant to be run in its own
+// goroutine.
+func pollWaitingRides(ctx context.Context, store RideStore, mb *messagebird.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-waitingRidesWake:
+		}
+		if err := assignWaitingRides(store, mb, time.Now()); err != nil {
+			log.Printf("Could not assign proxy numbers to waiting rides: %v", err)
+		}
+	}
+}
+
+// waitingRidesHandler lets operators cancel rides waiting for a proxy number
+func waitingRidesHandler(dbdata *RideSharingDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		message := ""
+		if r.Method == "POST" && r.FormValue("action") == "cancel" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			deleted, err := dbdata.store.DeleteWaitingRide(id)
+			switch {
+			case err != nil:
+				log.Println(err)
+				message = fmt.Sprint(err)
+			case !deleted:
+				message = "That ride is no longer waiting: it may have got a proxy number."
+			default:
+				message = "Waiting ride cancelled."
+			}
+		}
+
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			log.Println(err)
+			message = fmt.Sprint(err)
+		}
+		renderLanding(w, r, dbdata, message)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+)
+
+// webhookDedupWindow returns how long the IDs of inbound messages we
+// processed are remembered, set with WEBHOOK_DEDUP_WINDOW (e.g. "48h").
+// MessageBird retries webhooks it didn't get an answer to in time; retries
+// within the window are skipped.
+func webhookDedupWindow() time.Duration {
+	return envDuration("WEBHOOK_DEDUP_WINDOW", 24*time.Hour)
+}
+
+// dedupKey returns the ID MessageBird retries msg with, or an empty string
+// if the webhook didn't send one
+func (msg InboundSMS) dedupKey() string {
+	if msg.MessageID != "" {
+		return msg.MessageID
+	}
+	return msg.ID
+}
+
+// firstDelivery records that the inbound message with id is being
+// processed, reporting whether it is the first delivery of the message
+// within the window, see webhookDedupWindow. IDs older than the window are
+// dropped as messages come in.
+func firstDelivery(store RideStore, id string) (bool, error) {
+	now := time.Now().UTC()
+	return store.RecordDelivery(id, now, now.Add(-webhookDedupWindow()))
+}
+
+// webhookDedupStore is the part of RideStore that remembers the inbound
+// messages we processed
+type webhookDedupStore interface {
+	// RecordDelivery records that the message with id was received at,
+	// dropping the IDs received before since, and reports whether it wasn't
+	// recorded already
+	RecordDelivery(id string, at time.Time, since time.Time) (bool, error)
+}
+
+// RecordDelivery implements webhookDedupStore
+func (s *sqlStore) RecordDelivery(id string, at time.Time, since time.Time) (bool, error) {
+	_, err := s.exec(sqlQuery{
+		SQLite:   "DELETE FROM processed_messages WHERE received_at < ?",
+		Postgres: "DELETE FROM processed_messages WHERE received_at < $1",
+	}, since.Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := s.rowsAffected(sqlQuery{
+		SQLite:   "INSERT INTO processed_messages (message_id, received_at) VALUES (?, ?) ON CONFLICT (message_id) DO NOTHING",
+		Postgres: "INSERT INTO processed_messages (message_id, received_at) VALUES ($1, $2) ON CONFLICT (message_id) DO NOTHING",
+		MySQL:    "INSERT INTO processed_messages (message_id, received_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE message_id = message_id",
+	}, id, at.Format(time.RFC3339))
+	return n > 0, err
+}
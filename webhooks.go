@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/messagebird/go-rest-api/signature"
+)
+
+// maxWebhookBody limits how much of a JSON webhook body we read
+const maxWebhookBody = 1 << 20
+
+// requireWebhookSignature refuses webhook requests that weren't signed with
+// MESSAGEBIRD_SIGNING_KEY within the last few seconds, see the signature
+// package, so only MessageBird can make us relay texts and calls. Without a
+// key every request is accepted.
+func requireWebhookSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := webhookSigningKey(); key != "" {
+			if err := signature.NewValidator(key).ValidRequest(r); err != nil {
+				log.Printf("Refused %s %s from %s: missing or invalid MessageBird signature", r.Method, r.URL.Path, clientIP(r))
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "Invalid signature")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// handleWebhook serves handler at path, one of the webhook routes ending in
+// token. With a token, requests for the route without it, or with another
+// one, are refused with 404 Not Found, as if there were no webhook.
+func handleWebhook(mux *http.ServeMux, path string, token string, handler http.HandlerFunc) {
+	if token == "" {
+		mux.Handle(path, handler)
+		return
+	}
+	base := strings.TrimSuffix(path, "/"+token)
+	refuse := func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.URL.Path), []byte(path)) == 1 {
+			handler(w, r)
+			return
+		}
+		log.Printf("Refused %s %s from %s: missing or wrong webhook token", r.Method, base, clientIP(r))
+		http.NotFound(w, r)
+	}
+	mux.HandleFunc(base, refuse)
+	mux.HandleFunc(base+"/", refuse)
+}
+
+// InboundSMS is an SMS message forwarded to /webhook by a MessageBird flow.
+// See the comment above messageHookHandler for the full payload shape.
+type InboundSMS struct {
+	ID              string `json:"id"`
+	MessageID       string `json:"message_id"`
+	Originator      string `json:"originator"` // Number that sent the message
+	Receiver        string `json:"receiver"`   // Proxy number the message was sent to
+	Payload         string `json:"payload"`    // Message body
+	Reference       string `json:"reference"`
+	CreatedDatetime string `json:"createdDatetime"`
+
+	// Channel the message came in on, e.g. textChannelWhatsApp; empty for SMS
+	Channel string `json:"-"`
+}
+
+// InboundCall is a call forwarded to /webhook-voice by a MessageBird flow.
+// See the comment above voiceHookHandler for the full payload shape.
+type InboundCall struct {
+	CallID      string `json:"callID"`
+	NumberID    string `json:"numberID"`
+	Source      string `json:"source"`      // Caller's number, or e.g. "Restricted" when withheld
+	Destination string `json:"destination"` // Proxy number being called
+
+	// Variables set earlier in the call flow, e.g. digits entered by the caller
+	Variables map[string]string `json:"variables"`
+}
+
+// webhookFields returns a lookup function for the fields of a webhook request.
+// Flows configured in the MessageBird dashboard either send form data
+// (or query parameters for GET requests) or post a JSON object, depending on
+// how they were set up; both are read through the same function.
+func webhookFields(r *http.Request) (func(key string) string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("error parsing the form submitted: %v", err)
+		}
+		return r.FormValue, nil
+	}
+
+	// Numbers such as originator may be sent as JSON numbers rather than
+	// strings, so decode into a map and format each value as a string.
+	var fields map[string]interface{}
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxWebhookBody))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("error parsing the json submitted: %v", err)
+	}
+	return func(key string) string {
+		switch v := fields[key].(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		case nil:
+			return ""
+		case map[string]interface{}, []interface{}:
+			// Nested values such as call flow variables are handed on as
+			// JSON, which is also how form-encoded webhooks send them
+			b, _ := json.Marshal(v)
+			return string(b)
+		default:
+			return fmt.Sprint(v)
+		}
+	}, nil
+}
+
+// parseInboundSMS reads and validates an InboundSMS from a webhook request
+func parseInboundSMS(r *http.Request) (InboundSMS, error) {
+	field, err := webhookFields(r)
+	if err != nil {
+		return InboundSMS{}, err
+	}
+	msg := InboundSMS{
+		ID:              field("id"),
+		MessageID:       field("message_id"),
+		Originator:      field("originator"),
+		Receiver:        field("receiver"),
+		Payload:         field("payload"),
+		Reference:       field("reference"),
+		CreatedDatetime: field("createdDatetime"),
+	}
+	return msg, msg.validate()
+}
+
+// validate checks that the fields we need to relay the message are present
+func (msg InboundSMS) validate() error {
+	switch {
+	case msg.Originator == "":
+		return fmt.Errorf("inbound sms is missing originator")
+	case msg.Receiver == "":
+		return fmt.Errorf("inbound sms is missing receiver")
+	}
+	return nil
+}
+
+// parseInboundCall reads and validates an InboundCall from a webhook request
+func parseInboundCall(r *http.Request) (InboundCall, error) {
+	field, err := webhookFields(r)
+	if err != nil {
+		return InboundCall{}, err
+	}
+	call := InboundCall{
+		CallID:      field("callID"),
+		NumberID:    field("numberID"),
+		Source:      field("source"),
+		Destination: field("destination"),
+	}
+	if v := field("variables"); v != "" {
+		// Variables are a JSON object, e.g. {"identity":"319700000"}.
+		// Values we can't read are ignored, the same as missing ones.
+		var vars map[string]interface{}
+		if err := json.Unmarshal([]byte(v), &vars); err == nil {
+			call.Variables = make(map[string]string, len(vars))
+			for k, val := range vars {
+				call.Variables[k] = fmt.Sprint(val)
+			}
+		}
+	}
+	return call, call.validate()
+}
+
+// validate checks that the fields we need to route the call are present.
+// Source may be empty or e.g. "Restricted" when the caller ID is withheld;
+// those callers are asked to identify themselves instead.
+func (call InboundCall) validate() error {
+	if call.Destination == "" {
+		return fmt.Errorf("inbound call is missing destination")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		target      string
+		body        string
+		want        map[string]string
+	}{
+		{"form", "application/x-www-form-urlencoded", "/webhook",
+			"originator=319700000&receiver=319700004&payload=Hello+there",
+			map[string]string{"originator": "319700000", "receiver": "319700004", "payload": "Hello there", "missing": ""}},
+		{"query string", "", "/webhook?originator=319700000&payload=Hi", "",
+			map[string]string{"originator": "319700000", "payload": "Hi"}},
+		{"json strings", "application/json", "/webhook",
+			`{"originator": "319700000", "payload": "Hello there"}`,
+			map[string]string{"originator": "319700000", "payload": "Hello there", "missing": ""}},
+		{"json numbers", "application/json; charset=utf-8", "/webhook",
+			`{"originator": 31970000000001, "receiver": 319700004, "price": 0.07}`,
+			map[string]string{"originator": "31970000000001", "receiver": "319700004", "price": "0.07"}},
+		{"json null and bool", "application/json", "/webhook",
+			`{"reference": null, "flash": true}`,
+			map[string]string{"reference": "", "flash": "true"}},
+		{"json nested", "application/json", "/webhook",
+			`{"variables": {"identity": "319700000"}, "tags": ["a", 1]}`,
+			map[string]string{"variables": `{"identity":"319700000"}`, "tags": `["a",1]`}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", test.target, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		field, err := webhookFields(r)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for key, want := range test.want {
+			if got := field(key); got != want {
+				t.Errorf("%s: field(%q) = %q, want %q", test.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestWebhookFieldsRejectsMalformedBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"invalid json", "application/json", `{"originator": `},
+		{"json array", "application/json", `["319700000"]`},
+		{"json too large", "application/json", `{"payload": "` + strings.Repeat("a", maxWebhookBody) + `"}`},
+		{"invalid form", "application/x-www-form-urlencoded", "payload=%zz"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/webhook", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		if _, err := webhookFields(r); err == nil {
+			t.Errorf("%s: parsed without an error", test.name)
+		}
+	}
+}
+
+func TestParseInboundSMS(t *testing.T) {
+	r := httptest.NewRequest("POST", "/webhook", strings.NewReader(
+		`{"id": "e8077d80", "originator": 319700000, "receiver": "319700004", "payload": "On my way"}`))
+	r.Header.Set("Content-Type", "application/json")
+	msg, err := parseInboundSMS(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Originator != "319700000" || msg.Receiver != "319700004" || msg.Payload != "On my way" || msg.dedupKey() != "e8077d80" {
+		t.Errorf("parsed %+v", msg)
+	}
+
+	r = httptest.NewRequest("POST", "/webhook", strings.NewReader("receiver=319700004&payload=Hi"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := parseInboundSMS(r); err == nil {
+		t.Error("parsed an inbound SMS without an originator")
+	}
+}
+
+func TestSetupWebhookTokenKeepsTheGeneratedToken(t *testing.T) {
+	openTestDB(t, "memory")
+	setenv(t, "WEBHOOK_TOKEN", "")
+	setenv(t, "MESSAGEBIRD_SIGNING_KEY", "")
+
+	token, err := setupWebhookToken(appStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !webhookTokenPattern.MatchString(token) {
+		t.Fatalf("generated webhook token %q isn't a valid token", token)
+	}
+	// Later starts, also with a signing key, keep serving the same URLs
+	setenv(t, "MESSAGEBIRD_SIGNING_KEY", "key")
+	if again, err := setupWebhookToken(appStore); err != nil || again != token {
+		t.Errorf("webhook token on the next start is %q (%v), want %q", again, err, token)
+	}
+
+	setenv(t, "WEBHOOK_TOKEN", "chosen-webhook-token")
+	if chosen, err := setupWebhookToken(appStore); err != nil || chosen != "chosen-webhook-token" {
+		t.Errorf("webhook token with WEBHOOK_TOKEN set is %q (%v)", chosen, err)
+	}
+	setenv(t, "WEBHOOK_TOKEN", "short")
+	if _, err := setupWebhookToken(appStore); err == nil {
+		t.Error("invalid WEBHOOK_TOKEN accepted")
+	}
+}
+
+func TestSetupWebhookTokenLeavesSignedWebhooksWithoutOne(t *testing.T) {
+	openTestDB(t, "memory")
+	setenv(t, "WEBHOOK_TOKEN", "")
+	setenv(t, "MESSAGEBIRD_SIGNING_KEY", "key")
+
+	if token, err := setupWebhookToken(appStore); err != nil || token != "" {
+		t.Errorf("webhook token with a signing key is %q (%v), want none", token, err)
+	}
+}
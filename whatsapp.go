@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	messagebird "github.com/messagebird/go-rest-api"
+	"github.com/messagebird/go-rest-api/conversation"
+	"github.com/messagebird/go-rest-api/sms"
+)
+
+// Channels participants text us on. Once a participant texts on a channel
+// in a ride, their texts in the ride go there, see recordTextedFrom.
+const (
+	textChannelSMS      = "sms"
+	textChannelWhatsApp = "whatsapp"
+)
+
+// providerWhatsApp is the provider recorded for WhatsApp messages, whose
+// IDs are prefixed with it, e.g. "whatsapp:2e15efafec384e1c82e9842075e87beb"
+const providerWhatsApp = "whatsapp"
+
+// whatsAppChannelID returns the ID of the MessageBird Conversations API
+// channel of our WhatsApp business number, from WHATSAPP_CHANNEL_ID.
+// Participants can't text us on WhatsApp if it isn't set.
+func whatsAppChannelID() string {
+	return os.Getenv("WHATSAPP_CHANNEL_ID")
+}
+
+// channel returns the channel msg came in on
+func (msg InboundSMS) channel() string {
+	if msg.Channel == "" {
+		return textChannelSMS
+	}
+	return msg.Channel
+}
+
+// sendText sends body to recipient on channel, returning the message's ID
+// for the message log like mbSender. WhatsApp messages come from our
+// WhatsApp business number rather than originator; if one can't be sent,
+// e.g. because WhatsApp is no longer configured, it's sent by SMS instead.
+func sendText(store RideStore, mb *messagebird.Client, channel string, originator string, recipient string, body string, params *sms.Params) string {
+	if channel == textChannelWhatsApp {
+		if id := whatsAppSender(store, mb, recipient, body); id != "" {
+			return id
+		}
+		log.Printf("Sending the message to %s by SMS instead", recipient)
+	}
+	return mbSender(store, mb, originator, []string{recipient}, body, params)
+}
+
+// whatsAppSender sends body to recipient on WhatsApp, resuming their
+// conversation with us if they have one. It returns the ID of the
+// conversation, prefixed with providerWhatsApp, or an empty string if the
+// message couldn't be sent.
+func whatsAppSender(store RideStore, mb *messagebird.Client, recipient string, body string) string {
+	if !sendAllowed(recipient) || !consentGiven(store, recipient, consentTransactional) {
+		return suppressedMessageID
+	}
+	channelID := whatsAppChannelID()
+	if channelID == "" {
+		log.Printf("Could not send WhatsApp message to %s: WHATSAPP_CHANNEL_ID isn't set", recipient)
+		return ""
+	}
+	conv, err := conversation.Start(mb, &conversation.StartRequest{
+		ChannelID: channelID,
+		To:        recipient,
+		Type:      conversation.MessageTypeText,
+		Content:   &conversation.MessageContent{Text: body},
+	})
+	if err != nil {
+		mbError(err)
+		log.Printf("Could not send WhatsApp message to %s", recipient)
+		return ""
+	}
+	log.Printf("Sent WhatsApp message to %s in conversation %s", recipient, conv.ID)
+	return providerWhatsApp + ":" + conv.ID
+}
+
+// rideContactChannel returns the channel we text number on in the ride with
+// ID rideID, see recordTextedFrom
+func rideContactChannel(store RideStore, rideID int, number string) string {
+	if rideID == 0 || whatsAppChannelID() == "" {
+		return textChannelSMS
+	}
+	channel, err := store.RideContactChannel(rideID, number)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Could not look up how to text %s in ride %d: %v", number, rideID, err)
+		}
+		return textChannelSMS
+	}
+	return channel
+}
+
+// whatsAppWebhook is the part of a Conversations API webhook we read, e.g.
+//
+//	{"type": "message.created", "contact": {"msisdn": 319700000, ...},
+//	 "message": {"id": "...", "channelId": "...", "direction": "received",
+//	             "type": "text", "content": {"text": "I'm outside"}, ...}}
+type whatsAppWebhook struct {
+	Type    string               `json:"type"`
+	Contact conversation.Contact `json:"contact"`
+	Message conversation.Message `json:"message"`
+}
+
+// parseInboundWhatsApp reads a text sent to our WhatsApp business number
+// from a Conversations API webhook request. It reports false for other
+// events, e.g. messages we sent or ones on other channels.
+func parseInboundWhatsApp(r *http.Request) (InboundSMS, bool, error) {
+	var hook whatsAppWebhook
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxWebhookBody)).Decode(&hook); err != nil {
+		return InboundSMS{}, false, fmt.Errorf("error parsing the json submitted: %v", err)
+	}
+	m := hook.Message
+	if hook.Type != string(conversation.WebhookEventMessageCreated) || m.Direction != conversation.MessageDirectionReceived ||
+		m.ChannelID != whatsAppChannelID() {
+		return InboundSMS{}, false, nil
+	}
+	if m.Type != conversation.MessageTypeText {
+		log.Printf("Ignoring WhatsApp %s message %s from %s: only text is relayed", m.Type, m.ID, hook.Contact.MSISDN)
+		return InboundSMS{}, false, nil
+	}
+	msg := InboundSMS{
+		ID:         providerWhatsApp + ":" + m.ID,
+		Originator: hook.Contact.MSISDN,
+		Payload:    m.Content.Text,
+		Channel:    textChannelWhatsApp,
+	}
+	if msg.Originator == "" {
+		return msg, false, fmt.Errorf("inbound WhatsApp message is missing the contact's msisdn")
+	}
+	return msg, true, nil
+}
+
+// findWhatsAppRide returns the open ride a participant texting us on
+// WhatsApp from number is in, and their role in it. WhatsApp messages all go
+// to our business number rather than a proxy number, so rides where they
+// already text us on WhatsApp come first, then the latest ride.
+func findWhatsAppRide(dbdata *RideSharingDB, number string) (RideType, string, bool) {
+	var found RideType
+	var role string
+	sticky := false
+	for _, v := range dbdata.Rides {
+		if v.Status.Terminal() || v.ThisProxyNumber.ID == 0 {
+			continue
+		}
+		r := roleCustomer
+		if !v.ThisCustomer.hasNumber(number) {
+			if !v.ThisDriver.hasNumber(number) {
+				continue
+			}
+			r = roleDriver
+		}
+		onWhatsApp := v.textChannel(r) == textChannelWhatsApp
+		if role == "" || (onWhatsApp && !sticky) || (onWhatsApp == sticky && v.ID > found.ID) {
+			found, role, sticky = v, r, onWhatsApp
+		}
+	}
+	return found, role, role != ""
+}
+
+// whatsAppHookHandler handles texts participants send to our WhatsApp
+// business number, forwarded by a Conversations API webhook for the
+// message.created event. They are relayed like texts to the proxy number of
+// the sender's open ride, see relayInboundText, and from then on the sender
+// gets the ride's texts on WhatsApp; the other participant keeps getting
+// them on the channel they last texted on. Texts from people in no open ride
+// are handled like ones from unknown senders, answered on WhatsApp. Senders
+// who used up their bucket in limiter are refused like SMS senders, see
+// rateLimitBySender, which can't tell them from the webhook's nested fields.
+func whatsAppHookHandler(dbdata *RideSharingDB, mb *messagebird.Client, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if whatsAppChannelID() == "" {
+			log.Println("Ignoring WhatsApp webhook: WHATSAPP_CHANNEL_ID isn't set")
+			fmt.Fprint(w, "OK")
+			return
+		}
+		dbdata, err := dbdata.loadDB()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Server encountered an error: %v", err)
+			return
+		}
+
+		msg, ok, err := parseInboundWhatsApp(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid inbound WhatsApp message. error: %v", err)
+			return
+		}
+		if ok && !limiter.allow(msg.Originator) {
+			log.Printf("Refused %s %s from %s: too many requests from %s", r.Method, r.URL.Path, clientIP(r), msg.Originator)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if ok {
+			msg.Receiver = announcementOriginator()
+			if ride, _, found := findWhatsAppRide(dbdata, msg.Originator); found {
+				msg.Receiver = ride.ThisProxyNumber.Number
+			}
+			relayInboundText(r, dbdata, mb, msg)
+		}
+		// Return any response, MessageBird won't parse this
+		fmt.Fprint(w, "OK")
+	}
+}